@@ -2,6 +2,7 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
 	"os"
@@ -12,8 +13,10 @@ import (
 
 	"github.com/Grifonhard/Practicum-metrics/internal/cfg"
 	cryptoutils "github.com/Grifonhard/Practicum-metrics/internal/crypto_utils"
+	grpcclient "github.com/Grifonhard/Practicum-metrics/internal/grpc_client"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	metgen "github.com/Grifonhard/Practicum-metrics/internal/met_gen"
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
 	webclient "github.com/Grifonhard/Practicum-metrics/internal/web_client"
 )
 
@@ -43,6 +46,55 @@ func main() {
 		logger.Info("public key successfully loaded")
 	}
 
+	scheme := "http"
+	var tlsConfig *tls.Config
+	if cfg.UseTLS() {
+		tlsConfig, err = cryptoutils.ClientTLSConfig(*cfg.TLSCA, *cfg.TLSCert, *cfg.TLSKey)
+		if err != nil {
+			log.Fatal(err)
+		}
+		webclient.SetTLS(tlsConfig)
+		scheme = "https"
+		logger.Info("https with pinned server CA")
+	}
+	url := fmt.Sprintf("%s://%s/updates/", scheme, *cfg.Addr)
+	// сервер может принимать метрики только из доверенной подсети по X-Real-IP
+	realIP, err := webclient.OutboundIP(*cfg.Addr)
+	if err != nil {
+		logger.Error(fmt.Sprintf("fail while detect outbound address, X-Real-IP is not sent: %s", err.Error()))
+	} else {
+		webclient.SetRealIP(realIP)
+		logger.Info(fmt.Sprintf("X-Real-IP: %s", realIP))
+	}
+	if *cfg.AgentID != "" {
+		webclient.SetAgent(*cfg.AgentID, *cfg.KeyVersion)
+		logger.Info(fmt.Sprintf("agent %s signs requests with its own key", *cfg.AgentID))
+	}
+
+	var grpcClient *grpcclient.Client
+	if cfg.UseGRPC() {
+		grpcClient, err = grpcclient.New(*cfg.GRPCAddr, *cfg.Key, *cfg.AgentID, *cfg.KeyVersion, cfg.LabelSet(), tlsConfig.Clone())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer grpcClient.Close()
+		logger.Info(fmt.Sprintf("gRPC transport, server %s, tls %t", *cfg.GRPCAddr, tlsConfig != nil))
+		grpcIP, err := webclient.OutboundIP(*cfg.GRPCAddr)
+		if err != nil {
+			logger.Error(fmt.Sprintf("fail while detect outbound address, x-real-ip is not sent: %s", err.Error()))
+		} else {
+			grpcClient.SetRealIP(grpcIP)
+		}
+	}
+
+	if *cfg.SpoolDir != "" {
+		webclient.AgentSpool, err = webclient.OpenSpool(*cfg.SpoolDir, int64(*cfg.SpoolMaxSize))
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info(fmt.Sprintf("spool %s: %d batches to resend", *cfg.SpoolDir, webclient.AgentSpool.Len()))
+	}
+
 	generator := metgen.New()
 
 	timerPoll := time.NewTicker(time.Duration(*cfg.PollInterval) * time.Second)
@@ -63,13 +115,18 @@ func main() {
 				logger.Error(fmt.Sprintf("Fail renew metrics: %s\n", err.Error()))
 			}
 		case <-timerReport.C:
-			if *cfg.RateLimit == 0 {
-				go webclient.SendMetric(&wg, fmt.Sprintf("http://%s/updates/", *cfg.Addr), generator, *cfg.Key, webclient.SENDARRAY)
+			if grpcClient != nil {
+				go grpcClient.SendMetric(&wg, generator)
+			} else if *cfg.RateLimit == 0 {
+				go webclient.SendMetric(&wg, url, generator, *cfg.Key, webclient.SENDARRAY, cfg.LabelSet())
 			} else {
-				go webclient.SendMetricWithWorkerPool(&wg, fmt.Sprintf("http://%s/updates/", *cfg.Addr), generator, *cfg.Key, *cfg.RateLimit)
+				go webclient.SendMetricWithWorkerPool(&wg, url, generator, *cfg.Key, *cfg.RateLimit, cfg.LabelSet())
 			}
 		case <- ctx.Done():
 			wg.Wait()
+			for name, stats := range retry.Snapshot() {
+				logger.Info(fmt.Sprintf("retry %s: %+v", name, stats))
+			}
 			logger.Info("agent shut down")
 			return
 		}
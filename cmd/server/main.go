@@ -3,20 +3,28 @@
 package main
 
 import (
+	"context"
+	"crypto/tls"
 	"fmt"
 	"log"
+	"net"
+	"net/http"
 	"os"
 	"os/signal"
 	"sync"
 	"syscall"
+	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	"github.com/Grifonhard/Practicum-metrics/internal/alert"
 	"github.com/Grifonhard/Practicum-metrics/internal/cfg"
 	cryptoutils "github.com/Grifonhard/Practicum-metrics/internal/crypto_utils"
-	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	grpcserver "github.com/Grifonhard/Practicum-metrics/internal/grpc_server"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage"
 	web "github.com/Grifonhard/Practicum-metrics/internal/web_server"
 	"github.com/gin-gonic/gin"
+	"google.golang.org/grpc"
 )
 
 var (
@@ -47,54 +55,200 @@ func main() {
 
 	showMeta()
 
-	var dbInter psql.StorDB
-	var db *psql.DB
 	if *cfg.DatabaseDsn != "" {
 		logger.Info(fmt.Sprintf("Database DSN: %s\n", *cfg.DatabaseDsn))
-		db, err = psql.ConnectDB(*cfg.DatabaseDsn)
-		if err != nil {
-			log.Fatal(err)
-		}
-		dbInter = db
+	}
+	logger.Info(fmt.Sprintf("Storage: %s\n", *cfg.Storage))
+
+	stor, err := storage.Open(*cfg.Storage, storage.Options{
+		StoreInterval:    *cfg.StoreInterval,
+		FilePath:         *cfg.FileStoragePath,
+		Restore:          *cfg.Restore,
+		WAL:              *cfg.WAL,
+		WALSync:          *cfg.WALSync,
+		WALSyncInterval:  time.Duration(*cfg.WALSyncInterval) * time.Second,
+		BackupKeep:       *cfg.BackupKeep,
+		DSN:              *cfg.DatabaseDsn,
+		ReplicaDSN:       *cfg.ReplicaDsn,
+		ReplicaMaxLag:    time.Duration(*cfg.ReplicaMaxLag) * time.Second,
+		DualPrimary:      *cfg.DualPrimary,
+		QueryTimeout:     time.Duration(*cfg.DBQueryTimeout) * time.Second,
+		MaxOpenConns:     *cfg.DBMaxOpenConns,
+		MaxIdleConns:     *cfg.DBMaxIdleConns,
+		ConnMaxLifetime:  time.Duration(*cfg.DBConnLifetime) * time.Second,
+		StatementTimeout: time.Duration(*cfg.DBStmtTimeout) * time.Second,
+		BoltPath:         *cfg.BoltPath,
+		HistoryRetention: time.Duration(*cfg.HistoryRetention) * time.Second,
+	})
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// фоновые задачи останавливаются при завершении работы сервера
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	if *cfg.CompactInterval > 0 {
+		go storage.CompactLoop(ctx, stor, time.Duration(*cfg.CompactInterval)*time.Second, *cfg.CounterRetention)
 	}
 
-	stor, err := storage.New(*cfg.StoreInterval, *cfg.FileStoragePath, *cfg.Restore, dbInter)
+	rules, err := alert.ParseRules(cfg.AlertRules)
+	if err != nil {
+		log.Fatal(err)
+	}
+	notifier, err := initNotifier(&cfg)
 	if err != nil {
 		log.Fatal(err)
 	}
+	alerts := alert.NewManager(rules, stor, notifier)
+	if len(rules) > 0 && *cfg.AlertInterval > 0 {
+		logger.Info(fmt.Sprintf("Alert rules: %d\n", len(rules)))
+		go alerts.Run(ctx, time.Duration(*cfg.AlertInterval)*time.Second)
+	}
 
-	go stor.BackupLoop()
+	// ключи агентов хранятся рядом с метриками, реестр пуст, пока не зарегистрирован ни один агент
+	var registry *agents.Registry
+	if keys, ok := stor.(storage.KeyStore); ok {
+		registry, err = agents.NewRegistry(ctx, keys)
+		if err != nil {
+			log.Fatal(err)
+		}
+		logger.Info(fmt.Sprintf("Registered agents: %d\n", len(registry.List())))
+	}
 
 	// graceful shutdown
 	sig := make(chan os.Signal, 1)
 	signal.Notify(sig, syscall.SIGQUIT, syscall.SIGTERM, syscall.SIGINT)
 	var wg sync.WaitGroup
 
-	r := initRouter(&wg, stor, db, *cfg.Key)
+	trusted, err := cfg.TrustedNet()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if trusted != nil {
+		logger.Info(fmt.Sprintf("Trusted subnet: %s\n", trusted))
+	}
+
+	// подписанный запрос принимается один раз и только в пределах окна по времени
+	replay := agents.NewReplayGuard(time.Duration(*cfg.ReplayWindow)*time.Second, *cfg.NonceCacheSize)
+
+	r := initRouter(&wg, stor, alerts, registry, *cfg.Key, *cfg.AdminToken, *cfg.SharedFallback, cfg.AllowedSubjects(), trusted, replay)
 	
 	logger.Info(fmt.Sprintf("Server start %s\n", *cfg.Addr))
 
-	go func (){
-		log.Fatal(r.Run(*cfg.Addr))
-	}()
+	// один и тот же TLS, включая проверку сертификатов агентов, и для http, и для gRPC
+	var tlsConfig *tls.Config
+	if cfg.UseTLS() {
+		tlsConfig, err = cryptoutils.ServerTLSConfig(*cfg.TLSCert, *cfg.TLSKey, *cfg.TLSClientCA)
+		if err != nil {
+			log.Fatal(err)
+		}
+		srv := &http.Server{Addr: *cfg.Addr, Handler: r, TLSConfig: tlsConfig}
+		logger.Info(fmt.Sprintf("https, client certificates required: %t\n", *cfg.TLSClientCA != ""))
+		go func() {
+			log.Fatal(srv.ListenAndServeTLS("", ""))
+		}()
+	} else {
+		go func() {
+			log.Fatal(r.Run(*cfg.Addr))
+		}()
+	}
+
+	var grpcSrv *grpc.Server
+	if *cfg.GRPCAddr != "" {
+		listen, err := net.Listen("tcp", *cfg.GRPCAddr)
+		if err != nil {
+			log.Fatal(err)
+		}
+		grpcSrv = grpcserver.NewGRPCServer(stor, grpcserver.Options{
+			Key:            *cfg.Key,
+			Replay:         replay,
+			Trusted:        trusted,
+			TLS:            tlsConfig,
+			Subjects:       cfg.AllowedSubjects(),
+			Registry:       registry,
+			SharedFallback: *cfg.SharedFallback,
+		})
+
+		logger.Info(fmt.Sprintf("gRPC server start %s\n", *cfg.GRPCAddr))
+
+		go func() {
+			log.Fatal(grpcSrv.Serve(listen))
+		}()
+	}
 	
 	<-sig
+	cancel()
+	if grpcSrv != nil {
+		grpcSrv.GracefulStop()
+	}
 	wg.Wait()
+	err = stor.Close()
+	if err != nil {
+		logger.Error(fmt.Sprintf("fail while close storage: %v", err))
+	}
 	logger.Info("server shutdown")
 }
 
-func initRouter(wg *sync.WaitGroup, stor *storage.MemStorage, db *psql.DB, key string) *gin.Engine {
+// initNotifier каналы уведомлений об алертах из конфигурации, nil если ни один не задан
+func initNotifier(cfg *cfg.Server) (alert.Notifier, error) {
+	if *cfg.AlertWebhook == "" && *cfg.AlertSMTP == "" && *cfg.AlertFile == "" {
+		return nil, nil
+	}
+	tmpl, err := alert.LoadTemplates("./templates")
+	if err != nil {
+		return nil, err
+	}
+	window := time.Duration(*cfg.AlertDedup) * time.Second
+	var channels alert.Multi
+	if *cfg.AlertWebhook != "" {
+		webhook := alert.NewWebhook(*cfg.AlertWebhook)
+		webhook.Template = tmpl
+		channels = append(channels, alert.Channel("webhook", webhook, window))
+	}
+	if *cfg.AlertSMTP != "" {
+		mail, err := alert.NewSMTP(*cfg.AlertSMTP, tmpl)
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, alert.Channel("smtp", mail, window))
+	}
+	if *cfg.AlertFile != "" {
+		channels = append(channels, alert.Channel("file", alert.NewFile(*cfg.AlertFile, tmpl), window))
+	}
+	return channels, nil
+}
+
+// initRouter маршруты сервера
+// запись метрик разрешена только агентам с subject сертификата из subjects, если список не пуст
+// и только с адресов X-Real-IP из подсети trusted, если она задана
+// повтор подписанного пакета метрик отклоняется по replay
+// управление агентами доступно по adminToken, если хранилище умеет хранить их ключи,
+// общий ключ после регистрации агентов принимается только при sharedFallback
+func initRouter(wg *sync.WaitGroup, stor storage.Backend, alerts *alert.Manager, registry *agents.Registry, key, adminToken string, sharedFallback bool, subjects []string, trusted *net.IPNet, replay *agents.ReplayGuard) *gin.Engine {
 	router := gin.Default()
-	router.LoadHTMLGlob("./templates/*")
+	router.LoadHTMLGlob("./templates/*.html")
 
-	router.POST("/update/", web.WGadd(wg), web.ReqRespLogger(""), web.DataExtraction(), web.RespEncode(), web.Update(wg, stor))
-	router.POST("/update/:type/:name/:value", web.WGadd(wg), web.ReqRespLogger(""), web.DataExtraction(), web.Update(wg, stor))
-	router.POST("/updates/", web.WGadd(wg), web.PseudoAuth(key), cryptoutils.DecryptBody(), web.ReqRespLogger(key), web.DataExtraction(), web.Updates(wg, stor))
+	router.POST("/update/", web.WGadd(wg), web.TrustedSubnet(trusted), web.CertAuth(subjects), web.ReqRespLogger(""), web.DataExtraction(), web.RespEncode(), web.Update(wg, stor))
+	router.POST("/update/:type/:name/:value", web.WGadd(wg), web.TrustedSubnet(trusted), web.CertAuth(subjects), web.ReqRespLogger(""), web.DataExtraction(), web.Update(wg, stor))
+	router.POST("/updates/", web.WGadd(wg), web.TrustedSubnet(trusted), web.CertAuth(subjects), web.AgentAuth(registry, key, sharedFallback), web.ReplayProtect(replay), cryptoutils.DecryptBody(), web.ReqRespLogger(key), web.DataExtraction(), web.Updates(wg, stor))
 	router.GET("/value/:type/:name", web.ReqRespLogger(""), web.DataExtraction(), web.Get(stor))
 	router.POST("/value/", web.ReqRespLogger(""), web.RespEncode(), web.GetJSON(stor))
 	router.GET("/", web.ReqRespLogger(""), web.RespEncode(), web.List(stor))
-	if db != nil {
-		router.GET("/ping", web.PingDB(db))
+	router.GET("/metrics", web.ReqRespLogger(""), web.RespEncode(), web.Metrics(stor))
+	router.GET("/history/:type/:name", web.ReqRespLogger(""), web.RespEncode(), web.History(stor))
+	router.GET("/query", web.ReqRespLogger(""), web.RespEncode(), web.Query(stor))
+	router.GET("/ping", web.PingDB(stor))
+	router.GET("/health/db", web.HealthDB(stor))
+	router.GET("/health/retry", web.HealthRetry())
+	router.GET("/alerts", web.Alerts(alerts))
+	if registry != nil && adminToken != "" {
+		admin := router.Group("/admin", web.AdminAuth(adminToken), web.ReqRespLogger(""))
+		admin.GET("/agents", web.ListAgents(registry))
+		admin.POST("/agents/:id", web.AddAgent(registry))
+		admin.POST("/agents/:id/keys", web.RotateAgentKey(registry))
+		admin.DELETE("/agents/:id", web.RevokeAgent(registry))
+		admin.DELETE("/agents/:id/keys/:version", web.RevokeAgentKey(registry))
 	}
 
 	return router
@@ -0,0 +1,90 @@
+// Утилита переноса данных между бэкапом файлового хранилища и базой данных
+//
+//	storagectl import -f <директория бэкапа> -d <dsn> [-force]
+//	storagectl export -d <dsn> -f <директория бэкапа> [-backup-keep n]
+//
+// import загружает бэкап в хранилище, export выгружает текущие значения хранилища в бэкап
+// вместо postgres можно указать другое хранилище через -storage
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+)
+
+// Команды утилиты
+const (
+	CMDIMPORT = "import"
+	CMDEXPORT = "export"
+)
+
+var errUsage = errors.New("usage: storagectl import|export -f <backup dir> -d <dsn> [-storage name] [-force] [-backup-keep n]")
+
+func main() {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = run(context.Background(), os.Args[1:])
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// run разбор аргументов и выполнение команды
+func run(ctx context.Context, args []string) error {
+	if len(args) == 0 {
+		return errUsage
+	}
+	command := args[0]
+	if command != CMDIMPORT && command != CMDEXPORT {
+		return errUsage
+	}
+
+	flags := flag.NewFlagSet(command, flag.ContinueOnError)
+	backupDir := flags.String("f", "", "backup directory of file storage")
+	dsn := flags.String("d", "", "database connect")
+	name := flags.String("storage", storage.BACKENDPOSTGRES, "storage to import to or export from")
+	boltPath := flags.String("bolt-path", "", "directory of embedded bolt storage")
+	force := flags.Bool("force", false, "import into non-empty storage")
+	keep := flags.Int("backup-keep", 0, "number of backup snapshots kept, including the current one")
+	err := flags.Parse(args[1:])
+	if err != nil {
+		return err
+	}
+	if *backupDir == "" {
+		return errUsage
+	}
+
+	stor, err := storage.Open(*name, storage.Options{
+		DSN:      *dsn,
+		BoltPath: *boltPath,
+	})
+	if err != nil {
+		return err
+	}
+	defer stor.Close()
+
+	switch command {
+	case CMDIMPORT:
+		n, err := storage.ImportBackup(ctx, *backupDir, stor, *force)
+		if err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("imported %d values from %s into %s", n, *backupDir, *name))
+	case CMDEXPORT:
+		n, err := storage.ExportBackup(ctx, stor, *backupDir, *keep)
+		if err != nil {
+			return err
+		}
+		logger.Info(fmt.Sprintf("exported %d series from %s into %s", n, *name, *backupDir))
+	}
+	return nil
+}
@@ -14,7 +14,10 @@ require (
 	github.com/sirupsen/logrus v1.9.3
 	github.com/stretchr/testify v1.9.0
 	github.com/timakin/bodyclose v0.0.0-20241222091800-1db5c5ca4d67
+	go.etcd.io/bbolt v1.3.11
 	golang.org/x/tools v0.29.0
+	google.golang.org/grpc v1.67.1
+	google.golang.org/protobuf v1.34.2
 	honnef.co/go/tools v0.5.1
 )
 
@@ -59,6 +62,6 @@ require (
 	golang.org/x/sync v0.10.0 // indirect
 	golang.org/x/sys v0.29.0 // indirect
 	golang.org/x/text v0.21.0 // indirect
-	google.golang.org/protobuf v1.34.2 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240814211410-ddb44dafa142 // indirect
 	gopkg.in/yaml.v3 v3.0.1 // indirect
 )
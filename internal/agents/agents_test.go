@@ -0,0 +1,297 @@
+package agents
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestRegistry(t *testing.T, store storage.KeyStore) (*Registry, *time.Time) {
+	reg, err := NewRegistry(context.Background(), store)
+	require.NoError(t, err)
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	reg.clock = func() time.Time { return now }
+	return reg, &now
+}
+
+func newMemStore(t *testing.T) *storage.MemStorage {
+	stor, err := storage.New(0, "", false)
+	require.NoError(t, err)
+	return stor
+}
+
+// failingStore хранилище ключей, в котором не удаётся замена версий
+type failingStore struct {
+	*storage.MemStorage
+}
+
+func (f failingStore) ReplaceAgentKeys(context.Context, string, []storage.AgentKey) error {
+	return errors.New("store is down")
+}
+
+func TestRegistry(t *testing.T) {
+	ctx := context.Background()
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+
+	t.Run("пустой реестр выключен", func(t *testing.T) {
+		reg, _ := newTestRegistry(t, newMemStore(t))
+		assert.False(t, reg.Enabled())
+		var nilReg *Registry
+		assert.False(t, nilReg.Enabled())
+	})
+
+	t.Run("регистрация и проверка подписи", func(t *testing.T) {
+		reg, _ := newTestRegistry(t, newMemStore(t))
+		key, err := reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		assert.True(t, reg.Enabled())
+		assert.Equal(t, 1, key.Version)
+		assert.Len(t, key.Key, 2*KEYSIZE)
+
+		assert.NoError(t, reg.Verify("agent-1", 0, body, Sign(body, key.Key)))
+		assert.NoError(t, reg.Verify("agent-1", 1, body, Sign(body, key.Key)))
+		assert.ErrorIs(t, reg.Verify("agent-1", 0, body, Sign(body, "other")), ErrSignature)
+		assert.ErrorIs(t, reg.Verify("agent-1", 2, body, Sign(body, key.Key)), ErrKeyVersion)
+		assert.ErrorIs(t, reg.Verify("agent-2", 0, body, Sign(body, key.Key)), ErrAgentUnknown)
+	})
+
+	t.Run("неверный и повторный id", func(t *testing.T) {
+		reg, _ := newTestRegistry(t, newMemStore(t))
+		_, err := reg.Add(ctx, "")
+		assert.ErrorIs(t, err, ErrAgentID)
+		_, err = reg.Add(ctx, "agent 1")
+		assert.ErrorIs(t, err, ErrAgentID)
+		_, err = reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		_, err = reg.Add(ctx, "agent-1")
+		assert.ErrorIs(t, err, ErrAgentExists)
+	})
+
+	t.Run("старый ключ действует до конца периода смены", func(t *testing.T) {
+		reg, now := newTestRegistry(t, newMemStore(t))
+		old, err := reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		key, err := reg.Rotate(ctx, "agent-1", time.Hour)
+		require.NoError(t, err)
+		assert.Equal(t, 2, key.Version)
+		assert.NotEqual(t, old.Key, key.Key)
+
+		assert.NoError(t, reg.Verify("agent-1", 0, body, Sign(body, old.Key)))
+		assert.NoError(t, reg.Verify("agent-1", 0, body, Sign(body, key.Key)))
+
+		*now = now.Add(time.Hour)
+		assert.ErrorIs(t, reg.Verify("agent-1", 1, body, Sign(body, old.Key)), ErrKeyVersion)
+		assert.ErrorIs(t, reg.Verify("agent-1", 0, body, Sign(body, old.Key)), ErrSignature)
+		assert.NoError(t, reg.Verify("agent-1", 0, body, Sign(body, key.Key)))
+
+		_, err = reg.Rotate(ctx, "agent-1", time.Hour)
+		require.NoError(t, err)
+		list := reg.List()
+		require.Len(t, list, 1)
+		require.Len(t, list[0].Keys, 2, "истёкшая версия удалена при смене ключа")
+		assert.Equal(t, 2, list[0].Keys[0].Version)
+		assert.Equal(t, 3, list[0].Keys[1].Version)
+	})
+
+	t.Run("смена без периода отзывает старый ключ", func(t *testing.T) {
+		reg, _ := newTestRegistry(t, newMemStore(t))
+		old, err := reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		_, err = reg.Rotate(ctx, "agent-1", 0)
+		require.NoError(t, err)
+		assert.ErrorIs(t, reg.Verify("agent-1", 0, body, Sign(body, old.Key)), ErrSignature)
+		_, err = reg.Rotate(ctx, "agent-2", 0)
+		assert.ErrorIs(t, err, ErrAgentUnknown)
+	})
+
+	t.Run("ошибка записи при смене ключа не меняет реестр", func(t *testing.T) {
+		mem := newMemStore(t)
+		reg, _ := newTestRegistry(t, failingStore{mem})
+		old, err := reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+
+		_, err = reg.Rotate(ctx, "agent-1", 0)
+		require.Error(t, err)
+		assert.NoError(t, reg.Verify("agent-1", 1, body, Sign(body, old.Key)))
+		list := reg.List()
+		require.Len(t, list, 1)
+		assert.Len(t, list[0].Keys, 1)
+		assert.Nil(t, list[0].Keys[0].ExpiresAt)
+
+		stored, err := mem.AgentKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, stored, 2)
+		assert.Equal(t, ENABLEDMARKER, stored[0].AgentID)
+		assert.Equal(t, old, stored[1], "хранилище совпадает с реестром")
+	})
+
+	t.Run("отзыв версии и агента", func(t *testing.T) {
+		reg, _ := newTestRegistry(t, newMemStore(t))
+		old, err := reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		key, err := reg.Rotate(ctx, "agent-1", time.Hour)
+		require.NoError(t, err)
+
+		require.NoError(t, reg.Revoke(ctx, "agent-1", 1))
+		assert.ErrorIs(t, reg.Verify("agent-1", 0, body, Sign(body, old.Key)), ErrSignature)
+		assert.NoError(t, reg.Verify("agent-1", 0, body, Sign(body, key.Key)))
+		assert.ErrorIs(t, reg.Revoke(ctx, "agent-1", 1), ErrKeyVersion)
+
+		require.NoError(t, reg.Revoke(ctx, "agent-1", 0))
+		assert.ErrorIs(t, reg.Verify("agent-1", 0, body, Sign(body, key.Key)), ErrAgentUnknown)
+		assert.ErrorIs(t, reg.Revoke(ctx, "agent-1", 0), ErrAgentUnknown)
+		assert.True(t, reg.Enabled(), "отзыв всех агентов не выключает проверку")
+	})
+
+	t.Run("список без ключей", func(t *testing.T) {
+		reg, _ := newTestRegistry(t, newMemStore(t))
+		_, err := reg.Add(ctx, "b")
+		require.NoError(t, err)
+		_, err = reg.Add(ctx, "a")
+		require.NoError(t, err)
+		list := reg.List()
+		require.Len(t, list, 2)
+		assert.Equal(t, "a", list[0].ID)
+		assert.Equal(t, "b", list[1].ID)
+	})
+
+	t.Run("ключи переживают перезапуск", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := storage.Open(storage.BACKENDBOLT, storage.Options{BoltPath: dir})
+		require.NoError(t, err)
+		reg, _ := newTestRegistry(t, stor.(storage.KeyStore))
+		old, err := reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		key, err := reg.Rotate(ctx, "agent-1", time.Hour)
+		require.NoError(t, err)
+		require.NoError(t, stor.Close())
+
+		stor, err = storage.Open(storage.BACKENDBOLT, storage.Options{BoltPath: dir})
+		require.NoError(t, err)
+		defer stor.Close()
+		reg, _ = newTestRegistry(t, stor.(storage.KeyStore))
+		assert.NoError(t, reg.Verify("agent-1", 1, body, Sign(body, old.Key)), "период смены сохранён")
+		assert.NoError(t, reg.Verify("agent-1", 2, body, Sign(body, key.Key)))
+		require.Len(t, reg.List()[0].Keys, 2)
+		assert.NotNil(t, reg.List()[0].Keys[0].ExpiresAt)
+	})
+
+	t.Run("после отзыва всех агентов и перезапуска проверка не выключается", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := storage.Open(storage.BACKENDBOLT, storage.Options{BoltPath: dir})
+		require.NoError(t, err)
+		reg, _ := newTestRegistry(t, stor.(storage.KeyStore))
+		_, err = reg.Add(ctx, "agent-1")
+		require.NoError(t, err)
+		require.NoError(t, reg.Revoke(ctx, "agent-1", 0))
+		require.NoError(t, stor.Close())
+
+		stor, err = storage.Open(storage.BACKENDBOLT, storage.Options{BoltPath: dir})
+		require.NoError(t, err)
+		defer stor.Close()
+		reg, _ = newTestRegistry(t, stor.(storage.KeyStore))
+		assert.True(t, reg.Enabled())
+		assert.Empty(t, reg.List(), "служебная запись не считается агентом")
+	})
+
+	t.Run("хранилище с ключами без отметки получает её при загрузке", func(t *testing.T) {
+		mem := newMemStore(t)
+		require.NoError(t, mem.SaveAgentKey(ctx, storage.AgentKey{AgentID: "agent-1", Version: 1, Key: "k"}))
+		reg, _ := newTestRegistry(t, mem)
+		assert.True(t, reg.Enabled())
+		require.NoError(t, reg.Revoke(ctx, "agent-1", 0))
+
+		reg, _ = newTestRegistry(t, mem)
+		assert.True(t, reg.Enabled())
+	})
+}
+
+func TestReplayGuard(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	newGuard := func(size int) *ReplayGuard {
+		g := NewReplayGuard(time.Minute, size)
+		g.clock = func() time.Time { return now }
+		return g
+	}
+	ts := func(d time.Duration) string { return strconv.FormatInt(now.Add(d).Unix(), 10) }
+	nonce := func(t *testing.T) string {
+		n, err := NewNonce()
+		require.NoError(t, err)
+		return n
+	}
+
+	t.Run("подпись покрывает время и nonce", func(t *testing.T) {
+		body := []byte("body")
+		assert.Equal(t, body, Signed(body, "", ""), "без заголовков подписывается только тело")
+		assert.Equal(t, "1\nabc\nbody", string(Signed(body, "1", "abc")))
+		assert.NotEqual(t, Sign(Signed(body, "1", "abc"), "key"), Sign(Signed(body, "2", "abc"), "key"))
+	})
+
+	t.Run("повтор nonce", func(t *testing.T) {
+		g := newGuard(10)
+		n := nonce(t)
+		assert.NoError(t, g.Check(ts(0), n))
+		assert.ErrorIs(t, g.Check(ts(0), n), ErrReplay)
+		assert.ErrorIs(t, g.Check(ts(time.Second), n), ErrReplay, "то же nonce с другим временем")
+		assert.NoError(t, g.Check(ts(0), nonce(t)))
+	})
+
+	t.Run("окно расхождения часов", func(t *testing.T) {
+		g := newGuard(10)
+		assert.NoError(t, g.Check(ts(-time.Minute), nonce(t)))
+		assert.NoError(t, g.Check(ts(time.Minute), nonce(t)))
+		assert.ErrorIs(t, g.Check(ts(-time.Minute-time.Second), nonce(t)), ErrTimestamp)
+		assert.ErrorIs(t, g.Check(ts(time.Minute+time.Second), nonce(t)), ErrTimestamp)
+		assert.ErrorIs(t, g.Check("yesterday", nonce(t)), ErrTimestamp)
+	})
+
+	t.Run("неверный nonce", func(t *testing.T) {
+		g := newGuard(10)
+		assert.ErrorIs(t, g.Check(ts(0), ""), ErrNonce)
+		assert.ErrorIs(t, g.Check(ts(0), "abc"), ErrNonce)
+		assert.ErrorIs(t, g.Check(ts(0), strings.Repeat("z", 2*NONCESIZE)), ErrNonce)
+	})
+
+	t.Run("размер ограничен, nonce не забываются раньше срока", func(t *testing.T) {
+		g := newGuard(2)
+		first := nonce(t)
+		require.NoError(t, g.Check(ts(-2*time.Second), first))
+		require.NoError(t, g.Check(ts(-time.Second), nonce(t)))
+		assert.ErrorIs(t, g.Check(ts(0), nonce(t)), ErrNonceCache)
+		assert.Equal(t, 2, g.Len())
+		assert.ErrorIs(t, g.Check(ts(-2*time.Second), first), ErrReplay)
+
+		now = now.Add(time.Minute - time.Second)
+		require.NoError(t, g.Check(ts(0), nonce(t)), "самый ранний по времени nonce истёк")
+		assert.ErrorIs(t, g.Check(ts(0), nonce(t)), ErrNonceCache)
+	})
+
+	t.Run("время из будущего не мешает остальным", func(t *testing.T) {
+		g := newGuard(4)
+		future := nonce(t)
+		require.NoError(t, g.Check(ts(time.Minute), future))
+		require.NoError(t, g.Check(ts(-time.Minute), nonce(t)))
+		require.NoError(t, g.Check(ts(0), nonce(t)))
+		now = now.Add(time.Second)
+		require.NoError(t, g.Check(ts(-time.Second), nonce(t)), "нет общей нижней границы времени")
+		require.NoError(t, g.Check(ts(-time.Second), nonce(t)), "забыт самый ранний по времени, а не первый принятый")
+		assert.Equal(t, 4, g.Len())
+		assert.ErrorIs(t, g.Check(ts(time.Minute-time.Second), future), ErrReplay)
+	})
+
+	t.Run("устаревшие nonce забываются", func(t *testing.T) {
+		g := newGuard(10)
+		require.NoError(t, g.Check(ts(0), nonce(t)))
+		require.NoError(t, g.Check(ts(0), nonce(t)))
+		now = now.Add(2 * time.Minute)
+		require.NoError(t, g.Check(ts(0), nonce(t)))
+		assert.Equal(t, 1, g.Len())
+	})
+}
@@ -0,0 +1,15 @@
+package agents
+
+import "errors"
+
+var (
+	ErrAgentID      = errors.New("wrong agent id")
+	ErrAgentExists  = errors.New("agent already registered")
+	ErrAgentUnknown = errors.New("unknown agent")
+	ErrKeyVersion   = errors.New("unknown or expired agent key version")
+	ErrSignature    = errors.New("invalid agent signature")
+	ErrTimestamp    = errors.New("request timestamp is outside the allowed window")
+	ErrNonce        = errors.New("wrong request nonce")
+	ErrReplay       = errors.New("request replayed")
+	ErrNonceCache   = errors.New("nonce cache is full, retry later")
+)
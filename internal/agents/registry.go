@@ -0,0 +1,289 @@
+// Модуль реестра агентов: у каждого агента свой ключ подписи запросов HMAC,
+// ключ может иметь несколько действующих версий на время смены,
+// ключи хранятся в хранилище метрик, см. storage.KeyStore
+// здесь же защита подписанных запросов от повтора, см. ReplayGuard
+package agents
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"regexp"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+)
+
+// Заголовки запроса агента
+const (
+	HEADERAGENTID    = "X-Agent-ID"    // id агента, запрос подписан его ключом
+	HEADERKEYVERSION = "X-Key-Version" // версия ключа, без неё подходит любая действующая
+)
+
+// Параметры ключей агентов
+const (
+	KEYSIZE       = 32             // размер ключа в байтах, в hex ключ вдвое длиннее
+	ROTATIONGRACE = 24 * time.Hour // сколько по умолчанию действует прежняя версия после смены ключа
+)
+
+// ENABLEDMARKER id служебной записи в хранилище ключей: агенты уже регистрировались, см. Enabled
+// не проходит проверку id агента, поэтому не совпадает ни с одним агентом
+const ENABLEDMARKER = "*"
+
+// agentIDRe допустимый id агента
+var agentIDRe = regexp.MustCompile(`^[A-Za-z0-9._-]{1,64}$`)
+
+// Registry реестр агентов и их ключей
+// ключи читаются из хранилища при создании и держатся в памяти,
+// изменения сначала записываются в хранилище, потом в память
+type Registry struct {
+	store storage.KeyStore
+	keys  map[string][]storage.AgentKey // id агента -> версии ключа по возрастанию
+	used  bool                          // был ли зарегистрирован хотя бы один агент, хранится записью ENABLEDMARKER, см. Enabled
+	clock func() time.Time
+	mu    sync.RWMutex
+}
+
+// KeyInfo версия ключа агента без самого ключа
+type KeyInfo struct {
+	Version   int        `json:"version"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// AgentInfo агент и версии его ключа
+type AgentInfo struct {
+	ID   string    `json:"id"`
+	Keys []KeyInfo `json:"keys"`
+}
+
+// NewRegistry реестр поверх хранилища ключей store
+// для хранилищ с ключами, но без записи ENABLEDMARKER (до её появления), запись добавляется
+func NewRegistry(ctx context.Context, store storage.KeyStore) (*Registry, error) {
+	keys, err := store.AgentKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail while load agent keys: %w", err)
+	}
+	r := &Registry{
+		store: store,
+		keys:  make(map[string][]storage.AgentKey),
+	}
+	marked := false
+	for _, key := range keys {
+		if key.AgentID == ENABLEDMARKER {
+			marked = true
+			continue
+		}
+		r.keys[key.AgentID] = append(r.keys[key.AgentID], key)
+	}
+	r.used = marked
+	if len(r.keys) > 0 && !marked {
+		if err = r.markUsed(ctx); err != nil {
+			return nil, err
+		}
+	}
+	return r, nil
+}
+
+// markUsed запись в хранилище отметки о том, что агенты регистрировались,
+// чтобы проверка ключей агентов не выключилась после отзыва всех агентов и перезапуска
+func (r *Registry) markUsed(ctx context.Context) error {
+	if r.used {
+		return nil
+	}
+	err := r.store.SaveAgentKey(ctx, storage.AgentKey{AgentID: ENABLEDMARKER, CreatedAt: r.now()})
+	if err != nil {
+		return fmt.Errorf("fail while mark agent keys enabled: %w", err)
+	}
+	r.used = true
+	return nil
+}
+
+// Enabled включена ли аутентификация по ключам агентов
+// включается с первым агентом и не выключается при отзыве всех агентов, в том числе после перезапуска,
+// иначе отзыв последнего агента вернул бы сервер к общему ключу или вовсе без проверки
+func (r *Registry) Enabled() bool {
+	if r == nil {
+		return false
+	}
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	return r.used
+}
+
+// Verify проверка подписи hash тела запроса body ключом агента agentID
+// version 0 - подходит любая действующая версия ключа, иначе только указанная
+func (r *Registry) Verify(agentID string, version int, body []byte, hash string) error {
+	r.mu.RLock()
+	keys, ok := r.keys[agentID]
+	r.mu.RUnlock()
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAgentUnknown, agentID)
+	}
+
+	now := r.now()
+	matched := false
+	for _, key := range keys {
+		if version != 0 && key.Version != version || expired(key, now) {
+			continue
+		}
+		matched = true
+		if hmac.Equal([]byte(hash), []byte(Sign(body, key.Key))) {
+			return nil
+		}
+	}
+	if !matched {
+		return fmt.Errorf("%w: %s version %d", ErrKeyVersion, agentID, version)
+	}
+	return ErrSignature
+}
+
+// Add регистрация агента с первой версией ключа
+func (r *Registry) Add(ctx context.Context, agentID string) (storage.AgentKey, error) {
+	if !agentIDRe.MatchString(agentID) {
+		return storage.AgentKey{}, fmt.Errorf("%w: %q", ErrAgentID, agentID)
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if _, ok := r.keys[agentID]; ok {
+		return storage.AgentKey{}, fmt.Errorf("%w: %s", ErrAgentExists, agentID)
+	}
+	key, err := r.newKey(agentID, 1)
+	if err != nil {
+		return storage.AgentKey{}, err
+	}
+	// отметка пишется раньше ключа: ключ без отметки после отзыва снова выключил бы проверку
+	err = r.markUsed(ctx)
+	if err != nil {
+		return storage.AgentKey{}, err
+	}
+	err = r.store.SaveAgentKey(ctx, key)
+	if err != nil {
+		return storage.AgentKey{}, err
+	}
+	r.keys[agentID] = []storage.AgentKey{key}
+	return key, nil
+}
+
+// Rotate выпуск новой версии ключа агента
+// прежние версии действуют ещё grace, чтобы агенты успели перейти на новый ключ,
+// при grace 0 они отзываются сразу, уже истёкшие версии удаляются
+// новый набор версий записывается в хранилище целиком, память меняется только после записи
+func (r *Registry) Rotate(ctx context.Context, agentID string, grace time.Duration) (storage.AgentKey, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys, ok := r.keys[agentID]
+	if !ok {
+		return storage.AgentKey{}, fmt.Errorf("%w: %s", ErrAgentUnknown, agentID)
+	}
+	key, err := r.newKey(agentID, keys[len(keys)-1].Version+1)
+	if err != nil {
+		return storage.AgentKey{}, err
+	}
+
+	now := r.now()
+	deadline := now.Add(grace)
+	kept := make([]storage.AgentKey, 0, len(keys)+1)
+	for _, old := range keys {
+		if grace <= 0 || expired(old, now) {
+			continue
+		}
+		if old.ExpiresAt == nil || old.ExpiresAt.After(deadline) {
+			old.ExpiresAt = &deadline
+		}
+		kept = append(kept, old)
+	}
+	kept = append(kept, key)
+
+	err = r.store.ReplaceAgentKeys(ctx, agentID, kept)
+	if err != nil {
+		return storage.AgentKey{}, err
+	}
+	r.keys[agentID] = kept
+	return key, nil
+}
+
+// Revoke отзыв версии version ключа агента, 0 - отзыв всех версий, то есть удаление агента
+func (r *Registry) Revoke(ctx context.Context, agentID string, version int) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	keys, ok := r.keys[agentID]
+	if !ok {
+		return fmt.Errorf("%w: %s", ErrAgentUnknown, agentID)
+	}
+	kept := make([]storage.AgentKey, 0, len(keys))
+	for _, key := range keys {
+		if version != 0 && key.Version != version {
+			kept = append(kept, key)
+		}
+	}
+	if len(kept) == len(keys) {
+		return fmt.Errorf("%w: %s version %d", ErrKeyVersion, agentID, version)
+	}
+	err := r.store.DeleteAgentKeys(ctx, agentID, version)
+	if err != nil {
+		return err
+	}
+	if len(kept) == 0 {
+		delete(r.keys, agentID)
+		return nil
+	}
+	r.keys[agentID] = kept
+	return nil
+}
+
+// List агенты и версии их ключей, отсортированные по id
+func (r *Registry) List() []AgentInfo {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	list := make([]AgentInfo, 0, len(r.keys))
+	for id, keys := range r.keys {
+		info := AgentInfo{ID: id, Keys: make([]KeyInfo, 0, len(keys))}
+		for _, key := range keys {
+			info.Keys = append(info.Keys, KeyInfo{Version: key.Version, CreatedAt: key.CreatedAt, ExpiresAt: key.ExpiresAt})
+		}
+		list = append(list, info)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Sign подпись данных ключом агента, та же, что в заголовке HashSHA256
+func Sign(value []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// newKey новая версия ключа со случайным секретом
+func (r *Registry) newKey(agentID string, version int) (storage.AgentKey, error) {
+	secret := make([]byte, KEYSIZE)
+	_, err := rand.Read(secret)
+	if err != nil {
+		return storage.AgentKey{}, err
+	}
+	return storage.AgentKey{
+		AgentID:   agentID,
+		Version:   version,
+		Key:       hex.EncodeToString(secret),
+		CreatedAt: r.now(),
+	}, nil
+}
+
+// now текущее время, в тестах подменяется через clock
+func (r *Registry) now() time.Time {
+	if r.clock != nil {
+		return r.clock()
+	}
+	return time.Now()
+}
+
+// expired истёк ли срок действия версии ключа
+func expired(key storage.AgentKey, now time.Time) bool {
+	return key.ExpiresAt != nil && !now.Before(*key.ExpiresAt)
+}
@@ -0,0 +1,151 @@
+package agents
+
+import (
+	"container/heap"
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Заголовки защиты подписанных запросов от повтора
+const (
+	HEADERTIMESTAMP = "X-Timestamp" // unix время отправки в секундах
+	HEADERNONCE     = "X-Nonce"     // случайное одноразовое значение в hex
+)
+
+// NONCESIZE размер nonce в байтах, в hex вдвое длиннее
+const NONCESIZE = 16
+
+// Signed данные, которые подписываются ключом вместо одного тела запроса:
+// время отправки, nonce и тело через перевод строки
+// без времени и nonce подписывается только тело, как раньше
+func Signed(body []byte, timestamp, nonce string) []byte {
+	if timestamp == "" && nonce == "" {
+		return body
+	}
+	data := make([]byte, 0, len(timestamp)+len(nonce)+len(body)+2)
+	data = append(data, timestamp...)
+	data = append(data, '\n')
+	data = append(data, nonce...)
+	data = append(data, '\n')
+	return append(data, body...)
+}
+
+// NewNonce случайный nonce для очередного запроса
+func NewNonce() (string, error) {
+	nonce := make([]byte, NONCESIZE)
+	_, err := rand.Read(nonce)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(nonce), nil
+}
+
+// ReplayGuard защита от повтора перехваченных запросов
+// принимаются запросы со временем отправки не дальше Window от времени сервера в обе стороны
+// и с nonce, которого ещё не было
+// nonce помнятся, пока запрос с ними может пройти проверку времени, но не больше size штук:
+// раньше срока nonce не забываются, иначе запрос с ним можно было бы повторить,
+// поэтому при заполнении новые запросы отклоняются с ErrNonceCache, пока не истекут старые
+type ReplayGuard struct {
+	Window time.Duration
+
+	size   int
+	nonces map[string]struct{}
+	byTime seenHeap // принятые запросы, сверху самый ранний по времени отправки
+	clock  func() time.Time
+	mu     sync.Mutex
+}
+
+// seen принятый запрос
+type seen struct {
+	nonce string
+	ts    time.Time
+}
+
+// seenHeap принятые запросы, упорядоченные по времени отправки, для container/heap
+type seenHeap []seen
+
+func (h seenHeap) Len() int           { return len(h) }
+func (h seenHeap) Less(i, j int) bool { return h[i].ts.Before(h[j].ts) }
+func (h seenHeap) Swap(i, j int)      { h[i], h[j] = h[j], h[i] }
+func (h *seenHeap) Push(x any)        { *h = append(*h, x.(seen)) }
+func (h *seenHeap) Pop() any {
+	old := *h
+	last := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return last
+}
+
+// NewReplayGuard защита с окном window и не более size запомненных nonce
+func NewReplayGuard(window time.Duration, size int) *ReplayGuard {
+	if size < 1 {
+		size = 1
+	}
+	return &ReplayGuard{
+		Window: window,
+		size:   size,
+		nonces: make(map[string]struct{}),
+	}
+}
+
+// Check проверка заголовков запроса и запоминание nonce
+// timestamp - значение X-Timestamp, nonce - значение X-Nonce
+func (g *ReplayGuard) Check(timestamp, nonce string) error {
+	sec, err := strconv.ParseInt(timestamp, 10, 64)
+	if err != nil {
+		return fmt.Errorf("%w: %q", ErrTimestamp, timestamp)
+	}
+	if len(nonce) != 2*NONCESIZE {
+		return fmt.Errorf("%w: %q", ErrNonce, nonce)
+	}
+	if _, err = hex.DecodeString(nonce); err != nil {
+		return fmt.Errorf("%w: %q", ErrNonce, nonce)
+	}
+	ts := time.Unix(sec, 0)
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := g.now()
+	if ts.Before(now.Add(-g.Window)) || ts.After(now.Add(g.Window)) {
+		return fmt.Errorf("%w: %s, server time %s", ErrTimestamp, ts.UTC().Format(time.RFC3339), now.UTC().Format(time.RFC3339))
+	}
+	if _, ok := g.nonces[nonce]; ok {
+		return ErrReplay
+	}
+
+	g.prune(now)
+	if g.byTime.Len() >= g.size {
+		return fmt.Errorf("%w: %d nonces", ErrNonceCache, g.size)
+	}
+	g.nonces[nonce] = struct{}{}
+	heap.Push(&g.byTime, seen{nonce: nonce, ts: ts})
+	return nil
+}
+
+// Len количество запомненных nonce
+func (g *ReplayGuard) Len() int {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	return g.byTime.Len()
+}
+
+// prune забывание nonce запросов, которые уже не пройдут проверку времени
+func (g *ReplayGuard) prune(now time.Time) {
+	expired := now.Add(-g.Window)
+	for g.byTime.Len() > 0 && g.byTime[0].ts.Before(expired) {
+		oldest := heap.Pop(&g.byTime).(seen)
+		delete(g.nonces, oldest.nonce)
+	}
+}
+
+// now текущее время, в тестах подменяется через clock
+func (g *ReplayGuard) now() time.Time {
+	if g.clock != nil {
+		return g.clock()
+	}
+	return time.Now()
+}
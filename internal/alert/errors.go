@@ -0,0 +1,11 @@
+package alert
+
+import "errors"
+
+var (
+	ErrRuleFormat      = errors.New("wrong alert rule format")
+	ErrWebhookStatus   = errors.New("webhook responded with error status")
+	ErrNotifyTransient = errors.New("notification channel temporarily unavailable")
+	ErrSMTPConfig      = errors.New("wrong smtp notifier config")
+	ErrTemplate        = errors.New("alert template not found")
+)
@@ -0,0 +1,61 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"os"
+	"sync"
+	"text/template"
+)
+
+// FileRecord строка файла уведомлений
+type FileRecord struct {
+	Alert
+	Message string `json:"message,omitempty"`
+}
+
+// File дописывание уведомлений в файл по одному JSON объекту в строке
+// поле message строится по шаблону TEMPLATEFILE, без шаблона не заполняется
+type File struct {
+	Path     string
+	Template *template.Template
+
+	mu sync.Mutex
+}
+
+// NewFile канал уведомлений в файл path
+func NewFile(path string, tmpl *template.Template) *File {
+	return &File{Path: path, Template: tmpl}
+}
+
+// Notify дописывание уведомления в конец файла
+// файл открывается на каждую запись, поэтому его можно ротировать внешними средствами
+func (f *File) Notify(_ context.Context, alert Alert) error {
+	record := FileRecord{Alert: alert}
+	if f.Template != nil {
+		message, err := render(f.Template, TEMPLATEFILE, alert)
+		if err != nil {
+			return err
+		}
+		record.Message = string(bytes.TrimSpace(message))
+	}
+	line, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	file, err := os.OpenFile(f.Path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(line)
+	if err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
@@ -0,0 +1,193 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+)
+
+// Состояния правила
+const (
+	STATEINACTIVE = "inactive" // условие не выполняется
+	STATEPENDING  = "pending"  // условие выполняется, но меньше For
+	STATEFIRING   = "firing"   // алерт сработал
+)
+
+// Статусы уведомлений
+const (
+	STATUSFIRING   = "firing"
+	STATUSRESOLVED = "resolved"
+)
+
+// Alert уведомление о срабатывании или снятии алерта
+type Alert struct {
+	Rule      string     `json:"rule"`
+	Status    string     `json:"status"`
+	Value     float64    `json:"value"`
+	Threshold float64    `json:"threshold"`
+	StartsAt  time.Time  `json:"starts_at"`
+	EndsAt    *time.Time `json:"ends_at,omitempty"`
+}
+
+// RuleState состояние правила после последней проверки
+type RuleState struct {
+	Rule        string    `json:"rule"`
+	State       string    `json:"state"`
+	Value       float64   `json:"value"`
+	ActiveSince time.Time `json:"active_since"`
+	EvaluatedAt time.Time `json:"evaluated_at"`
+	Error       string    `json:"error,omitempty"`
+}
+
+// Manager периодическая проверка правил по хранилищу и рассылка уведомлений
+// уведомление отправляется при переходе в firing и при снятии сработавшего алерта
+type Manager struct {
+	rules    []Rule
+	stor     storage.Backend
+	notifier Notifier
+
+	mu     sync.Mutex
+	states []RuleState
+	clock  func() time.Time // источник времени, подменяется в тестах
+}
+
+// NewManager менеджер правил rules над хранилищем stor
+// notifier nil - уведомления только журналируются
+func NewManager(rules []Rule, stor storage.Backend, notifier Notifier) *Manager {
+	states := make([]RuleState, len(rules))
+	for i, rule := range rules {
+		states[i] = RuleState{Rule: rule.Expr, State: STATEINACTIVE}
+	}
+	return &Manager{
+		rules:    rules,
+		stor:     stor,
+		notifier: notifier,
+		states:   states,
+	}
+}
+
+// Run проверка правил каждые interval до отмены ctx
+func (m *Manager) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			m.Evaluate(ctx)
+		}
+	}
+}
+
+// Evaluate однократная проверка всех правил и рассылка уведомлений о смене состояния
+func (m *Manager) Evaluate(ctx context.Context) {
+	var alerts []Alert
+	for i, rule := range m.rules {
+		value, err := m.value(ctx, rule)
+		m.mu.Lock()
+		if alert, ok := m.transition(i, value, err); ok {
+			alerts = append(alerts, alert)
+		}
+		m.mu.Unlock()
+	}
+	for _, alert := range alerts {
+		m.notify(ctx, alert)
+	}
+	if flusher, ok := m.notifier.(Flusher); ok {
+		if err := flusher.Flush(ctx); err != nil {
+			logger.Error(fmt.Sprintf("fail while flush alert notifications: %v", err))
+		}
+	}
+}
+
+// States состояния всех правил после последней проверки
+func (m *Manager) States() []RuleState {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]RuleState(nil), m.states...)
+}
+
+// value текущее значение, с которым сравнивается порог правила
+func (m *Manager) value(ctx context.Context, rule Rule) (float64, error) {
+	if rule.Query != nil {
+		agg, ok := m.stor.(storage.Aggregator)
+		if !ok {
+			return 0, storage.ErrQueryUnsupported
+		}
+		return agg.Aggregate(ctx, rule.Query)
+	}
+	metric := rule.Metric
+	return m.stor.Get(ctx, &metric)
+}
+
+// transition смена состояния правила i по результату проверки
+// отсутствие данных считается невыполненным условием, прочие ошибки состояние не меняют
+// возвращает уведомление, если его нужно отправить
+// вызывается под блокировкой
+func (m *Manager) transition(i int, value float64, err error) (Alert, bool) {
+	rule := m.rules[i]
+	state := &m.states[i]
+	now := m.now()
+	state.EvaluatedAt = now
+	state.Error = ""
+
+	noData := errors.Is(err, storage.ErrMetricNoData) || errors.Is(err, psql.ErrNoData)
+	if err != nil && !noData {
+		state.Error = err.Error()
+		logger.Error(fmt.Sprintf("fail while evaluate alert rule %q: %v", rule.Expr, err))
+		return Alert{}, false
+	}
+	if !noData {
+		state.Value = value
+	}
+
+	if noData || !rule.Match(value) {
+		wasFiring := state.State == STATEFIRING
+		startsAt := state.ActiveSince
+		state.State = STATEINACTIVE
+		state.ActiveSince = time.Time{}
+		if !wasFiring {
+			return Alert{}, false
+		}
+		return Alert{Rule: rule.Expr, Status: STATUSRESOLVED, Value: state.Value, Threshold: rule.Threshold, StartsAt: startsAt, EndsAt: &now}, true
+	}
+
+	switch state.State {
+	case STATEINACTIVE:
+		state.ActiveSince = now
+		state.State = STATEPENDING
+	case STATEFIRING:
+		return Alert{}, false
+	}
+	if now.Sub(state.ActiveSince) < rule.For {
+		return Alert{}, false
+	}
+	state.State = STATEFIRING
+	return Alert{Rule: rule.Expr, Status: STATUSFIRING, Value: value, Threshold: rule.Threshold, StartsAt: state.ActiveSince}, true
+}
+
+// notify отправка уведомления, ошибка отправки журналируется
+func (m *Manager) notify(ctx context.Context, alert Alert) {
+	logger.Info(fmt.Sprintf("alert %s: %s, value %v", alert.Status, alert.Rule, alert.Value))
+	if m.notifier == nil {
+		return
+	}
+	if err := m.notifier.Notify(ctx, alert); err != nil {
+		logger.Error(fmt.Sprintf("fail while notify alert %q: %v", alert.Rule, err))
+	}
+}
+
+// now текущее время сервера
+func (m *Manager) now() time.Time {
+	if m.clock != nil {
+		return m.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,176 @@
+package alert
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
+)
+
+// DEDUPWINDOW окно подавления повторных и дребезжащих уведомлений по умолчанию
+const DEDUPWINDOW = 5 * time.Minute
+
+// Notifier канал уведомлений об алертах
+type Notifier interface {
+	Notify(ctx context.Context, alert Alert) error
+}
+
+// Flusher канал, откладывающий часть уведомлений, см. Dedup
+// Manager вызывает Flush после каждой проверки правил
+type Flusher interface {
+	Flush(ctx context.Context) error
+}
+
+// Channel канал уведомлений name с повторами отправки и подавлением дребезга в окне window
+func Channel(name string, n Notifier, window time.Duration) Notifier {
+	return NewDedup(NewRetrying(name, n), window)
+}
+
+// Multi рассылка уведомления во все каналы
+// ошибка одного канала не мешает отправке в остальные
+type Multi []Notifier
+
+// Notify отправка во все каналы, ошибки объединяются
+func (m Multi) Notify(ctx context.Context, alert Alert) error {
+	var errs []error
+	for _, n := range m {
+		errs = append(errs, n.Notify(ctx, alert))
+	}
+	return errors.Join(errs...)
+}
+
+// Flush отправка отложенных уведомлений всех каналов
+func (m Multi) Flush(ctx context.Context) error {
+	var errs []error
+	for _, n := range m {
+		if flusher, ok := n.(Flusher); ok {
+			errs = append(errs, flusher.Flush(ctx))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Retrying повтор отправки при временных ошибках канала по общей политике повторов
+type Retrying struct {
+	Notifier Notifier
+	Policy   *retry.Policy
+}
+
+// NewRetrying повторы отправки в канал name, счётчики повторов ведутся под именем alert-name
+func NewRetrying(name string, n Notifier) *Retrying {
+	return &Retrying{
+		Notifier: n,
+		Policy:   retry.New("alert-"+name, isTransient),
+	}
+}
+
+// Notify отправка с повторами
+func (r *Retrying) Notify(ctx context.Context, alert Alert) error {
+	return r.Policy.Do(ctx, func(ctx context.Context) error {
+		return r.Notifier.Notify(ctx, alert)
+	})
+}
+
+// isTransient временная ошибка канала: сетевой сбой или временный отказ получателя
+func isTransient(err error) bool {
+	return errors.Is(err, ErrNotifyTransient) || retry.Transient(err)
+}
+
+// Dedup подавление повторных и дребезжащих уведомлений одного правила
+// уведомление с тем же статусом, что и последнее отправленное, не отправляется никогда:
+// новостей в нём нет, а Manager шлёт только смены состояния;
+// смена статуса раньше, чем через Window после последней отправки, откладывается
+// и отправляется в Flush по истечении окна, если статус так и не вернулся к отправленному,
+// поэтому дребезг метрики даёт не больше одного уведомления на окно,
+// а получатель в итоге узнаёт последнее состояние
+type Dedup struct {
+	Notifier Notifier
+	Window   time.Duration
+
+	mu      sync.Mutex
+	sent    map[string]sentAlert
+	pending map[string]Alert
+	clock   func() time.Time // источник времени, подменяется в тестах
+}
+
+// sentAlert статус и время последнего отправленного уведомления правила
+type sentAlert struct {
+	status string
+	at     time.Time
+}
+
+// NewDedup подавление дребезга в окне window, 0 - DEDUPWINDOW
+func NewDedup(n Notifier, window time.Duration) *Dedup {
+	if window <= 0 {
+		window = DEDUPWINDOW
+	}
+	return &Dedup{
+		Notifier: n,
+		Window:   window,
+		sent:     make(map[string]sentAlert),
+		pending:  make(map[string]Alert),
+	}
+}
+
+// Notify отправка, повтора или откладывание уведомления
+func (d *Dedup) Notify(ctx context.Context, alert Alert) error {
+	d.mu.Lock()
+	now := d.now()
+	last, ok := d.sent[alert.Rule]
+	switch {
+	case ok && last.status == alert.Status:
+		delete(d.pending, alert.Rule)
+		d.mu.Unlock()
+		return nil
+	case ok && now.Sub(last.at) < d.Window:
+		d.pending[alert.Rule] = alert
+		d.mu.Unlock()
+		return nil
+	}
+	delete(d.pending, alert.Rule)
+	d.mu.Unlock()
+	return d.send(ctx, alert)
+}
+
+// Flush отправка отложенных уведомлений, окно которых истекло
+func (d *Dedup) Flush(ctx context.Context) error {
+	d.mu.Lock()
+	now := d.now()
+	var ready []Alert
+	for rule, alert := range d.pending {
+		if now.Sub(d.sent[rule].at) >= d.Window {
+			ready = append(ready, alert)
+			delete(d.pending, rule)
+		}
+	}
+	d.mu.Unlock()
+
+	var errs []error
+	for _, alert := range ready {
+		errs = append(errs, d.send(ctx, alert))
+	}
+	return errors.Join(errs...)
+}
+
+// send отправка в канал и запоминание отправленного
+// неотправленное уведомление не запоминается, чтобы следующая смена статуса не была подавлена
+func (d *Dedup) send(ctx context.Context, alert Alert) error {
+	err := d.Notifier.Notify(ctx, alert)
+	if err != nil {
+		return err
+	}
+	d.mu.Lock()
+	d.sent[alert.Rule] = sentAlert{status: alert.Status, at: d.now()}
+	d.mu.Unlock()
+	return nil
+}
+
+// now текущее время
+func (d *Dedup) now() time.Time {
+	if d.clock != nil {
+		return d.clock()
+	}
+	return time.Now()
+}
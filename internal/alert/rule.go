@@ -0,0 +1,123 @@
+// Модуль алертинга: правила с порогами, их периодическая проверка по хранилищу метрик
+// и уведомления о срабатывании и снятии алертов
+package alert
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+)
+
+// Операторы сравнения значения метрики с порогом
+const (
+	OPGT = ">"
+	OPGE = ">="
+	OPLT = "<"
+	OPLE = "<="
+	OPEQ = "=="
+	OPNE = "!="
+)
+
+// RULEFOR ключевое слово длительности, которую условие должно выполняться до срабатывания
+const RULEFOR = "for"
+
+// Rule правило алертинга, например "gauge CpuUtilization > 90 for 2m"
+// значение берётся либо текущее из серии Metric, либо агрегат Query по истории,
+// например "rate(counter:PollCount[5m]) < 0.1 for 1m"
+type Rule struct {
+	Expr      string         // определение правила в исходном виде
+	Metric    storage.Metric // серия, значение которой сравнивается с порогом, если Query не задан
+	Query     *storage.Query // агрегат по истории, см. storage.ParseQuery
+	Op        string         // оператор сравнения
+	Threshold float64        // порог
+	For       time.Duration  // сколько условие должно выполняться до срабатывания, 0 - сразу
+}
+
+// ParseRule разбор правила вида "<type> <name>[{k="v"}] <op> <threshold> [for <duration>]"
+// или "<выражение агрегата> <op> <threshold> [for <duration>]"
+func ParseRule(expr string) (Rule, error) {
+	rule := Rule{Expr: strings.TrimSpace(expr)}
+	fields := strings.Fields(rule.Expr)
+
+	if n := len(fields); n >= 2 && fields[n-2] == RULEFOR {
+		d, err := time.ParseDuration(fields[n-1])
+		if err != nil || d < 0 {
+			return Rule{}, fmt.Errorf("%w: wrong duration %q in %q", ErrRuleFormat, fields[n-1], expr)
+		}
+		rule.For = d
+		fields = fields[:n-2]
+	}
+	n := len(fields)
+	if n < 3 {
+		return Rule{}, fmt.Errorf("%w: %q", ErrRuleFormat, expr)
+	}
+
+	switch fields[n-2] {
+	case OPGT, OPGE, OPLT, OPLE, OPEQ, OPNE:
+		rule.Op = fields[n-2]
+	default:
+		return Rule{}, fmt.Errorf("%w: unknown operator %q in %q", ErrRuleFormat, fields[n-2], expr)
+	}
+	threshold, err := strconv.ParseFloat(fields[n-1], 64)
+	if err != nil {
+		return Rule{}, fmt.Errorf("%w: wrong threshold %q in %q", ErrRuleFormat, fields[n-1], expr)
+	}
+	rule.Threshold = threshold
+
+	selector := fields[:n-2]
+	if strings.Contains(selector[0], "(") {
+		rule.Query, err = storage.ParseQuery(strings.Join(selector, " "))
+		if err != nil {
+			return Rule{}, fmt.Errorf("%w: %w", ErrRuleFormat, err)
+		}
+		return rule, nil
+	}
+	if len(selector) != 2 {
+		return Rule{}, fmt.Errorf("%w: expected type and name in %q", ErrRuleFormat, expr)
+	}
+	if selector[0] != storage.TYPEGAUGE && selector[0] != storage.TYPECOUNTER {
+		return Rule{}, fmt.Errorf("%w: %w", ErrRuleFormat, storage.ErrMetricTypeUnknown)
+	}
+	name, l := labels.ParseKey(selector[1])
+	if name == "" || strings.ContainsAny(name, "{}") {
+		return Rule{}, fmt.Errorf("%w: wrong metric name or labels %q", ErrRuleFormat, selector[1])
+	}
+	rule.Metric = storage.Metric{Type: selector[0], Name: name, Labels: l}
+	return rule, nil
+}
+
+// ParseRules разбор списка правил, например из файла конфигурации
+func ParseRules(exprs []string) ([]Rule, error) {
+	rules := make([]Rule, 0, len(exprs))
+	for _, expr := range exprs {
+		rule, err := ParseRule(expr)
+		if err != nil {
+			return nil, err
+		}
+		rules = append(rules, rule)
+	}
+	return rules, nil
+}
+
+// Match выполняется ли условие правила для значения value
+func (r Rule) Match(value float64) bool {
+	switch r.Op {
+	case OPGT:
+		return value > r.Threshold
+	case OPGE:
+		return value >= r.Threshold
+	case OPLT:
+		return value < r.Threshold
+	case OPLE:
+		return value <= r.Threshold
+	case OPEQ:
+		return value == r.Threshold
+	case OPNE:
+		return value != r.Threshold
+	}
+	return false
+}
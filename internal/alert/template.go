@@ -0,0 +1,48 @@
+package alert
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"text/template"
+)
+
+// Шаблоны уведомлений в директории шаблонов сервера
+const (
+	TEMPLATEPATTERN      = "alert_*.tmpl"             // маска файлов шаблонов уведомлений
+	TEMPLATEWEBHOOK      = "alert_webhook.tmpl"       // тело запроса webhook, должно быть JSON
+	TEMPLATEEMAILSUBJECT = "alert_email_subject.tmpl" // тема письма
+	TEMPLATEEMAIL        = "alert_email.tmpl"         // текст письма
+	TEMPLATEFILE         = "alert_file.tmpl"          // поле message строки файла уведомлений
+)
+
+// templateFuncs функции, доступные в шаблонах уведомлений
+var templateFuncs = template.FuncMap{
+	"json": func(v any) (string, error) {
+		data, err := json.Marshal(v)
+		return string(data), err
+	},
+}
+
+// LoadTemplates загрузка шаблонов уведомлений alert_*.tmpl из директории dir
+// в шаблонах доступны поля Alert и функция json для экранирования значений
+func LoadTemplates(dir string) (*template.Template, error) {
+	tmpl, err := template.New("alert").Funcs(templateFuncs).ParseGlob(filepath.Join(dir, TEMPLATEPATTERN))
+	if err != nil {
+		return nil, fmt.Errorf("fail while parse alert templates: %w", err)
+	}
+	return tmpl, nil
+}
+
+// render заполнение шаблона name данными уведомления
+func render(tmpl *template.Template, name string, alert Alert) ([]byte, error) {
+	if tmpl == nil || tmpl.Lookup(name) == nil {
+		return nil, fmt.Errorf("%w: %s", ErrTemplate, name)
+	}
+	var buf bytes.Buffer
+	if err := tmpl.ExecuteTemplate(&buf, name, alert); err != nil {
+		return nil, fmt.Errorf("fail while render %s: %w", name, err)
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,72 @@
+package alert
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"text/template"
+	"time"
+)
+
+// WEBHOOKTIMEOUT ограничение времени одной отправки уведомления
+const WEBHOOKTIMEOUT = 10 * time.Second
+
+// Webhook отправка уведомлений POST запросом с JSON телом
+// тело строится по шаблону TEMPLATEWEBHOOK, без шаблона - JSON представление Alert
+type Webhook struct {
+	URL      string
+	Client   *http.Client
+	Template *template.Template
+}
+
+// NewWebhook получатель уведомлений по адресу url
+func NewWebhook(url string) *Webhook {
+	return &Webhook{
+		URL:    url,
+		Client: &http.Client{Timeout: WEBHOOKTIMEOUT},
+	}
+}
+
+// Notify отправка уведомления, ответ не из диапазона 2xx считается ошибкой,
+// 429 и 5xx - временной ошибкой
+func (w *Webhook) Notify(ctx context.Context, alert Alert) error {
+	body, err := w.body(alert)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, w.URL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := w.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusTooManyRequests || resp.StatusCode >= 500 {
+		return fmt.Errorf("%w: %w: %s", ErrNotifyTransient, ErrWebhookStatus, resp.Status)
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("%w: %s", ErrWebhookStatus, resp.Status)
+	}
+	return nil
+}
+
+// body тело запроса по шаблону или JSON представление уведомления
+func (w *Webhook) body(alert Alert) ([]byte, error) {
+	if w.Template == nil {
+		return json.Marshal(alert)
+	}
+	body, err := render(w.Template, TEMPLATEWEBHOOK, alert)
+	if err != nil {
+		return nil, err
+	}
+	if !json.Valid(body) {
+		return nil, fmt.Errorf("%s rendered invalid json", TEMPLATEWEBHOOK)
+	}
+	return body, nil
+}
@@ -7,6 +7,7 @@ import (
 	"fmt"
 	"os"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	"github.com/caarlos0/env/v10"
 )
@@ -18,6 +19,16 @@ type Agent struct {
 	Key            *string `env:"KEY"`
 	RateLimit      *int    `env:"RATE_LIMIT"`
 	CryptoKey      *string `env:"CRYPTO_KEY"`
+	Transport      *string `env:"TRANSPORT"`
+	GRPCAddr       *string `env:"GRPC_ADDRESS"`
+	Labels         *string `env:"LABELS"`
+	SpoolDir       *string `env:"SPOOL_DIR"`
+	SpoolMaxSize   *int    `env:"SPOOL_MAX_SIZE"`
+	TLSCA          *string `env:"TLS_CA"`
+	TLSCert        *string `env:"TLS_CERT"`
+	TLSKey         *string `env:"TLS_KEY"`
+	AgentID        *string `env:"AGENT_ID"`
+	KeyVersion     *int    `env:"KEY_VERSION"`
 	Config         *string `env:"CONFIG"`
 }
 
@@ -28,6 +39,16 @@ type AgentFile struct {
 	CryptoKey      *string `json:"crypto_key"`
 	Key            *string `json:"key"`
 	RateLimit      *int    `json:"rate_limit"`
+	Transport      *string `json:"transport"`
+	GRPCAddress    *string `json:"grpc_address"`
+	Labels         *string `json:"labels"`
+	SpoolDir       *string `json:"spool_dir"`
+	SpoolMaxSize   *int    `json:"spool_max_size"`
+	TLSCA          *string `json:"tls_ca"`
+	TLSCert        *string `json:"tls_cert"`
+	TLSKey         *string `json:"tls_key"`
+	AgentID        *string `json:"agent_id"`
+	KeyVersion     *int    `json:"key_version"`
 }
 
 type AgentFlags struct {
@@ -37,6 +58,16 @@ type AgentFlags struct {
 	CryptoKey      *string
 	Key            *string
 	RateLimit      *int
+	Transport      *string
+	GRPCAddress    *string
+	Labels         *string
+	SpoolDir       *string
+	SpoolMaxSize   *int
+	TLSCA          *string
+	TLSCert        *string
+	TLSKey         *string
+	AgentID        *string
+	KeyVersion     *int
 	Config         *string
 }
 
@@ -52,6 +83,16 @@ func (a *Agent) Load() error {
 		Key            string `env:"KEY"`
 		RateLimit      int    `env:"RATE_LIMIT"`
 		CryptoKey      string `env:"CRYPTO_KEY"`
+		Transport      string `env:"TRANSPORT"`
+		GRPCAddr       string `env:"GRPC_ADDRESS"`
+		Labels         string `env:"LABELS"`
+		SpoolDir       string `env:"SPOOL_DIR"`
+		SpoolMaxSize   int    `env:"SPOOL_MAX_SIZE"`
+		TLSCA          string `env:"TLS_CA"`
+		TLSCert        string `env:"TLS_CERT"`
+		TLSKey         string `env:"TLS_KEY"`
+		AgentID        string `env:"AGENT_ID"`
+		KeyVersion     int    `env:"KEY_VERSION"`
 		Config         string `env:"CONFIG"`
 	}
 
@@ -68,6 +109,16 @@ func (a *Agent) Load() error {
 	a.Key = &a2.Key
 	a.RateLimit = &a2.RateLimit
 	a.CryptoKey = &a2.CryptoKey
+	a.Transport = &a2.Transport
+	a.GRPCAddr = &a2.GRPCAddr
+	a.Labels = &a2.Labels
+	a.SpoolDir = &a2.SpoolDir
+	a.SpoolMaxSize = &a2.SpoolMaxSize
+	a.TLSCA = &a2.TLSCA
+	a.TLSCert = &a2.TLSCert
+	a.TLSKey = &a2.TLSKey
+	a.AgentID = &a2.AgentID
+	a.KeyVersion = &a2.KeyVersion
 	a.Config = &a2.Config
 
 	flags := &AgentFlags{}
@@ -142,9 +193,141 @@ func (a *Agent) Resolve(flags *AgentFlags, file *AgentFile) error {
 		var cryptoKey string
 		a.CryptoKey = &cryptoKey
 	}
+	if a.Transport != nil && *a.Transport != "" {
+	} else if flags.Transport != nil && *flags.Transport != "" {
+		a.Transport = flags.Transport
+	} else if file.Transport != nil {
+		a.Transport = file.Transport
+	} else {
+		transport := TRANSPORTHTTP
+		a.Transport = &transport
+	}
+	if *a.Transport != TRANSPORTHTTP && *a.Transport != TRANSPORTGRPC {
+		return fmt.Errorf("%w %s", ErrWrongTransport, *a.Transport)
+	}
+	if a.GRPCAddr != nil && *a.GRPCAddr != "" {
+	} else if flags.GRPCAddress != nil && *flags.GRPCAddress != "" {
+		a.GRPCAddr = flags.GRPCAddress
+	} else if file.GRPCAddress != nil {
+		a.GRPCAddr = file.GRPCAddress
+	} else {
+		grpcAddr := DEFAULTGRPCADDR
+		a.GRPCAddr = &grpcAddr
+	}
+	if a.Labels != nil && *a.Labels != "" {
+	} else if flags.Labels != nil && *flags.Labels != "" {
+		a.Labels = flags.Labels
+	} else if file.Labels != nil {
+		a.Labels = file.Labels
+	} else {
+		var l string
+		a.Labels = &l
+	}
+	if _, err := labels.Parse(*a.Labels); err != nil {
+		return fmt.Errorf("%w %s: %w", ErrWrongLabels, *a.Labels, err)
+	}
+	if a.SpoolDir != nil && *a.SpoolDir != "" {
+	} else if flags.SpoolDir != nil && *flags.SpoolDir != "" {
+		a.SpoolDir = flags.SpoolDir
+	} else if file.SpoolDir != nil {
+		a.SpoolDir = file.SpoolDir
+	} else {
+		var spoolDir string
+		a.SpoolDir = &spoolDir
+	}
+	if a.SpoolMaxSize != nil && *a.SpoolMaxSize != 0 {
+	} else if flags.SpoolMaxSize != nil && *flags.SpoolMaxSize != 0 {
+		a.SpoolMaxSize = flags.SpoolMaxSize
+	} else if file.SpoolMaxSize != nil {
+		a.SpoolMaxSize = file.SpoolMaxSize
+	} else {
+		spoolMaxSize := DEFAULTSPOOLMAXSIZE
+		a.SpoolMaxSize = &spoolMaxSize
+	}
+	// буфер неотправленных метрик используется только при отправке одной пачкой по http
+	if *a.SpoolDir != "" && (*a.Transport != TRANSPORTHTTP || *a.RateLimit != 0) {
+		return fmt.Errorf("%w: spool works only with http transport without rate limit", ErrSpoolConfig)
+	}
+	if a.TLSCA != nil && *a.TLSCA != "" {
+	} else if flags.TLSCA != nil && *flags.TLSCA != "" {
+		a.TLSCA = flags.TLSCA
+	} else if file.TLSCA != nil {
+		a.TLSCA = file.TLSCA
+	} else {
+		var tlsCA string
+		a.TLSCA = &tlsCA
+	}
+	if a.TLSCert != nil && *a.TLSCert != "" {
+	} else if flags.TLSCert != nil && *flags.TLSCert != "" {
+		a.TLSCert = flags.TLSCert
+	} else if file.TLSCert != nil {
+		a.TLSCert = file.TLSCert
+	} else {
+		var tlsCert string
+		a.TLSCert = &tlsCert
+	}
+	if a.TLSKey != nil && *a.TLSKey != "" {
+	} else if flags.TLSKey != nil && *flags.TLSKey != "" {
+		a.TLSKey = flags.TLSKey
+	} else if file.TLSKey != nil {
+		a.TLSKey = file.TLSKey
+	} else {
+		var tlsKey string
+		a.TLSKey = &tlsKey
+	}
+	if a.AgentID != nil && *a.AgentID != "" {
+	} else if flags.AgentID != nil && *flags.AgentID != "" {
+		a.AgentID = flags.AgentID
+	} else if file.AgentID != nil {
+		a.AgentID = file.AgentID
+	} else {
+		var agentID string
+		a.AgentID = &agentID
+	}
+	if a.KeyVersion != nil && *a.KeyVersion != 0 {
+	} else if flags.KeyVersion != nil && *flags.KeyVersion != 0 {
+		a.KeyVersion = flags.KeyVersion
+	} else if file.KeyVersion != nil {
+		a.KeyVersion = file.KeyVersion
+	} else {
+		var keyVersion int
+		a.KeyVersion = &keyVersion
+	}
+	if (*a.TLSCert == "") != (*a.TLSKey == "") {
+		return fmt.Errorf("%w: certificate and key are set together", ErrTLSConfig)
+	}
+	if *a.TLSCert != "" && *a.TLSCA == "" {
+		return fmt.Errorf("%w: client certificate needs server CA", ErrTLSConfig)
+	}
+	if *a.AgentID != "" && *a.Key == "" {
+		return fmt.Errorf("%w: agent id needs agent key", ErrAgentKey)
+	}
+	if *a.KeyVersion < 0 || (*a.KeyVersion != 0 && *a.AgentID == "") {
+		return fmt.Errorf("%w: key version %d", ErrAgentKey, *a.KeyVersion)
+	}
 	return nil
 }
 
+// UseTLS метрики отправляются по https с проверкой сервера по TLSCA
+func (a *Agent) UseTLS() bool {
+	return a.TLSCA != nil && *a.TLSCA != ""
+}
+
+// UseGRPC метрики отправляются по gRPC, а не по http
+func (a *Agent) UseGRPC() bool {
+	return a.Transport != nil && *a.Transport == TRANSPORTGRPC
+}
+
+// LabelSet метки, которые агент добавляет к каждой метрике
+// корректность формата проверяется при загрузке конфигурации
+func (a *Agent) LabelSet() labels.Labels {
+	if a.Labels == nil {
+		return nil
+	}
+	l, _ := labels.Parse(*a.Labels)
+	return l
+}
+
 func (a *AgentFlags) loadConfigFromFlags() error {
 	a.Address = flag.String("a", "", "адрес сервера")
 	a.ReportInterval = flag.Int("r", 0, "секунд частота отправки метрик")
@@ -152,6 +335,16 @@ func (a *AgentFlags) loadConfigFromFlags() error {
 	a.Key = flag.String("k", "", "ключ для хэша")
 	a.RateLimit = flag.Int("l", 0, "ограничение количества одновременно исходящих запросов")
 	a.CryptoKey = flag.String("crypto-key", "", "path to RSA public key (for encryption)")
+	a.Transport = flag.String("transport", "", "транспорт для отправки метрик: http или grpc")
+	a.GRPCAddress = flag.String("grpc-address", "", "адрес gRPC сервера")
+	a.Labels = flag.String("labels", "", "метки метрик агента в формате k1=v1,k2=v2")
+	a.SpoolDir = flag.String("spool-dir", "", "директория буфера неотправленных метрик, пусто - без буфера")
+	a.SpoolMaxSize = flag.Int("spool-max-size", 0, "байт ограничение размера буфера неотправленных метрик")
+	a.TLSCA = flag.String("tls-ca", "", "CA сертификата сервера, включает https, другие CA не принимаются")
+	a.TLSCert = flag.String("tls-cert", "", "клиентский сертификат агента")
+	a.TLSKey = flag.String("tls-key", "", "ключ клиентского сертификата агента")
+	a.AgentID = flag.String("agent-id", "", "id агента, запросы подписываются его собственным ключом из -k")
+	a.KeyVersion = flag.Int("key-version", 0, "версия ключа агента, 0 - сервер подбирает действующую")
 	a.Config = flag.String("c", "", "path to json config")
 
 	flag.Parse()
@@ -180,6 +373,16 @@ func (a *AgentFile) loadConfigFromFile(pathEnv, pathFlag *string) error {
 		CryptoKey      *string `json:"crypto_key"`
 		Key            *string `json:"key"`
 		RateLimit      *int    `json:"rate_limit"`
+		Transport      *string `json:"transport"`
+		GRPCAddress    *string `json:"grpc_address"`
+		Labels         *string `json:"labels"`
+		SpoolDir       *string `json:"spool_dir"`
+		SpoolMaxSize   *int    `json:"spool_max_size"`
+		TLSCA          *string `json:"tls_ca"`
+		TLSCert        *string `json:"tls_cert"`
+		TLSKey         *string `json:"tls_key"`
+		AgentID        *string `json:"agent_id"`
+		KeyVersion     *int    `json:"key_version"`
 	}
 
 	var im interm
@@ -202,6 +405,16 @@ func (a *AgentFile) loadConfigFromFile(pathEnv, pathFlag *string) error {
 	a.CryptoKey = im.CryptoKey
 	a.Key = im.Key
 	a.RateLimit = im.RateLimit
+	a.Transport = im.Transport
+	a.GRPCAddress = im.GRPCAddress
+	a.Labels = im.Labels
+	a.SpoolDir = im.SpoolDir
+	a.SpoolMaxSize = im.SpoolMaxSize
+	a.TLSCA = im.TLSCA
+	a.TLSCert = im.TLSCert
+	a.TLSKey = im.TLSKey
+	a.AgentID = im.AgentID
+	a.KeyVersion = im.KeyVersion
 
 	return nil
 }
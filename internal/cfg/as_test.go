@@ -2,6 +2,7 @@ package cfg
 
 import (
 	"encoding/json"
+	"errors"
 	"flag"
 	"log"
 	"os"
@@ -105,6 +106,9 @@ func TestLoadConfigFromFileServer(t *testing.T) {
 		DatabaseDSN   *string `json:"database_dsn"`
 		Key           *string `json:"key"`
 		CryptoKey     *string `json:"crypto_key"`
+		History       *string `json:"history_retention"`
+		Compact       *string `json:"compact_interval"`
+		CounterKeep   *int    `json:"counter_retention"`
 	}
 
 	testConfig := interm{
@@ -115,6 +119,9 @@ func TestLoadConfigFromFileServer(t *testing.T) {
 		DatabaseDSN:   strPtr("/path/to/db"),
 		Key:           strPtr("my_secret_key"),
 		CryptoKey:     strPtr("/tmp/crypto_key.pub"),
+		History:       strPtr("2h"),
+		Compact:       strPtr("10m"),
+		CounterKeep:   intPtr(0),
 	}
 
 	data, err := json.Marshal(testConfig)
@@ -166,6 +173,15 @@ func TestLoadConfigFromFileServer(t *testing.T) {
 	if server.CryptoKey == nil || *server.CryptoKey != *testConfig.CryptoKey {
 		t.Errorf("expected crypto key %s, got %v", *testConfig.CryptoKey, *server.CryptoKey)
 	}
+	if server.HistoryRetention == nil || *server.HistoryRetention != 7200 {
+		t.Errorf("expected history retention %s, got %v", *testConfig.History, *server.HistoryRetention)
+	}
+	if server.CompactInterval == nil || *server.CompactInterval != 600 {
+		t.Errorf("expected compact interval %s, got %v", *testConfig.Compact, *server.CompactInterval)
+	}
+	if server.CounterRetention == nil || *server.CounterRetention != 0 {
+		t.Errorf("expected counter retention %d, got %v", *testConfig.CounterKeep, *server.CounterRetention)
+	}
 }
 
 func TestLoadConfigFromFlags(t *testing.T) {
@@ -470,6 +486,536 @@ func TestLoadConfigPriority(t *testing.T) {
 	}
 }
 
+func TestAgentTransport(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("gRPC из ENV", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+		os.Setenv("TRANSPORT", "grpc")
+		os.Setenv("GRPC_ADDRESS", "env.grpc:3200")
+		defer func() {
+			os.Unsetenv("TRANSPORT")
+			os.Unsetenv("GRPC_ADDRESS")
+		}()
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if !agent.UseGRPC() {
+			t.Errorf("expected grpc transport, got %v", *agent.Transport)
+		}
+		if *agent.GRPCAddr != "env.grpc:3200" {
+			t.Errorf("expected grpc address %q, got %v", "env.grpc:3200", *agent.GRPCAddr)
+		}
+	})
+
+	t.Run("по умолчанию http", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if agent.UseGRPC() || *agent.Transport != TRANSPORTHTTP {
+			t.Errorf("expected http transport, got %v", *agent.Transport)
+		}
+		if *agent.GRPCAddr != DEFAULTGRPCADDR {
+			t.Errorf("expected grpc address %q, got %v", DEFAULTGRPCADDR, *agent.GRPCAddr)
+		}
+	})
+
+	t.Run("неизвестный транспорт", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-transport", "smoke"}
+
+		agent := Agent{}
+		err := agent.Load()
+		if !errors.Is(err, ErrWrongTransport) {
+			t.Errorf("expected ErrWrongTransport, got %v", err)
+		}
+	})
+}
+
+func TestAgentLabels(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("метки из ENV важнее флагов", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-labels", "host=flag"}
+		os.Setenv("LABELS", "host=env,env=prod")
+		defer os.Unsetenv("LABELS")
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		l := agent.LabelSet()
+		if l["host"] != "env" || l["env"] != "prod" || len(l) != 2 {
+			t.Errorf("unexpected labels %v", l)
+		}
+	})
+
+	t.Run("без меток", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if l := agent.LabelSet(); l != nil {
+			t.Errorf("expected no labels, got %v", l)
+		}
+	})
+
+	t.Run("некорректные метки", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-labels", "host"}
+
+		agent := Agent{}
+		err := agent.Load()
+		if !errors.Is(err, ErrWrongLabels) {
+			t.Errorf("expected ErrWrongLabels, got %v", err)
+		}
+	})
+}
+
+func TestAgentSpool(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию без буфера", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if *agent.SpoolDir != "" || *agent.SpoolMaxSize != DEFAULTSPOOLMAXSIZE {
+			t.Errorf("unexpected spool config %q %d", *agent.SpoolDir, *agent.SpoolMaxSize)
+		}
+	})
+
+	t.Run("ENV важнее флагов", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-spool-dir", "/tmp/flag", "-spool-max-size", "2048"}
+		os.Setenv("SPOOL_DIR", "/tmp/env")
+		defer os.Unsetenv("SPOOL_DIR")
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if *agent.SpoolDir != "/tmp/env" || *agent.SpoolMaxSize != 2048 {
+			t.Errorf("unexpected spool config %q %d", *agent.SpoolDir, *agent.SpoolMaxSize)
+		}
+	})
+
+	t.Run("из файла", func(t *testing.T) {
+		path := filepath.Join(t.TempDir(), "agent.json")
+		if err := os.WriteFile(path, []byte(`{"spool_dir": "/tmp/file", "spool_max_size": 4096}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if *agent.SpoolDir != "/tmp/file" || *agent.SpoolMaxSize != 4096 {
+			t.Errorf("unexpected spool config %q %d", *agent.SpoolDir, *agent.SpoolMaxSize)
+		}
+	})
+
+	t.Run("буфер не совместим с gRPC", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-spool-dir", "/tmp/flag", "-transport", "grpc"}
+
+		agent := Agent{}
+		err := agent.Load()
+		if !errors.Is(err, ErrSpoolConfig) {
+			t.Errorf("expected ErrSpoolConfig, got %v", err)
+		}
+	})
+
+	t.Run("буфер не совместим с RATE_LIMIT", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-spool-dir", "/tmp/flag"}
+		os.Setenv("RATE_LIMIT", "2")
+		defer os.Unsetenv("RATE_LIMIT")
+
+		agent := Agent{}
+		err := agent.Load()
+		if !errors.Is(err, ErrSpoolConfig) {
+			t.Errorf("expected ErrSpoolConfig, got %v", err)
+		}
+	})
+}
+
+func TestServerStorage(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	cases := []struct {
+		name string
+		args []string
+		want string
+	}{
+		{name: "по умолчанию память", args: []string{"testbinary"}, want: STORAGEMEMORY},
+		{name: "путь к файлу - file", args: []string{"testbinary", "-f", "/tmp/backup"}, want: STORAGEFILE},
+		{name: "путь к bolt - bolt", args: []string{"testbinary", "-f", "/tmp/backup", "-bolt-path", "/tmp/bolt"}, want: STORAGEBOLT},
+		{name: "dsn - postgres", args: []string{"testbinary", "-f", "/tmp/backup", "-d", "postgres://localhost/db"}, want: STORAGEPOSTGRES},
+		{name: "явный выбор важнее dsn", args: []string{"testbinary", "-d", "postgres://localhost/db", "-storage", "memory"}, want: STORAGEMEMORY},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+			os.Args = tc.args
+
+			srv := Server{}
+			if err := srv.Load(); err != nil {
+				t.Fatalf("Server.Load() returned an error: %v", err)
+			}
+			if srv.Storage == nil || *srv.Storage != tc.want {
+				t.Errorf("expected storage = %s, got %v", tc.want, srv.Storage)
+			}
+		})
+	}
+
+	t.Run("из ENV", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-storage", "memory"}
+		os.Setenv("STORAGE", "file")
+		defer os.Unsetenv("STORAGE")
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.Storage != STORAGEFILE {
+			t.Errorf("expected storage = file, got %s", *srv.Storage)
+		}
+	})
+}
+
+func TestServerWAL(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.WAL || *srv.WALSync != WALSYNCINTERVAL || *srv.WALSyncInterval != DEFAULTWALSYNCINTERVAL {
+			t.Errorf("unexpected wal config %v %s %d", *srv.WAL, *srv.WALSync, *srv.WALSyncInterval)
+		}
+	})
+
+	t.Run("из флагов", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-wal", "-wal-sync", "batch"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if !*srv.WAL || *srv.WALSync != WALSYNCBATCH {
+			t.Errorf("unexpected wal config %v %s", *srv.WAL, *srv.WALSync)
+		}
+	})
+
+	t.Run("неизвестная политика", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+		os.Setenv("WAL_SYNC", "sometimes")
+		defer os.Unsetenv("WAL_SYNC")
+
+		srv := Server{}
+		err := srv.Load()
+		if !errors.Is(err, ErrWrongWALSync) {
+			t.Errorf("expected ErrWrongWALSync, got %v", err)
+		}
+	})
+}
+
+func TestServerBackupKeep(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.BackupKeep != DEFAULTBACKUPKEEP {
+			t.Errorf("expected backup keep %d, got %d", DEFAULTBACKUPKEEP, *srv.BackupKeep)
+		}
+	})
+
+	t.Run("env важнее флага", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-backup-keep", "5"}
+		os.Setenv("BACKUP_KEEP", "7")
+		defer os.Unsetenv("BACKUP_KEEP")
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.BackupKeep != 7 {
+			t.Errorf("expected backup keep 7, got %d", *srv.BackupKeep)
+		}
+	})
+}
+
+func TestServerDBQueryTimeout(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.DBQueryTimeout != DEFAULTDBQUERYTIMEOUT {
+			t.Errorf("expected db query timeout %d, got %d", DEFAULTDBQUERYTIMEOUT, *srv.DBQueryTimeout)
+		}
+	})
+
+	t.Run("из флагов", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-db-query-timeout", "2"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.DBQueryTimeout != 2 {
+			t.Errorf("expected db query timeout 2, got %d", *srv.DBQueryTimeout)
+		}
+	})
+
+	t.Run("из файла", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		if err := os.WriteFile(path, []byte(`{"db_query_timeout": "10s"}`), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.DBQueryTimeout != 10 {
+			t.Errorf("expected db query timeout 10, got %d", *srv.DBQueryTimeout)
+		}
+	})
+}
+
+func TestServerDBPool(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.DBMaxOpenConns != DEFAULTDBMAXOPENCONNS || *srv.DBMaxIdleConns != DEFAULTDBMAXIDLECONNS ||
+			*srv.DBConnLifetime != DEFAULTDBCONNLIFETIME || *srv.DBStmtTimeout != DEFAULTDBSTMTTIMEOUT {
+			t.Errorf("unexpected pool config %d %d %d %d", *srv.DBMaxOpenConns, *srv.DBMaxIdleConns, *srv.DBConnLifetime, *srv.DBStmtTimeout)
+		}
+	})
+
+	t.Run("env, флаги и файл", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-db-max-idle-conns", "3"}
+		os.Setenv("DB_MAX_OPEN_CONNS", "50")
+		defer os.Unsetenv("DB_MAX_OPEN_CONNS")
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		data := `{"db_max_open_conns": 10, "db_conn_max_lifetime": "10m", "db_statement_timeout": "30s"}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.DBMaxOpenConns != 50 || *srv.DBMaxIdleConns != 3 || *srv.DBConnLifetime != 600 || *srv.DBStmtTimeout != 30 {
+			t.Errorf("unexpected pool config %d %d %d %d", *srv.DBMaxOpenConns, *srv.DBMaxIdleConns, *srv.DBConnLifetime, *srv.DBStmtTimeout)
+		}
+	})
+}
+
+func TestServerReplica(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию без реплики", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.ReplicaDsn != "" || *srv.ReplicaMaxLag != DEFAULTREPLICAMAXLAG {
+			t.Errorf("unexpected replica config %q %d", *srv.ReplicaDsn, *srv.ReplicaMaxLag)
+		}
+	})
+
+	t.Run("из файла", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		data := `{"database_replica_dsn": "postgres://replica/metrics", "replica_max_lag": "1m"}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.ReplicaDsn != "postgres://replica/metrics" || *srv.ReplicaMaxLag != 60 {
+			t.Errorf("unexpected replica config %q %d", *srv.ReplicaDsn, *srv.ReplicaMaxLag)
+		}
+	})
+}
+
+func TestServerDualPrimary(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию файл", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-storage", "dual"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.Storage != STORAGEDUAL || *srv.DualPrimary != STORAGEFILE {
+			t.Errorf("unexpected dual config %s %s", *srv.Storage, *srv.DualPrimary)
+		}
+	})
+
+	t.Run("неизвестное основное хранилище", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-dual-primary", "bolt"}
+
+		srv := Server{}
+		err := srv.Load()
+		if !errors.Is(err, ErrWrongDualPrimary) {
+			t.Errorf("expected ErrWrongDualPrimary, got %v", err)
+		}
+	})
+}
+
+func TestServerAlerts(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("по умолчанию без правил", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if len(srv.AlertRules) != 0 || *srv.AlertWebhook != "" || *srv.AlertInterval != DEFAULTALERTINTERVAL {
+			t.Errorf("unexpected alert config %v %q %d", srv.AlertRules, *srv.AlertWebhook, *srv.AlertInterval)
+		}
+		if *srv.AlertSMTP != "" || *srv.AlertFile != "" || *srv.AlertDedup != DEFAULTALERTDEDUP {
+			t.Errorf("unexpected alert channels %q %q %d", *srv.AlertSMTP, *srv.AlertFile, *srv.AlertDedup)
+		}
+	})
+
+	t.Run("правила из файла, адрес из флага", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-alert-webhook", "http://localhost:9093/hook"}
+
+		path := filepath.Join(t.TempDir(), "config.json")
+		data := `{"alert_rules": ["gauge CpuUtilization > 90 for 2m"], "alert_webhook": "http://file/hook", "alert_interval": "30s",
+			"alert_file": "/var/log/alerts.jsonl", "alert_dedup_window": "10m"}`
+		if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		srv := Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if len(srv.AlertRules) != 1 || srv.AlertRules[0] != "gauge CpuUtilization > 90 for 2m" {
+			t.Errorf("unexpected alert rules %v", srv.AlertRules)
+		}
+		if *srv.AlertWebhook != "http://localhost:9093/hook" || *srv.AlertInterval != 30 {
+			t.Errorf("unexpected alert config %q %d", *srv.AlertWebhook, *srv.AlertInterval)
+		}
+		if *srv.AlertFile != "/var/log/alerts.jsonl" || *srv.AlertDedup != 600 {
+			t.Errorf("unexpected alert channels %q %d", *srv.AlertFile, *srv.AlertDedup)
+		}
+	})
+}
+
 // Хэлпер-функции для сокращения записи
 func strPtr(s string) *string {
 	return &s
@@ -482,3 +1028,293 @@ func intPtr(i int) *int {
 func boolPtr(b bool) *bool {
 	return &b
 }
+
+func TestTLS(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("сервер с mTLS", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-tls-cert", "server.pem", "-tls-key", "server.key", "-tls-client-ca", "ca.pem",
+			"-tls-allowed-subjects", "agent-1; CN=agent-2,O=Metrics ;"}
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if !srv.UseTLS() || *srv.TLSClientCA != "ca.pem" {
+			t.Errorf("unexpected tls config %q %q", *srv.TLSCert, *srv.TLSClientCA)
+		}
+		subjects := srv.AllowedSubjects()
+		if len(subjects) != 2 || subjects[0] != "agent-1" || subjects[1] != "CN=agent-2,O=Metrics" {
+			t.Errorf("unexpected subjects %q", subjects)
+		}
+	})
+
+	t.Run("сервер без ключа", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-tls-cert", "server.pem"}
+
+		var srv Server
+		if err := srv.Load(); !errors.Is(err, ErrTLSConfig) {
+			t.Errorf("expected ErrTLSConfig, got %v", err)
+		}
+	})
+
+	t.Run("агент по умолчанию без TLS", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if agent.UseTLS() {
+			t.Errorf("unexpected tls ca %q", *agent.TLSCA)
+		}
+	})
+
+	t.Run("агент с клиентским сертификатом из ENV", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-tls-ca", "ca.pem"}
+		os.Setenv("TLS_CERT", "agent.pem")
+		os.Setenv("TLS_KEY", "agent.key")
+		defer func() {
+			os.Unsetenv("TLS_CERT")
+			os.Unsetenv("TLS_KEY")
+		}()
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if !agent.UseTLS() || *agent.TLSCert != "agent.pem" || *agent.TLSKey != "agent.key" {
+			t.Errorf("unexpected tls config %q %q %q", *agent.TLSCA, *agent.TLSCert, *agent.TLSKey)
+		}
+	})
+
+	t.Run("клиентский сертификат без CA сервера", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-tls-cert", "agent.pem", "-tls-key", "agent.key"}
+
+		agent := Agent{}
+		if err := agent.Load(); !errors.Is(err, ErrTLSConfig) {
+			t.Errorf("expected ErrTLSConfig, got %v", err)
+		}
+	})
+}
+
+func TestAgentKey(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("токен управления агентами из ENV", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-admin-token", "from-flag"}
+		os.Setenv("ADMIN_TOKEN", "from-env")
+		defer os.Unsetenv("ADMIN_TOKEN")
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.AdminToken != "from-env" {
+			t.Errorf("unexpected admin token %q", *srv.AdminToken)
+		}
+	})
+
+	t.Run("общий ключ рядом с ключами агентов", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.SharedFallback {
+			t.Error("shared key fallback must be off by default")
+		}
+
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-shared-key-fallback"}
+		srv = Server{}
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if !*srv.SharedFallback {
+			t.Error("shared key fallback expected from flag")
+		}
+	})
+
+	t.Run("агент с собственным ключом", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-k", "secret", "-agent-id", "agent-1", "-key-version", "2"}
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if *agent.AgentID != "agent-1" || *agent.KeyVersion != 2 {
+			t.Errorf("unexpected agent %q version %d", *agent.AgentID, *agent.KeyVersion)
+		}
+	})
+
+	t.Run("агент из файла конфигурации", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-k", "secret"}
+		path := filepath.Join(t.TempDir(), "agent.json")
+		if err := os.WriteFile(path, []byte(`{"agent_id": "agent-2", "key_version": 3}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		agent := Agent{}
+		if err := agent.Load(); err != nil {
+			t.Fatalf("Agent.Load() returned an error: %v", err)
+		}
+		if *agent.AgentID != "agent-2" || *agent.KeyVersion != 3 {
+			t.Errorf("unexpected agent %q version %d", *agent.AgentID, *agent.KeyVersion)
+		}
+	})
+
+	t.Run("id агента без ключа", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-agent-id", "agent-1"}
+
+		agent := Agent{}
+		if err := agent.Load(); !errors.Is(err, ErrAgentKey) {
+			t.Errorf("expected ErrAgentKey, got %v", err)
+		}
+	})
+
+	t.Run("версия ключа без id агента", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-k", "secret", "-key-version", "2"}
+
+		agent := Agent{}
+		if err := agent.Load(); !errors.Is(err, ErrAgentKey) {
+			t.Errorf("expected ErrAgentKey, got %v", err)
+		}
+	})
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("подсеть из флага", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-t", "192.168.1.0/24"}
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		subnet, err := srv.TrustedNet()
+		if err != nil || subnet.String() != "192.168.1.0/24" {
+			t.Errorf("unexpected trusted subnet %v, %v", subnet, err)
+		}
+	})
+
+	t.Run("подсеть из файла конфигурации", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+		path := filepath.Join(t.TempDir(), "server.json")
+		if err := os.WriteFile(path, []byte(`{"trusted_subnet": "10.0.0.0/8"}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.TrustedSubnet != "10.0.0.0/8" {
+			t.Errorf("unexpected trusted subnet %q", *srv.TrustedSubnet)
+		}
+	})
+
+	t.Run("без подсети проверки нет", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if subnet, err := srv.TrustedNet(); subnet != nil || err != nil {
+			t.Errorf("unexpected trusted subnet %v, %v", subnet, err)
+		}
+	})
+
+	t.Run("неверная подсеть из ENV", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+		os.Setenv("TRUSTED_SUBNET", "192.168.1.1")
+		defer os.Unsetenv("TRUSTED_SUBNET")
+
+		var srv Server
+		if err := srv.Load(); !errors.Is(err, ErrTrustedSubnet) {
+			t.Errorf("expected ErrTrustedSubnet, got %v", err)
+		}
+	})
+}
+
+func TestReplay(t *testing.T) {
+	err := logger.Init(os.Stdout, 4)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	t.Run("значения по умолчанию", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.ReplayWindow != DEFAULTREPLAYWINDOW || *srv.NonceCacheSize != DEFAULTNONCECACHESIZE {
+			t.Errorf("unexpected replay config %d %d", *srv.ReplayWindow, *srv.NonceCacheSize)
+		}
+	})
+
+	t.Run("окно из файла, размер из флага", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary", "-nonce-cache-size", "500"}
+		path := filepath.Join(t.TempDir(), "server.json")
+		if err := os.WriteFile(path, []byte(`{"replay_window": "2m", "nonce_cache_size": 10}`), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		os.Setenv("CONFIG", path)
+		defer os.Unsetenv("CONFIG")
+
+		var srv Server
+		if err := srv.Load(); err != nil {
+			t.Fatalf("Server.Load() returned an error: %v", err)
+		}
+		if *srv.ReplayWindow != 120 || *srv.NonceCacheSize != 500 {
+			t.Errorf("unexpected replay config %d %d", *srv.ReplayWindow, *srv.NonceCacheSize)
+		}
+	})
+
+	t.Run("отрицательное окно из ENV", func(t *testing.T) {
+		flag.CommandLine = flag.NewFlagSet("test", flag.ContinueOnError)
+		os.Args = []string{"testbinary"}
+		os.Setenv("REPLAY_WINDOW", "-1")
+		defer os.Unsetenv("REPLAY_WINDOW")
+
+		var srv Server
+		if err := srv.Load(); !errors.Is(err, ErrReplayConfig) {
+			t.Errorf("expected ErrReplayConfig, got %v", err)
+		}
+	})
+}
@@ -1,17 +1,60 @@
 package cfg
 
 const (
-	DEFAULTADDR = "localhost:8080"
+	DEFAULTADDR     = "localhost:8080"
+	DEFAULTGRPCADDR = "localhost:3200"
 )
 
 // костанты агента
 const (
 	DEFAULTREPORTINTERVAL = 10
 	DEFAULTPOLLINTERVAL   = 2
+	DEFAULTSPOOLMAXSIZE   = 10 << 20
+)
+
+// транспорт агента
+const (
+	TRANSPORTHTTP = "http"
+	TRANSPORTGRPC = "grpc"
+)
+
+// хранилища сервера, имена совпадают с зарегистрированными в storage
+const (
+	STORAGEMEMORY   = "memory"
+	STORAGEFILE     = "file"
+	STORAGEBOLT     = "bolt"
+	STORAGEPOSTGRES = "postgres"
+	STORAGEDUAL     = "dual" // запись в файл и в postgres на время переезда
+)
+
+// политики сброса журнала WAL на диск, совпадают с storage/wal
+const (
+	WALSYNCALWAYS   = "always"
+	WALSYNCBATCH    = "batch"
+	WALSYNCINTERVAL = "interval"
 )
 
 // константы сервера
 const (
-	DEFAULTSTOREINTERVAL = 300
-	DEFAULTRESTORE       = true
+	DEFAULTSTOREINTERVAL    = 300
+	DEFAULTRESTORE          = true
+	DEFAULTHISTORYRETENTION = 86400
+	DEFAULTCOMPACTINTERVAL  = 300
+	DEFAULTCOUNTERRETENTION = 100
+	DEFAULTWAL              = false
+	DEFAULTWALSYNC          = WALSYNCINTERVAL
+	DEFAULTWALSYNCINTERVAL  = 1
+	DEFAULTBACKUPKEEP       = 3
+	DEFAULTDBQUERYTIMEOUT   = 5
+	DEFAULTDBMAXOPENCONNS   = 25
+	DEFAULTDBMAXIDLECONNS   = 5
+	DEFAULTDBCONNLIFETIME   = 1800
+	DEFAULTDBSTMTTIMEOUT    = 0
+	DEFAULTREPLICAMAXLAG    = 10
+	DEFAULTDUALPRIMARY      = STORAGEFILE
+	DEFAULTALERTINTERVAL    = 15
+	DEFAULTALERTDEDUP       = 300
+	DEFAULTREPLAYWINDOW     = 300
+	DEFAULTNONCECACHESIZE   = 100000
+	DEFAULTSHAREDFALLBACK   = false
 )
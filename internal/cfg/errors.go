@@ -3,6 +3,15 @@ package cfg
 import "errors"
 
 var (
-	ErrWrongTimeFormat = errors.New("time format wrong")
-	ErrCFGFile         = errors.New("problem with cfg file: ")
+	ErrWrongTimeFormat  = errors.New("time format wrong")
+	ErrCFGFile          = errors.New("problem with cfg file: ")
+	ErrWrongTransport   = errors.New("unknown transport")
+	ErrWrongLabels      = errors.New("wrong labels format")
+	ErrWrongWALSync     = errors.New("unknown wal sync policy")
+	ErrWrongDualPrimary = errors.New("unknown dual storage primary")
+	ErrTLSConfig        = errors.New("wrong tls config")
+	ErrAgentKey         = errors.New("wrong agent key config")
+	ErrTrustedSubnet    = errors.New("wrong trusted subnet")
+	ErrReplayConfig     = errors.New("wrong replay protection config")
+	ErrSpoolConfig      = errors.New("wrong spool config")
 )
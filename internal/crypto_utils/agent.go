@@ -32,6 +32,8 @@ func LoadPublicKey(path string) (*rsa.PublicKey, error) {
 	return rsaPub, nil
 }
 
+// EncryptRSA шифрование данных целиком RSA-OAEP
+// размер данных ограничен размером ключа (190 байт для 2048 бит), тела запросов шифруются EncryptEnvelope
 func EncryptRSA(jsonData []byte, pub *rsa.PublicKey) (string, error) {
 	encryptedBytes, err := rsa.EncryptOAEP(
 		sha256.New(),
@@ -3,18 +3,25 @@ package cryptoutils
 import (
 	"bytes"
 	"crypto"
+	"crypto/ecdsa"
+	"crypto/elliptic"
 	"crypto/rand"
 	"crypto/rsa"
+	"crypto/tls"
 	"crypto/x509"
+	"crypto/x509/pkix"
 	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
 	"io"
+	"math/big"
+	"net"
 	"net/http"
 	"net/http/httptest"
 	"os"
 	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/require"
@@ -281,6 +288,169 @@ func TestDecryptBodyMiddleware_InvalidJSON(t *testing.T) {
 	require.Contains(t, w.Body.String(), "invalid encrypted JSON")
 }
 
+//
+// Тесты на конверт EncryptEnvelope / DecryptEnvelope
+//
+
+func TestEnvelope(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+
+	// данные заметно больше предела RSA-OAEP для ключа 2048 бит
+	original := bytes.Repeat([]byte(`{"id":"Alloc","type":"gauge","value":123.456}`), 1000)
+	_, err = EncryptRSA(original, &priv.PublicKey)
+	require.Error(t, err, "RSA целиком такие данные не шифрует")
+
+	env, err := EncryptEnvelope(original, &priv.PublicKey)
+	require.NoError(t, err)
+	decrypted, err := DecryptEnvelope(env, priv)
+	require.NoError(t, err)
+	require.Equal(t, original, decrypted)
+
+	t.Run("Подмена полей обнаруживается", func(t *testing.T) {
+		flip := func(b64 string) string {
+			raw, err := base64.StdEncoding.DecodeString(b64)
+			require.NoError(t, err)
+			raw[len(raw)/2] ^= 0x01
+			return base64.StdEncoding.EncodeToString(raw)
+		}
+		other, err := EncryptEnvelope(original, &priv.PublicKey)
+		require.NoError(t, err)
+
+		tampered := map[string]Envelope{
+			"data":              {Key: env.Key, Nonce: env.Nonce, Data: flip(env.Data)},
+			"nonce":             {Key: env.Key, Nonce: flip(env.Nonce), Data: env.Data},
+			"key":               {Key: flip(env.Key), Nonce: env.Nonce, Data: env.Data},
+			"чужой ключ":        {Key: other.Key, Nonce: env.Nonce, Data: env.Data},
+			"обрезанные данные": {Key: env.Key, Nonce: env.Nonce, Data: base64.StdEncoding.EncodeToString([]byte("short"))},
+		}
+		for name, e := range tampered {
+			_, err := DecryptEnvelope(&e, priv)
+			require.ErrorIs(t, err, ErrDecrypt, name)
+		}
+	})
+
+	t.Run("Чужой приватный ключ", func(t *testing.T) {
+		stranger, err := rsa.GenerateKey(rand.Reader, 2048)
+		require.NoError(t, err)
+		_, err = DecryptEnvelope(env, stranger)
+		require.ErrorIs(t, err, ErrDecrypt)
+	})
+
+	t.Run("Некорректный base64", func(t *testing.T) {
+		_, err := DecryptEnvelope(&Envelope{Key: "NOT_BASE64", Nonce: env.Nonce, Data: env.Data}, priv)
+		require.ErrorIs(t, err, ErrBase64)
+	})
+}
+
+func TestDecryptBodyMiddleware_Envelope(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	PrivateKey = priv
+	defer func() { PrivateKey = nil }()
+
+	original := bytes.Repeat([]byte(`{"hello":"world"}`), 100)
+	env, err := EncryptEnvelope(original, &priv.PublicKey)
+	require.NoError(t, err)
+
+	r := gin.Default()
+	r.Use(DecryptBody())
+	r.POST("/test", func(c *gin.Context) {
+		body, err := io.ReadAll(c.Request.Body)
+		require.NoError(t, err)
+		require.Equal(t, original, body)
+		c.String(http.StatusOK, "ok")
+	})
+	do := func(env *Envelope) *httptest.ResponseRecorder {
+		payload, err := json.Marshal(env)
+		require.NoError(t, err)
+		req := httptest.NewRequest(http.MethodPost, "/test", bytes.NewBuffer(payload))
+		req.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, req)
+		return w
+	}
+
+	w := do(env)
+	require.Equal(t, http.StatusOK, w.Code)
+
+	sealed, err := base64.StdEncoding.DecodeString(env.Data)
+	require.NoError(t, err)
+	sealed[0] ^= 0xff
+	tampered := *env
+	tampered.Data = base64.StdEncoding.EncodeToString(sealed)
+	w = do(&tampered)
+	require.Equal(t, http.StatusBadRequest, w.Code)
+	require.Contains(t, w.Body.String(), "decryption error")
+}
+
+//
+// Тесты на mTLS
+//
+
+func TestTLSConfig(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCA(t, dir, "ca")
+	rogue := newTestCA(t, dir, "rogue")
+	serverCert, serverKey := ca.issue(t, dir, "server", "localhost", false)
+	agentCert, agentKey := ca.issue(t, dir, "agent", "agent-1", true)
+	rogueCert, rogueKey := rogue.issue(t, dir, "rogue-agent", "agent-1", true)
+
+	serverTLS, err := ServerTLSConfig(serverCert, serverKey, ca.certFile)
+	require.NoError(t, err)
+	ts := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.TLS.VerifiedChains[0][0].Subject.CommonName)
+	}))
+	ts.TLS = serverTLS
+	ts.StartTLS()
+	defer ts.Close()
+
+	get := func(caFile, certFile, keyFile string) (string, error) {
+		clientTLS, err := ClientTLSConfig(caFile, certFile, keyFile)
+		require.NoError(t, err)
+		cl := &http.Client{Transport: &http.Transport{TLSClientConfig: clientTLS}}
+		resp, err := cl.Get(ts.URL)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		body, err := io.ReadAll(resp.Body)
+		return string(body), err
+	}
+
+	t.Run("Агент с сертификатом от доверенного CA", func(t *testing.T) {
+		subject, err := get(ca.certFile, agentCert, agentKey)
+		require.NoError(t, err)
+		require.Equal(t, "agent-1", subject)
+	})
+
+	t.Run("Агент без сертификата", func(t *testing.T) {
+		_, err := get(ca.certFile, "", "")
+		require.Error(t, err)
+	})
+
+	t.Run("Сертификат от чужого CA", func(t *testing.T) {
+		_, err := get(ca.certFile, rogueCert, rogueKey)
+		require.Error(t, err)
+	})
+
+	t.Run("Сервер не подписан закреплённым CA", func(t *testing.T) {
+		_, err := get(rogue.certFile, agentCert, agentKey)
+		require.Error(t, err)
+	})
+
+	t.Run("Файл CA без сертификатов", func(t *testing.T) {
+		_, err := ClientTLSConfig(agentKey, "", "")
+		require.ErrorIs(t, err, ErrParsePEMCA)
+	})
+
+	t.Run("Сервер без mTLS", func(t *testing.T) {
+		config, err := ServerTLSConfig(serverCert, serverKey, "")
+		require.NoError(t, err)
+		require.Equal(t, tls.NoClientCert, config.ClientAuth)
+	})
+}
+
 //
 // ------------------
 // Вспомогательные функции
@@ -310,3 +480,63 @@ func rsaDecryptBase64(b64 string, priv *rsa.PrivateKey) ([]byte, error) {
 func hashFunc() crypto.Hash {
 	return crypto.SHA256
 }
+
+// testCA тестовый удостоверяющий центр
+type testCA struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+}
+
+// newTestCA самоподписанный CA, сертификат сохраняется в dir/name.pem
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+	cert, err := x509.ParseCertificate(der)
+	require.NoError(t, err)
+	certFile := filepath.Join(dir, name+".pem")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	return &testCA{cert: cert, key: key, certFile: certFile}
+}
+
+// issue сертификат с CommonName cn, подписанный CA, файлы dir/name.pem и dir/name.key
+// серверный сертификат выдаётся на localhost и 127.0.0.1
+func (ca *testCA) issue(t *testing.T, dir, name, cn string, client bool) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		DNSNames:     []string{"localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+	}
+	if client {
+		template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+		template.DNSNames, template.IPAddresses = nil, nil
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, ca.cert, &key.PublicKey, ca.key)
+	require.NoError(t, err)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	require.NoError(t, err)
+
+	certFile := filepath.Join(dir, name+".pem")
+	keyFile := filepath.Join(dir, name+".key")
+	require.NoError(t, os.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(t, os.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600))
+	return certFile, keyFile
+}
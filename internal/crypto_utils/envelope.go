@@ -0,0 +1,109 @@
+package cryptoutils
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"encoding/base64"
+	"fmt"
+	"io"
+)
+
+// ENVELOPEKEYSIZE размер ключа AES-256 в байтах
+const ENVELOPEKEYSIZE = 32
+
+// Envelope зашифрованное тело запроса, передаётся как JSON
+// Data - данные, зашифрованные AES-256-GCM случайным ключом запроса,
+// Key - этот ключ, зашифрованный RSA-OAEP открытым ключом сервера, Nonce - nonce GCM, всё в base64
+// тег GCM проверяется с зашифрованным ключом в качестве дополнительных данных,
+// поэтому подмена любого поля обнаруживается при расшифровке
+// без Key поле Data считается зашифрованным RSA-OAEP целиком, как в EncryptRSA
+type Envelope struct {
+	Key   string `json:"key,omitempty"`
+	Nonce string `json:"nonce,omitempty"`
+	Data  string `json:"data"`
+}
+
+// EncryptEnvelope шифрование данных любого размера
+// RSA шифрует только ключ AES, поэтому размер данных не ограничен размером ключа RSA
+func EncryptEnvelope(data []byte, pub *rsa.PublicKey) (*Envelope, error) {
+	key := make([]byte, ENVELOPEKEYSIZE)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return nil, err
+	}
+	wrapped, err := rsa.EncryptOAEP(sha256.New(), rand.Reader, pub, key, nil)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+	sealed := gcm.Seal(nil, nonce, data, wrapped)
+
+	return &Envelope{
+		Key:   base64.StdEncoding.EncodeToString(wrapped),
+		Nonce: base64.StdEncoding.EncodeToString(nonce),
+		Data:  base64.StdEncoding.EncodeToString(sealed),
+	}, nil
+}
+
+// DecryptEnvelope расшифровка конверта приватным ключом сервера
+// понимает и конверт без Key от агентов, шифрующих EncryptRSA
+// ошибки формата base64 оборачивают ErrBase64, все прочие - ErrDecrypt
+func DecryptEnvelope(env *Envelope, priv *rsa.PrivateKey) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(env.Data)
+	if err != nil {
+		return nil, fmt.Errorf("%w: data: %w", ErrBase64, err)
+	}
+	if env.Key == "" {
+		plain, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, data, nil)
+		if err != nil {
+			return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+		}
+		return plain, nil
+	}
+
+	wrapped, err := base64.StdEncoding.DecodeString(env.Key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: key: %w", ErrBase64, err)
+	}
+	nonce, err := base64.StdEncoding.DecodeString(env.Nonce)
+	if err != nil {
+		return nil, fmt.Errorf("%w: nonce: %w", ErrBase64, err)
+	}
+	key, err := rsa.DecryptOAEP(sha256.New(), rand.Reader, priv, wrapped, nil)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	if len(key) != ENVELOPEKEYSIZE {
+		return nil, fmt.Errorf("%w: wrong key size %d", ErrDecrypt, len(key))
+	}
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	if len(nonce) != gcm.NonceSize() {
+		return nil, fmt.Errorf("%w: wrong nonce size %d", ErrDecrypt, len(nonce))
+	}
+	plain, err := gcm.Open(nil, nonce, data, wrapped)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrDecrypt, err)
+	}
+	return plain, nil
+}
+
+// newGCM AES-GCM с ключом key
+func newGCM(key []byte) (cipher.AEAD, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
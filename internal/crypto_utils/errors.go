@@ -6,4 +6,7 @@ var (
 	ErrParsePEMpubl    = errors.New("failed to parse PEM block from public key")
 	ErrParsePEMprivate = errors.New("failed to parse PEM block from private key")
 	ErrNotPublicKey    = errors.New("not RSA public key")
+	ErrParsePEMCA      = errors.New("no certificates in CA file")
+	ErrBase64          = errors.New("invalid base64 data")
+	ErrDecrypt         = errors.New("decryption error")
 )
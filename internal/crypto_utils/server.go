@@ -2,13 +2,11 @@ package cryptoutils
 
 import (
 	"bytes"
-	"crypto/rand"
 	"crypto/rsa"
-	"crypto/sha256"
 	"crypto/x509"
-	"encoding/base64"
 	"encoding/json"
 	"encoding/pem"
+	"errors"
 	"io"
 	"net/http"
 	"os"
@@ -35,6 +33,7 @@ func LoadPrivateKey(path string) (*rsa.PrivateKey, error) {
 }
 
 // DecryptBody Middleware для расшифровки тела запроса
+// тело - JSON Envelope, подменённое или повреждённое тело отклоняется с 400
 func DecryptBody() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if PrivateKey == nil {
@@ -50,27 +49,17 @@ func DecryptBody() gin.HandlerFunc {
 
 		c.Request.Body.Close()
 
-		var wrapper struct {
-			Data string `json:"data"`
-		}
-		if err := json.Unmarshal(body, &wrapper); err != nil {
+		var envelope Envelope
+		if err := json.Unmarshal(body, &envelope); err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid encrypted JSON"})
 			return
 		}
 
-		encrypted, err := base64.StdEncoding.DecodeString(wrapper.Data)
-		if err != nil {
+		decryptedBytes, err := DecryptEnvelope(&envelope, PrivateKey)
+		if errors.Is(err, ErrBase64) {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "invalid base64 data"})
 			return
 		}
-
-		decryptedBytes, err := rsa.DecryptOAEP(
-			sha256.New(),
-			rand.Reader,
-			PrivateKey,
-			encrypted,
-			nil,
-		)
 		if err != nil {
 			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "decryption error"})
 			return
@@ -0,0 +1,74 @@
+package cryptoutils
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"os"
+)
+
+// ServerTLSConfig настройки TLS сервера с сертификатом certFile и ключом keyFile
+// если задан clientCAFile, сервер требует клиентский сертификат, подписанный этим CA (mTLS)
+func ServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, fmt.Errorf("fail while load server certificate: %w", err)
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if clientCAFile != "" {
+		pool, err := loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// ClientTLSConfig настройки TLS агента
+// сертификат сервера проверяется только по CA из caFile, системные корневые сертификаты не используются,
+// если заданы certFile и keyFile, агент предъявляет клиентский сертификат
+func ClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	pool, err := loadCertPool(caFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		RootCAs:    pool,
+		MinVersion: tls.VersionTLS12,
+	}
+	if certFile != "" || keyFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("fail while load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// SubjectAllowed есть ли subject клиентского сертификата среди allowed
+// subject сверяется и с CommonName, и с полным DN вида CN=agent,O=org
+func SubjectAllowed(allowed map[string]struct{}, subject pkix.Name) bool {
+	_, okCN := allowed[subject.CommonName]
+	_, okDN := allowed[subject.String()]
+	return okCN || okDN
+}
+
+// loadCertPool набор доверенных CA из PEM файла
+func loadCertPool(path string) (*x509.CertPool, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, fmt.Errorf("%w: %s", ErrParsePEMCA, path)
+	}
+	return pool, nil
+}
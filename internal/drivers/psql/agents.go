@@ -0,0 +1,84 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// AGENTKEYSTABLENAME таблица ключей агентов, создаётся миграцией 0003_agent_keys
+const AGENTKEYSTABLENAME = "agent_keys"
+
+// AgentKey строка таблицы ключей агентов
+type AgentKey struct {
+	AgentID   string
+	Version   int
+	Key       string
+	CreatedAt time.Time
+	ExpiresAt *time.Time
+}
+
+// AgentKeys все версии ключей всех агентов
+func (db *DB) AgentKeys(ctx context.Context) ([]AgentKey, error) {
+	query := `SELECT agent_id, version, key, ` + COLUMNCREATEDAT + `, expires_at FROM ` + AGENTKEYSTABLENAME + ` ORDER BY agent_id, version;`
+
+	var keys []AgentKey
+	err := db.queryRetry(ctx, query, func(rows *sql.Rows) error {
+		keys = keys[:0]
+		for rows.Next() {
+			var key AgentKey
+			var expires sql.NullTime
+			if err := rows.Scan(&key.AgentID, &key.Version, &key.Key, &key.CreatedAt, &expires); err != nil {
+				return err
+			}
+			if expires.Valid {
+				key.ExpiresAt = &expires.Time
+			}
+			keys = append(keys, key)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// SaveAgentKey добавление версии ключа или обновление срока её действия
+func (db *DB) SaveAgentKey(ctx context.Context, key AgentKey) error {
+	query := `INSERT INTO ` + AGENTKEYSTABLENAME + ` (agent_id, version, key, ` + COLUMNCREATEDAT + `, expires_at)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (agent_id, version) DO UPDATE SET key = EXCLUDED.key, expires_at = EXCLUDED.expires_at;`
+
+	_, err := db.execRetry(ctx, query, key.AgentID, key.Version, key.Key, key.CreatedAt, key.ExpiresAt)
+	return err
+}
+
+// ReplaceAgentKeys замена всех версий ключа агента на keys одной транзакцией
+func (db *DB) ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error {
+	deleteQuery := `DELETE FROM ` + AGENTKEYSTABLENAME + ` WHERE agent_id = $1;`
+	insertQuery := `INSERT INTO ` + AGENTKEYSTABLENAME + ` (agent_id, version, key, ` + COLUMNCREATEDAT + `, expires_at)
+		VALUES ($1, $2, $3, $4, $5);`
+
+	return db.txRetry(ctx, db.queryTimeout, func(tx *sql.Tx) error {
+		_, err := tx.ExecContext(ctx, deleteQuery, agentID)
+		if err != nil {
+			return err
+		}
+		for _, key := range keys {
+			_, err = tx.ExecContext(ctx, insertQuery, agentID, key.Version, key.Key, key.CreatedAt, key.ExpiresAt)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// DeleteAgentKeys удаление версии version ключа агента, 0 - всех версий
+func (db *DB) DeleteAgentKeys(ctx context.Context, agentID string, version int) error {
+	query := `DELETE FROM ` + AGENTKEYSTABLENAME + ` WHERE agent_id = $1 AND ($2 = 0 OR version = $2);`
+
+	_, err := db.execRetry(ctx, query, agentID, version)
+	return err
+}
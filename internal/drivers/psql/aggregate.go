@@ -0,0 +1,80 @@
+package psql
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+)
+
+// Агрегатные функции запроса Aggregate
+const (
+	AGGSUM      = "sum"
+	AGGAVG      = "avg"
+	AGGMIN      = "min"
+	AGGMAX      = "max"
+	AGGCOUNT    = "count"
+	AGGQUANTILE = "quantile"
+)
+
+// AggregateQuery запрос агрегата по истории значений за период [From, To]
+// Exact - только серия с точно совпадающими метками, иначе все серии, метки которых содержат Labels
+// Quantile - доля от 0 до 1 для AGGQUANTILE
+type AggregateQuery struct {
+	MetricType string
+	MetricName string
+	Labels     labels.Labels
+	Exact      bool
+	Func       string
+	Quantile   float64
+	From       time.Time
+	To         time.Time
+}
+
+// Aggregate вычисление агрегата по истории значений на стороне базы
+// возвращает значение агрегата и количество значений, по которым он вычислен,
+// при отсутствии значений за период количество нулевое
+func (db *DB) Aggregate(ctx context.Context, q AggregateQuery) (float64, int64, error) {
+	var expr string
+	switch q.Func {
+	case AGGSUM:
+		expr = `SUM(` + COLUMNMETRICVALUE + `)`
+	case AGGAVG:
+		expr = `AVG(` + COLUMNMETRICVALUE + `)`
+	case AGGMIN:
+		expr = `MIN(` + COLUMNMETRICVALUE + `)`
+	case AGGMAX:
+		expr = `MAX(` + COLUMNMETRICVALUE + `)`
+	case AGGCOUNT:
+		expr = `COUNT(*)`
+	case AGGQUANTILE:
+		expr = `percentile_cont($6::float8) WITHIN GROUP (ORDER BY ` + COLUMNMETRICVALUE + `)`
+	default:
+		return 0, 0, fmt.Errorf("%w: %q", ErrAggregateFunc, q.Func)
+	}
+	lj, err := labelsToJSON(q.Labels)
+	if err != nil {
+		return 0, 0, err
+	}
+	match := ` @> $3::jsonb`
+	if q.Exact {
+		match = ` = $3::jsonb`
+	}
+	query := `SELECT COALESCE(` + expr + `, 0), COUNT(*) ` +
+		`FROM ` + HISTORYTABLENAME + ` ` +
+		`WHERE ` + COLUMNTYPE + `=$1 AND ` + COLUMNNAME + `=$2 AND ` + COLUMNLABELS + match + ` ` +
+		`AND ` + COLUMNCREATEDAT + ` >= $4 AND ` + COLUMNCREATEDAT + ` <= $5;`
+	args := []any{q.MetricType, q.MetricName, lj, q.From, q.To}
+	if q.Func == AGGQUANTILE {
+		args = append(args, q.Quantile)
+	}
+
+	var value float64
+	var count int64
+	err = db.queryRowRetry(ctx, query, args, &value, &count)
+	if err != nil {
+		return 0, 0, err
+	}
+	return value, count, nil
+}
@@ -0,0 +1,239 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+)
+
+// MAXBATCHPARAMS предел количества параметров одного запроса в postgres,
+// пачки больше разбиваются на несколько запросов в той же транзакции
+const MAXBATCHPARAMS = 65535
+
+// BatchItem значение метрики для пакетной записи
+type BatchItem struct {
+	MetricType string
+	MetricName string
+	Labels     labels.Labels
+	Value      float64
+}
+
+// batchRow элемент пачки в формате БД
+type batchRow struct {
+	metric string
+	name   string
+	labels string
+	key    string
+	value  float64
+}
+
+// PushBatch запись пачки метрик в одной транзакции
+// метрики типа metricOneValue заменяют значение серии, остальные добавляются строками,
+// все значения сохраняются в историю с отметкой ts
+// возвращает значения серий после применения каждого элемента, как при поочерёдной записи,
+// значения читаются одним запросом после записи
+func (db *DB) PushBatch(ctx context.Context, metricOneValue string, items []BatchItem, ts time.Time) ([]float64, error) {
+	if db == nil || db.DB == nil {
+		return nil, ErrNotInit
+	}
+	if len(items) == 0 {
+		return nil, nil
+	}
+
+	rows := make([]batchRow, len(items))
+	for i, item := range items {
+		lj, err := labelsToJSON(item.Labels)
+		if err != nil {
+			return nil, err
+		}
+		rows[i] = batchRow{
+			metric: item.MetricType,
+			name:   item.MetricName,
+			labels: lj,
+			key:    seriesKey(item.MetricType, item.MetricName, item.Labels),
+			value:  item.Value,
+		}
+	}
+
+	var totals map[string]float64
+	err := db.txRetry(ctx, db.queryTimeout, func(tx *sql.Tx) error {
+		var err error
+		totals, err = pushBatchTx(ctx, tx, metricOneValue, items, rows, ts)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return batchValues(metricOneValue, items, rows, totals), nil
+}
+
+// pushBatchTx запросы пакетной записи внутри транзакции
+// возвращает суммы значений затронутых серий после записи
+func pushBatchTx(ctx context.Context, tx *sql.Tx, metricOneValue string, items []BatchItem, rows []batchRow, ts time.Time) (map[string]float64, error) {
+	// для заменяемых значений важно только последнее значение серии в пачке
+	last := make(map[string]int)
+	var replaceArgs, addArgs, historyArgs, seriesArgs [][]any
+	for i, row := range rows {
+		args := []any{row.metric, row.name, row.value, row.labels}
+		if items[i].MetricType == metricOneValue {
+			if j, ok := last[row.key]; ok {
+				replaceArgs[j] = args
+				continue
+			}
+			last[row.key] = len(replaceArgs)
+			replaceArgs = append(replaceArgs, args)
+		} else {
+			addArgs = append(addArgs, args)
+		}
+	}
+	// в историю попадают все значения, включая перезаписанные в той же пачке
+	seen := make(map[string]bool)
+	for _, row := range rows {
+		historyArgs = append(historyArgs, []any{row.metric, row.name, row.value, row.labels, ts})
+		if !seen[row.key] {
+			seen[row.key] = true
+			seriesArgs = append(seriesArgs, []any{row.metric, row.name, row.labels})
+		}
+	}
+
+	columns := `(` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + `)`
+
+	// upsert по уникальному ключу серии, повторы серии в пачке уже свёрнуты
+	replacePrefix := `INSERT INTO ` + TABLENAME + ` ` + columns + ` VALUES `
+	replaceSuffix := ` ON CONFLICT ` + gaugeConflict + ` ` +
+		`DO UPDATE SET ` + COLUMNMETRICVALUE + ` = EXCLUDED.` + COLUMNMETRICVALUE + `, ` + COLUMNCREATEDAT + ` = now();`
+	err := execValues(ctx, tx, replacePrefix, replaceSuffix, []string{"", "", "", "::jsonb"}, replaceArgs)
+	if err != nil {
+		return nil, fmt.Errorf("fail while replace values: %w", err)
+	}
+
+	addPrefix := `INSERT INTO ` + TABLENAME + ` ` + columns + ` VALUES `
+	err = execValues(ctx, tx, addPrefix, `;`, []string{"", "", "", "::jsonb"}, addArgs)
+	if err != nil {
+		return nil, fmt.Errorf("fail while add values: %w", err)
+	}
+
+	historyPrefix := `INSERT INTO ` + HISTORYTABLENAME + ` (` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + `, ` + COLUMNCREATEDAT + `) VALUES `
+	err = execValues(ctx, tx, historyPrefix, `;`, []string{"", "", "", "::jsonb", ""}, historyArgs)
+	if err != nil {
+		return nil, fmt.Errorf("fail while push history: %w", err)
+	}
+
+	// обновлённые значения всех затронутых серий
+	selectPrefix := `SELECT ` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNLABELS + `, SUM(` + COLUMNMETRICVALUE + `) ` +
+		`FROM ` + TABLENAME + ` ` +
+		`WHERE (` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNLABELS + `) IN (VALUES `
+	selectSuffix := `) GROUP BY ` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNLABELS + `;`
+	totals := make(map[string]float64)
+	for _, chunk := range chunkArgs(seriesArgs, 3) {
+		query, args := valuesQuery(selectPrefix, selectSuffix, []string{"", "", "::jsonb"}, chunk)
+		err = scanTotals(ctx, tx, query, args, totals)
+		if err != nil {
+			return nil, fmt.Errorf("fail while select renew values: %w", err)
+		}
+	}
+	return totals, nil
+}
+
+// scanTotals чтение сумм значений серий
+func scanTotals(ctx context.Context, tx *sql.Tx, query string, args []any, totals map[string]float64) error {
+	rows, err := tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var metric Metric
+		err = rows.Scan(&metric.MetricS.MetricType, &metric.MetricS.MetricName, &metric.Labels, &metric.Value)
+		if err != nil {
+			return err
+		}
+		totals[seriesKey(metric.MetricS.MetricType, metric.MetricS.MetricName, metric.Labels.Labels)] = metric.Value
+	}
+	return rows.Err()
+}
+
+// batchValues значения серий после применения каждого элемента пачки
+// для заменяемых значений это само значение, для добавляемых - нарастающий итог:
+// сумма серии до пачки плюс приращения пачки до элемента включительно
+func batchValues(metricOneValue string, items []BatchItem, rows []batchRow, totals map[string]float64) []float64 {
+	base := make(map[string]float64)
+	for i, row := range rows {
+		if items[i].MetricType != metricOneValue {
+			base[row.key] -= row.value
+		}
+	}
+	for key := range base {
+		base[key] += totals[key]
+	}
+
+	values := make([]float64, len(items))
+	for i, row := range rows {
+		if items[i].MetricType == metricOneValue {
+			values[i] = row.value
+			continue
+		}
+		base[row.key] += row.value
+		values[i] = base[row.key]
+	}
+	return values
+}
+
+// execValues выполнение запроса вида prefix VALUES (...), (...) suffix
+// строки разбиваются на части, чтобы не превысить MAXBATCHPARAMS
+func execValues(ctx context.Context, tx *sql.Tx, prefix, suffix string, casts []string, rows [][]any) error {
+	for _, chunk := range chunkArgs(rows, len(casts)) {
+		query, args := valuesQuery(prefix, suffix, casts, chunk)
+		_, err := tx.ExecContext(ctx, query, args...)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// chunkArgs разбиение строк параметров на части не длиннее MAXBATCHPARAMS параметров
+func chunkArgs(rows [][]any, columns int) [][][]any {
+	size := MAXBATCHPARAMS / columns
+	var chunks [][][]any
+	for len(rows) > 0 {
+		n := min(size, len(rows))
+		chunks = append(chunks, rows[:n])
+		rows = rows[n:]
+	}
+	return chunks
+}
+
+// valuesQuery сборка запроса со списком строк VALUES
+// casts приведения типов для каждой колонки
+func valuesQuery(prefix, suffix string, casts []string, rows [][]any) (string, []any) {
+	var sb strings.Builder
+	args := make([]any, 0, len(rows)*len(casts))
+	sb.WriteString(prefix)
+	for i, row := range rows {
+		if i > 0 {
+			sb.WriteString(", ")
+		}
+		sb.WriteString("(")
+		for j, cast := range casts {
+			if j > 0 {
+				sb.WriteString(", ")
+			}
+			args = append(args, row[j])
+			fmt.Fprintf(&sb, "$%d%s", len(args), cast)
+		}
+		sb.WriteString(")")
+	}
+	sb.WriteString(suffix)
+	return sb.String(), args
+}
+
+// seriesKey ключ серии с учётом типа метрики
+func seriesKey(metric, metricName string, l labels.Labels) string {
+	return metric + METRICSEPARATOR + labels.Key(metricName, l)
+}
@@ -2,17 +2,29 @@ package psql
 
 import (
 	"database/sql/driver"
+	"encoding/json"
 	"fmt"
 	"strings"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 )
 
-// METRICSEPARATOR - разделитель для хранения типа и имени в одном поле в БД
+// METRICSEPARATOR - разделитель типа и имени в одном поле
+// так метрики хранились в БД до миграции 0002, сейчас используется в ключах серий
 const METRICSEPARATOR = "///"
 
 // Metric хранит в себе метрику в формате БД
 type Metric struct {
 	MetricS MetricString
 	Value   float64
+	Labels  LabelsJSON
+}
+
+// Sample значение метрики с отметкой времени
+type Sample struct {
+	Time  time.Time
+	Value float64
 }
 
 // MetricString хранит в себе тип и имя метрики для автоматического преобразования
@@ -52,3 +64,44 @@ func (m *MetricString) Scan(value interface{}) error {
 	m.MetricName = mFields[1]
 	return nil
 }
+
+// LabelsJSON хранит в себе метки метрики для автоматического преобразования из jsonb
+type LabelsJSON struct {
+	labels.Labels
+}
+
+// Scan преобразует поле jsonb из БД в набор меток
+func (l *LabelsJSON) Scan(value interface{}) error {
+	l.Labels = nil
+	var data []byte
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []byte:
+		data = v
+	case string:
+		data = []byte(v)
+	default:
+		return ErrConvertProblem
+	}
+	if err := json.Unmarshal(data, &l.Labels); err != nil {
+		return fmt.Errorf("cannot scan labels: %w", err)
+	}
+	if len(l.Labels) == 0 {
+		l.Labels = nil
+	}
+	return nil
+}
+
+// labelsToJSON преобразует набор меток в строку для сравнения с полем jsonb
+// пустой набор соответствует пустому объекту
+func labelsToJSON(l labels.Labels) (string, error) {
+	if len(l) == 0 {
+		return "{}", nil
+	}
+	data, err := json.Marshal(l)
+	if err != nil {
+		return "", err
+	}
+	return string(data), nil
+}
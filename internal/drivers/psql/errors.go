@@ -7,4 +7,8 @@ var (
 	ErrUnexpectedMetricType = errors.New("unexpected metric type from db")
 	ErrConvertProblem       = errors.New("cannot scan value. cannot convert value to string")
 	ErrNotInit              = errors.New("db not initialized correctly")
+	ErrMigrationName        = errors.New("wrong migration file name")
+	ErrMigrationDuplicate   = errors.New("duplicate migration version")
+	ErrDSN                  = errors.New("wrong database dsn")
+	ErrAggregateFunc        = errors.New("unknown aggregate function")
 )
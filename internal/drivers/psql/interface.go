@@ -5,35 +5,50 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 )
 
 // StorDB интерфейс для предоставления возможности вышестоящим сервисам мокировать DB
 type StorDB interface {
+	AgentKeys(ctx context.Context) ([]AgentKey, error)
+	Aggregate(ctx context.Context, q AggregateQuery) (float64, int64, error)
 	Begin() (*sql.Tx, error)
 	BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx, error)
 	Close() error
+	CompactCounters(ctx context.Context, metric string, keep int) error
 	Conn(ctx context.Context) (*sql.Conn, error)
-	CreateMetricsTable() error
+	DeleteAgentKeys(ctx context.Context, agentID string, version int) error
 	Driver() driver.Driver
 	Exec(query string, args ...any) (sql.Result, error)
 	ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error)
-	GetArrayValues(metric string, metricName string) (values []float64, err error)
-	GetOneValue(metric string, metricName string) (float64, error)
-	List(metricOneValue string, metricArrayValues string) (map[string]float64, map[string][]float64, error)
+	GetArrayValues(ctx context.Context, metric string, metricName string, l labels.Labels) (values []float64, err error)
+	GetOneValue(ctx context.Context, metric string, metricName string, l labels.Labels) (float64, error)
+	History(ctx context.Context, metric string, metricName string, filter labels.Labels, from time.Time) (map[string][]Sample, error)
+	List(ctx context.Context, metricOneValue string, metricArrayValues string) (map[string]float64, map[string][]float64, error)
+	Migrate(ctx context.Context) error
 	Ping() error
 	PingContext(ctx context.Context) error
-	PingDB() error
+	PingDB(ctx context.Context) error
 	Prepare(query string) (*sql.Stmt, error)
 	PrepareContext(ctx context.Context, query string) (*sql.Stmt, error)
-	PushAdd(metric string, metricName string, value float64) error
-	PushReplace(metric string, metricName string, value float64) error
+	PushBatch(ctx context.Context, metricOneValue string, items []BatchItem, ts time.Time) ([]float64, error)
+	PushAdd(ctx context.Context, metric string, metricName string, l labels.Labels, value float64) error
+	PushHistory(ctx context.Context, metric string, metricName string, l labels.Labels, value float64, ts time.Time) error
+	PushReplace(ctx context.Context, metric string, metricName string, l labels.Labels, value float64) error
 	Query(query string, args ...any) (*sql.Rows, error)
 	QueryContext(ctx context.Context, query string, args ...any) (*sql.Rows, error)
 	QueryRow(query string, args ...any) *sql.Row
 	QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row
+	ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error
+	ReplicationLag(ctx context.Context) (time.Duration, error)
+	SaveAgentKey(ctx context.Context, key AgentKey) error
+	Select(ctx context.Context, metric string, metricName string, filter labels.Labels) (map[string][]float64, error)
 	SetConnMaxIdleTime(d time.Duration)
 	SetConnMaxLifetime(d time.Duration)
 	SetMaxIdleConns(n int)
 	SetMaxOpenConns(n int)
+	SetQueryTimeout(timeout time.Duration)
 	Stats() sql.DBStats
+	TrimHistory(ctx context.Context, before time.Time) error
 }
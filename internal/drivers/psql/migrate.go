@@ -0,0 +1,143 @@
+package psql
+
+import (
+	"context"
+	"database/sql"
+	"embed"
+	"fmt"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+)
+
+// Настройки миграций
+const (
+	MIGRATIONSTABLENAME = "schema_migrations"
+	MIGRATIONSDIR       = "migrations"
+	MIGRATIONSLOCK      = 7262001 // ключ advisory lock, чтобы несколько серверов не мигрировали базу одновременно
+)
+
+// migrationsFS миграции схемы, встроенные в бинарный файл
+// имя файла: номер версии, подчёркивание, описание, например 0002_split_type_name.sql
+//
+//go:embed migrations/*.sql
+var migrationsFS embed.FS
+
+// migration одна версия схемы
+type migration struct {
+	version int
+	name    string
+	query   string
+}
+
+// Migrate приводит схему базы данных к последней версии
+// каждая миграция применяется в своей транзакции вместе с отметкой о версии,
+// применённые версии хранятся в таблице MIGRATIONSTABLENAME
+// таймаут запроса на миграции не действует, ограничить их можно через ctx
+func (db *DB) Migrate(ctx context.Context) error {
+	if db == nil || db.DB == nil {
+		return ErrNotInit
+	}
+	migrations, err := loadMigrations(migrationsFS)
+	if err != nil {
+		return err
+	}
+
+	query := `CREATE TABLE IF NOT EXISTS ` + MIGRATIONSTABLENAME + ` (
+							version INTEGER PRIMARY KEY,
+							name TEXT NOT NULL,
+							` + COLUMNCREATEDAT + ` ` + COLUMNCREATEDATTYPE + `
+						);`
+	_, err = db.execRetry(ctx, query)
+	if err != nil {
+		return fmt.Errorf("fail while create migrations table: %w", err)
+	}
+
+	for _, m := range migrations {
+		var applied bool
+		err = db.txRetry(ctx, 0, func(tx *sql.Tx) (txErr error) {
+			applied, txErr = applyMigration(ctx, tx, m)
+			return txErr
+		})
+		if err != nil {
+			return fmt.Errorf("fail while apply migration %s: %w", m.name, err)
+		}
+		if applied {
+			logger.Info(fmt.Sprintf("db migration applied: %s", m.name))
+		}
+	}
+	return nil
+}
+
+// applyMigration применение миграции, если она ещё не применена
+// блокировка держится до конца транзакции
+func applyMigration(ctx context.Context, tx *sql.Tx, m migration) (bool, error) {
+	_, err := tx.ExecContext(ctx, `SELECT pg_advisory_xact_lock($1);`, MIGRATIONSLOCK)
+	if err != nil {
+		return false, err
+	}
+
+	var exists bool
+	err = tx.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+MIGRATIONSTABLENAME+` WHERE version = $1);`, m.version).Scan(&exists)
+	if err != nil {
+		return false, err
+	}
+	if exists {
+		return false, nil
+	}
+
+	_, err = tx.ExecContext(ctx, m.query)
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.ExecContext(ctx, `INSERT INTO `+MIGRATIONSTABLENAME+` (version, name) VALUES ($1, $2);`, m.version, m.name)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// loadMigrations чтение миграций, упорядоченных по версии
+func loadMigrations(fsys fs.FS) ([]migration, error) {
+	files, err := fs.Glob(fsys, path.Join(MIGRATIONSDIR, "*.sql"))
+	if err != nil {
+		return nil, err
+	}
+
+	var migrations []migration
+	versions := make(map[int]string)
+	for _, file := range files {
+		name := path.Base(file)
+		prefix, _, ok := strings.Cut(name, "_")
+		if !ok {
+			return nil, fmt.Errorf("%w: %s", ErrMigrationName, name)
+		}
+		version, err := strconv.Atoi(prefix)
+		if err != nil || version < 1 {
+			return nil, fmt.Errorf("%w: %s", ErrMigrationName, name)
+		}
+		if other, dup := versions[version]; dup {
+			return nil, fmt.Errorf("%w: %s and %s", ErrMigrationDuplicate, other, name)
+		}
+		versions[version] = name
+
+		query, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+		migrations = append(migrations, migration{
+			version: version,
+			name:    strings.TrimSuffix(name, ".sql"),
+			query:   string(query),
+		})
+	}
+
+	sort.Slice(migrations, func(i, j int) bool {
+		return migrations[i].version < migrations[j].version
+	})
+	return migrations, nil
+}
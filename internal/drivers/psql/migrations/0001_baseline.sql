@@ -0,0 +1,17 @@
+-- Исходная схема, которую раньше создавал CreateMetricsTable:
+-- тип и имя метрики хранятся в одной колонке metric в виде "type///name".
+-- Все операции идемпотентны, так что миграция применяется и к базам, созданным до появления миграций.
+CREATE TABLE IF NOT EXISTS metrics (
+    metric TEXT,
+    value DOUBLE PRECISION
+);
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS labels JSONB NOT NULL DEFAULT '{}';
+ALTER TABLE metrics ADD COLUMN IF NOT EXISTS created_at TIMESTAMPTZ NOT NULL DEFAULT now();
+
+CREATE TABLE IF NOT EXISTS metrics_history (
+    metric TEXT,
+    value DOUBLE PRECISION,
+    labels JSONB NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now()
+);
+CREATE INDEX IF NOT EXISTS metrics_history_metric_created_at_idx ON metrics_history (metric, created_at);
@@ -0,0 +1,45 @@
+-- Тип и имя метрики в отдельных колонках, уникальный ключ серии gauge.
+-- Существующие строки "type///name" разбираются на месте. Строки без разделителя не распознать:
+-- они переносятся как есть в metrics_unparsed и metrics_history_unparsed для ручного разбора.
+
+-- метрики
+CREATE TABLE metrics_unparsed AS
+    SELECT * FROM metrics WHERE metric IS NULL OR strpos(metric, '///') = 0;
+DELETE FROM metrics WHERE metric IS NULL OR strpos(metric, '///') = 0;
+ALTER TABLE metrics ADD COLUMN type TEXT, ADD COLUMN name TEXT;
+UPDATE metrics SET
+    type = split_part(metric, '///', 1),
+    name = substr(metric, strpos(metric, '///') + 3);
+ALTER TABLE metrics
+    ALTER COLUMN type SET NOT NULL,
+    ALTER COLUMN name SET NOT NULL,
+    DROP COLUMN metric;
+
+-- UPDATE-then-INSERT мог оставить несколько строк одной серии gauge, остаётся самая свежая
+DELETE FROM metrics m
+USING (
+    SELECT ctid AS row_id,
+        ROW_NUMBER() OVER (PARTITION BY name, labels ORDER BY created_at DESC, ctid DESC) AS rn
+    FROM metrics
+    WHERE type = 'gauge'
+) d
+WHERE m.ctid = d.row_id AND d.rn > 1;
+
+CREATE UNIQUE INDEX metrics_gauge_key ON metrics (name, labels) WHERE type = 'gauge';
+CREATE INDEX metrics_type_name_idx ON metrics (type, name);
+
+-- история
+CREATE TABLE metrics_history_unparsed AS
+    SELECT * FROM metrics_history WHERE metric IS NULL OR strpos(metric, '///') = 0;
+DELETE FROM metrics_history WHERE metric IS NULL OR strpos(metric, '///') = 0;
+ALTER TABLE metrics_history ADD COLUMN type TEXT, ADD COLUMN name TEXT;
+UPDATE metrics_history SET
+    type = split_part(metric, '///', 1),
+    name = substr(metric, strpos(metric, '///') + 3);
+DROP INDEX IF EXISTS metrics_history_metric_created_at_idx;
+ALTER TABLE metrics_history
+    ALTER COLUMN type SET NOT NULL,
+    ALTER COLUMN name SET NOT NULL,
+    DROP COLUMN metric;
+
+CREATE INDEX metrics_history_type_name_created_at_idx ON metrics_history (type, name, created_at);
@@ -0,0 +1,11 @@
+-- Ключи агентов для подписи запросов HMAC.
+-- У агента может быть несколько версий ключа одновременно на время смены ключа,
+-- отозванная версия удаляется, expires_at - время, после которого версия перестаёт действовать.
+CREATE TABLE agent_keys (
+    agent_id TEXT NOT NULL,
+    version INTEGER NOT NULL,
+    key TEXT NOT NULL,
+    created_at TIMESTAMPTZ NOT NULL DEFAULT now(),
+    expires_at TIMESTAMPTZ,
+    PRIMARY KEY (agent_id, version)
+);
@@ -2,129 +2,201 @@
 package psql
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	_ "github.com/jackc/pgx/v5/stdlib"
 )
 
 // Названия полей и типы полей в базе данных
 const (
-	TABLENAME             = "metrics"
-	COLUMNMETRIC          = "metric"
-	COLUMNMETRICTYPE      = "TEXT"
-	COLUMNMETRICVALUE     = "value"
-	COLUMNMETRICVALUETYPE = "DOUBLE PRECISION"
+	TABLENAME           = "metrics"
+	COLUMNTYPE          = "type"
+	COLUMNNAME          = "name"
+	COLUMNMETRICVALUE   = "value"
+	COLUMNLABELS        = "labels"
+	HISTORYTABLENAME    = "metrics_history"
+	COLUMNCREATEDAT     = "created_at"
+	COLUMNCREATEDATTYPE = "TIMESTAMPTZ NOT NULL DEFAULT now()"
 )
 
+// REPLACETYPE тип метрик, у серии которых одно значение
+// для него в схеме действует уникальный ключ (имя, метки), см. migrations/0002_split_type_name.sql
+const REPLACETYPE = "gauge"
+
+// gaugeConflict цель ON CONFLICT для уникального ключа серий REPLACETYPE
+const gaugeConflict = `(` + COLUMNNAME + `, ` + COLUMNLABELS + `) WHERE ` + COLUMNTYPE + ` = '` + REPLACETYPE + `'`
+
+// QUERYTIMEOUT таймаут одной попытки запроса по умолчанию
+const QUERYTIMEOUT = 5 * time.Second
+
+// STATEMENTTIMEOUTPARAM параметр сессии postgres, ограничивающий время выполнения запроса на сервере
+const STATEMENTTIMEOUTPARAM = "statement_timeout"
+
 // DB хранит в себе подключение к базе данных
+// queryTimeout ограничивает каждую попытку запроса, 0 - без ограничения
 type DB struct {
 	*sql.DB
+	queryTimeout time.Duration
 }
 
-// ConnectDB подключение к базе данных
-func ConnectDB(dsn string) (*DB, error) {
-	db, err := openRetry("pgx", dsn)
+// PoolConfig настройки пула подключений к базе данных
+// нулевые значения оставляют настройки database/sql по умолчанию
+type PoolConfig struct {
+	MaxOpenConns     int           // максимум открытых подключений
+	MaxIdleConns     int           // максимум простаивающих подключений
+	ConnMaxLifetime  time.Duration // время жизни подключения
+	StatementTimeout time.Duration // statement_timeout сессии на стороне postgres
+}
+
+// ConnectDB подключение к базе данных с настройками пула pool
+// проверка подключения повторяется при временных ошибках, каждая попытка ограничена таймаутом запроса
+func ConnectDB(ctx context.Context, dsn string, pool PoolConfig) (*DB, error) {
+	db, err := OpenDB(dsn, pool)
 	if err != nil {
 		return nil, err
 	}
-	err = db.Ping()
+	err = db.pingRetry(ctx)
 	if err != nil {
+		db.Close()
 		return nil, err
 	}
+	return db, nil
+}
+
+// OpenDB открытие пула подключений к базе данных без проверки подключения
+// подходит для необязательных баз, например реплики, доступность которой проверяется при обращении
+func OpenDB(dsn string, pool PoolConfig) (*DB, error) {
+	dsn, err := withStatementTimeout(dsn, pool.StatementTimeout)
+	if err != nil {
+		return nil, err
+	}
+	sqlDB, err := sql.Open("pgx", dsn)
+	if err != nil {
+		return nil, err
+	}
+	if pool.MaxOpenConns > 0 {
+		sqlDB.SetMaxOpenConns(pool.MaxOpenConns)
+	}
+	if pool.MaxIdleConns > 0 {
+		sqlDB.SetMaxIdleConns(pool.MaxIdleConns)
+	}
+	if pool.ConnMaxLifetime > 0 {
+		sqlDB.SetConnMaxLifetime(pool.ConnMaxLifetime)
+	}
 	return &DB{
-		DB: db,
+		DB:           sqlDB,
+		queryTimeout: QUERYTIMEOUT,
 	}, nil
 }
 
-// PingDB пинг базы данных
-func (db *DB) PingDB() error {
-	return db.DB.Ping()
+// withStatementTimeout добавляет к dsn параметр сессии statement_timeout в миллисекундах
+// pgx передаёт незнакомые ему параметры dsn серверу как параметры сессии,
+// поддерживаются оба формата dsn: URL и ключ=значение
+func withStatementTimeout(dsn string, timeout time.Duration) (string, error) {
+	if timeout <= 0 {
+		return dsn, nil
+	}
+	value := strconv.FormatInt(timeout.Milliseconds(), 10)
+	if strings.HasPrefix(dsn, "postgres://") || strings.HasPrefix(dsn, "postgresql://") {
+		u, err := url.Parse(dsn)
+		if err != nil {
+			return "", fmt.Errorf("%w: %v", ErrDSN, err)
+		}
+		query := u.Query()
+		query.Set(STATEMENTTIMEOUTPARAM, value)
+		u.RawQuery = query.Encode()
+		return u.String(), nil
+	}
+	return strings.TrimSpace(dsn + " " + STATEMENTTIMEOUTPARAM + "=" + value), nil
 }
 
-// Close закрытие соединения с базой данных
-func (db *DB) Close() error {
-	return db.DB.Close()
+// SetQueryTimeout задаёт таймаут одной попытки запроса, 0 - без ограничения
+func (db *DB) SetQueryTimeout(timeout time.Duration) {
+	db.queryTimeout = timeout
 }
 
-// CreateMetricsTable создание таблицы для хранения метрик
-func (db *DB) CreateMetricsTable() error {
-	if db == nil {
+// PingDB пинг базы данных с таймаутом запроса
+func (db *DB) PingDB(ctx context.Context) error {
+	if db == nil || db.DB == nil {
 		return ErrNotInit
 	}
-	if db.DB == nil {
-		return ErrNotInit
+	return attempt(ctx, db.queryTimeout, db.DB.PingContext)
+}
+
+// ReplicationLag отставание реплики от основной базы
+// для основной базы и для реплики, применившей всё полученное, отставание нулевое:
+// иначе при отсутствии записей время последней применённой транзакции только растёт
+func (db *DB) ReplicationLag(ctx context.Context) (time.Duration, error) {
+	query := `SELECT CASE
+				WHEN NOT pg_is_in_recovery() THEN 0
+				WHEN pg_last_wal_receive_lsn() = pg_last_wal_replay_lsn() THEN 0
+				ELSE COALESCE(EXTRACT(EPOCH FROM now() - pg_last_xact_replay_timestamp()), 0)
+			END;`
+	var seconds float64
+	err := db.queryRowRetry(ctx, query, nil, &seconds)
+	if err != nil {
+		return 0, err
 	}
-	query := fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
-							%s %s,
-							%s %s
-						);`,
-		TABLENAME,
-		COLUMNMETRIC, COLUMNMETRICTYPE,
-		COLUMNMETRICVALUE, COLUMNMETRICVALUETYPE)
+	return time.Duration(seconds * float64(time.Second)), nil
+}
 
-	_, err := db.execRetry(query)
-	return err
+// Close закрытие соединения с базой данных
+func (db *DB) Close() error {
+	return db.DB.Close()
 }
 
 // PushReplace апдейт данных по метрикам
-func (db *DB) PushReplace(metric, metricName string, value float64) error {
-	ms := MetricString{
-		MetricType: metric,
-		MetricName: metricName,
-	}
-	query := `UPDATE ` + TABLENAME + ` ` +
-		`SET ` + COLUMNMETRICVALUE + ` = $1 ` +
-		`WHERE ` + COLUMNMETRIC + ` = $2;`
-
-	// pgx НЕ ПОДДЕРЖИВАЕТ Value()
-	result, err := db.execRetry(query, value, ms.MetricType+METRICSEPARATOR+ms.MetricName)
-	if err != nil {
-		return err
-	}
-	rowsAffected, err := result.RowsAffected()
+// серия определяется именем метрики и точным набором меток,
+// для типа REPLACETYPE запись выполняется одним upsert по уникальному ключу серии
+func (db *DB) PushReplace(ctx context.Context, metric, metricName string, l labels.Labels, value float64) error {
+	lj, err := labelsToJSON(l)
 	if err != nil {
 		return err
 	}
+	query := `INSERT INTO ` + TABLENAME + ` (` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + `) ` +
+		`VALUES ($1, $2, $3, $4::jsonb) ` +
+		`ON CONFLICT ` + gaugeConflict + ` ` +
+		`DO UPDATE SET ` + COLUMNMETRICVALUE + ` = EXCLUDED.` + COLUMNMETRICVALUE + `, ` + COLUMNCREATEDAT + ` = now();`
 
-	if rowsAffected == 0 {
-		insertQuery := `INSERT INTO ` + TABLENAME + ` (` + COLUMNMETRIC + `, ` + COLUMNMETRICVALUE + `) VALUES ($1, $2);`
-		_, err = db.execRetry(insertQuery, ms.MetricType+METRICSEPARATOR+ms.MetricName, value)
-	}
+	_, err = db.execRetry(ctx, query, metric, metricName, value, lj)
 	return err
 }
 
 // PushAdd добавление данных о метриках
-func (db *DB) PushAdd(metric, metricName string, value float64) error {
-	ms := MetricString{
-		MetricType: metric,
-		MetricName: metricName,
+func (db *DB) PushAdd(ctx context.Context, metric, metricName string, l labels.Labels, value float64) error {
+	lj, err := labelsToJSON(l)
+	if err != nil {
+		return err
 	}
 	query := `INSERT INTO ` + TABLENAME +
-		`(` + COLUMNMETRIC + `, ` + COLUMNMETRICVALUE + `) ` +
-		`VALUES ($1, $2);`
+		`(` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + `) ` +
+		`VALUES ($1, $2, $3, $4::jsonb);`
 
-	// pgx НЕ ПОДДЕРЖИВАЕТ Value()
-	_, err := db.execRetry(query, ms.MetricType+METRICSEPARATOR+ms.MetricName, value)
+	_, err = db.execWriteRetry(ctx, query, metric, metricName, value, lj)
 	return err
 }
 
 // GetOneValue получение значения одной метрики
-func (db *DB) GetOneValue(metric, metricName string) (float64, error) {
-	ms := MetricString{
-		MetricType: metric,
-		MetricName: metricName,
+func (db *DB) GetOneValue(ctx context.Context, metric, metricName string, l labels.Labels) (float64, error) {
+	lj, err := labelsToJSON(l)
+	if err != nil {
+		return 0, err
 	}
 	query := `SELECT ` + COLUMNMETRICVALUE + ` ` +
 		`FROM ` + TABLENAME + ` ` +
-		`WHERE ` + COLUMNMETRIC + `=$1;`
+		`WHERE ` + COLUMNTYPE + `=$1 AND ` + COLUMNNAME + `=$2 AND ` + COLUMNLABELS + `=$3::jsonb;`
 
-	// pgx НЕ ПОДДЕРЖИВАЕТ Value()
-	row := db.QueryRow(query, ms.MetricType+METRICSEPARATOR+ms.MetricName)
 	var value sql.NullFloat64
 
-	err := db.rowScanRetry(row, &value)
+	err = db.queryRowRetry(ctx, query, []any{metric, metricName, lj}, &value)
 	if errors.Is(err, sql.ErrNoRows) {
 		return 0, ErrNoData
 	} else if err != nil {
@@ -138,36 +210,29 @@ func (db *DB) GetOneValue(metric, metricName string) (float64, error) {
 }
 
 // GetArrayValues получения множества значений одной метрики
-func (db *DB) GetArrayValues(metric, metricName string) (values []float64, err error) {
-	ms := MetricString{
-		MetricType: metric,
-		MetricName: metricName,
+func (db *DB) GetArrayValues(ctx context.Context, metric, metricName string, l labels.Labels) (values []float64, err error) {
+	lj, err := labelsToJSON(l)
+	if err != nil {
+		return nil, err
 	}
 	query := `SELECT ` + COLUMNMETRICVALUE + ` ` +
 		`FROM ` + TABLENAME + ` ` +
-		`WHERE ` + COLUMNMETRIC + `=$1;`
+		`WHERE ` + COLUMNTYPE + `=$1 AND ` + COLUMNNAME + `=$2 AND ` + COLUMNLABELS + `=$3::jsonb;`
 
-	// pgx НЕ ПОДДЕРЖИВАЕТ Value()
-	rows, err := db.queryRetry(query, ms.MetricType+METRICSEPARATOR+ms.MetricName)
-	if errors.Is(err, sql.ErrNoRows) {
-		return nil, ErrNoData
-	} else if err != nil {
-		return nil, err
-	}
-	defer rows.Close()
+	err = db.queryRetry(ctx, query, func(rows *sql.Rows) error {
+		values = nil
+		for rows.Next() {
+			var value float64
 
-	for rows.Next() {
-		var value float64
+			err := rows.Scan(&value)
+			if err != nil {
+				return err
+			}
 
-		err = rows.Scan(&value)
-		if err != nil {
-			return nil, err
+			values = append(values, value)
 		}
-
-		values = append(values, value)
-	}
-
-	err = rows.Err()
+		return nil
+	}, metric, metricName, lj)
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, ErrNoData
 	} else if err != nil {
@@ -178,44 +243,159 @@ func (db *DB) GetArrayValues(metric, metricName string) (values []float64, err e
 }
 
 // List получение всех данных по метрикам
-func (db *DB) List(metricOneValue, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
-	typeValue := make(map[string]float64)
-	typeValues := make(map[string][]float64)
-
-	query := `SELECT * FROM ` + TABLENAME + `;`
-
-	rows, err := db.queryRetry(query)
+// ключами служат ключи серий labels.Key
+func (db *DB) List(ctx context.Context, metricOneValue, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
+	var typeValue map[string]float64
+	var typeValues map[string][]float64
+
+	query := `SELECT ` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + ` FROM ` + TABLENAME + `;`
+
+	err := db.queryRetry(ctx, query, func(rows *sql.Rows) error {
+		typeValue = make(map[string]float64)
+		typeValues = make(map[string][]float64)
+		for rows.Next() {
+			var metric Metric
+
+			err := rows.Scan(&metric.MetricS.MetricType, &metric.MetricS.MetricName, &metric.Value, &metric.Labels)
+			if err != nil {
+				return err
+			}
+
+			key := labels.Key(metric.MetricS.MetricName, metric.Labels.Labels)
+			switch metric.MetricS.MetricType {
+			case metricOneValue:
+				typeValue[key] = metric.Value
+			case metricArrayValues:
+				typeValues[key] = append(typeValues[key], metric.Value)
+			default:
+				return ErrUnexpectedMetricType
+			}
+		}
+		return nil
+	})
 	if errors.Is(err, sql.ErrNoRows) {
 		return nil, nil, ErrNoData
 	} else if err != nil {
 		return nil, nil, err
 	}
-	defer rows.Close()
 
-	for rows.Next() {
-		var metric Metric
+	return typeValue, typeValues, nil
+}
 
-		err = rows.Scan(&metric.MetricS, &metric.Value)
-		if err != nil {
-			return nil, nil, err
-		}
+// Select получение значений всех серий метрики, метки которых содержат фильтр
+// ключами служат ключи серий labels.Key
+func (db *DB) Select(ctx context.Context, metric, metricName string, filter labels.Labels) (map[string][]float64, error) {
+	lj, err := labelsToJSON(filter)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + ` ` +
+		`FROM ` + TABLENAME + ` ` +
+		`WHERE ` + COLUMNTYPE + `=$1 AND ` + COLUMNNAME + `=$2 AND ` + COLUMNLABELS + ` @> $3::jsonb;`
+
+	var series map[string][]float64
+	err = db.queryRetry(ctx, query, func(rows *sql.Rows) error {
+		series = make(map[string][]float64)
+		for rows.Next() {
+			var metric Metric
 
-		switch metric.MetricS.MetricType {
-		case metricOneValue:
-			typeValue[metric.MetricS.MetricName] = metric.Value
-		case metricArrayValues:
-			typeValues[metric.MetricS.MetricName] = append(typeValues[metric.MetricS.MetricName], metric.Value)
-		default:
-			return nil, nil, ErrUnexpectedMetricType
+			err := rows.Scan(&metric.Value, &metric.Labels)
+			if err != nil {
+				return err
+			}
+
+			key := labels.Key(metricName, metric.Labels.Labels)
+			series[key] = append(series[key], metric.Value)
 		}
+		return nil
+	}, metric, metricName, lj)
+	if err != nil {
+		return nil, err
 	}
 
-	err = rows.Err()
-	if errors.Is(err, sql.ErrNoRows) {
-		return nil, nil, ErrNoData
-	} else if err != nil {
-		return nil, nil, err
+	return series, nil
+}
+
+// PushHistory сохранение значения метрики в историю с отметкой времени
+func (db *DB) PushHistory(ctx context.Context, metric, metricName string, l labels.Labels, value float64, ts time.Time) error {
+	lj, err := labelsToJSON(l)
+	if err != nil {
+		return err
 	}
+	query := `INSERT INTO ` + HISTORYTABLENAME +
+		`(` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + `, ` + COLUMNCREATEDAT + `) ` +
+		`VALUES ($1, $2, $3, $4::jsonb, $5);`
 
-	return typeValue, typeValues, nil
+	_, err = db.execWriteRetry(ctx, query, metric, metricName, value, lj, ts)
+	return err
+}
+
+// History получение истории значений всех серий метрики, метки которых содержат фильтр,
+// начиная с момента from
+// ключами служат ключи серий labels.Key, значения упорядочены по времени
+func (db *DB) History(ctx context.Context, metric, metricName string, filter labels.Labels, from time.Time) (map[string][]Sample, error) {
+	lj, err := labelsToJSON(filter)
+	if err != nil {
+		return nil, err
+	}
+	query := `SELECT ` + COLUMNMETRICVALUE + `, ` + COLUMNLABELS + `, ` + COLUMNCREATEDAT + ` ` +
+		`FROM ` + HISTORYTABLENAME + ` ` +
+		`WHERE ` + COLUMNTYPE + `=$1 AND ` + COLUMNNAME + `=$2 AND ` + COLUMNLABELS + ` @> $3::jsonb AND ` + COLUMNCREATEDAT + ` >= $4 ` +
+		`ORDER BY ` + COLUMNCREATEDAT + `;`
+
+	var history map[string][]Sample
+	err = db.queryRetry(ctx, query, func(rows *sql.Rows) error {
+		history = make(map[string][]Sample)
+		for rows.Next() {
+			var sample Sample
+			var l LabelsJSON
+
+			err := rows.Scan(&sample.Value, &l, &sample.Time)
+			if err != nil {
+				return err
+			}
+
+			key := labels.Key(metricName, l.Labels)
+			history[key] = append(history[key], sample)
+		}
+		return nil
+	}, metric, metricName, lj, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return history, nil
+}
+
+// TrimHistory удаление из истории значений старше before
+func (db *DB) TrimHistory(ctx context.Context, before time.Time) error {
+	query := `DELETE FROM ` + HISTORYTABLENAME + ` WHERE ` + COLUMNCREATEDAT + ` < $1;`
+
+	_, err := db.execRetry(ctx, query, before)
+	return err
+}
+
+// CompactCounters сворачивание старых строк counter в одну строку с их суммой
+// в каждой серии остаются keep последних строк и строка с накопленной суммой,
+// выполняется одним запросом, поэтому сумма значений серии не меняется ни в какой момент
+func (db *DB) CompactCounters(ctx context.Context, metric string, keep int) error {
+	query := `WITH ranked AS (
+		SELECT ctid AS row_id,
+			ROW_NUMBER() OVER (PARTITION BY ` + COLUMNNAME + `, ` + COLUMNLABELS + ` ORDER BY ` + COLUMNCREATEDAT + ` DESC) AS rn,
+			COUNT(*) OVER (PARTITION BY ` + COLUMNNAME + `, ` + COLUMNLABELS + `) AS cnt
+		FROM ` + TABLENAME + `
+		WHERE ` + COLUMNTYPE + ` = $1
+	), folded AS (
+		DELETE FROM ` + TABLENAME + ` m
+		USING ranked r
+		WHERE m.ctid = r.row_id AND r.rn > $2 AND r.cnt > $2 + 1
+		RETURNING m.` + COLUMNNAME + `, m.` + COLUMNLABELS + `, m.` + COLUMNMETRICVALUE + `, m.` + COLUMNCREATEDAT + `
+	)
+	INSERT INTO ` + TABLENAME + ` (` + COLUMNTYPE + `, ` + COLUMNNAME + `, ` + COLUMNLABELS + `, ` + COLUMNMETRICVALUE + `, ` + COLUMNCREATEDAT + `)
+	SELECT $1, ` + COLUMNNAME + `, ` + COLUMNLABELS + `, SUM(` + COLUMNMETRICVALUE + `), MAX(` + COLUMNCREATEDAT + `)
+	FROM folded
+	GROUP BY ` + COLUMNNAME + `, ` + COLUMNLABELS + `;`
+
+	_, err := db.execRetry(ctx, query, metric, keep)
+	return err
 }
@@ -5,9 +5,18 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
 	"testing"
+	"testing/fstest"
 	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
+	"github.com/jackc/pgerrcode"
+	"github.com/jackc/pgx/v5/pgconn"
 	"github.com/stretchr/testify/assert"
 )
 
@@ -49,6 +58,41 @@ func TestMetricString_Scan_NilValue(t *testing.T) {
 	assert.Empty(t, m.MetricName, "MetricName должен стать пустым")
 }
 
+// --------------------- //
+//    LabelsJSON ТЕСТЫ   //
+// --------------------- //
+
+func TestLabelsJSON_Scan(t *testing.T) {
+	var l LabelsJSON
+	err := l.Scan([]byte(`{"host": "h1", "env": "prod"}`))
+	assert.NoError(t, err)
+	assert.Equal(t, labels.Labels{"host": "h1", "env": "prod"}, l.Labels)
+
+	err = l.Scan("{}")
+	assert.NoError(t, err)
+	assert.Nil(t, l.Labels, "пустой объект => нет меток")
+
+	err = l.Scan(nil)
+	assert.NoError(t, err)
+	assert.Nil(t, l.Labels)
+
+	err = l.Scan(42)
+	assert.ErrorIs(t, err, ErrConvertProblem)
+
+	err = l.Scan("not json")
+	assert.Error(t, err)
+}
+
+func TestLabelsToJSON(t *testing.T) {
+	lj, err := labelsToJSON(nil)
+	assert.NoError(t, err)
+	assert.Equal(t, "{}", lj)
+
+	lj, err = labelsToJSON(labels.Labels{"host": "h1", "env": "prod"})
+	assert.NoError(t, err)
+	assert.Equal(t, `{"env":"prod","host":"h1"}`, lj, "ключи сортируются => стабильное сравнение в БД")
+}
+
 // --------------------- //
 //  Заглушка без памяти  //
 // --------------------- //
@@ -64,41 +108,60 @@ func (m *mockDBConn) BeginTx(ctx context.Context, opts *sql.TxOptions) (*sql.Tx,
 	return nil, errors.New("not implemented")
 }
 func (m *mockDBConn) Close() error { return nil }
+func (m *mockDBConn) CompactCounters(ctx context.Context, metric string, keep int) error {
+	return nil
+}
 func (m *mockDBConn) Conn(ctx context.Context) (*sql.Conn, error) {
 	return nil, errors.New("not implemented")
 }
-func (m *mockDBConn) CreateMetricsTable() error { return nil }
-func (m *mockDBConn) Driver() driver.Driver     { return driverStub{} }
+func (m *mockDBConn) Driver() driver.Driver { return driverStub{} }
 func (m *mockDBConn) Exec(query string, args ...any) (sql.Result, error) {
 	return nil, errors.New("not implemented")
 }
 func (m *mockDBConn) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
 	return nil, errors.New("not implemented")
 }
-func (m *mockDBConn) GetArrayValues(metric string, metricName string) (values []float64, err error) {
+func (m *mockDBConn) GetArrayValues(ctx context.Context, metric string, metricName string, l labels.Labels) (values []float64, err error) {
 	return nil, ErrNoData
 }
-func (m *mockDBConn) GetOneValue(metric string, metricName string) (float64, error) {
+func (m *mockDBConn) GetOneValue(ctx context.Context, metric string, metricName string, l labels.Labels) (float64, error) {
 	return 0, ErrNoData
 }
-func (m *mockDBConn) List(metricOneValue, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
+func (m *mockDBConn) List(ctx context.Context, metricOneValue, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
 	return nil, nil, ErrNoData
 }
+func (m *mockDBConn) Select(ctx context.Context, metric, metricName string, filter labels.Labels) (map[string][]float64, error) {
+	return nil, ErrNoData
+}
+func (m *mockDBConn) PushHistory(ctx context.Context, metric, metricName string, l labels.Labels, value float64, ts time.Time) error {
+	return nil
+}
+func (m *mockDBConn) History(ctx context.Context, metric, metricName string, filter labels.Labels, from time.Time) (map[string][]Sample, error) {
+	return nil, ErrNoData
+}
+func (m *mockDBConn) TrimHistory(ctx context.Context, before time.Time) error { return nil }
+func (m *mockDBConn) Aggregate(ctx context.Context, q AggregateQuery) (float64, int64, error) {
+	return 0, 0, nil
+}
+func (m *mockDBConn) Migrate(ctx context.Context) error { return nil }
 func (m *mockDBConn) Ping() error { return nil }
 func (m *mockDBConn) PingContext(ctx context.Context) error {
 	return nil
 }
-func (m *mockDBConn) PingDB() error { return nil }
+func (m *mockDBConn) PingDB(ctx context.Context) error { return nil }
 func (m *mockDBConn) Prepare(query string) (*sql.Stmt, error) {
 	return nil, errors.New("not implemented")
 }
 func (m *mockDBConn) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
 	return nil, errors.New("not implemented")
 }
-func (m *mockDBConn) PushAdd(metric string, metricName string, value float64) error {
+func (m *mockDBConn) PushBatch(ctx context.Context, metricOneValue string, items []BatchItem, ts time.Time) ([]float64, error) {
+	return make([]float64, len(items)), nil
+}
+func (m *mockDBConn) PushAdd(ctx context.Context, metric string, metricName string, l labels.Labels, value float64) error {
 	return nil
 }
-func (m *mockDBConn) PushReplace(metric string, metricName string, value float64) error {
+func (m *mockDBConn) PushReplace(ctx context.Context, metric string, metricName string, l labels.Labels, value float64) error {
 	return nil
 }
 func (m *mockDBConn) Query(query string, args ...any) (*sql.Rows, error) {
@@ -113,10 +176,22 @@ func (m *mockDBConn) QueryRow(query string, args ...any) *sql.Row {
 func (m *mockDBConn) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
 	return nil
 }
+func (m *mockDBConn) ReplicationLag(ctx context.Context) (time.Duration, error) {
+	return 0, nil
+}
+func (m *mockDBConn) AgentKeys(ctx context.Context) ([]AgentKey, error) { return nil, nil }
+func (m *mockDBConn) SaveAgentKey(ctx context.Context, key AgentKey) error { return nil }
+func (m *mockDBConn) DeleteAgentKeys(ctx context.Context, agentID string, version int) error {
+	return nil
+}
+func (m *mockDBConn) ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error {
+	return nil
+}
 func (m *mockDBConn) SetConnMaxIdleTime(d time.Duration) {}
 func (m *mockDBConn) SetConnMaxLifetime(d time.Duration) {}
 func (m *mockDBConn) SetMaxIdleConns(n int)              {}
 func (m *mockDBConn) SetMaxOpenConns(n int)              {}
+func (m *mockDBConn) SetQueryTimeout(d time.Duration)    {}
 func (m *mockDBConn) Stats() sql.DBStats {
 	return sql.DBStats{}
 }
@@ -127,13 +202,13 @@ func (m *mockDBConn) Stats() sql.DBStats {
 
 func TestDB_PushReplace_Stub(t *testing.T) {
 	mock := &mockDBConn{}
-	err := mock.PushReplace("gauge", "Alloc", 1.23)
+	err := mock.PushReplace(context.Background(), "gauge", "Alloc", nil, 1.23)
 	assert.NoError(t, err, "заглушка возвращает nil => нет ошибки")
 }
 
 func TestDB_PushAdd_Stub(t *testing.T) {
 	mock := &mockDBConn{}
-	err := mock.PushAdd("gauge", "Heap", 99.99)
+	err := mock.PushAdd(context.Background(), "gauge", "Heap", labels.Labels{"host": "h1"}, 99.99)
 	assert.NoError(t, err, "заглушка возвращает nil => нет ошибки")
 }
 
@@ -143,49 +218,255 @@ func TestDB_PushAdd_Stub(t *testing.T) {
 
 // Пытаемся соединиться с невалидным DSN
 func TestConnectDB_InvalidDSN(t *testing.T) {
-	db, err := ConnectDB("invalid_dsn")
+	db, err := ConnectDB(context.Background(), "invalid_dsn", PoolConfig{})
 	assert.Nil(t, db, "при некорректном DSN db должно быть nil (если Ping() упадёт)")
 	assert.Error(t, err, "ConnectDB должна вернуть ошибку на невалидный DSN")
 }
 
-// CreateMetricsTable: без реальной DB будет ошибка
-func TestDB_CreateMetricsTable_NoRealDB(t *testing.T) {
+func TestWithStatementTimeout(t *testing.T) {
+	tests := []struct {
+		name    string
+		dsn     string
+		timeout time.Duration
+		want    string
+	}{
+		{
+			name:    "без таймаута dsn не меняется",
+			dsn:     "host=localhost user=postgres",
+			timeout: 0,
+			want:    "host=localhost user=postgres",
+		},
+		{
+			name:    "формат ключ=значение",
+			dsn:     "host=localhost user=postgres",
+			timeout: 3 * time.Second,
+			want:    "host=localhost user=postgres statement_timeout=3000",
+		},
+		{
+			name:    "формат URL",
+			dsn:     "postgres://postgres@localhost:5432/metrics?sslmode=disable",
+			timeout: 1500 * time.Millisecond,
+			want:    "postgres://postgres@localhost:5432/metrics?sslmode=disable&statement_timeout=1500",
+		},
+		{
+			name:    "значение из dsn перекрывается",
+			dsn:     "postgresql://localhost/metrics?statement_timeout=1",
+			timeout: time.Second,
+			want:    "postgresql://localhost/metrics?statement_timeout=1000",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := withStatementTimeout(tt.dsn, tt.timeout)
+			assert.NoError(t, err)
+			assert.Equal(t, tt.want, got)
+		})
+	}
+
+	t.Run("некорректный URL", func(t *testing.T) {
+		_, err := withStatementTimeout("postgres://local host:%zz/", time.Second)
+		assert.ErrorIs(t, err, ErrDSN)
+	})
+}
+
+func TestAggregate(t *testing.T) {
+	t.Run("неизвестная функция", func(t *testing.T) {
+		db := &DB{DB: nil}
+		_, _, err := db.Aggregate(context.Background(), AggregateQuery{Func: "median"})
+		assert.ErrorIs(t, err, ErrAggregateFunc)
+	})
+
+	t.Run("nil DB", func(t *testing.T) {
+		db := &DB{DB: nil}
+		_, _, err := db.Aggregate(context.Background(), AggregateQuery{MetricType: "counter", MetricName: "PollCount", Func: AGGSUM})
+		assert.ErrorIs(t, err, ErrNotInit)
+	})
+}
+
+func TestReplicationLag_WithNilDB(t *testing.T) {
+	db := &DB{DB: nil}
+	_, err := db.ReplicationLag(context.Background())
+	assert.ErrorIs(t, err, ErrNotInit)
+}
+
+// OpenDB не проверяет подключение, ошибка будет только при обращении
+func TestOpenDB_Lazy(t *testing.T) {
+	db, err := OpenDB("postgres://127.0.0.1:1/metrics?connect_timeout=1", PoolConfig{MaxOpenConns: 2})
+	assert.NoError(t, err)
+	defer db.Close()
+	assert.Equal(t, 2, db.Stats().MaxOpenConnections)
+	assert.Error(t, db.PingDB(context.Background()))
+}
+
+// Migrate: без реальной DB будет ошибка
+func TestDB_Migrate_NoRealDB(t *testing.T) {
 	db := &DB{DB: nil}
-	err := db.CreateMetricsTable()
+	err := db.Migrate(context.Background())
 	assert.Error(t, err, "без реального соединения => ошибка")
 }
 
 // --------------------- //
-//   Тесты openRetry и т.п.
+//   Тесты execRetry и т.п.
 // --------------------- //
 
-func TestOpenRetry(t *testing.T) {
-	db, err := openRetry("bad_driver", "some_dsn")
-	assert.Nil(t, db, "ожидаем nil при некорректном драйвере")
-	assert.Error(t, err, "openRetry должна вернуть ошибку")
+func TestIsTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection_exception", &pgconn.PgError{Code: pgerrcode.ConnectionException}, true},
+		{"connection_failure", &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, true},
+		{"admin_shutdown", &pgconn.PgError{Code: pgerrcode.AdminShutdown}, true},
+		{"serialization_failure", &pgconn.PgError{Code: pgerrcode.SerializationFailure}, true},
+		{"deadlock_detected", &pgconn.PgError{Code: pgerrcode.DeadlockDetected}, true},
+		{"unique_violation", &pgconn.PgError{Code: pgerrcode.UniqueViolation}, false},
+		{"сетевая ошибка не PgError", &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}, true},
+		{"разорванное подключение", driver.ErrBadConn, true},
+		{"нет строк", sql.ErrNoRows, false},
+		{"отмена контекста", context.Canceled, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isTransient(fmt.Errorf("wrap: %w", tt.err)))
+		})
+	}
+}
+
+func TestIsSafeToRetry(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"connection_failure", &pgconn.PgError{Code: pgerrcode.ConnectionFailure}, true},
+		{"serialization_failure", &pgconn.PgError{Code: pgerrcode.SerializationFailure}, true},
+		{"unique_violation", &pgconn.PgError{Code: pgerrcode.UniqueViolation}, false},
+		{"разорванное до отправки подключение", driver.ErrBadConn, true},
+		{"сброс соединения после отправки", syscall.ECONNRESET, false},
+		{"обрыв чтения ответа", io.ErrUnexpectedEOF, false},
+		{"сетевая ошибка не PgError", &net.OpError{Op: "read", Net: "tcp", Err: syscall.ECONNRESET}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, isSafeToRetry(fmt.Errorf("wrap: %w", tt.err)))
+		})
+	}
+}
+
+// MAXRETRIESTEST количество попыток политики fastRetry
+const MAXRETRIESTEST = 3
+
+// fastRetry подмена политики повторов на политику без ожидания на время теста
+func fastRetry(t *testing.T) {
+	old, oldWrite := retryPolicy, writePolicy
+	retryPolicy = &retry.Policy{Name: "psql-test", MaxAttempts: MAXRETRIESTEST, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Retryable: isTransient}
+	writePolicy = &retry.Policy{Name: "psql-test", MaxAttempts: MAXRETRIESTEST, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Retryable: isSafeToRetry}
+	t.Cleanup(func() { retryPolicy, writePolicy = old, oldWrite })
 }
 
 func TestExecRetry_WithNilDB(t *testing.T) {
 	db := &DB{DB: nil}
-	_, err := db.execRetry("UPDATE sometable SET value=$1", 123)
+	_, err := db.execRetry(context.Background(), "UPDATE sometable SET value=$1", 123)
+	assert.Error(t, err, "nil DB => ожидаем ошибку")
+	_, err = db.execWriteRetry(context.Background(), "INSERT INTO sometable VALUES ($1)", 123)
 	assert.Error(t, err, "nil DB => ожидаем ошибку")
 }
 
-func TestRowScanRetry_WithNilDB(t *testing.T) {
-	// Пытаемся вызвать rowScanRetry на nil-DB и nil-строке.
+func TestQueryRowRetry_WithNilDB(t *testing.T) {
 	db := &DB{DB: nil}
-	err := db.rowScanRetry(nil) // row = nil
-	assert.Error(t, err, "должна быть ошибка, т.к. row == nil или db.DB == nil")
+	var value float64
+	err := db.queryRowRetry(context.Background(), "SELECT 1", nil, &value)
+	assert.Error(t, err, "nil DB => ожидаем ошибку")
 }
 
 func TestQueryRetry_WithNilDB(t *testing.T) {
 	db := &DB{DB: nil}
-	rows, err := db.queryRetry("SELECT 1")
+	called := false
+	err := db.queryRetry(context.Background(), "SELECT 1", func(rows *sql.Rows) error {
+		called = true
+		return nil
+	})
 	assert.Error(t, err, "nil DB => ожидаем ошибку")
-	assert.Nil(t, rows, "rows должны быть nil, т.к. был возврат ошибки")
-	if rows != nil {
-		assert.Nil(t, rows.Err(), "vet тест требует")
-	}
+	assert.False(t, called, "строки не обрабатываются, т.к. был возврат ошибки")
+}
+
+func TestRetry(t *testing.T) {
+	connErr := &pgconn.PgError{Code: pgerrcode.ConnectionException}
+
+	t.Run("обрыв соединения повторяется", func(t *testing.T) {
+		fastRetry(t)
+		attempts := 0
+		err := withRetry(context.Background(), 0, func(ctx context.Context) error {
+			attempts++
+			if attempts == 1 {
+				return connErr
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+	})
+
+	t.Run("конфликт сериализации повторяется до исчерпания попыток", func(t *testing.T) {
+		fastRetry(t)
+		serErr := &pgconn.PgError{Code: pgerrcode.SerializationFailure}
+		attempts := 0
+		err := withRetry(context.Background(), 0, func(ctx context.Context) error {
+			attempts++
+			return serErr
+		})
+		assert.ErrorIs(t, err, serErr)
+		assert.Equal(t, MAXRETRIESTEST, attempts)
+	})
+
+	t.Run("прочие ошибки не повторяются", func(t *testing.T) {
+		attempts := 0
+		err := withRetry(context.Background(), 0, func(ctx context.Context) error {
+			attempts++
+			return sql.ErrNoRows
+		})
+		assert.ErrorIs(t, err, sql.ErrNoRows)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("отмена контекста прерывает ожидание", func(t *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		attempts := 0
+		start := time.Now()
+		err := withRetry(ctx, 0, func(ctx context.Context) error {
+			attempts++
+			return connErr
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, err, connErr)
+		assert.Equal(t, 1, attempts)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+
+	t.Run("отменённый контекст", func(t *testing.T) {
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		attempts := 0
+		err := withRetry(ctx, 0, func(ctx context.Context) error {
+			attempts++
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, context.Canceled)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("таймаут попытки", func(t *testing.T) {
+		err := withRetry(context.Background(), 10*time.Millisecond, func(ctx context.Context) error {
+			deadline, ok := ctx.Deadline()
+			assert.True(t, ok)
+			assert.WithinDuration(t, time.Now().Add(10*time.Millisecond), deadline, 10*time.Millisecond)
+			<-ctx.Done()
+			return ctx.Err()
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+	})
 }
 
 // driverStub — заглушка, реализующая driver.Driver
@@ -226,32 +507,48 @@ func (m *mockDBConnMemory) BeginTx(ctx context.Context, opts *sql.TxOptions) (*s
 	return nil, errors.New("not implemented")
 }
 func (m *mockDBConnMemory) Close() error { return nil }
+func (m *mockDBConnMemory) CompactCounters(ctx context.Context, metric string, keep int) error {
+	return nil
+}
 func (m *mockDBConnMemory) Conn(ctx context.Context) (*sql.Conn, error) {
 	return nil, errors.New("not implemented")
 }
-func (m *mockDBConnMemory) CreateMetricsTable() error { return nil }
-func (m *mockDBConnMemory) Driver() driver.Driver     { return driverStub{} }
+func (m *mockDBConnMemory) Driver() driver.Driver { return driverStub{} }
 func (m *mockDBConnMemory) Exec(query string, args ...any) (sql.Result, error) {
 	return nil, errors.New("not implemented")
 }
 func (m *mockDBConnMemory) ExecContext(ctx context.Context, query string, args ...any) (sql.Result, error) {
 	return nil, errors.New("not implemented")
 }
+func (m *mockDBConnMemory) PushHistory(ctx context.Context, metric, metricName string, l labels.Labels, value float64, ts time.Time) error {
+	return nil
+}
+func (m *mockDBConnMemory) History(ctx context.Context, metric, metricName string, filter labels.Labels, from time.Time) (map[string][]Sample, error) {
+	return nil, ErrNoData
+}
+func (m *mockDBConnMemory) TrimHistory(ctx context.Context, before time.Time) error { return nil }
+func (m *mockDBConnMemory) Aggregate(ctx context.Context, q AggregateQuery) (float64, int64, error) {
+	return 0, 0, nil
+}
+func (m *mockDBConnMemory) Migrate(ctx context.Context) error { return nil }
 func (m *mockDBConnMemory) Ping() error { return nil }
 func (m *mockDBConnMemory) PingContext(ctx context.Context) error {
 	return nil
 }
-func (m *mockDBConnMemory) PingDB() error { return nil }
+func (m *mockDBConnMemory) PingDB(ctx context.Context) error { return nil }
 func (m *mockDBConnMemory) Prepare(query string) (*sql.Stmt, error) {
 	return nil, errors.New("not implemented")
 }
 func (m *mockDBConnMemory) PrepareContext(ctx context.Context, query string) (*sql.Stmt, error) {
 	return nil, errors.New("not implemented")
 }
-func (m *mockDBConnMemory) PushAdd(metric string, metricName string, value float64) error {
+func (m *mockDBConnMemory) PushBatch(ctx context.Context, metricOneValue string, items []BatchItem, ts time.Time) ([]float64, error) {
+	return nil, errors.New("not implemented")
+}
+func (m *mockDBConnMemory) PushAdd(ctx context.Context, metric string, metricName string, l labels.Labels, value float64) error {
 	return nil
 }
-func (m *mockDBConnMemory) PushReplace(metric string, metricName string, value float64) error {
+func (m *mockDBConnMemory) PushReplace(ctx context.Context, metric string, metricName string, l labels.Labels, value float64) error {
 	return nil
 }
 func (m *mockDBConnMemory) Query(query string, args ...any) (*sql.Rows, error) {
@@ -266,17 +563,29 @@ func (m *mockDBConnMemory) QueryRow(query string, args ...any) *sql.Row {
 func (m *mockDBConnMemory) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
 	return nil
 }
+func (m *mockDBConnMemory) ReplicationLag(ctx context.Context) (time.Duration, error) {
+	return 0, nil
+}
+func (m *mockDBConnMemory) AgentKeys(ctx context.Context) ([]AgentKey, error) { return nil, nil }
+func (m *mockDBConnMemory) SaveAgentKey(ctx context.Context, key AgentKey) error { return nil }
+func (m *mockDBConnMemory) DeleteAgentKeys(ctx context.Context, agentID string, version int) error {
+	return nil
+}
+func (m *mockDBConnMemory) ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error {
+	return nil
+}
 func (m *mockDBConnMemory) SetConnMaxIdleTime(d time.Duration) {}
 func (m *mockDBConnMemory) SetConnMaxLifetime(d time.Duration) {}
 func (m *mockDBConnMemory) SetMaxIdleConns(n int)              {}
 func (m *mockDBConnMemory) SetMaxOpenConns(n int)              {}
+func (m *mockDBConnMemory) SetQueryTimeout(d time.Duration)    {}
 func (m *mockDBConnMemory) Stats() sql.DBStats {
 	return sql.DBStats{}
 }
 
-// GetOneValue: ищем в oneValueMap по ключу "type///name"
-func (m *mockDBConnMemory) GetOneValue(metric string, metricName string) (float64, error) {
-	key := metric + METRICSEPARATOR + metricName
+// GetOneValue: ищем в oneValueMap по ключу "type///name{labels}"
+func (m *mockDBConnMemory) GetOneValue(ctx context.Context, metric string, metricName string, l labels.Labels) (float64, error) {
+	key := metric + METRICSEPARATOR + labels.Key(metricName, l)
 	val, ok := m.oneValueMap[key]
 	if !ok {
 		return 0, ErrNoData
@@ -285,8 +594,8 @@ func (m *mockDBConnMemory) GetOneValue(metric string, metricName string) (float6
 }
 
 // GetArrayValues: ищем в arrayValueMap
-func (m *mockDBConnMemory) GetArrayValues(metric string, metricName string) ([]float64, error) {
-	key := metric + METRICSEPARATOR + metricName
+func (m *mockDBConnMemory) GetArrayValues(ctx context.Context, metric string, metricName string, l labels.Labels) ([]float64, error) {
+	key := metric + METRICSEPARATOR + labels.Key(metricName, l)
 	vals, ok := m.arrayValueMap[key]
 	if !ok {
 		return nil, ErrNoData
@@ -295,7 +604,7 @@ func (m *mockDBConnMemory) GetArrayValues(metric string, metricName string) ([]f
 }
 
 // List: разбираем ключи, кладём в разные карты
-func (m *mockDBConnMemory) List(metricOneValue, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
+func (m *mockDBConnMemory) List(ctx context.Context, metricOneValue, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
 	typeValue := make(map[string]float64)
 	typeValues := make(map[string][]float64)
 
@@ -320,6 +629,24 @@ func (m *mockDBConnMemory) List(metricOneValue, metricArrayValues string) (map[s
 	return typeValue, typeValues, nil
 }
 
+// Select: отбираем серии метрики, метки которых содержат фильтр
+func (m *mockDBConnMemory) Select(ctx context.Context, metric string, metricName string, filter labels.Labels) (map[string][]float64, error) {
+	series := make(map[string][]float64)
+	for key, v := range m.oneValueMap {
+		ms := parseKey(key)
+		if name, l := labels.ParseKey(ms.MetricName); ms.MetricType == metric && name == metricName && l.Match(filter) {
+			series[ms.MetricName] = []float64{v}
+		}
+	}
+	for key, slice := range m.arrayValueMap {
+		ms := parseKey(key)
+		if name, l := labels.ParseKey(ms.MetricName); ms.MetricType == metric && name == metricName && l.Match(filter) {
+			series[ms.MetricName] = slice
+		}
+	}
+	return series, nil
+}
+
 // parseKey вспомогательно разбирает "type///name"
 func parseKey(key string) MetricString {
 	sep := METRICSEPARATOR
@@ -354,16 +681,16 @@ func TestDB_GetOneValue_Stub(t *testing.T) {
 		arrayValueMap: map[string][]float64{},
 	}
 
-	val, err := mockMem.GetOneValue("counter", "PollCount")
+	val, err := mockMem.GetOneValue(context.Background(), "counter", "PollCount", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, float64(123), val)
 
-	val2, err2 := mockMem.GetOneValue("gauge", "Alloc")
+	val2, err2 := mockMem.GetOneValue(context.Background(), "gauge", "Alloc", nil)
 	assert.NoError(t, err2)
 	assert.Equal(t, 999.0, val2)
 
 	// Проверим «нет данных»
-	_, err3 := mockMem.GetOneValue("counter", "NotExists")
+	_, err3 := mockMem.GetOneValue(context.Background(), "counter", "NotExists", nil)
 	assert.ErrorIs(t, err3, ErrNoData)
 }
 
@@ -376,16 +703,16 @@ func TestDB_GetArrayValues_Stub(t *testing.T) {
 		},
 	}
 
-	vals, err := mockMem.GetArrayValues("gauge", "AllocHistory")
+	vals, err := mockMem.GetArrayValues(context.Background(), "gauge", "AllocHistory", nil)
 	assert.NoError(t, err)
 	assert.Equal(t, []float64{1.1, 2.2, 3.3}, vals)
 
-	vals2, err2 := mockMem.GetArrayValues("counter", "PollCountList")
+	vals2, err2 := mockMem.GetArrayValues(context.Background(), "counter", "PollCountList", nil)
 	assert.NoError(t, err2)
 	assert.Equal(t, []float64{10, 20, 30}, vals2)
 
 	// Проверим «нет данных»
-	_, err3 := mockMem.GetArrayValues("gauge", "MissingKey")
+	_, err3 := mockMem.GetArrayValues(context.Background(), "gauge", "MissingKey", nil)
 	assert.ErrorIs(t, err3, ErrNoData)
 }
 
@@ -401,7 +728,7 @@ func TestDB_List_Stub(t *testing.T) {
 		},
 	}
 
-	oneMap, arrMap, err := mockMem.List("oneValue", "arrayValue")
+	oneMap, arrMap, err := mockMem.List(context.Background(), "oneValue", "arrayValue")
 	assert.NoError(t, err)
 
 	// Проверяем данные
@@ -410,3 +737,120 @@ func TestDB_List_Stub(t *testing.T) {
 	assert.Equal(t, []float64{1, 2}, arrMap["PollCount"])
 	assert.Equal(t, []float64{10, 20}, arrMap["HeapList"])
 }
+
+func TestDB_Select_Stub(t *testing.T) {
+	mockMem := &mockDBConnMemory{
+		oneValueMap: map[string]float64{
+			`gauge///Alloc{host="h1"}`: 1,
+			`gauge///Alloc{host="h2"}`: 2,
+			`gauge///Sys{host="h1"}`:   3,
+		},
+		arrayValueMap: map[string][]float64{},
+	}
+
+	series, err := mockMem.Select(context.Background(), "gauge", "Alloc", labels.Labels{"host": "h2"})
+	assert.NoError(t, err)
+	assert.Equal(t, map[string][]float64{`Alloc{host="h2"}`: {2}}, series)
+
+	series, err = mockMem.Select(context.Background(), "gauge", "Alloc", nil)
+	assert.NoError(t, err)
+	assert.Len(t, series, 2)
+}
+
+// --------------------- //
+//   Тесты PushBatch
+// --------------------- //
+
+func TestDB_PushBatch_WithNilDB(t *testing.T) {
+	db := &DB{DB: nil}
+	_, err := db.PushBatch(context.Background(), "gauge", []BatchItem{{MetricType: "gauge", MetricName: "Alloc", Value: 1}}, time.Now())
+	assert.ErrorIs(t, err, ErrNotInit)
+}
+
+func TestValuesQuery(t *testing.T) {
+	query, args := valuesQuery("INSERT INTO t (a, b) VALUES ", ";", []string{"", "::jsonb"}, [][]any{
+		{"gauge///Alloc", "{}"},
+		{"counter///PollCount", `{"host":"h1"}`},
+	})
+	assert.Equal(t, "INSERT INTO t (a, b) VALUES ($1, $2::jsonb), ($3, $4::jsonb);", query)
+	assert.Equal(t, []any{"gauge///Alloc", "{}", "counter///PollCount", `{"host":"h1"}`}, args)
+}
+
+func TestChunkArgs(t *testing.T) {
+	rows := make([][]any, MAXBATCHPARAMS/3+1)
+	chunks := chunkArgs(rows, 3)
+	assert.Len(t, chunks, 2)
+	assert.Len(t, chunks[0], MAXBATCHPARAMS/3)
+	assert.Len(t, chunks[1], 1)
+
+	assert.Empty(t, chunkArgs(nil, 3))
+}
+
+func TestBatchValues(t *testing.T) {
+	items := []BatchItem{
+		{MetricType: "counter", MetricName: "PollCount", Value: 1},
+		{MetricType: "gauge", MetricName: "Alloc", Value: 5},
+		{MetricType: "counter", MetricName: "PollCount", Value: 2},
+		{MetricType: "counter", MetricName: "PollCount", Labels: labels.Labels{"host": "h1"}, Value: 3},
+		{MetricType: "gauge", MetricName: "Alloc", Value: 6},
+	}
+	rows := make([]batchRow, len(items))
+	for i, item := range items {
+		rows[i] = batchRow{key: seriesKey(item.MetricType, item.MetricName, item.Labels), value: item.Value}
+	}
+	// до пачки в PollCount было 10, серии с меткой не было
+	totals := map[string]float64{
+		seriesKey("counter", "PollCount", nil):                         13,
+		seriesKey("counter", "PollCount", labels.Labels{"host": "h1"}): 3,
+		seriesKey("gauge", "Alloc", nil):                               6,
+	}
+	assert.Equal(t, []float64{11, 5, 13, 3, 6}, batchValues("gauge", items, rows, totals))
+}
+
+// --------------------- //
+//   Тесты миграций
+// --------------------- //
+
+func TestLoadMigrations(t *testing.T) {
+	t.Run("встроенные миграции", func(t *testing.T) {
+		migrations, err := loadMigrations(migrationsFS)
+		assert.NoError(t, err)
+		if assert.Len(t, migrations, 3) {
+			assert.Equal(t, 1, migrations[0].version)
+			assert.Equal(t, "0001_baseline", migrations[0].name)
+			assert.Equal(t, 2, migrations[1].version)
+			assert.Contains(t, migrations[1].query, "CREATE UNIQUE INDEX metrics_gauge_key")
+			assert.Equal(t, "0003_agent_keys", migrations[2].name)
+			assert.Contains(t, migrations[2].query, "CREATE TABLE agent_keys")
+		}
+	})
+
+	t.Run("порядок по номеру версии", func(t *testing.T) {
+		migrations, err := loadMigrations(fstest.MapFS{
+			"migrations/10_ten.sql": {Data: []byte("SELECT 10;")},
+			"migrations/2_two.sql":  {Data: []byte("SELECT 2;")},
+			"migrations/README.md":  {Data: []byte("not a migration")},
+		})
+		assert.NoError(t, err)
+		if assert.Len(t, migrations, 2) {
+			assert.Equal(t, 2, migrations[0].version)
+			assert.Equal(t, 10, migrations[1].version)
+			assert.Equal(t, "SELECT 10;", migrations[1].query)
+		}
+	})
+
+	t.Run("неверное имя", func(t *testing.T) {
+		_, err := loadMigrations(fstest.MapFS{"migrations/init.sql": {}})
+		assert.ErrorIs(t, err, ErrMigrationName)
+		_, err = loadMigrations(fstest.MapFS{"migrations/v1_init.sql": {}})
+		assert.ErrorIs(t, err, ErrMigrationName)
+	})
+
+	t.Run("повтор версии", func(t *testing.T) {
+		_, err := loadMigrations(fstest.MapFS{
+			"migrations/1_init.sql":  {},
+			"migrations/01_more.sql": {},
+		})
+		assert.ErrorIs(t, err, ErrMigrationDuplicate)
+	})
+}
@@ -1,102 +1,188 @@
 package psql
 
 import (
+	"context"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
 	"github.com/jackc/pgerrcode"
 	"github.com/jackc/pgx/v5/pgconn"
 )
 
-// Настройки повторных обращений в случае неудачных попыток
-const (
-	MAXRETRIES            = 3               // Максимальное количество попыток
-	RETRYINTERVALINCREASE = 2 * time.Second // на столько растёт интервал между попытками, начиная с 1 секунды
-)
+// retryPolicy политика повторов чтения и идемпотентных директив, переменная для подмены задержек в тестах
+var retryPolicy = retry.New("psql", isTransient)
 
-// openRetry повторение попыток открытия данных
-func openRetry(driverName string, dataSourceName string) (db *sql.DB, err error) {
-	for i := 0; i < MAXRETRIES; i++ {
-		db, err = sql.Open(driverName, dataSourceName)
-		if err != nil {
-			if pgErr := new(pgconn.PgError); errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ConnectionException {
-				time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
-				continue
-			}
-			break
-		} else {
-			break
-		}
+// writePolicy политика повторов неидемпотентных директив и транзакций, переменная для подмены в тестах
+var writePolicy = retry.New("psql", isSafeToRetry)
+
+// isTransient временная ошибка базы, после которой запрос или транзакцию имеет смысл повторить:
+// обрыв и отказ соединения (класс 08), остановка или перезапуск сервера, исчерпание подключений,
+// конфликт сериализации и взаимоблокировка, а также сетевые ошибки pgconn, которые не являются PgError
+func isTransient(err error) bool {
+	if pgErr := new(pgconn.PgError); errors.As(err, &pgErr) {
+		return transientCode(pgErr.Code)
+	}
+	return errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err) || retry.Transient(err)
+}
+
+// isSafeToRetry временная ошибка, после которой директива точно не применена:
+// сервер сам отклонил запрос с кодом из isTransient или pgconn не успел его отправить
+// обрыв соединения после отправки (сброс, неожиданный EOF) не повторяется: директива или COMMIT
+// могли выполниться, и повтор прибавил бы значение счётчика дважды
+func isSafeToRetry(err error) bool {
+	if pgErr := new(pgconn.PgError); errors.As(err, &pgErr) {
+		return transientCode(pgErr.Code)
 	}
-	return
+	return errors.Is(err, driver.ErrBadConn) || pgconn.SafeToRetry(err)
 }
 
-// execRetry повторение попыток отправить директивы в базу
-func (db *DB) execRetry(query string, args ...any) (result sql.Result, err error) {
+// transientCode код ошибки сервера, при котором запрос не выполнен и его можно повторить
+func transientCode(code string) bool {
+	switch code {
+	case pgerrcode.AdminShutdown,
+		pgerrcode.CrashShutdown,
+		pgerrcode.CannotConnectNow,
+		pgerrcode.TooManyConnections,
+		pgerrcode.SerializationFailure,
+		pgerrcode.DeadlockDetected:
+		return true
+	}
+	return pgerrcode.IsConnectionException(code)
+}
+
+// pingRetry повторение попыток проверить подключение к базе
+func (db *DB) pingRetry(ctx context.Context) error {
+	if db == nil || db.DB == nil {
+		return ErrNotInit
+	}
+	return withRetry(ctx, db.queryTimeout, db.DB.PingContext)
+}
+
+// execRetry повторение попыток отправить в базу идемпотентные директивы: замену значения, удаление, сжатие
+// неидемпотентные отправляются через execWriteRetry
+// каждая попытка ограничена таймаутом запроса, ожидание между попытками прерывается отменой ctx
+func (db *DB) execRetry(ctx context.Context, query string, args ...any) (result sql.Result, err error) {
 	if db == nil {
 		return nil, ErrNotInit
 	}
 	if db.DB == nil {
 		return nil, ErrNotInit
 	}
-	for i := 0; i < MAXRETRIES; i++ {
-		result, err = db.Exec(query, args...)
-		if err != nil {
-			if pgErr := new(pgconn.PgError); errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ConnectionException {
-				time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
-				continue
-			}
-			break
-		} else {
-			break
-		}
+	err = withRetry(ctx, db.queryTimeout, func(ctx context.Context) error {
+		var err error
+		result, err = db.ExecContext(ctx, query, args...)
+		return err
+	})
+	return result, err
+}
+
+// execWriteRetry повторение попыток отправить неидемпотентную директиву, например прибавление к счётчику
+// повторяется только то, что точно не выполнено, см. isSafeToRetry
+func (db *DB) execWriteRetry(ctx context.Context, query string, args ...any) (result sql.Result, err error) {
+	if db == nil {
+		return nil, ErrNotInit
+	}
+	if db.DB == nil {
+		return nil, ErrNotInit
 	}
+	err = writePolicy.Do(ctx, func(ctx context.Context) error {
+		return attempt(ctx, db.queryTimeout, func(ctx context.Context) error {
+			var err error
+			result, err = db.ExecContext(ctx, query, args...)
+			return err
+		})
+	})
 	return result, err
 }
 
-// rowScanRetry повторение попыток сканировать строку данных, пришедших из базы
-func (db *DB) rowScanRetry(row *sql.Row, dest ...any) (err error) {
+// queryRowRetry повторение попыток получить одну строку данных и сканировать её в dest
+func (db *DB) queryRowRetry(ctx context.Context, query string, args []any, dest ...any) (err error) {
 	if db == nil {
 		return ErrNotInit
 	}
 	if db.DB == nil {
 		return ErrNotInit
 	}
-	for i := 0; i < MAXRETRIES; i++ {
-		err = row.Scan(dest...)
-		if err != nil {
-			if pgErr := new(pgconn.PgError); errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ConnectionException {
-				time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
-				continue
-			}
-			break
-		} else {
-			break
-		}
-	}
-	return err
+	return withRetry(ctx, db.queryTimeout, func(ctx context.Context) error {
+		return db.QueryRowContext(ctx, query, args...).Scan(dest...)
+	})
 }
 
 // queryRetry повторение попыток сделать запрос
-func (db *DB) queryRetry(query string, args ...any) (rows *sql.Rows, err error) {
+// строки обрабатываются в scan, пока действует таймаут запроса
+func (db *DB) queryRetry(ctx context.Context, query string, scan func(rows *sql.Rows) error, args ...any) (err error) {
 	if db == nil {
-		return nil, ErrNotInit
+		return ErrNotInit
 	}
 	if db.DB == nil {
-		return nil, ErrNotInit
+		return ErrNotInit
 	}
-	for i := 0; i < MAXRETRIES; i++ {
-		rows, err = db.Query(query, args...)
+	return withRetry(ctx, db.queryTimeout, func(ctx context.Context) error {
+		rows, err := db.QueryContext(ctx, query, args...)
 		if err != nil {
-			if pgErr := new(pgconn.PgError); errors.As(err, &pgErr) && pgErr.Code == pgerrcode.ConnectionException {
-				time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
-				continue
-			}
-			break
-		} else {
-			break
+			return err
 		}
+		defer rows.Close()
+		err = scan(rows)
+		if err != nil {
+			return err
+		}
+		return rows.Err()
+	})
+}
+
+// txRetry выполнение fn в транзакции
+// транзакция повторяется целиком только при ошибке, после которой она точно не зафиксирована, см. isSafeToRetry:
+// при обрыве во время COMMIT неизвестно, применились ли данные
+// timeout ограничивает одну попытку, 0 - без ограничения
+func (db *DB) txRetry(ctx context.Context, timeout time.Duration, fn func(tx *sql.Tx) error) (err error) {
+	if db == nil {
+		return ErrNotInit
+	}
+	if db.DB == nil {
+		return ErrNotInit
+	}
+	return writePolicy.Do(ctx, func(ctx context.Context) error {
+		return attempt(ctx, timeout, func(ctx context.Context) error {
+			return db.tx(ctx, fn)
+		})
+	})
+}
+
+// tx выполнение fn в транзакции, при ошибке транзакция откатывается
+func (db *DB) tx(ctx context.Context, fn func(tx *sql.Tx) error) error {
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	err = fn(tx)
+	if err != nil {
+		if rbErr := tx.Rollback(); rbErr != nil && !errors.Is(rbErr, sql.ErrTxDone) {
+			return errors.Join(err, rbErr)
+		}
+		return err
+	}
+	return tx.Commit()
+}
+
+// withRetry повторение попыток fn по политике retryPolicy
+// каждая попытка получает контекст с таймаутом timeout,
+// повторы прекращаются, как только отменён ctx
+func withRetry(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	return retryPolicy.Do(ctx, func(ctx context.Context) error {
+		return attempt(ctx, timeout, fn)
+	})
+}
+
+// attempt одна попытка fn с таймаутом, 0 - без ограничения
+func attempt(ctx context.Context, timeout time.Duration, fn func(ctx context.Context) error) error {
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
 	}
-	return rows, err
+	return fn(ctx)
 }
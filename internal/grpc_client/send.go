@@ -0,0 +1,201 @@
+// Модуль используется для передачи данных из агента на сервер хранения метрик по gRPC
+package grpcclient
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	metgen "github.com/Grifonhard/Practicum-metrics/internal/met_gen"
+	"github.com/Grifonhard/Practicum-metrics/internal/pb"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/encoding/gzip"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Ключи метаданных подписи запроса
+const (
+	HASHHEADER      = "hashsha256"  // подпись запроса, аналог заголовка HashSHA256
+	TIMESTAMPHEADER = "x-timestamp" // время отправки, аналог заголовка X-Timestamp
+	NONCEHEADER     = "x-nonce"     // одноразовое значение, аналог заголовка X-Nonce
+)
+
+// REALIPHEADER ключ метаданных с адресом агента, аналог заголовка X-Real-IP
+const REALIPHEADER = "x-real-ip"
+
+// Ключи метаданных агента со своим ключом
+const (
+	AGENTIDHEADER    = "x-agent-id"    // id агента, аналог заголовка X-Agent-ID
+	KEYVERSIONHEADER = "x-key-version" // версия ключа агента, аналог заголовка X-Key-Version
+)
+
+// Настройки повторных попыток отправить данные, если происходят сбои
+const (
+	MAXRETRIES            = 3               // Максимальное количество попыток
+	RETRYINTERVALINCREASE = 2 * time.Second // на столько растёт интервал между попытками, начиная с 1 секунды
+	REQUESTTIMEOUT        = time.Minute     // таймаут одного вызова
+)
+
+// Client хранит в себе соединение с gRPC сервером
+type Client struct {
+	conn       *grpc.ClientConn
+	metrics    pb.MetricsClient
+	key        string
+	agentID    string
+	keyVersion int
+	labels     labels.Labels
+	realIP     net.IP
+}
+
+// New создание клиента
+// соединение устанавливается лениво, при первом вызове
+// key - ключ подписи: общий или, если задан agentID, ключ этого агента версии keyVersion,
+// keyVersion 0 - сервер проверяет подпись всеми действующими версиями ключа агента
+// метки l добавляются к каждой отправляемой метрике
+// tlsConfig - настройки TLS агента, см. cryptoutils.ClientTLSConfig, nil - без шифрования
+func New(addr, key, agentID string, keyVersion int, l labels.Labels, tlsConfig *tls.Config) (*Client, error) {
+	creds := insecure.NewCredentials()
+	if tlsConfig != nil {
+		creds = credentials.NewTLS(tlsConfig)
+	}
+	conn, err := grpc.NewClient(addr,
+		grpc.WithTransportCredentials(creds),
+		grpc.WithDefaultCallOptions(grpc.UseCompressor(gzip.Name)),
+	)
+	if err != nil {
+		return nil, err
+	}
+	return &Client{
+		conn:       conn,
+		metrics:    pb.NewMetricsClient(conn),
+		key:        key,
+		agentID:    agentID,
+		keyVersion: keyVersion,
+		labels:     l,
+	}, nil
+}
+
+// SetRealIP адрес агента, отправляемый в метаданных x-real-ip, nil - не отправляется
+func (cl *Client) SetRealIP(ip net.IP) {
+	cl.realIP = ip
+}
+
+// Close закрытие соединения
+func (cl *Client) Close() error {
+	return cl.conn.Close()
+}
+
+// SendMetric агрегирует и отправляет данные на сервер одной пачкой
+func (cl *Client) SendMetric(wg *sync.WaitGroup, gen *metgen.MetGen) {
+	wg.Add(1)
+	defer wg.Done()
+
+	gauge, counter, err := gen.Collect()
+	if err != nil {
+		logger.Error(fmt.Sprintf("fail collect metrics: %s", err.Error()))
+		return
+	}
+
+	req := &pb.UpdateMetricsRequest{Metrics: prepareDataToSend(gauge, counter, cl.labels)}
+
+	var resp *pb.UpdateMetricsResponse
+	var errCollect []error
+	for i := 0; i < MAXRETRIES; i++ {
+		resp, err = cl.send(req)
+		if err == nil {
+			break
+		}
+		errCollect = append(errCollect, err)
+		if status.Code(err) != codes.Unavailable {
+			break
+		}
+		time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
+	}
+	if errCollect != nil {
+		logger.Error(fmt.Sprintf("problem with sending metrics: %s\n", errors.Join(errCollect...).Error()))
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("fail while sending metrics: %s\n", err.Error()))
+		return
+	}
+	logger.Info(fmt.Sprintf("success send, metrics: %d\n", len(resp.GetMetrics())))
+}
+
+// send один вызов UpdateMetrics с подписью запроса
+// время и nonce у каждой попытки свои, иначе сервер принял бы повтор за перехваченный запрос
+func (cl *Client) send(req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), REQUESTTIMEOUT)
+	defer cancel()
+
+	if cl.realIP != nil {
+		ctx = metadata.AppendToOutgoingContext(ctx, REALIPHEADER, cl.realIP.String())
+	}
+	if cl.key != "" {
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+		if err != nil {
+			return nil, err
+		}
+		nonce, err := agents.NewNonce()
+		if err != nil {
+			return nil, err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		ctx = metadata.AppendToOutgoingContext(ctx,
+			HASHHEADER, computeHMAC(agents.Signed(data, timestamp, nonce), cl.key),
+			TIMESTAMPHEADER, timestamp,
+			NONCEHEADER, nonce)
+		if cl.agentID != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, AGENTIDHEADER, cl.agentID)
+			if cl.keyVersion != 0 {
+				ctx = metadata.AppendToOutgoingContext(ctx, KEYVERSIONHEADER, strconv.Itoa(cl.keyVersion))
+			}
+		}
+	}
+
+	return cl.metrics.UpdateMetrics(ctx, req)
+}
+
+// prepareDataToSend перевод метрик генератора в формат protobuf
+func prepareDataToSend(g map[string]float64, c map[string]int64, l labels.Labels) []*pb.Metric {
+	metrics := make([]*pb.Metric, 0, len(g)+len(c))
+	for k, v := range g {
+		metrics = append(metrics, &pb.Metric{
+			Id:     k,
+			Type:   pb.MType_GAUGE,
+			Value:  v,
+			Labels: l,
+		})
+	}
+	for k, v := range c {
+		metrics = append(metrics, &pb.Metric{
+			Id:     k,
+			Type:   pb.MType_COUNTER,
+			Delta:  v,
+			Labels: l,
+		})
+	}
+	return metrics
+}
+
+// computeHMAC подготовка hmac для отправляемых данных
+func computeHMAC(value []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil))
+}
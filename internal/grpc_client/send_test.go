@@ -0,0 +1,106 @@
+package grpcclient
+
+import (
+	"context"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	grpcserver "github.com/Grifonhard/Practicum-metrics/internal/grpc_server"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	metgen "github.com/Grifonhard/Practicum-metrics/internal/met_gen"
+	"github.com/Grifonhard/Practicum-metrics/internal/pb"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	webclient "github.com/Grifonhard/Practicum-metrics/internal/web_client"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestPrepareDataToSend(t *testing.T) {
+	metrics := prepareDataToSend(map[string]float64{"Alloc": 1.1}, map[string]int64{"PollCount": 3}, labels.Labels{"host": "h1"})
+	require.Len(t, metrics, 2)
+	assert.Equal(t, "Alloc", metrics[0].GetId())
+	assert.Equal(t, pb.MType_GAUGE, metrics[0].GetType())
+	assert.Equal(t, 1.1, metrics[0].GetValue())
+	assert.Equal(t, "PollCount", metrics[1].GetId())
+	assert.Equal(t, pb.MType_COUNTER, metrics[1].GetType())
+	assert.Equal(t, int64(3), metrics[1].GetDelta())
+	assert.Equal(t, map[string]string{"host": "h1"}, metrics[1].GetLabels())
+}
+
+func TestSendMetric(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 0))
+
+	stor, err := storage.New(0, "", false)
+	require.NoError(t, err)
+	go stor.BackupLoop()
+
+	key := "secret"
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	_, trusted, err := net.ParseCIDR("127.0.0.0/8")
+	require.NoError(t, err)
+	srv := grpcserver.NewGRPCServer(stor, grpcserver.Options{Key: key, Replay: agents.NewReplayGuard(time.Minute, 100), Trusted: trusted})
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	cl, err := New(listener.Addr().String(), key, "", 0, labels.Labels{"host": "h1"}, nil)
+	require.NoError(t, err)
+	defer cl.Close()
+	ip, err := webclient.OutboundIP(listener.Addr().String())
+	require.NoError(t, err)
+	cl.SetRealIP(ip)
+
+	gen := metgen.New()
+	gen.MetricsGauge["Alloc"] = 42
+	gen.MetricsCounter["PollCount"] = 4
+
+	var wg sync.WaitGroup
+	cl.SendMetric(&wg, gen)
+	wg.Wait()
+
+	value, err := stor.Get(context.Background(), &storage.Metric{Type: storage.TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "h1"}})
+	require.NoError(t, err)
+	assert.Equal(t, float64(42), value)
+
+	value, err = stor.Get(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "PollCount"})
+	require.NoError(t, err)
+	assert.Equal(t, float64(4), value)
+}
+
+func TestSendMetricAgent(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 0))
+
+	stor, err := storage.New(0, "", false)
+	require.NoError(t, err)
+	go stor.BackupLoop()
+	reg, err := agents.NewRegistry(context.Background(), stor)
+	require.NoError(t, err)
+	agent, err := reg.Add(context.Background(), "agent-1")
+	require.NoError(t, err)
+
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	srv := grpcserver.NewGRPCServer(stor, grpcserver.Options{Key: "secret", Replay: agents.NewReplayGuard(time.Minute, 100), Registry: reg})
+	go srv.Serve(listener)
+	defer srv.Stop()
+
+	cl, err := New(listener.Addr().String(), agent.Key, agent.AgentID, agent.Version, nil, nil)
+	require.NoError(t, err)
+	defer cl.Close()
+
+	gen := metgen.New()
+	gen.MetricsGauge["Alloc"] = 42
+
+	var wg sync.WaitGroup
+	cl.SendMetric(&wg, gen)
+	wg.Wait()
+
+	value, err := stor.Get(context.Background(), &storage.Metric{Type: storage.TYPEGAUGE, Name: "Alloc"})
+	require.NoError(t, err)
+	assert.Equal(t, float64(42), value)
+}
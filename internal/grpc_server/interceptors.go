@@ -0,0 +1,388 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	cryptoutils "github.com/Grifonhard/Practicum-metrics/internal/crypto_utils"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/sirupsen/logrus"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/protobuf/proto"
+)
+
+// Ключи метаданных подписи запроса
+const (
+	HASHHEADER      = "hashsha256"  // подпись запроса, аналог заголовка HashSHA256
+	TIMESTAMPHEADER = "x-timestamp" // время отправки, аналог заголовка X-Timestamp
+	NONCEHEADER     = "x-nonce"     // одноразовое значение, аналог заголовка X-Nonce
+)
+
+// REALIPHEADER ключ метаданных с адресом агента, аналог заголовка X-Real-IP
+const REALIPHEADER = "x-real-ip"
+
+// Ключи метаданных агента со своим ключом, см. UnaryAgentAuth
+const (
+	AGENTIDHEADER    = "x-agent-id"    // id агента, аналог заголовка X-Agent-ID
+	KEYVERSIONHEADER = "x-key-version" // версия ключа агента, аналог заголовка X-Key-Version
+)
+
+// UnaryLogger логирует унарные вызовы
+func UnaryLogger() grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		start := time.Now()
+		resp, err := handler(ctx, req)
+		logger.WithFields(logrus.Fields{
+			"method":       info.FullMethod,
+			"lead time ms": time.Since(start).Milliseconds(),
+			"status":       status.Code(err).String(),
+		}).Info()
+		return resp, err
+	}
+}
+
+// StreamLogger логирует потоковые вызовы
+func StreamLogger() grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		start := time.Now()
+		err := handler(srv, ss)
+		logger.WithFields(logrus.Fields{
+			"method":       info.FullMethod,
+			"lead time ms": time.Since(start).Milliseconds(),
+			"status":       status.Code(err).String(),
+		}).Info()
+		return err
+	}
+}
+
+// UnaryCertAuth авторизация унарных вызовов по subject клиентского сертификата, как CertAuth в web_server
+// пустой subjects - проверка отключена
+func UnaryCertAuth(subjects []string) grpc.UnaryServerInterceptor {
+	allowed := subjectSet(subjects)
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkCert(ctx, allowed); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamCertAuth авторизация потоковых вызовов по subject клиентского сертификата
+func StreamCertAuth(subjects []string) grpc.StreamServerInterceptor {
+	allowed := subjectSet(subjects)
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkCert(ss.Context(), allowed); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// subjectSet набор разрешённых subject
+func subjectSet(subjects []string) map[string]struct{} {
+	allowed := make(map[string]struct{}, len(subjects))
+	for _, s := range subjects {
+		allowed[s] = struct{}{}
+	}
+	return allowed
+}
+
+// checkCert проверка subject проверенного при TLS рукопожатии сертификата агента
+// без сертификата вызов отклоняется с Unauthenticated, с чужим subject - с PermissionDenied
+func checkCert(ctx context.Context, allowed map[string]struct{}) error {
+	if len(allowed) == 0 {
+		return nil
+	}
+	p, ok := peer.FromContext(ctx)
+	if !ok {
+		return status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	info, ok := p.AuthInfo.(credentials.TLSInfo)
+	if !ok || len(info.State.VerifiedChains) == 0 {
+		return status.Error(codes.Unauthenticated, "client certificate required")
+	}
+	subject := info.State.VerifiedChains[0][0].Subject
+	if !cryptoutils.SubjectAllowed(allowed, subject) {
+		return status.Errorf(codes.PermissionDenied, "subject %s is not allowed", subject.String())
+	}
+	return nil
+}
+
+// UnaryTrustedSubnet приём унарных вызовов только от агентов из подсети subnet
+// адрес агента берётся из метаданных x-real-ip, nil subnet - проверка выключена
+func UnaryTrustedSubnet(subnet *net.IPNet) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		if err := checkSubnet(ctx, subnet); err != nil {
+			return nil, err
+		}
+		return handler(ctx, req)
+	}
+}
+
+// StreamTrustedSubnet приём потоковых вызовов только от агентов из подсети subnet
+func StreamTrustedSubnet(subnet *net.IPNet) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		if err := checkSubnet(ss.Context(), subnet); err != nil {
+			return err
+		}
+		return handler(srv, ss)
+	}
+}
+
+// checkSubnet проверка адреса агента из метаданных вызова
+// вызов без адреса или с чужим адресом отклоняется
+func checkSubnet(ctx context.Context, subnet *net.IPNet) error {
+	if subnet == nil {
+		return nil
+	}
+	var ip net.IP
+	if md, ok := metadata.FromIncomingContext(ctx); ok {
+		if values := md.Get(REALIPHEADER); len(values) > 0 {
+			ip = net.ParseIP(strings.TrimSpace(values[0]))
+		}
+	}
+	if ip == nil || !subnet.Contains(ip) {
+		return status.Error(codes.PermissionDenied, "address is not in trusted subnet")
+	}
+	return nil
+}
+
+// UnaryPseudoAuth аутентификация унарных вызовов общим ключом key
+// подпись считается от сериализованного (детерминированно) сообщения запроса
+// вместе с временем и nonce из метаданных, см. agents.Signed,
+// после проверки подписи guard отклоняет повтор запроса, nil guard - без защиты от повтора
+func UnaryPseudoAuth(key string, guard *agents.ReplayGuard) grpc.UnaryServerInterceptor {
+	return UnaryAgentAuth(nil, key, false, guard)
+}
+
+// StreamPseudoAuth аутентификация потоковых вызовов общим ключом key
+// подпись считается от времени и nonce из метаданных и склеенных сериализованных сообщений всего потока
+// и проверяется при получении конца потока, до того как обработчик применит данные,
+// тогда же guard отклоняет повтор потока
+func StreamPseudoAuth(key string, guard *agents.ReplayGuard) grpc.StreamServerInterceptor {
+	return StreamAgentAuth(nil, key, false, guard)
+}
+
+// UnaryAgentAuth аутентификация унарных вызовов по ключу агента из реестра reg, как AgentAuth в web_server
+// пока в реестре не было ни одного агента, работает общий ключ key, как в UnaryPseudoAuth,
+// после этого вызов проверяется ключом агента из метаданных x-agent-id, версия берётся из x-key-version,
+// а без x-agent-id отклоняется, общий ключ принимается только при sharedFallback
+func UnaryAgentAuth(reg *agents.Registry, key string, sharedFallback bool, guard *agents.ReplayGuard) grpc.UnaryServerInterceptor {
+	return func(ctx context.Context, req any, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+		verify, err := resolveVerifier(ctx, reg, key, sharedFallback)
+		if err != nil {
+			return nil, err
+		}
+		if verify == nil {
+			return handler(ctx, req)
+		}
+
+		sig, err := signatureFromContext(ctx)
+		if err != nil {
+			return nil, err
+		}
+
+		msg, ok := req.(proto.Message)
+		if !ok {
+			return nil, status.Error(codes.Internal, "unexpected request type")
+		}
+		data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+		if err != nil {
+			return nil, status.Error(codes.InvalidArgument, "fail marshal request")
+		}
+
+		if err = verify(agents.Signed(data, sig.timestamp, sig.nonce), sig.hash); err != nil {
+			return nil, err
+		}
+		if err = checkReplay(guard, sig); err != nil {
+			return nil, err
+		}
+
+		return handler(ctx, req)
+	}
+}
+
+// StreamAgentAuth аутентификация потоковых вызовов по ключу агента, правила выбора ключа как в UnaryAgentAuth
+func StreamAgentAuth(reg *agents.Registry, key string, sharedFallback bool, guard *agents.ReplayGuard) grpc.StreamServerInterceptor {
+	return func(srv any, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+		verify, err := resolveVerifier(ss.Context(), reg, key, sharedFallback)
+		if err != nil {
+			return err
+		}
+		if verify == nil {
+			return handler(srv, ss)
+		}
+
+		sig, err := signatureFromContext(ss.Context())
+		if err != nil {
+			return err
+		}
+
+		return handler(srv, &authServerStream{
+			ServerStream: ss,
+			verify:       verify,
+			sig:          sig,
+			guard:        guard,
+		})
+	}
+}
+
+// verifier проверка подписи hash подписанных данных signed, ошибка - статус gRPC
+type verifier func(signed []byte, hash string) error
+
+// resolveVerifier выбор ключа для проверки вызова по тем же правилам, что AgentAuth в web_server
+// nil verifier - вызов не проверяется: реестр не включён и общий ключ не задан
+func resolveVerifier(ctx context.Context, reg *agents.Registry, key string, sharedFallback bool) (verifier, error) {
+	agentID := metadataValue(ctx, AGENTIDHEADER)
+	if !reg.Enabled() || (agentID == "" && sharedFallback && key != "") {
+		if key == "" {
+			return nil, nil
+		}
+		return func(signed []byte, hash string) error {
+			if !hmac.Equal([]byte(hash), []byte(ComputeHMAC(signed, key))) {
+				return status.Error(codes.Unauthenticated, "invalid HMAC")
+			}
+			return nil
+		}, nil
+	}
+	if agentID == "" {
+		return nil, status.Errorf(codes.Unauthenticated, "missing %s metadata", AGENTIDHEADER)
+	}
+	var version int
+	if v := metadataValue(ctx, KEYVERSIONHEADER); v != "" {
+		var err error
+		version, err = strconv.Atoi(v)
+		if err != nil || version <= 0 {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid %s metadata", KEYVERSIONHEADER)
+		}
+	}
+	return func(signed []byte, hash string) error {
+		if err := reg.Verify(agentID, version, signed, hash); err != nil {
+			logger.Error(fmt.Sprintf("agent auth: %s", err.Error()))
+			return status.Error(codes.Unauthenticated, "invalid agent credentials")
+		}
+		return nil
+	}, nil
+}
+
+// metadataValue первое значение ключа метаданных входящего вызова, пустая строка - ключа нет
+func metadataValue(ctx context.Context, name string) string {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return ""
+	}
+	if values := md.Get(name); len(values) > 0 {
+		return values[0]
+	}
+	return ""
+}
+
+// authServerStream обёртка для ServerStream, копящая сериализованные сообщения для проверки подписи
+type authServerStream struct {
+	grpc.ServerStream
+	data   []byte
+	verify verifier
+	sig    signature
+	guard  *agents.ReplayGuard
+}
+
+// RecvMsg принимает сообщение и добавляет его в подписываемые данные
+// при окончании потока сверяет подпись и проверяет, не повтор ли это
+func (s *authServerStream) RecvMsg(m any) error {
+	err := s.ServerStream.RecvMsg(m)
+	if errors.Is(err, io.EOF) {
+		if verifyErr := s.verify(agents.Signed(s.data, s.sig.timestamp, s.sig.nonce), s.sig.hash); verifyErr != nil {
+			return verifyErr
+		}
+		if replayErr := checkReplay(s.guard, s.sig); replayErr != nil {
+			return replayErr
+		}
+		return err
+	}
+	if err != nil {
+		return err
+	}
+
+	msg, ok := m.(proto.Message)
+	if !ok {
+		return status.Error(codes.Internal, "unexpected request type")
+	}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(msg)
+	if err != nil {
+		return status.Error(codes.InvalidArgument, "fail marshal request")
+	}
+	s.data = append(s.data, data...)
+	return nil
+}
+
+// signature подпись вызова и подписанные вместе с данными время и nonce
+type signature struct {
+	hash      string
+	timestamp string
+	nonce     string
+}
+
+// signatureFromContext достаёт подпись, время и nonce из метаданных вызова
+// при заданном ключе все три обязательны, без времени и nonce запрос можно было бы повторить
+func signatureFromContext(ctx context.Context) (signature, error) {
+	md, ok := metadata.FromIncomingContext(ctx)
+	if !ok {
+		return signature{}, status.Error(codes.Unauthenticated, "missing metadata")
+	}
+	var sig signature
+	for _, field := range []struct {
+		name  string
+		value *string
+	}{
+		{HASHHEADER, &sig.hash},
+		{TIMESTAMPHEADER, &sig.timestamp},
+		{NONCEHEADER, &sig.nonce},
+	} {
+		values := md.Get(field.name)
+		if len(values) == 0 || values[0] == "" {
+			return signature{}, status.Errorf(codes.Unauthenticated, "missing %s metadata", field.name)
+		}
+		*field.value = values[0]
+	}
+	return sig, nil
+}
+
+// checkReplay проверка времени и nonce подписанного вызова, nil guard - без проверки
+// при заполненном кэше nonce вызов отклоняется как временно недоступный, клиент повторит его
+func checkReplay(guard *agents.ReplayGuard, sig signature) error {
+	if guard == nil {
+		return nil
+	}
+	err := guard.Check(sig.timestamp, sig.nonce)
+	if errors.Is(err, agents.ErrNonceCache) {
+		logger.Error(fmt.Sprintf("replay protection: %s", err.Error()))
+		return status.Error(codes.Unavailable, err.Error())
+	}
+	if err != nil {
+		logger.Error(fmt.Sprintf("replay protection: %s", err.Error()))
+		return status.Error(codes.Unauthenticated, err.Error())
+	}
+	return nil
+}
+
+// ComputeHMAC высчитывает хэш данных
+func ComputeHMAC(value []byte, key string) string {
+	h := hmac.New(sha256.New, []byte(key))
+	h.Write(value)
+	return hex.EncodeToString(h.Sum(nil))
+}
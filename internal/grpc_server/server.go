@@ -0,0 +1,165 @@
+// Модуль предназначен для приёма данных из агентов по gRPC
+// использует то же хранилище, что и web_server
+package grpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/pb"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	_ "google.golang.org/grpc/encoding/gzip" // регистрирует gzip компрессор для входящих запросов
+	"google.golang.org/grpc/status"
+)
+
+// MetricsServer реализация gRPC сервиса приёма метрик
+type MetricsServer struct {
+	pb.UnimplementedMetricsServer
+	stor storage.Backend
+}
+
+// New создание сервиса приёма метрик
+func New(stor storage.Backend) *MetricsServer {
+	return &MetricsServer{
+		stor: stor,
+	}
+}
+
+// Options настройки gRPC сервера
+type Options struct {
+	Key     string              // общий ключ подписи запросов, пустой - без проверки подписи, пока не включён Registry
+	Replay  *agents.ReplayGuard // защита подписанных запросов от повтора, nil - выключена
+	Trusted *net.IPNet          // подсеть агентов, которым разрешена запись, nil - любые адреса
+	// TLS настройки TLS сервера, см. cryptoutils.ServerTLSConfig, nil - без шифрования
+	TLS *tls.Config
+	// Subjects разрешённые subject клиентских сертификатов, пустой - любые
+	Subjects []string
+	// Registry реестр ключей агентов, nil - только общий ключ Key
+	Registry *agents.Registry
+	// SharedFallback принимать общий ключ от агентов без x-agent-id и после включения реестра
+	SharedFallback bool
+}
+
+// NewGRPCServer создаёт grpc.Server с зарегистрированным сервисом метрик и перехватчиками
+// логирования, проверки подсети агента, его сертификата и подписи запроса ключом агента или общим ключом
+// для graceful shutdown используется GracefulStop сервера
+func NewGRPCServer(stor storage.Backend, opts Options) *grpc.Server {
+	serverOpts := []grpc.ServerOption{
+		grpc.ChainUnaryInterceptor(UnaryLogger(), UnaryTrustedSubnet(opts.Trusted), UnaryCertAuth(opts.Subjects), UnaryAgentAuth(opts.Registry, opts.Key, opts.SharedFallback, opts.Replay)),
+		grpc.ChainStreamInterceptor(StreamLogger(), StreamTrustedSubnet(opts.Trusted), StreamCertAuth(opts.Subjects), StreamAgentAuth(opts.Registry, opts.Key, opts.SharedFallback, opts.Replay)),
+	}
+	if opts.TLS != nil {
+		serverOpts = append(serverOpts, grpc.Creds(credentials.NewTLS(opts.TLS)))
+	}
+	srv := grpc.NewServer(serverOpts...)
+	pb.RegisterMetricsServer(srv, New(stor))
+	return srv
+}
+
+// UpdateMetrics сохраняет одну пачку метрик
+// аналог POST /updates/
+func (s *MetricsServer) UpdateMetrics(ctx context.Context, req *pb.UpdateMetricsRequest) (*pb.UpdateMetricsResponse, error) {
+	items, err := fromProto(req.GetMetrics())
+	if err != nil {
+		return nil, status.Error(codes.InvalidArgument, err.Error())
+	}
+
+	renewed, err := s.apply(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+
+	return &pb.UpdateMetricsResponse{Metrics: toProto(renewed)}, nil
+}
+
+// StreamMetrics принимает поток пачек метрик
+// данные применяются только после того, как клиент закрыл поток
+func (s *MetricsServer) StreamMetrics(stream pb.Metrics_StreamMetricsServer) error {
+	var items []storage.Metric
+	for {
+		req, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return err
+		}
+
+		batch, err := fromProto(req.GetMetrics())
+		if err != nil {
+			return status.Error(codes.InvalidArgument, err.Error())
+		}
+		items = append(items, batch...)
+	}
+
+	renewed, err := s.apply(stream.Context(), items)
+	if err != nil {
+		return err
+	}
+
+	return stream.SendAndClose(&pb.UpdateMetricsResponse{Metrics: toProto(renewed)})
+}
+
+// apply сохраняет метрики и возвращает их актуальные значения
+func (s *MetricsServer) apply(ctx context.Context, items []storage.Metric) ([]storage.Metric, error) {
+	renewed, err := s.stor.PushBatch(ctx, items)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "fail push data to db: %s", err.Error())
+	}
+	return renewed, nil
+}
+
+// fromProto перевод метрик из формата protobuf в формат хранилища
+func fromProto(in []*pb.Metric) ([]storage.Metric, error) {
+	items := make([]storage.Metric, 0, len(in))
+	for _, m := range in {
+		if m.GetId() == "" {
+			return nil, storage.ErrMetricValEmptyField
+		}
+		item := storage.Metric{Name: m.GetId()}
+		if len(m.GetLabels()) > 0 {
+			item.Labels = labels.Labels(m.GetLabels())
+			if err := item.Labels.Validate(); err != nil {
+				return nil, err
+			}
+		}
+		switch m.GetType() {
+		case pb.MType_GAUGE:
+			item.Type = storage.TYPEGAUGE
+			item.Value = m.GetValue()
+		case pb.MType_COUNTER:
+			item.Type = storage.TYPECOUNTER
+			item.Value = float64(m.GetDelta())
+		default:
+			return nil, storage.ErrMetricValWrongType
+		}
+		items = append(items, item)
+	}
+	return items, nil
+}
+
+// toProto перевод метрик из формата хранилища в формат protobuf
+func toProto(in []storage.Metric) []*pb.Metric {
+	out := make([]*pb.Metric, 0, len(in))
+	for _, item := range in {
+		m := &pb.Metric{Id: item.Name, Labels: item.Labels}
+		switch item.Type {
+		case storage.TYPEGAUGE:
+			m.Type = pb.MType_GAUGE
+			m.Value = item.Value
+		case storage.TYPECOUNTER:
+			m.Type = pb.MType_COUNTER
+			m.Delta = int64(item.Value)
+		}
+		out = append(out, m)
+	}
+	return out
+}
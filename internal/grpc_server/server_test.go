@@ -0,0 +1,364 @@
+package grpcserver
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"net"
+	"os"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/pb"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"google.golang.org/protobuf/proto"
+)
+
+// startServer поднимает gRPC сервер с ключом key поверх bufconn и возвращает клиента к нему
+func startServer(t *testing.T, key string) (pb.MetricsClient, *storage.MemStorage) {
+	t.Helper()
+	return startServerWith(t, Options{Key: key, Replay: agents.NewReplayGuard(time.Minute, 100)})
+}
+
+// startServerWith поднимает gRPC сервер с настройками opts
+func startServerWith(t *testing.T, opts Options) (pb.MetricsClient, *storage.MemStorage) {
+	t.Helper()
+	require.NoError(t, logger.Init(os.Stdout, 0))
+
+	stor, err := storage.New(0, "", false)
+	require.NoError(t, err)
+	go stor.BackupLoop()
+
+	listener := bufconn.Listen(1024 * 1024)
+	srv := NewGRPCServer(stor, opts)
+	go srv.Serve(listener)
+	t.Cleanup(srv.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufnet",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return listener.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	require.NoError(t, err)
+	t.Cleanup(func() { conn.Close() })
+
+	return pb.NewMetricsClient(conn), stor
+}
+
+func TestUpdateMetrics(t *testing.T) {
+	client, stor := startServer(t, "")
+
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 1.5},
+		{Id: "PollCount", Type: pb.MType_COUNTER, Delta: 2},
+		{Id: "PollCount", Type: pb.MType_COUNTER, Delta: 3},
+	}}
+
+	resp, err := client.UpdateMetrics(context.Background(), req)
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 3)
+	assert.Equal(t, 1.5, resp.GetMetrics()[0].GetValue())
+	assert.Equal(t, int64(2), resp.GetMetrics()[1].GetDelta())
+	assert.Equal(t, int64(5), resp.GetMetrics()[2].GetDelta())
+
+	value, err := stor.Get(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "PollCount"})
+	require.NoError(t, err)
+	assert.Equal(t, float64(5), value)
+}
+
+func TestUpdateMetrics_InvalidType(t *testing.T) {
+	client, _ := startServer(t, "")
+
+	_, err := client.UpdateMetrics(context.Background(), &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_MTYPE_UNSPECIFIED, Value: 1},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestUpdateMetrics_Labels(t *testing.T) {
+	client, stor := startServer(t, "")
+
+	resp, err := client.UpdateMetrics(context.Background(), &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 1, Labels: map[string]string{"host": "h1"}},
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 2, Labels: map[string]string{"host": "h2"}},
+	}})
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 2)
+	assert.Equal(t, map[string]string{"host": "h2"}, resp.GetMetrics()[1].GetLabels())
+	assert.Equal(t, 2.0, resp.GetMetrics()[1].GetValue())
+
+	value, err := stor.Get(context.Background(), &storage.Metric{Type: storage.TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "h1"}})
+	require.NoError(t, err)
+	assert.Equal(t, 1.0, value)
+
+	_, err = client.UpdateMetrics(context.Background(), &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 1, Labels: map[string]string{"bad-name": "h1"}},
+	}})
+	assert.Equal(t, codes.InvalidArgument, status.Code(err))
+}
+
+func TestStreamMetrics(t *testing.T) {
+	client, stor := startServer(t, "")
+
+	stream, err := client.StreamMetrics(context.Background())
+	require.NoError(t, err)
+	for i := 0; i < 3; i++ {
+		require.NoError(t, stream.Send(&pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+			{Id: "PollCount", Type: pb.MType_COUNTER, Delta: 1},
+		}}))
+	}
+	resp, err := stream.CloseAndRecv()
+	require.NoError(t, err)
+	require.Len(t, resp.GetMetrics(), 3)
+
+	value, err := stor.Get(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "PollCount"})
+	require.NoError(t, err)
+	assert.Equal(t, float64(3), value)
+}
+
+// signedContext контекст вызова с подписью data ключом key, временем ts и новым nonce
+func signedContext(t *testing.T, data []byte, key, ts string) context.Context {
+	nonce, err := agents.NewNonce()
+	require.NoError(t, err)
+	return metadata.AppendToOutgoingContext(context.Background(),
+		HASHHEADER, ComputeHMAC(agents.Signed(data, ts, nonce), key),
+		TIMESTAMPHEADER, ts,
+		NONCEHEADER, nonce)
+}
+
+func TestPseudoAuth(t *testing.T) {
+	key := "secret"
+	client, stor := startServer(t, key)
+
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 7},
+	}}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	require.NoError(t, err)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+
+	t.Run("без подписи", func(t *testing.T) {
+		_, err := client.UpdateMetrics(context.Background(), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("неверная подпись", func(t *testing.T) {
+		_, err := client.UpdateMetrics(signedContext(t, data, "wrong", now), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("подпись без времени и nonce", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(context.Background(), HASHHEADER, ComputeHMAC(data, key))
+		_, err := client.UpdateMetrics(ctx, req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("верная подпись", func(t *testing.T) {
+		_, err := client.UpdateMetrics(signedContext(t, data, key, now), req)
+		require.NoError(t, err)
+	})
+
+	t.Run("повтор перехваченного вызова", func(t *testing.T) {
+		ctx := signedContext(t, data, key, now)
+		_, err := client.UpdateMetrics(ctx, req)
+		require.NoError(t, err)
+		_, err = client.UpdateMetrics(ctx, req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("время вне окна", func(t *testing.T) {
+		stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+		_, err := client.UpdateMetrics(signedContext(t, data, key, stale), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("поток с неверной подписью не применяется", func(t *testing.T) {
+		streamReq := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+			{Id: "StreamCount", Type: pb.MType_COUNTER, Delta: 1},
+		}}
+		stream, err := client.StreamMetrics(signedContext(t, data, key, now))
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(streamReq))
+		_, err = stream.CloseAndRecv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+
+		_, err = stor.Get(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "StreamCount"})
+		assert.ErrorIs(t, err, storage.ErrMetricNoData)
+	})
+
+	t.Run("поток с верной подписью", func(t *testing.T) {
+		streamReq := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+			{Id: "StreamCount", Type: pb.MType_COUNTER, Delta: 1},
+		}}
+		streamData, err := proto.MarshalOptions{Deterministic: true}.Marshal(streamReq)
+		require.NoError(t, err)
+		ctx := signedContext(t, append(streamData, streamData...), key, now)
+		send := func() error {
+			stream, err := client.StreamMetrics(ctx)
+			require.NoError(t, err)
+			require.NoError(t, stream.Send(streamReq))
+			require.NoError(t, stream.Send(streamReq))
+			_, err = stream.CloseAndRecv()
+			return err
+		}
+		require.NoError(t, send())
+		assert.Equal(t, codes.Unauthenticated, status.Code(send()), "повтор потока")
+
+		value, err := stor.Get(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "StreamCount"})
+		require.NoError(t, err)
+		assert.Equal(t, float64(2), value)
+	})
+}
+
+func TestAgentAuth(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 0))
+	keys, err := storage.New(0, "", false)
+	require.NoError(t, err)
+	reg, err := agents.NewRegistry(context.Background(), keys)
+	require.NoError(t, err)
+
+	shared := "secret"
+	client, _ := startServerWith(t, Options{Key: shared, Replay: agents.NewReplayGuard(time.Minute, 100), Registry: reg})
+
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 7},
+	}}
+	data, err := proto.MarshalOptions{Deterministic: true}.Marshal(req)
+	require.NoError(t, err)
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	// agentContext подписанный ключом key контекст вызова от агента agentID
+	agentContext := func(key, agentID string) context.Context {
+		return metadata.AppendToOutgoingContext(signedContext(t, data, key, now), AGENTIDHEADER, agentID)
+	}
+
+	t.Run("до регистрации агентов работает общий ключ", func(t *testing.T) {
+		_, err := client.UpdateMetrics(signedContext(t, data, shared, now), req)
+		require.NoError(t, err)
+	})
+
+	agent, err := reg.Add(context.Background(), "agent-1")
+	require.NoError(t, err)
+
+	t.Run("общий ключ отклоняется", func(t *testing.T) {
+		_, err := client.UpdateMetrics(signedContext(t, data, shared, now), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("неизвестный агент", func(t *testing.T) {
+		_, err := client.UpdateMetrics(agentContext(agent.Key, "agent-2"), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("чужой ключ", func(t *testing.T) {
+		_, err := client.UpdateMetrics(agentContext(shared, "agent-1"), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("неверная версия ключа", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(agentContext(agent.Key, "agent-1"), KEYVERSIONHEADER, "x")
+		_, err := client.UpdateMetrics(ctx, req)
+		assert.Equal(t, codes.InvalidArgument, status.Code(err))
+	})
+
+	t.Run("ключ агента", func(t *testing.T) {
+		ctx := metadata.AppendToOutgoingContext(agentContext(agent.Key, "agent-1"), KEYVERSIONHEADER, "1")
+		_, err := client.UpdateMetrics(ctx, req)
+		require.NoError(t, err)
+	})
+
+	t.Run("поток с ключом агента", func(t *testing.T) {
+		stream, err := client.StreamMetrics(agentContext(agent.Key, "agent-1"))
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(req))
+		_, err = stream.CloseAndRecv()
+		require.NoError(t, err)
+	})
+
+	t.Run("поток с общим ключом отклоняется", func(t *testing.T) {
+		stream, err := client.StreamMetrics(signedContext(t, data, shared, now))
+		require.NoError(t, err)
+		require.NoError(t, stream.Send(req))
+		_, err = stream.CloseAndRecv()
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("без ключа на сервере подпись всё равно обязательна", func(t *testing.T) {
+		open, _ := startServerWith(t, Options{Registry: reg})
+		_, err := open.UpdateMetrics(context.Background(), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err))
+	})
+
+	t.Run("общий ключ при SharedFallback", func(t *testing.T) {
+		fallback, _ := startServerWith(t, Options{Key: shared, Registry: reg, SharedFallback: true})
+		_, err := fallback.UpdateMetrics(signedContext(t, data, shared, now), req)
+		require.NoError(t, err)
+		_, err = fallback.UpdateMetrics(agentContext(shared, "agent-1"), req)
+		assert.Equal(t, codes.Unauthenticated, status.Code(err), "с x-agent-id проверяется ключ агента")
+	})
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	require.NoError(t, err)
+	client, _ := startServerWith(t, Options{Trusted: subnet})
+	req := &pb.UpdateMetricsRequest{Metrics: []*pb.Metric{
+		{Id: "Alloc", Type: pb.MType_GAUGE, Value: 7},
+	}}
+	call := func(ip string) codes.Code {
+		ctx := context.Background()
+		if ip != "" {
+			ctx = metadata.AppendToOutgoingContext(ctx, REALIPHEADER, ip)
+		}
+		_, err := client.UpdateMetrics(ctx, req)
+		return status.Code(err)
+	}
+
+	assert.Equal(t, codes.OK, call("192.168.1.10"))
+	assert.Equal(t, codes.PermissionDenied, call("10.0.0.1"), "чужая подсеть")
+	assert.Equal(t, codes.PermissionDenied, call("not-an-ip"))
+	assert.Equal(t, codes.PermissionDenied, call(""), "без адреса")
+
+	stream, err := client.StreamMetrics(metadata.AppendToOutgoingContext(context.Background(), REALIPHEADER, "10.0.0.1"))
+	require.NoError(t, err)
+	_, err = stream.CloseAndRecv()
+	assert.Equal(t, codes.PermissionDenied, status.Code(err), "поток из чужой подсети")
+}
+
+func TestCertAuth(t *testing.T) {
+	interceptor := UnaryCertAuth([]string{"agent-1", "CN=agent-2,O=Metrics"})
+	handler := func(ctx context.Context, req any) (any, error) { return nil, nil }
+	call := func(subject *pkix.Name) codes.Code {
+		ctx := context.Background()
+		if subject != nil {
+			ctx = peer.NewContext(ctx, &peer.Peer{AuthInfo: credentials.TLSInfo{State: tls.ConnectionState{
+				VerifiedChains: [][]*x509.Certificate{{{Subject: *subject}}},
+			}}})
+		}
+		_, err := interceptor(ctx, nil, &grpc.UnaryServerInfo{}, handler)
+		return status.Code(err)
+	}
+
+	assert.Equal(t, codes.OK, call(&pkix.Name{CommonName: "agent-1"}), "разрешённый CN")
+	assert.Equal(t, codes.OK, call(&pkix.Name{CommonName: "agent-2", Organization: []string{"Metrics"}}), "разрешённый DN")
+	assert.Equal(t, codes.PermissionDenied, call(&pkix.Name{CommonName: "agent-3"}))
+	assert.Equal(t, codes.Unauthenticated, call(nil), "без сертификата")
+
+	_, err := UnaryCertAuth(nil)(context.Background(), nil, &grpc.UnaryServerInfo{}, handler)
+	assert.NoError(t, err, "проверка выключена")
+}
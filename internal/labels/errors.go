@@ -0,0 +1,8 @@
+package labels
+
+import "errors"
+
+var (
+	ErrLabelName   = errors.New("invalid label name")
+	ErrLabelFormat = errors.New("invalid labels format")
+)
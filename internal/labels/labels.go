@@ -0,0 +1,152 @@
+// Модуль отвечает за метки (labels) метрик:
+// каноническое представление, ключи серий и фильтрацию
+package labels
+
+import (
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// Labels набор меток метрики ключ - значение
+type Labels map[string]string
+
+// String каноническое представление меток {k1="v1",k2="v2"}
+// ключи отсортированы, значения экранированы
+// для пустого набора возвращается пустая строка
+func (l Labels) String() string {
+	if len(l) == 0 {
+		return ""
+	}
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range l.Names() {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		sb.WriteString(k)
+		sb.WriteByte('=')
+		sb.WriteString(strconv.Quote(l[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// Names отсортированный список имён меток
+func (l Labels) Names() []string {
+	names := make([]string, 0, len(l))
+	for k := range l {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Match проверяет, что набор содержит все метки фильтра с теми же значениями
+// пустой фильтр подходит под любой набор
+func (l Labels) Match(filter Labels) bool {
+	for k, v := range filter {
+		if lv, ok := l[k]; !ok || lv != v {
+			return false
+		}
+	}
+	return true
+}
+
+// Validate проверяет имена меток
+// допустимы имена вида [a-zA-Z_][a-zA-Z0-9_]*
+func (l Labels) Validate() error {
+	for k := range l {
+		if !validName(k) {
+			return ErrLabelName
+		}
+	}
+	return nil
+}
+
+// Key ключ серии: имя метрики и каноническое представление меток
+// для метрики без меток ключ совпадает с именем
+func Key(name string, l Labels) string {
+	return name + l.String()
+}
+
+// ParseKey разбор ключа серии на имя и метки
+// если метки разобрать не удалось, весь ключ считается именем
+func ParseKey(key string) (string, Labels) {
+	idx := strings.IndexByte(key, '{')
+	if idx < 0 || !strings.HasSuffix(key, "}") {
+		return key, nil
+	}
+	l, err := parseCanonical(key[idx:])
+	if err != nil {
+		return key, nil
+	}
+	return key[:idx], l
+}
+
+// Parse разбор меток из строки вида k1=v1,k2=v2
+// используется для конфигурации и параметров запросов
+func Parse(source string) (Labels, error) {
+	if strings.TrimSpace(source) == "" {
+		return nil, nil
+	}
+	l := make(Labels)
+	for _, pair := range strings.Split(source, ",") {
+		k, v, ok := strings.Cut(pair, "=")
+		k = strings.TrimSpace(k)
+		if !ok || k == "" {
+			return nil, ErrLabelFormat
+		}
+		l[k] = strings.TrimSpace(v)
+	}
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// parseCanonical разбор канонического представления {k1="v1",k2="v2"}
+func parseCanonical(source string) (Labels, error) {
+	source = strings.TrimPrefix(source, "{")
+	source = strings.TrimSuffix(source, "}")
+	l := make(Labels)
+	for source != "" {
+		k, rest, ok := strings.Cut(source, "=")
+		if !ok || !validName(k) {
+			return nil, ErrLabelFormat
+		}
+		quoted, err := strconv.QuotedPrefix(rest)
+		if err != nil {
+			return nil, ErrLabelFormat
+		}
+		v, err := strconv.Unquote(quoted)
+		if err != nil {
+			return nil, ErrLabelFormat
+		}
+		l[k] = v
+		source = rest[len(quoted):]
+		if source != "" {
+			if source[0] != ',' {
+				return nil, ErrLabelFormat
+			}
+			source = source[1:]
+		}
+	}
+	return l, nil
+}
+
+// validName проверка имени метки
+func validName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, ch := range name {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch == '_':
+		case ch >= '0' && ch <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,69 @@
+package labels
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestLabels_String(t *testing.T) {
+	assert.Equal(t, "", Labels(nil).String())
+	assert.Equal(t, `{env="prod",host="a\"b"}`, Labels{"host": `a"b`, "env": "prod"}.String())
+}
+
+func TestKey(t *testing.T) {
+	assert.Equal(t, "Alloc", Key("Alloc", nil))
+	assert.Equal(t, `Alloc{host="h1"}`, Key("Alloc", Labels{"host": "h1"}))
+}
+
+func TestParseKey(t *testing.T) {
+	tests := []struct {
+		key        string
+		wantName   string
+		wantLabels Labels
+	}{
+		{"Alloc", "Alloc", nil},
+		{`Alloc{host="h1",env="a,b=\"c\""}`, "Alloc", Labels{"host": "h1", "env": `a,b="c"`}},
+		{"strange{name", "strange{name", nil},
+		{"strange{name}", "strange{name}", nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.key, func(t *testing.T) {
+			name, l := ParseKey(tt.key)
+			assert.Equal(t, tt.wantName, name)
+			assert.Equal(t, tt.wantLabels, l)
+		})
+	}
+
+	// ключ и разбор обратимы
+	orig := Labels{"agent": "1", "host": "x y"}
+	name, l := ParseKey(Key("PollCount", orig))
+	assert.Equal(t, "PollCount", name)
+	assert.Equal(t, orig, l)
+}
+
+func TestLabels_Match(t *testing.T) {
+	l := Labels{"host": "h1", "env": "prod"}
+	assert.True(t, l.Match(nil))
+	assert.True(t, l.Match(Labels{"host": "h1"}))
+	assert.False(t, l.Match(Labels{"host": "h2"}))
+	assert.False(t, l.Match(Labels{"dc": "x"}))
+	assert.False(t, Labels(nil).Match(Labels{"host": "h1"}))
+}
+
+func TestParse(t *testing.T) {
+	l, err := Parse("host=h1, env = prod")
+	require.NoError(t, err)
+	assert.Equal(t, Labels{"host": "h1", "env": "prod"}, l)
+
+	l, err = Parse("")
+	require.NoError(t, err)
+	assert.Nil(t, l)
+
+	_, err = Parse("novalue")
+	assert.ErrorIs(t, err, ErrLabelFormat)
+
+	_, err = Parse("1host=h1")
+	assert.ErrorIs(t, err, ErrLabelName)
+}
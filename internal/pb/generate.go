@@ -0,0 +1,5 @@
+// Модуль содержит сгенерированный код gRPC сервиса приёма метрик
+// исходник: api/proto/metrics.proto
+package pb
+
+//go:generate protoc --proto_path=../../api/proto --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative metrics.proto
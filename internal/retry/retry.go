@@ -0,0 +1,155 @@
+// Модуль общей политики повторных попыток для psql, fileio и webclient:
+// классификация временных ошибок, экспоненциальная задержка со случайным разбросом
+// и счётчики повторов по имени политики
+package retry
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math/rand/v2"
+	"net"
+	"syscall"
+	"time"
+)
+
+// Настройки политики по умолчанию
+const (
+	MAXATTEMPTS = 3                // максимальное количество попыток
+	BASEDELAY   = time.Second      // задержка перед первым повтором
+	MAXDELAY    = 10 * time.Second // предел задержки между попытками
+	MULTIPLIER  = 2.0              // во сколько раз растёт задержка с каждым повтором
+	JITTER      = 0.2              // доля случайного разброса задержки в обе стороны
+)
+
+// Policy политика повторных попыток
+// нулевые числовые поля заменяются значениями по умолчанию,
+// Retryable решает, стоит ли повторять после ошибки, nil - повторять временные ошибки сети
+type Policy struct {
+	Name        string // имя политики в счётчиках
+	MaxAttempts int
+	BaseDelay   time.Duration
+	MaxDelay    time.Duration
+	Multiplier  float64
+	Jitter      float64
+	Retryable   func(err error) bool
+}
+
+// New политика с настройками по умолчанию и классификацией ошибок retryable
+func New(name string, retryable func(err error) bool) *Policy {
+	return &Policy{
+		Name:        name,
+		MaxAttempts: MAXATTEMPTS,
+		BaseDelay:   BASEDELAY,
+		MaxDelay:    MAXDELAY,
+		Multiplier:  MULTIPLIER,
+		Jitter:      JITTER,
+		Retryable:   retryable,
+	}
+}
+
+// Do выполнение fn с повторами при временных ошибках
+// повторы прекращаются при отмене ctx, ожидание между попытками тоже прерывается,
+// в этом случае возвращаются и ошибка попытки, и ошибка контекста
+func (p *Policy) Do(ctx context.Context, fn func(ctx context.Context) error) error {
+	c := counters(p.Name)
+	c.calls.Add(1)
+
+	var err error
+	for attempt := 1; ; attempt++ {
+		err = fn(ctx)
+		if err == nil {
+			if attempt > 1 {
+				c.recovered.Add(1)
+			}
+			return nil
+		}
+		if ctx.Err() != nil || !p.retryable(err) {
+			c.permanent.Add(1)
+			return err
+		}
+		if attempt >= p.maxAttempts() {
+			c.exhausted.Add(1)
+			return err
+		}
+		c.retries.Add(1)
+		if sleepErr := Sleep(ctx, p.Delay(attempt)); sleepErr != nil {
+			c.permanent.Add(1)
+			return errors.Join(err, sleepErr)
+		}
+	}
+}
+
+// Delay задержка перед повтором номер attempt, начиная с 1
+// BaseDelay * Multiplier^(attempt-1), не больше MaxDelay, со случайным разбросом ±Jitter
+func (p *Policy) Delay(attempt int) time.Duration {
+	base, maxDelay, multiplier, jitter := p.BaseDelay, p.MaxDelay, p.Multiplier, p.Jitter
+	if base <= 0 {
+		base = BASEDELAY
+	}
+	if maxDelay <= 0 {
+		maxDelay = MAXDELAY
+	}
+	if multiplier < 1 {
+		multiplier = MULTIPLIER
+	}
+	delay := float64(base)
+	for i := 1; i < attempt && delay < float64(maxDelay); i++ {
+		delay *= multiplier
+	}
+	delay = min(delay, float64(maxDelay))
+	if jitter > 0 {
+		delay += delay * jitter * (2*rand.Float64() - 1)
+	}
+	return time.Duration(delay)
+}
+
+// maxAttempts количество попыток с учётом значения по умолчанию
+func (p *Policy) maxAttempts() int {
+	if p.MaxAttempts <= 0 {
+		return MAXATTEMPTS
+	}
+	return p.MaxAttempts
+}
+
+// retryable классификация ошибки политикой
+func (p *Policy) retryable(err error) bool {
+	if p.Retryable == nil {
+		return Transient(err)
+	}
+	return p.Retryable(err)
+}
+
+// Transient временная ошибка сети: обрыв или отказ в соединении, таймаут сети
+// отмена и истечение контекста временными не считаются - их решает вызывающий
+func Transient(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	if errors.Is(err, io.ErrUnexpectedEOF) ||
+		errors.Is(err, syscall.ECONNREFUSED) ||
+		errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.ECONNABORTED) ||
+		errors.Is(err, syscall.EPIPE) ||
+		errors.Is(err, net.ErrClosed) {
+		return true
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) && netErr.Timeout() {
+		return true
+	}
+	var opErr *net.OpError
+	return errors.As(err, &opErr)
+}
+
+// Sleep ожидание d, прерывается отменой ctx
+func Sleep(ctx context.Context, d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,128 @@
+package retry
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fastPolicy политика без заметного ожидания между попытками
+func fastPolicy(name string) *Policy {
+	return &Policy{Name: name, MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond}
+}
+
+func TestDo(t *testing.T) {
+	transientErr := &net.OpError{Op: "dial", Net: "tcp", Err: syscall.ECONNREFUSED}
+
+	t.Run("успех после повтора", func(t *testing.T) {
+		p := fastPolicy("test-recovered")
+		attempts := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			if attempts < 2 {
+				return transientErr
+			}
+			return nil
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, 2, attempts)
+		assert.Equal(t, Stats{Calls: 1, Retries: 1, Recovered: 1}, Snapshot()["test-recovered"])
+	})
+
+	t.Run("исчерпание попыток", func(t *testing.T) {
+		p := fastPolicy("test-exhausted")
+		attempts := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			return transientErr
+		})
+		assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Equal(t, 3, attempts)
+		assert.Equal(t, Stats{Calls: 1, Retries: 2, Exhausted: 1}, Snapshot()["test-exhausted"])
+	})
+
+	t.Run("постоянная ошибка не повторяется", func(t *testing.T) {
+		p := fastPolicy("test-permanent")
+		permanent := errors.New("bad request")
+		attempts := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			return permanent
+		})
+		assert.ErrorIs(t, err, permanent)
+		assert.Equal(t, 1, attempts)
+		assert.Equal(t, Stats{Calls: 1, Permanent: 1}, Snapshot()["test-permanent"])
+	})
+
+	t.Run("своя классификация", func(t *testing.T) {
+		p := fastPolicy("test-custom")
+		custom := errors.New("busy")
+		p.Retryable = func(err error) bool { return errors.Is(err, custom) }
+		attempts := 0
+		err := p.Do(context.Background(), func(ctx context.Context) error {
+			attempts++
+			return custom
+		})
+		assert.ErrorIs(t, err, custom)
+		assert.Equal(t, 3, attempts)
+	})
+
+	t.Run("отмена контекста прерывает ожидание", func(t *testing.T) {
+		p := &Policy{Name: "test-cancel", MaxAttempts: 3, BaseDelay: time.Hour}
+		ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+		defer cancel()
+		start := time.Now()
+		err := p.Do(ctx, func(ctx context.Context) error {
+			return transientErr
+		})
+		assert.ErrorIs(t, err, context.DeadlineExceeded)
+		assert.ErrorIs(t, err, syscall.ECONNREFUSED)
+		assert.Less(t, time.Since(start), time.Second)
+	})
+}
+
+func TestDelay(t *testing.T) {
+	p := &Policy{BaseDelay: time.Second, MaxDelay: 5 * time.Second, Multiplier: 2}
+	assert.Equal(t, time.Second, p.Delay(1))
+	assert.Equal(t, 2*time.Second, p.Delay(2))
+	assert.Equal(t, 4*time.Second, p.Delay(3))
+	assert.Equal(t, 5*time.Second, p.Delay(4), "задержка ограничена MaxDelay")
+	assert.Equal(t, 5*time.Second, p.Delay(100))
+
+	p.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		d := p.Delay(2)
+		assert.GreaterOrEqual(t, d, time.Second)
+		assert.LessOrEqual(t, d, 3*time.Second)
+	}
+}
+
+func TestTransient(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"отказ в соединении", fmt.Errorf("send: %w", syscall.ECONNREFUSED), true},
+		{"сброс соединения", syscall.ECONNRESET, true},
+		{"обрыв чтения", io.ErrUnexpectedEOF, true},
+		{"сетевая ошибка", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("broken")}, true},
+		{"таймаут сети", &net.DNSError{IsTimeout: true}, true},
+		{"отмена контекста", context.Canceled, false},
+		{"истечение контекста", context.DeadlineExceeded, false},
+		{"прочая ошибка", errors.New("bad request"), false},
+		{"nil", nil, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			assert.Equal(t, tt.want, Transient(tt.err))
+		})
+	}
+}
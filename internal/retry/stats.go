@@ -0,0 +1,61 @@
+package retry
+
+import (
+	"sync"
+	"sync/atomic"
+)
+
+// Stats счётчики одной политики
+// Calls - вызовы Do, Retries - повторные попытки,
+// Recovered - успех после повторов, Exhausted - все попытки исчерпаны на временной ошибке,
+// Permanent - постоянная ошибка или отмена контекста
+type Stats struct {
+	Calls     int64 `json:"calls"`
+	Retries   int64 `json:"retries"`
+	Recovered int64 `json:"recovered"`
+	Exhausted int64 `json:"exhausted"`
+	Permanent int64 `json:"permanent"`
+}
+
+// policyCounters счётчики политики, обновляются без блокировок
+type policyCounters struct {
+	calls     atomic.Int64
+	retries   atomic.Int64
+	recovered atomic.Int64
+	exhausted atomic.Int64
+	permanent atomic.Int64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   = make(map[string]*policyCounters)
+)
+
+// counters счётчики политики name, создаются при первом обращении
+func counters(name string) *policyCounters {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	c, ok := registry[name]
+	if !ok {
+		c = &policyCounters{}
+		registry[name] = c
+	}
+	return c
+}
+
+// Snapshot текущие значения счётчиков всех политик по имени
+func Snapshot() map[string]Stats {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	stats := make(map[string]Stats, len(registry))
+	for name, c := range registry {
+		stats[name] = Stats{
+			Calls:     c.calls.Load(),
+			Retries:   c.retries.Load(),
+			Recovered: c.recovered.Load(),
+			Exhausted: c.exhausted.Load(),
+			Permanent: c.permanent.Load(),
+		}
+	}
+	return stats
+}
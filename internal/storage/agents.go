@@ -0,0 +1,330 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sort"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	bolt "go.etcd.io/bbolt"
+)
+
+// AGENTSFILENAME файл ключей агентов в директории бэкапа хранилища file
+const AGENTSFILENAME = "agents.json"
+
+// AgentKey версия ключа агента для подписи запросов
+// ExpiresAt - время, после которого версия перестаёт приниматься, nil - бессрочно
+type AgentKey struct {
+	AgentID   string     `json:"agent_id"`
+	Version   int        `json:"version"`
+	Key       string     `json:"key"`
+	CreatedAt time.Time  `json:"created_at"`
+	ExpiresAt *time.Time `json:"expires_at,omitempty"`
+}
+
+// KeyStore хранилище ключей агентов рядом с метриками
+// реализуется всеми встроенными хранилищами, для memory ключи живут до перезапуска
+type KeyStore interface {
+	// AgentKeys все версии ключей всех агентов, по id агента и версии
+	AgentKeys(ctx context.Context) ([]AgentKey, error)
+	// SaveAgentKey добавление версии ключа или замена версии с тем же номером
+	SaveAgentKey(ctx context.Context, key AgentKey) error
+	// DeleteAgentKeys удаление версии version ключа агента, 0 - всех версий
+	DeleteAgentKeys(ctx context.Context, agentID string, version int) error
+	// ReplaceAgentKeys замена всех версий ключа агента на keys одной записью:
+	// либо записываются все изменения, либо ни одного
+	ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error
+}
+
+// sortAgentKeys упорядочивание ключей по id агента и версии
+func sortAgentKeys(keys []AgentKey) {
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].AgentID != keys[j].AgentID {
+			return keys[i].AgentID < keys[j].AgentID
+		}
+		return keys[i].Version < keys[j].Version
+	})
+}
+
+// openAgents чтение ключей агентов из файла path, отсутствующий файл - ключей нет
+// дальше каждое изменение ключей перезаписывает файл
+func (ms *MemStorage) openAgents(path string) error {
+	ms.agentsPath = path
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("fail while read agents file: %w", err)
+	}
+	err = json.Unmarshal(data, &ms.agentKeys)
+	if err != nil {
+		return fmt.Errorf("fail while decode agents file: %w", err)
+	}
+	return nil
+}
+
+// AgentKeys все версии ключей всех агентов
+func (ms *MemStorage) AgentKeys(_ context.Context) ([]AgentKey, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return append([]AgentKey(nil), ms.agentKeys...), nil
+}
+
+// SaveAgentKey добавление или замена версии ключа агента
+func (ms *MemStorage) SaveAgentKey(_ context.Context, key AgentKey) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keys := make([]AgentKey, 0, len(ms.agentKeys)+1)
+	for _, k := range ms.agentKeys {
+		if k.AgentID != key.AgentID || k.Version != key.Version {
+			keys = append(keys, k)
+		}
+	}
+	keys = append(keys, key)
+	sortAgentKeys(keys)
+	return ms.setAgentKeys(keys)
+}
+
+// DeleteAgentKeys удаление версии ключа агента, 0 - всех версий
+func (ms *MemStorage) DeleteAgentKeys(_ context.Context, agentID string, version int) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keys := make([]AgentKey, 0, len(ms.agentKeys))
+	for _, k := range ms.agentKeys {
+		if k.AgentID != agentID || (version != 0 && k.Version != version) {
+			keys = append(keys, k)
+		}
+	}
+	return ms.setAgentKeys(keys)
+}
+
+// ReplaceAgentKeys замена всех версий ключа агента
+func (ms *MemStorage) ReplaceAgentKeys(_ context.Context, agentID string, replace []AgentKey) error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	keys := make([]AgentKey, 0, len(ms.agentKeys)+len(replace))
+	for _, k := range ms.agentKeys {
+		if k.AgentID != agentID {
+			keys = append(keys, k)
+		}
+	}
+	keys = append(keys, replace...)
+	sortAgentKeys(keys)
+	return ms.setAgentKeys(keys)
+}
+
+// setAgentKeys замена ключей и запись их в файл, если он задан
+// файл пишется во временный и переименовывается, при ошибке ключи в памяти не меняются
+func (ms *MemStorage) setAgentKeys(keys []AgentKey) error {
+	if ms.agentsPath != "" {
+		data, err := json.Marshal(keys)
+		if err != nil {
+			return err
+		}
+		tmp := ms.agentsPath + ".tmp"
+		err = os.WriteFile(tmp, data, 0o600)
+		if err != nil {
+			return fmt.Errorf("fail while write agents file: %w", err)
+		}
+		err = os.Rename(tmp, ms.agentsPath)
+		if err != nil {
+			os.Remove(tmp)
+			return fmt.Errorf("fail while write agents file: %w", err)
+		}
+	}
+	ms.agentKeys = keys
+	return nil
+}
+
+// AgentKeys все версии ключей всех агентов из бакета agents
+func (bs *BoltStorage) AgentKeys(_ context.Context) ([]AgentKey, error) {
+	var keys []AgentKey
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAgents).ForEach(func(_, v []byte) error {
+			var key AgentKey
+			if err := json.Unmarshal(v, &key); err != nil {
+				return err
+			}
+			keys = append(keys, key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail while read agent keys from bolt: %w", err)
+	}
+	return keys, nil
+}
+
+// SaveAgentKey добавление или замена версии ключа агента
+func (bs *BoltStorage) SaveAgentKey(_ context.Context, key AgentKey) error {
+	data, err := json.Marshal(key)
+	if err != nil {
+		return err
+	}
+	err = bs.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketAgents).Put(agentKeyID(key.AgentID, key.Version), data)
+	})
+	if err != nil {
+		return fmt.Errorf("fail while save agent key to bolt: %w", err)
+	}
+	return nil
+}
+
+// DeleteAgentKeys удаление версии ключа агента, 0 - всех версий
+func (bs *BoltStorage) DeleteAgentKeys(_ context.Context, agentID string, version int) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAgents)
+		if version != 0 {
+			return bucket.Delete(agentKeyID(agentID, version))
+		}
+		return deleteAgentVersions(bucket, agentID)
+	})
+	if err != nil {
+		return fmt.Errorf("fail while delete agent keys from bolt: %w", err)
+	}
+	return nil
+}
+
+// ReplaceAgentKeys замена всех версий ключа агента в одной транзакции
+func (bs *BoltStorage) ReplaceAgentKeys(_ context.Context, agentID string, keys []AgentKey) error {
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketAgents)
+		if err := deleteAgentVersions(bucket, agentID); err != nil {
+			return err
+		}
+		for _, key := range keys {
+			data, err := json.Marshal(key)
+			if err != nil {
+				return err
+			}
+			if err := bucket.Put(agentKeyID(agentID, key.Version), data); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("fail while replace agent keys in bolt: %w", err)
+	}
+	return nil
+}
+
+// deleteAgentVersions удаление всех версий ключа агента из бакета agents
+func deleteAgentVersions(bucket *bolt.Bucket, agentID string) error {
+	prefix := append([]byte(agentID), 0)
+	var ids [][]byte
+	c := bucket.Cursor()
+	for k, _ := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		ids = append(ids, k)
+	}
+	for _, k := range ids {
+		if err := bucket.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// agentKeyID ключ версии ключа агента в бакете agents: id, нулевой байт и версия,
+// так что версии одного агента лежат подряд по возрастанию
+func agentKeyID(agentID string, version int) []byte {
+	return append(append([]byte(agentID), 0), encodeUint(uint64(version))...)
+}
+
+// AgentKeys все версии ключей всех агентов из основной базы
+func (ds *DBStorage) AgentKeys(ctx context.Context) ([]AgentKey, error) {
+	rows, err := ds.DB.AgentKeys(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail while read agent keys from db: %w", err)
+	}
+	keys := make([]AgentKey, 0, len(rows))
+	for _, row := range rows {
+		keys = append(keys, AgentKey(row))
+	}
+	return keys, nil
+}
+
+// SaveAgentKey добавление или замена версии ключа агента
+func (ds *DBStorage) SaveAgentKey(ctx context.Context, key AgentKey) error {
+	err := ds.DB.SaveAgentKey(ctx, psql.AgentKey(key))
+	if err != nil {
+		return fmt.Errorf("fail while save agent key to db: %w", err)
+	}
+	return nil
+}
+
+// DeleteAgentKeys удаление версии ключа агента, 0 - всех версий
+func (ds *DBStorage) DeleteAgentKeys(ctx context.Context, agentID string, version int) error {
+	err := ds.DB.DeleteAgentKeys(ctx, agentID, version)
+	if err != nil {
+		return fmt.Errorf("fail while delete agent keys from db: %w", err)
+	}
+	return nil
+}
+
+// ReplaceAgentKeys замена всех версий ключа агента в основной базе
+func (ds *DBStorage) ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error {
+	rows := make([]psql.AgentKey, 0, len(keys))
+	for _, key := range keys {
+		rows = append(rows, psql.AgentKey(key))
+	}
+	err := ds.DB.ReplaceAgentKeys(ctx, agentID, rows)
+	if err != nil {
+		return fmt.Errorf("fail while replace agent keys in db: %w", err)
+	}
+	return nil
+}
+
+// AgentKeys ключи агентов из основного хранилища
+func (d *DualStorage) AgentKeys(ctx context.Context) ([]AgentKey, error) {
+	keys, ok := d.Primary.(KeyStore)
+	if !ok {
+		return nil, nil
+	}
+	return keys.AgentKeys(ctx)
+}
+
+// SaveAgentKey сохранение версии ключа агента в оба хранилища
+func (d *DualStorage) SaveAgentKey(ctx context.Context, key AgentKey) error {
+	if keys, ok := d.Primary.(KeyStore); ok {
+		if err := keys.SaveAgentKey(ctx, key); err != nil {
+			return err
+		}
+	}
+	if keys, ok := d.Secondary.(KeyStore); ok {
+		d.secondaryError("save agent key", keys.SaveAgentKey(ctx, key))
+	}
+	return nil
+}
+
+// DeleteAgentKeys удаление ключей агента из обоих хранилищ
+func (d *DualStorage) DeleteAgentKeys(ctx context.Context, agentID string, version int) error {
+	if keys, ok := d.Primary.(KeyStore); ok {
+		if err := keys.DeleteAgentKeys(ctx, agentID, version); err != nil {
+			return err
+		}
+	}
+	if keys, ok := d.Secondary.(KeyStore); ok {
+		d.secondaryError("delete agent keys", keys.DeleteAgentKeys(ctx, agentID, version))
+	}
+	return nil
+}
+
+// ReplaceAgentKeys замена версий ключа агента в обоих хранилищах
+func (d *DualStorage) ReplaceAgentKeys(ctx context.Context, agentID string, keys []AgentKey) error {
+	if store, ok := d.Primary.(KeyStore); ok {
+		if err := store.ReplaceAgentKeys(ctx, agentID, keys); err != nil {
+			return err
+		}
+	}
+	if store, ok := d.Secondary.(KeyStore); ok {
+		d.secondaryError("replace agent keys", store.ReplaceAgentKeys(ctx, agentID, keys))
+	}
+	return nil
+}
@@ -0,0 +1,142 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Названия встроенных хранилищ
+const (
+	BACKENDMEMORY   = "memory"   // только оперативная память
+	BACKENDFILE     = "file"     // оперативная память с бэкапом в файл
+	BACKENDBOLT     = "bolt"     // встроенное key-value хранилище на диске (bbolt)
+	BACKENDPOSTGRES = "postgres" // база данных postgres
+	BACKENDDUAL     = "dual"     // переходный режим: запись в файл и в postgres, чтение из основного
+)
+
+// Backend интерфейс хранилища метрик
+// реализации регистрируются через Register и выбираются по имени в Open
+// ctx ограничивает время обращения к хранилищу, обычно это контекст запроса
+type Backend interface {
+	// Push сохраняет значение метрики
+	Push(ctx context.Context, metric *Metric) error
+	// PushBatch сохраняет пачку метрик и возвращает их обновлённые значения
+	PushBatch(ctx context.Context, items []Metric) ([]Metric, error)
+	// Get значение метрики, метки работают как фильтр серий
+	Get(ctx context.Context, metric *Metric) (float64, error)
+	// List отформатированный перечень хранимых метрик
+	List(ctx context.Context) ([]string, error)
+	// Snapshot текущие значения всех серий, для counter - накопленная сумма
+	Snapshot(ctx context.Context) (gauges map[string]float64, counters map[string]float64, err error)
+	// History история значений метрики за период
+	History(ctx context.Context, metric *Metric, from, to time.Time, step time.Duration) ([]Sample, error)
+	// Compact сворачивает старые приращения counter
+	Compact(ctx context.Context, keep int) error
+	// Ping проверка доступности хранилища
+	Ping(ctx context.Context) error
+	// Close освобождение ресурсов хранилища
+	Close() error
+}
+
+// DBStatser хранилище поверх пула подключений к базе данных
+// реализуется хранилищами, которым есть что сказать о пуле, см. DBStorage
+type DBStatser interface {
+	DBStats() sql.DBStats
+}
+
+// Options настройки для создания хранилища
+// каждая реализация использует только нужные ей поля
+type Options struct {
+	StoreInterval    int           // интервал бэкапа в секундах, 0 - бэкап при каждой записи
+	FilePath         string        // директория файла бэкапа
+	Restore          bool          // восстановление из бэкапа при старте
+	WAL              bool          // журнал упреждающей записи рядом с файлом бэкапа
+	WALSync          string        // политика сброса журнала на диск: always, batch, interval
+	WALSyncInterval  time.Duration // период сброса журнала для политики interval
+	BackupKeep       int           // сколько снимков бэкапа хранить, включая текущий, 0 - по умолчанию
+	DSN              string        // строка подключения к базе данных
+	ReplicaDSN       string        // строка подключения к реплике для чтения, пусто - без реплики
+	ReplicaMaxLag    time.Duration // допустимое отставание реплики, 0 - по умолчанию
+	DualPrimary      string        // основное хранилище режима dual: file или postgres, пусто - file
+	QueryTimeout     time.Duration // ограничение времени одного запроса к базе данных, 0 - по умолчанию
+	MaxOpenConns     int           // максимум открытых подключений к базе данных, 0 - без ограничения
+	MaxIdleConns     int           // максимум простаивающих подключений к базе данных, 0 - по умолчанию
+	ConnMaxLifetime  time.Duration // время жизни подключения к базе данных, 0 - без ограничения
+	StatementTimeout time.Duration // statement_timeout на стороне базы данных, 0 - без ограничения
+	BoltPath         string        // директория базы встроенного хранилища bolt
+	HistoryRetention time.Duration // время хранения истории, 0 - по умолчанию
+}
+
+// Factory создаёт хранилище по настройкам
+type Factory func(opts Options) (Backend, error)
+
+var (
+	registryMu sync.RWMutex
+	registry   = make(map[string]Factory)
+)
+
+// Register регистрирует реализацию хранилища под именем name
+// повторная регистрация имени - ошибка программиста, поэтому паника
+func Register(name string, factory Factory) {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if factory == nil {
+		panic("storage: register factory is nil")
+	}
+	if _, dup := registry[name]; dup {
+		panic("storage: register called twice for backend " + name)
+	}
+	registry[name] = factory
+}
+
+// Open создаёт хранилище, зарегистрированное под именем name
+func Open(name string, opts Options) (Backend, error) {
+	registryMu.RLock()
+	factory, ok := registry[name]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("%w: %q", ErrBackendUnknown, name)
+	}
+	return factory(opts)
+}
+
+// Backends отсортированный список имён зарегистрированных хранилищ
+func Backends() []string {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validatePush общая проверка метрики перед записью
+func validatePush(metric *Metric) error {
+	if metric == nil {
+		return ErrMetricEmpty
+	}
+	if err := metric.Labels.Validate(); err != nil {
+		return fmt.Errorf("fail while validate labels: %w", err)
+	}
+	if metric.Type != TYPEGAUGE && metric.Type != TYPECOUNTER {
+		return ErrMetricTypeUnknown
+	}
+	return nil
+}
+
+// validateGet общая проверка метрики перед чтением
+func validateGet(metric *Metric) error {
+	if metric == nil {
+		return ErrMetricEmpty
+	}
+	if metric.Type != TYPEGAUGE && metric.Type != TYPECOUNTER {
+		return ErrMetricTypeUnknown
+	}
+	return nil
+}
@@ -0,0 +1,501 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	bolt "go.etcd.io/bbolt"
+)
+
+// Настройки хранилища bolt
+const (
+	BOLTFILENAME = "metrics.db" // название файла базы в директории Options.BoltPath
+	BOLTTIMEOUT  = time.Second  // ожидание блокировки файла другим процессом
+)
+
+// Бакеты хранилища bolt
+// в бакетах counter и history_* на каждую серию заводится вложенный бакет
+var (
+	bucketGauge          = []byte("gauge")           // ключ серии -> значение
+	bucketCounter        = []byte("counter")         // ключ серии -> {порядковый номер -> приращение}
+	bucketCounterBase    = []byte("counter_base")    // ключ серии -> сумма свёрнутых приращений
+	bucketHistoryGauge   = []byte("history_gauge")   // ключ серии -> {время+номер -> значение}
+	bucketHistoryCounter = []byte("history_counter") // ключ серии -> {время+номер -> приращение}
+	bucketAgents         = []byte("agents")          // id агента+версия -> ключ агента в JSON
+)
+
+func init() {
+	Register(BACKENDBOLT, openBolt)
+}
+
+// BoltStorage хранилище метрик во встроенной key-value базе bbolt, реализует Backend под именем bolt
+// каждая запись сохраняется на диск своей транзакцией, перезапись всех данных не нужна
+type BoltStorage struct {
+	db               *bolt.DB
+	historyRetention time.Duration
+	lastTrim         time.Time
+	clock            func() time.Time
+	mu               sync.Mutex
+}
+
+// openBolt создание хранилища bolt в директории Options.BoltPath
+func openBolt(opts Options) (Backend, error) {
+	if opts.BoltPath == "" {
+		return nil, fmt.Errorf("%w: empty bolt path", ErrBackendOptions)
+	}
+	storage, err := NewBolt(opts.BoltPath)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HistoryRetention > 0 {
+		storage.SetHistoryRetention(opts.HistoryRetention)
+	}
+	return storage, nil
+}
+
+// NewBolt открывает или создаёт базу bbolt в директории path
+func NewBolt(path string) (*BoltStorage, error) {
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, fmt.Errorf("fail while create bolt directory: %w", err)
+	}
+	db, err := bolt.Open(filepath.Join(path, BOLTFILENAME), 0600, &bolt.Options{Timeout: BOLTTIMEOUT})
+	if err != nil {
+		return nil, fmt.Errorf("fail while open bolt db: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{bucketGauge, bucketCounter, bucketCounterBase, bucketHistoryGauge, bucketHistoryCounter, bucketAgents} {
+			if _, err := tx.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("fail while create bolt buckets: %w", err)
+	}
+	return &BoltStorage{
+		db:               db,
+		historyRetention: HISTORYRETENTION,
+	}, nil
+}
+
+// Push отправляет метрики на хранение
+// каждое значение также сохраняется в историю с отметкой времени сервера
+func (bs *BoltStorage) Push(_ context.Context, metric *Metric) error {
+	if err := validatePush(metric); err != nil {
+		return err
+	}
+	now, before, trim := bs.pushTime()
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		if err := boltPush(tx, metric, now); err != nil {
+			return err
+		}
+		if trim {
+			return boltTrimHistory(tx, before)
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("fail while push to bolt: %w", err)
+	}
+	return nil
+}
+
+// PushBatch сохраняет пачку метрик одной транзакцией и возвращает их обновлённые значения
+// при ошибке не сохраняется ни одна метрика пачки
+func (bs *BoltStorage) PushBatch(_ context.Context, items []Metric) ([]Metric, error) {
+	for i := range items {
+		if err := validatePush(&items[i]); err != nil {
+			return nil, err
+		}
+	}
+	now, before, trim := bs.pushTime()
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		for i := range items {
+			if err := boltPush(tx, &items[i], now); err != nil {
+				return err
+			}
+			renewValue, err := resolve(&items[i], boltSelect(tx, &items[i]))
+			if err != nil {
+				return fmt.Errorf("fail while control renew data: %w", err)
+			}
+			items[i].Value = renewValue
+		}
+		if trim {
+			return boltTrimHistory(tx, before)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail while push batch to bolt: %w", err)
+	}
+	return items, nil
+}
+
+// Get получение значения конкретной метрики
+// метки работают как фильтр так же, как в MemStorage.Get
+func (bs *BoltStorage) Get(_ context.Context, metric *Metric) (float64, error) {
+	if err := validateGet(metric); err != nil {
+		return 0, err
+	}
+	var value float64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		var err error
+		value, err = resolve(metric, boltSelect(tx, metric))
+		return err
+	})
+	return value, err
+}
+
+// List предоставляет весь список хранимых метрик в формате ряда отформатированных записей
+func (bs *BoltStorage) List(_ context.Context) ([]string, error) {
+	var list []string
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		list = formatList(boltGauges(tx), boltCounters(tx))
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail while get list of metrics from bolt: %w", err)
+	}
+	return list, nil
+}
+
+// Snapshot предоставляет текущие значения всех хранимых метрик
+// для counter возвращается накопленная сумма
+func (bs *BoltStorage) Snapshot(_ context.Context) (gauges map[string]float64, counters map[string]float64, err error) {
+	err = bs.db.View(func(tx *bolt.Tx) error {
+		gauges, counters, err = snapshot(boltGauges(tx), boltCounters(tx))
+		return err
+	})
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail while get list of metrics from bolt: %w", err)
+	}
+	return gauges, counters, nil
+}
+
+// History получение истории значений метрики за период [from, to]
+// параметры те же, что у MemStorage.History
+func (bs *BoltStorage) History(ctx context.Context, metric *Metric, from, to time.Time, step time.Duration) ([]Sample, error) {
+	bs.mu.Lock()
+	now := bs.now()
+	retention := bs.historyRetention
+	bs.mu.Unlock()
+	return history(ctx, metric, from, to, step, now, retention, bs.historyBolt)
+}
+
+// Aggregate вычисление агрегата по истории значений, см. Query
+func (bs *BoltStorage) Aggregate(_ context.Context, q *Query) (float64, error) {
+	if err := validateQuery(q); err != nil {
+		return 0, err
+	}
+	bs.mu.Lock()
+	now := bs.now()
+	bs.mu.Unlock()
+	from := now.Add(-q.Range)
+
+	var values []float64
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		history := tx.Bucket(historyBucket(q.Metric.Type))
+		for key := range boltSelect(tx, &q.Metric) {
+			b := history.Bucket([]byte(key))
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, v := c.Seek(historyKey(from, 0)); k != nil && !historyTime(k).After(now); k, v = c.Next() {
+				values = append(values, decodeFloat(v))
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("fail while aggregate history in bolt: %w", err)
+	}
+	return evaluate(q, values)
+}
+
+// SetHistoryRetention задаёт время хранения истории значений метрик
+func (bs *BoltStorage) SetHistoryRetention(retention time.Duration) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	bs.historyRetention = retention
+}
+
+// Compact сворачивает старые приращения counter в накопленную сумму
+// в каждой серии остаётся не больше keep последних приращений
+func (bs *BoltStorage) Compact(_ context.Context, keep int) error {
+	if keep < 0 {
+		keep = 0
+	}
+	err := bs.db.Update(func(tx *bolt.Tx) error {
+		counters := tx.Bucket(bucketCounter)
+		base := tx.Bucket(bucketCounterBase)
+		return counters.ForEachBucket(func(key []byte) error {
+			series := counters.Bucket(key)
+			fold := series.Stats().KeyN - keep
+			if fold <= 0 {
+				return nil
+			}
+			var folded float64
+			keys := make([][]byte, 0, fold)
+			c := series.Cursor()
+			for k, v := c.First(); k != nil && len(keys) < fold; k, v = c.Next() {
+				folded += decodeFloat(v)
+				keys = append(keys, k)
+			}
+			for _, k := range keys {
+				if err := series.Delete(k); err != nil {
+					return err
+				}
+			}
+			return base.Put(key, encodeFloat(decodeFloat(base.Get(key))+folded))
+		})
+	})
+	if err != nil {
+		return fmt.Errorf("fail while compact counters in bolt: %w", err)
+	}
+	return nil
+}
+
+// Ping проверка, что база открыта
+func (bs *BoltStorage) Ping(_ context.Context) error {
+	return bs.db.View(func(*bolt.Tx) error { return nil })
+}
+
+// Close закрытие базы
+func (bs *BoltStorage) Close() error {
+	return bs.db.Close()
+}
+
+// pushTime время записи и необходимость очистки истории
+// история чистится не чаще HISTORYTRIMINTERVAL
+func (bs *BoltStorage) pushTime() (now time.Time, before time.Time, trim bool) {
+	bs.mu.Lock()
+	defer bs.mu.Unlock()
+	now = bs.now()
+	trim = now.Sub(bs.lastTrim) >= HISTORYTRIMINTERVAL
+	if trim {
+		bs.lastTrim = now
+	}
+	return now, now.Add(-bs.historyRetention), trim
+}
+
+// historyBolt текущее значение метрики и её история из базы начиная с from
+func (bs *BoltStorage) historyBolt(_ context.Context, metric *Metric, from time.Time) (float64, []Sample, error) {
+	var current float64
+	var samples []Sample
+	err := bs.db.View(func(tx *bolt.Tx) error {
+		series := narrow(metric, boltSelect(tx, metric))
+		var err error
+		current, err = resolve(metric, series)
+		if err != nil {
+			return err
+		}
+		history := tx.Bucket(historyBucket(metric.Type))
+		for key := range series {
+			b := history.Bucket([]byte(key))
+			if b == nil {
+				continue
+			}
+			c := b.Cursor()
+			for k, v := c.Seek(historyKey(from, 0)); k != nil; k, v = c.Next() {
+				samples = append(samples, Sample{Time: historyTime(k), Value: decodeFloat(v)})
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, nil, err
+	}
+	return current, samples, nil
+}
+
+// now текущее время сервера
+func (bs *BoltStorage) now() time.Time {
+	if bs.clock != nil {
+		return bs.clock()
+	}
+	return time.Now()
+}
+
+// boltPush запись значения метрики и его истории в транзакции
+func boltPush(tx *bolt.Tx, metric *Metric, now time.Time) error {
+	key := []byte(metric.Key())
+	switch metric.Type {
+	case TYPEGAUGE:
+		if err := tx.Bucket(bucketGauge).Put(key, encodeFloat(metric.Value)); err != nil {
+			return err
+		}
+	case TYPECOUNTER:
+		series, err := tx.Bucket(bucketCounter).CreateBucketIfNotExists(key)
+		if err != nil {
+			return err
+		}
+		seq, err := series.NextSequence()
+		if err != nil {
+			return err
+		}
+		if err = series.Put(encodeUint(seq), encodeFloat(metric.Value)); err != nil {
+			return err
+		}
+	}
+
+	history, err := tx.Bucket(historyBucket(metric.Type)).CreateBucketIfNotExists(key)
+	if err != nil {
+		return err
+	}
+	seq, err := history.NextSequence()
+	if err != nil {
+		return err
+	}
+	return history.Put(historyKey(now, seq), encodeFloat(metric.Value))
+}
+
+// boltSelect отбор серий метрики, подходящих под метки
+// как и в памяти, при наличии серии с точно такими метками берётся только она
+func boltSelect(tx *bolt.Tx, metric *Metric) map[string][]float64 {
+	series := make(map[string][]float64)
+	key := metric.Key()
+	switch metric.Type {
+	case TYPEGAUGE:
+		gauges := tx.Bucket(bucketGauge)
+		if v := gauges.Get([]byte(key)); v != nil {
+			series[key] = []float64{decodeFloat(v)}
+			return series
+		}
+		gauges.ForEach(func(k, v []byte) error {
+			if name, l := labels.ParseKey(string(k)); name == metric.Name && l.Match(metric.Labels) {
+				series[string(k)] = []float64{decodeFloat(v)}
+			}
+			return nil
+		})
+	case TYPECOUNTER:
+		if values, ok := boltCounterValues(tx, []byte(key)); ok {
+			series[key] = values
+			return series
+		}
+		tx.Bucket(bucketCounter).ForEachBucket(func(k []byte) error {
+			if name, l := labels.ParseKey(string(k)); name == metric.Name && l.Match(metric.Labels) {
+				series[string(k)], _ = boltCounterValues(tx, k)
+			}
+			return nil
+		})
+	}
+	return series
+}
+
+// boltCounterValues приращения серии counter вместе с суммой свёрнутых приращений
+func boltCounterValues(tx *bolt.Tx, key []byte) ([]float64, bool) {
+	series := tx.Bucket(bucketCounter).Bucket(key)
+	if series == nil {
+		return nil, false
+	}
+	var values []float64
+	if base := tx.Bucket(bucketCounterBase).Get(key); base != nil {
+		values = append(values, decodeFloat(base))
+	}
+	series.ForEach(func(_, v []byte) error {
+		values = append(values, decodeFloat(v))
+		return nil
+	})
+	return values, true
+}
+
+// boltGauges все серии gauge
+func boltGauges(tx *bolt.Tx) map[string]float64 {
+	gauges := make(map[string]float64)
+	tx.Bucket(bucketGauge).ForEach(func(k, v []byte) error {
+		gauges[string(k)] = decodeFloat(v)
+		return nil
+	})
+	return gauges
+}
+
+// boltCounters все серии counter вместе с накопленными суммами
+func boltCounters(tx *bolt.Tx) map[string][]float64 {
+	counters := make(map[string][]float64)
+	tx.Bucket(bucketCounter).ForEachBucket(func(k []byte) error {
+		counters[string(k)], _ = boltCounterValues(tx, k)
+		return nil
+	})
+	return counters
+}
+
+// boltTrimHistory удаление значений истории старше before
+// касается только бакетов истории, ключи агентов по времени не удаляются
+func boltTrimHistory(tx *bolt.Tx, before time.Time) error {
+	limit := historyKey(before, 0)
+	for _, name := range [][]byte{bucketHistoryGauge, bucketHistoryCounter} {
+		history := tx.Bucket(name)
+		err := history.ForEachBucket(func(key []byte) error {
+			series := history.Bucket(key)
+			var old [][]byte
+			c := series.Cursor()
+			for k, _ := c.First(); k != nil && bytes.Compare(k, limit) < 0; k, _ = c.Next() {
+				old = append(old, k)
+			}
+			for _, k := range old {
+				if err := series.Delete(k); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// historyBucket бакет истории для типа метрики
+func historyBucket(mType string) []byte {
+	if mType == TYPECOUNTER {
+		return bucketHistoryCounter
+	}
+	return bucketHistoryGauge
+}
+
+// historyKey ключ значения истории: время в наносекундах и порядковый номер,
+// big endian сохраняет порядок по времени при обходе курсором
+func historyKey(ts time.Time, seq uint64) []byte {
+	key := make([]byte, 16)
+	binary.BigEndian.PutUint64(key, uint64(ts.UnixNano()))
+	binary.BigEndian.PutUint64(key[8:], seq)
+	return key
+}
+
+// historyTime время из ключа значения истории
+func historyTime(key []byte) time.Time {
+	return time.Unix(0, int64(binary.BigEndian.Uint64(key))).UTC()
+}
+
+// encodeUint кодирование порядкового номера
+func encodeUint(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// encodeFloat кодирование значения метрики
+func encodeFloat(v float64) []byte {
+	return encodeUint(math.Float64bits(v))
+}
+
+// decodeFloat декодирование значения метрики, для отсутствующего значения 0
+func decodeFloat(b []byte) float64 {
+	if len(b) != 8 {
+		return 0
+	}
+	return math.Float64frombits(binary.BigEndian.Uint64(b))
+}
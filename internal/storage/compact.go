@@ -0,0 +1,46 @@
+package storage
+
+import (
+	"context"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+)
+
+// Compact сворачивает старые приращения counter в накопленную сумму
+// в каждой серии остаётся не больше keep последних приращений,
+// суммарное значение серии не меняется
+func (ms *MemStorage) Compact(_ context.Context, keep int) error {
+	if keep < 0 {
+		keep = 0
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	for key, values := range ms.ItemsCounter {
+		if len(values) <= keep {
+			continue
+		}
+		fold := len(values) - keep
+		ms.CounterBase[key] += sum(values[:fold])
+		ms.ItemsCounter[key] = append(values[:0:0], values[fold:]...)
+	}
+	return nil
+}
+
+// CompactLoop периодически сворачивает старые приращения counter в хранилище stor
+// цикл завершается с отменой ctx
+func CompactLoop(ctx context.Context, stor Backend, interval time.Duration, keep int) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := stor.Compact(ctx, keep)
+			if err != nil {
+				logger.Error(err)
+			}
+		}
+	}
+}
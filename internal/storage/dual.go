@@ -0,0 +1,167 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+)
+
+func init() {
+	Register(BACKENDDUAL, openDual)
+}
+
+// DualStorage переходное хранилище для переезда между файлом и базой данных
+// запись идёт в оба хранилища, чтение - из основного Primary,
+// ошибки записи во второе хранилище Secondary только журналируются, чтобы переезд не мешал агентам
+type DualStorage struct {
+	Primary   Backend
+	Secondary Backend
+}
+
+// openDual открытие файлового хранилища и базы данных
+// основное хранилище выбирается по opts.DualPrimary, по умолчанию файл
+// если второе хранилище пустое, в него переносятся текущие значения основного,
+// ключи агентов переносятся всегда
+func openDual(opts Options) (Backend, error) {
+	primaryName, secondaryName := BACKENDFILE, BACKENDPOSTGRES
+	switch opts.DualPrimary {
+	case "", BACKENDFILE:
+	case BACKENDPOSTGRES:
+		primaryName, secondaryName = secondaryName, primaryName
+	default:
+		return nil, fmt.Errorf("%w: dual primary %q", ErrBackendOptions, opts.DualPrimary)
+	}
+
+	primary, err := Open(primaryName, opts)
+	if err != nil {
+		return nil, err
+	}
+	secondary, err := Open(secondaryName, opts)
+	if err != nil {
+		primary.Close()
+		return nil, err
+	}
+
+	n, err := Copy(context.Background(), primary, secondary, false)
+	switch {
+	case errors.Is(err, ErrTransferNotEmpty):
+		// второе хранилище уже заполнено, например предыдущим запуском в этом режиме
+	case err != nil:
+		primary.Close()
+		secondary.Close()
+		return nil, fmt.Errorf("fail while copy %s to %s: %w", primaryName, secondaryName, err)
+	default:
+		logger.Info(fmt.Sprintf("dual storage: %d series copied from %s to %s", n, primaryName, secondaryName))
+	}
+	n, err = CopyAgentKeys(context.Background(), primary, secondary)
+	if err != nil {
+		primary.Close()
+		secondary.Close()
+		return nil, fmt.Errorf("fail while copy agent keys from %s to %s: %w", primaryName, secondaryName, err)
+	}
+	if n > 0 {
+		logger.Info(fmt.Sprintf("dual storage: %d agent keys copied from %s to %s", n, primaryName, secondaryName))
+	}
+	return NewDual(primary, secondary), nil
+}
+
+// NewDual создаёт хранилище, пишущее в primary и secondary и читающее из primary
+func NewDual(primary, secondary Backend) *DualStorage {
+	return &DualStorage{
+		Primary:   primary,
+		Secondary: secondary,
+	}
+}
+
+// Push сохраняет значение метрики в оба хранилища
+func (d *DualStorage) Push(ctx context.Context, metric *Metric) error {
+	copied := *metric
+	err := d.Primary.Push(ctx, metric)
+	if err != nil {
+		return err
+	}
+	d.secondaryError("push", d.Secondary.Push(ctx, &copied))
+	return nil
+}
+
+// PushBatch сохраняет пачку метрик в оба хранилища, обновлённые значения берутся из основного
+func (d *DualStorage) PushBatch(ctx context.Context, items []Metric) ([]Metric, error) {
+	copied := append([]Metric(nil), items...)
+	renewed, err := d.Primary.PushBatch(ctx, items)
+	if err != nil {
+		return nil, err
+	}
+	_, err = d.Secondary.PushBatch(ctx, copied)
+	d.secondaryError("push batch", err)
+	return renewed, nil
+}
+
+// Get значение метрики из основного хранилища
+func (d *DualStorage) Get(ctx context.Context, metric *Metric) (float64, error) {
+	return d.Primary.Get(ctx, metric)
+}
+
+// List перечень метрик основного хранилища
+func (d *DualStorage) List(ctx context.Context) ([]string, error) {
+	return d.Primary.List(ctx)
+}
+
+// Snapshot текущие значения серий основного хранилища
+func (d *DualStorage) Snapshot(ctx context.Context) (gauges map[string]float64, counters map[string]float64, err error) {
+	return d.Primary.Snapshot(ctx)
+}
+
+// History история значений метрики из основного хранилища
+func (d *DualStorage) History(ctx context.Context, metric *Metric, from, to time.Time, step time.Duration) ([]Sample, error) {
+	return d.Primary.History(ctx, metric, from, to, step)
+}
+
+// Aggregate вычисление агрегата по истории основного хранилища
+func (d *DualStorage) Aggregate(ctx context.Context, q *Query) (float64, error) {
+	agg, ok := d.Primary.(Aggregator)
+	if !ok {
+		return 0, ErrQueryUnsupported
+	}
+	return agg.Aggregate(ctx, q)
+}
+
+// Compact сворачивает старые приращения counter в обоих хранилищах
+func (d *DualStorage) Compact(ctx context.Context, keep int) error {
+	err := d.Primary.Compact(ctx, keep)
+	if err != nil {
+		return err
+	}
+	d.secondaryError("compact", d.Secondary.Compact(ctx, keep))
+	return nil
+}
+
+// Ping проверка доступности основного хранилища
+func (d *DualStorage) Ping(ctx context.Context) error {
+	return d.Primary.Ping(ctx)
+}
+
+// Close освобождение ресурсов обоих хранилищ
+func (d *DualStorage) Close() error {
+	return errors.Join(d.Primary.Close(), d.Secondary.Close())
+}
+
+// DBStats статистика пула подключений того из хранилищ, что работает с базой данных
+func (d *DualStorage) DBStats() sql.DBStats {
+	for _, stor := range []Backend{d.Primary, d.Secondary} {
+		if statser, ok := stor.(DBStatser); ok {
+			return statser.DBStats()
+		}
+	}
+	return sql.DBStats{}
+}
+
+// secondaryError журналирование ошибки второго хранилища
+func (d *DualStorage) secondaryError(op string, err error) {
+	if err != nil {
+		logger.Error(fmt.Sprintf("dual storage: fail while %s to secondary storage: %v", op, err))
+	}
+}
@@ -9,4 +9,11 @@ var (
 	ErrMetricValEmptyField      = errors.New("empty field in metrics")
 	ErrMetricValWrongType       = errors.New("wrong type of metrics")
 	ErrMetricValValueIsNotFloat = errors.New("value is not float64")
+	ErrMetricAmbiguous          = errors.New("several series match, specify labels")
+	ErrHistoryRange             = errors.New("wrong history range")
+	ErrBackendUnknown           = errors.New("unknown storage backend")
+	ErrBackendOptions           = errors.New("wrong storage backend options")
+	ErrTransferNotEmpty         = errors.New("destination storage is not empty")
+	ErrQuery                    = errors.New("wrong query expression")
+	ErrQueryUnsupported         = errors.New("storage does not support queries")
 )
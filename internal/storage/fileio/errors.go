@@ -3,5 +3,9 @@ package fileio
 import "errors"
 
 var (
-	ErrFileNil = errors.New("store file not inizialized")
+	ErrFileNil           = errors.New("store file not inizialized")
+	ErrSnapshotCorrupted = errors.New("snapshot is corrupted")
+	ErrSnapshotChecksum  = errors.New("snapshot checksum mismatch")
+	ErrSnapshotVersion   = errors.New("unsupported snapshot version")
+	ErrNoValidSnapshot   = errors.New("no snapshot could be read")
 )
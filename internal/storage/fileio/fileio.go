@@ -1,4 +1,6 @@
 // Модуль отвечает за сохранение/чтение бэкапа данных о метриках
+// бэкап пишется во временный файл и атомарно переименовывается,
+// несколько последних снимков хранятся для восстановления при повреждении
 package fileio
 
 import (
@@ -7,85 +9,116 @@ import (
 	"sync"
 )
 
+// KEEPSNAPSHOTS сколько снимков хранится по умолчанию, включая текущий
+const KEEPSNAPSHOTS = 3
+
 // File хранит данные о файле для бэкапов
+// dir пустой, если бэкап не ведётся
 type File struct {
+	dir      string
+	filename string
 	fullpath string
-	file     *os.File
+	keep     int
 	mu       *sync.Mutex
 }
 
 // Data в этом формате данные передаются выше
+// ключами служат ключи серий: имя метрики и её метки в каноническом виде
+// CounterBase накопленные суммы свёрнутых приращений counter,
+// в старых бэкапах поле отсутствует
+// WALSeq номер последней записи журнала WAL, учтённой в бэкапе
 type Data struct {
 	ItemsGauge   map[string]float64
 	ItemsCounter map[string][]float64
+	CounterBase  map[string]float64
+	WALSeq       uint64
 }
 
 // New создание нового экземпляра file
+// директория создаётся при необходимости, сам файл появляется при первой записи
 func New(path, filename string) (*File, error) {
 	var mu sync.Mutex
-	var file *os.File
 
-	fullpath := filepath.Join(path, filename)
 	if path != "" {
 		err := os.MkdirAll(path, 0755)
 		if err != nil && !os.IsExist(err) {
 			return nil, err
 		}
-		file, err = openFileRetry(fullpath, os.O_RDWR, 0666)
-		if err != nil {
-			return nil, err
-		}
 	}
 
 	return &File{
-		fullpath: fullpath,
-		file:     file,
+		dir:      path,
+		filename: filename,
+		fullpath: filepath.Join(path, filename),
+		keep:     KEEPSNAPSHOTS,
 		mu:       &mu,
 	}, nil
 }
 
-// Write запись данных в файл
-// данные кодируются в gob
-func (f *File) Write(data *Data) error {
+// SetKeep задаёт, сколько последних снимков хранить, включая текущий
+func (f *File) SetKeep(keep int) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
-	if f.file == nil {
-		return nil
+	if keep < 1 {
+		keep = 1
 	}
+	f.keep = keep
+}
 
-	err := f.writeToFileRetry(data)
-	if err != nil {
-		return err
+// Write запись снимка данных
+// данные кодируются в gob, перед ними пишется заголовок с версией формата,
+// временем создания и контрольной суммой
+func (f *File) Write(data *Data) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.dir == "" {
+		return nil
 	}
 
-	return f.file.Sync()
+	return f.writeToFileRetry(data)
 }
 
 // Read чтение данных из файла
 func (f *File) Read() (map[string]float64, map[string][]float64, error) {
+	data, err := f.ReadData()
+	if err != nil {
+		return nil, nil, err
+	}
+	return data.ItemsGauge, data.ItemsCounter, nil
+}
+
+// ReadData чтение всех данных из последнего целого снимка, включая накопленные суммы counter
+// повреждённые снимки пропускаются, если снимков нет - данные пустые,
+// если снимки есть, но целых среди них нет - ошибка ErrNoValidSnapshot
+// временные файлы прерванной записи удаляются
+// все карты гарантированно не nil
+func (f *File) ReadData() (*Data, error) {
 	f.mu.Lock()
 	defer f.mu.Unlock()
 
 	var data Data
-	data.ItemsGauge = make(map[string]float64)
-	data.ItemsCounter = make(map[string][]float64)
 
-	if f.file == nil {
-		return data.ItemsGauge, data.ItemsCounter, nil
+	if f.dir != "" {
+		err := f.readFromFileRetry(&data)
+		if err != nil {
+			return nil, err
+		}
 	}
 
-	err := f.readFromFileRetry(&data)
-	if err != nil {
-		return nil, nil, err
+	if data.ItemsGauge == nil {
+		data.ItemsGauge = make(map[string]float64)
+	}
+	if data.ItemsCounter == nil {
+		data.ItemsCounter = make(map[string][]float64)
+	}
+	if data.CounterBase == nil {
+		data.CounterBase = make(map[string]float64)
 	}
 
-	return data.ItemsGauge, data.ItemsCounter, nil
+	return &data, nil
 }
 
-// Close закрытие файла, открытого в New
+// Close файл между записями не держится открытым, метод оставлен для совместимости
 func (f *File) Close() error {
-	if f.file == nil {
-		return nil
-	}
-	return f.file.Close()
+	return nil
 }
@@ -3,9 +3,11 @@ package fileio
 import (
 	"encoding/gob"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
 	"sync"
+	"syscall"
 	"testing"
 
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
@@ -31,8 +33,11 @@ func TestNew(t *testing.T) {
 		assert.NotNil(t, f)
 		defer f.Close()
 
-		// Проверяем, что файл действительно создан
+		// файл появляется только при первой записи
 		_, statErr := os.Stat(filepath.Join(tmpDir, fileName))
+		assert.True(t, os.IsNotExist(statErr))
+		require.NoError(t, f.Write(&Data{}))
+		_, statErr = os.Stat(filepath.Join(tmpDir, fileName))
 		assert.NoError(t, statErr)
 	})
 
@@ -46,8 +51,9 @@ func TestNew(t *testing.T) {
 		assert.NotNil(t, f)
 		defer f.Close()
 
-		_, statErr := os.Stat(filepath.Join(nestedDir, fileName))
-		assert.NoError(t, statErr)
+		info, statErr := os.Stat(nestedDir)
+		require.NoError(t, statErr)
+		assert.True(t, info.IsDir())
 	})
 
 	t.Run("Ошибка при создании директории", func(t *testing.T) {
@@ -83,21 +89,17 @@ func TestFile_Write(t *testing.T) {
 		err = f.Write(data)
 		require.NoError(t, err)
 
-		// Проверим напрямую, что записалось в файл (гоб-декод).
-		file, err := os.Open(filepath.Join(tmpDir, "test_write"))
-		require.NoError(t, err)
-		defer file.Close()
-
+		// Проверим напрямую, что записалось в файл
 		var readData Data
-		dec := gob.NewDecoder(file)
-		err = dec.Decode(&readData)
+		snap, err := readSnapshot(filepath.Join(tmpDir, "test_write"), &readData)
 		require.NoError(t, err)
+		assert.Equal(t, uint16(FORMATVERSION), snap.Version)
 
 		assert.Equal(t, data.ItemsGauge, readData.ItemsGauge)
 		assert.Equal(t, data.ItemsCounter, readData.ItemsCounter)
 	})
 
-	t.Run("Запись не происходит, если f.file == nil", func(t *testing.T) {
+	t.Run("Запись не происходит, если бэкап не ведётся", func(t *testing.T) {
 		f := &File{mu: &sync.Mutex{}}
 		err := f.Write(&Data{
 			ItemsGauge: map[string]float64{"niltest": 123},
@@ -128,7 +130,7 @@ func TestFile_Read(t *testing.T) {
 		assert.Equal(t, data.ItemsCounter, counters)
 	})
 
-	t.Run("Чтение при f.file == nil возвращает пустые мапы", func(t *testing.T) {
+	t.Run("Чтение без бэкапа возвращает пустые мапы", func(t *testing.T) {
 		f := &File{mu: &sync.Mutex{}}
 		gauges, counters, err := f.Read()
 		require.NoError(t, err)
@@ -137,6 +139,40 @@ func TestFile_Read(t *testing.T) {
 	})
 }
 
+func TestFile_ReadData(t *testing.T) {
+	assert.NoError(t, logger.Init(&mockLogger{}, 5))
+	t.Run("Накопленные суммы counter сохраняются", func(t *testing.T) {
+		f, err := New(t.TempDir(), "test_read_data")
+		require.NoError(t, err)
+		defer f.Close()
+
+		data := &Data{
+			ItemsGauge:   map[string]float64{"g": 1},
+			ItemsCounter: map[string][]float64{"c": {3}},
+			CounterBase:  map[string]float64{"c": 100},
+		}
+		require.NoError(t, f.Write(data))
+
+		read, err := f.ReadData()
+		require.NoError(t, err)
+		assert.Equal(t, data, read)
+	})
+
+	t.Run("Бэкап без накопленных сумм", func(t *testing.T) {
+		f, err := New(t.TempDir(), "test_read_data_old")
+		require.NoError(t, err)
+		defer f.Close()
+
+		require.NoError(t, f.Write(&Data{ItemsCounter: map[string][]float64{"c": {1, 2}}}))
+
+		read, err := f.ReadData()
+		require.NoError(t, err)
+		assert.Equal(t, []float64{1, 2}, read.ItemsCounter["c"])
+		assert.NotNil(t, read.CounterBase)
+		assert.NotNil(t, read.ItemsGauge)
+	})
+}
+
 func TestFile_Close(t *testing.T) {
 	assert.NoError(t, logger.Init(&mockLogger{}, 0))
 	t.Run("Успешное закрытие файла", func(t *testing.T) {
@@ -148,171 +184,185 @@ func TestFile_Close(t *testing.T) {
 		require.NoError(t, closeErr)
 	})
 
-	t.Run("Close при f.file == nil возвращает nil-ошибку", func(t *testing.T) {
+	t.Run("Close без бэкапа возвращает nil-ошибку", func(t *testing.T) {
 		f := &File{mu: &sync.Mutex{}}
 		err := f.Close()
 		require.NoError(t, err)
 	})
 }
 
-func Test_openFileRetry(t *testing.T) {
+func TestSnapshots(t *testing.T) {
 	assert.NoError(t, logger.Init(&mockLogger{}, 0))
-	t.Run("Успешное открытие файла (сразу или с созданием)", func(t *testing.T) {
-		tmpDir := t.TempDir()
-		fullPath := filepath.Join(tmpDir, "retry_test")
 
-		file, err := openFileRetry(fullPath, os.O_RDWR|os.O_CREATE, 0644)
+	// write пишет снимок со значением gauge v
+	write := func(t *testing.T, f *File, v float64) {
+		t.Helper()
+		require.NoError(t, f.Write(&Data{ItemsGauge: map[string]float64{"g": v}}))
+	}
+	// gauge значение gauge из прочитанного снимка
+	gauge := func(t *testing.T, f *File) float64 {
+		t.Helper()
+		data, err := f.ReadData()
 		require.NoError(t, err)
-		require.NotNil(t, file)
-		file.Close()
+		return data.ItemsGauge["g"]
+	}
+	// corrupt портит байт данных снимка, заголовок остаётся целым
+	corrupt := func(t *testing.T, path string) {
+		t.Helper()
+		raw, err := os.ReadFile(path)
+		require.NoError(t, err)
+		raw[len(raw)-2] ^= 0xff
+		require.NoError(t, os.WriteFile(path, raw, 0644))
+	}
 
-		_, statErr := os.Stat(fullPath)
-		assert.NoError(t, statErr)
-	})
+	t.Run("хранятся последние снимки", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := New(dir, "backup")
+		require.NoError(t, err)
+		for i := 1; i <= 5; i++ {
+			write(t, f, float64(i))
+		}
 
-	t.Run("Не удаётся открыть файл из-за неверного пути", func(t *testing.T) {
-		// Пример пути, который с высокой вероятностью вызовет ошибку
-		invalidPath := string(os.PathSeparator) + "root_denied" + string(os.PathSeparator) + "file"
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		var names []string
+		for _, e := range entries {
+			names = append(names, e.Name())
+		}
+		assert.ElementsMatch(t, []string{"backup", "backup.1", "backup.2"}, names)
 
-		file, err := openFileRetry(invalidPath, os.O_RDWR, 0644)
-		assert.Error(t, err)
-		assert.Nil(t, file)
+		var data Data
+		_, err = readSnapshot(filepath.Join(dir, "backup.2"), &data)
+		require.NoError(t, err)
+		assert.Equal(t, 3.0, data.ItemsGauge["g"])
 	})
-}
 
-func Test_writeToFileRetry(t *testing.T) {
-	assert.NoError(t, logger.Init(&mockLogger{}, 0))
-	t.Run("Успешная запись (без ошибок)", func(t *testing.T) {
-		tmpDir := t.TempDir()
-		f, err := New(tmpDir, "write_retry_test")
+	t.Run("SetKeep", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := New(dir, "backup")
 		require.NoError(t, err)
-		defer f.Close()
-
-		data := &Data{
-			ItemsGauge:   map[string]float64{"test": 3.14},
-			ItemsCounter: map[string][]float64{"count": {1, 2, 3}},
+		f.SetKeep(0)
+		for i := 1; i <= 3; i++ {
+			write(t, f, float64(i))
 		}
-		err = f.writeToFileRetry(data)
-		require.NoError(t, err)
+		assert.Equal(t, []string{filepath.Join(dir, "backup")}, f.candidates())
+	})
 
-		// Проверим результат
-		file, err := os.Open(filepath.Join(tmpDir, "write_retry_test"))
+	t.Run("повреждённый снимок пропускается", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := New(dir, "backup")
 		require.NoError(t, err)
-		defer file.Close()
+		write(t, f, 1)
+		write(t, f, 2)
+		write(t, f, 3)
 
-		var check Data
-		require.NoError(t, gob.NewDecoder(file).Decode(&check))
+		corrupt(t, filepath.Join(dir, "backup"))
+		var data Data
+		_, err = readSnapshot(filepath.Join(dir, "backup"), &data)
+		assert.ErrorIs(t, err, ErrSnapshotChecksum)
+		assert.Equal(t, 2.0, gauge(t, f))
 
-		assert.Equal(t, data.ItemsGauge, check.ItemsGauge)
-		assert.Equal(t, data.ItemsCounter, check.ItemsCounter)
-	})
+		corrupt(t, filepath.Join(dir, "backup.1"))
+		assert.Equal(t, 1.0, gauge(t, f))
 
-	t.Run("Ошибка при Truncate (или Seek)", func(t *testing.T) {
-		tmpDir := t.TempDir()
+		// повреждённые снимки не удаляются
+		_, err = os.Stat(filepath.Join(dir, "backup"))
+		assert.NoError(t, err)
+	})
 
-		// Создаем файл только для чтения
-		filePath := filepath.Join(tmpDir, "readonly_file")
-		roFile, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDONLY, 0644)
+	t.Run("нет целых снимков", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "backup"), []byte("bad data"), 0644))
+		f, err := New(dir, "backup")
 		require.NoError(t, err)
+		_, err = f.ReadData()
+		assert.ErrorIs(t, err, ErrNoValidSnapshot)
+		assert.ErrorIs(t, err, ErrSnapshotCorrupted)
+	})
 
-		t.Cleanup(func() { roFile.Close() })
-
-		f := &File{
-			mu:   &sync.Mutex{},
-			file: roFile,
-		}
-
-		err = f.writeToFileRetry(&Data{})
-		assert.Error(t, err)
+	t.Run("нет снимков", func(t *testing.T) {
+		f, err := New(t.TempDir(), "backup")
+		require.NoError(t, err)
+		data, err := f.ReadData()
+		require.NoError(t, err)
+		assert.Empty(t, data.ItemsGauge)
+		assert.Empty(t, data.ItemsCounter)
 	})
-}
 
-func Test_readFromFileRetry(t *testing.T) {
-	assert.NoError(t, logger.Init(&mockLogger{}, 0))
-	t.Run("Чтение из непустого файла (валидный gob)", func(t *testing.T) {
-		tmpDir := t.TempDir()
-		filePath := filepath.Join(tmpDir, "read_retry_test")
-
-		// Сразу запишем туда валидные данные
-		{
-			f, err := os.OpenFile(filePath, os.O_CREATE|os.O_RDWR, 0644)
-			require.NoError(t, err)
-
-			data := &Data{
-				ItemsGauge:   map[string]float64{"g": 2.71},
-				ItemsCounter: map[string][]float64{"c": {42, 43}},
-			}
-			require.NoError(t, gob.NewEncoder(f).Encode(data))
-			f.Close()
-		}
+	t.Run("неизвестная версия формата", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := New(dir, "backup")
+		require.NoError(t, err)
+		write(t, f, 1)
+		write(t, f, 2)
 
-		// Создаём структуру File и читаем
-		fobj, err := New(tmpDir, "read_retry_test")
+		path := filepath.Join(dir, "backup")
+		raw, err := os.ReadFile(path)
 		require.NoError(t, err)
-		defer fobj.Close()
+		raw[4], raw[5] = 0xff, 0xff
+		require.NoError(t, os.WriteFile(path, raw, 0644))
 
 		var data Data
-		data.ItemsGauge = make(map[string]float64)
-		data.ItemsCounter = make(map[string][]float64)
+		_, err = readSnapshot(path, &data)
+		assert.ErrorIs(t, err, ErrSnapshotVersion)
+		assert.Equal(t, 1.0, gauge(t, f))
+	})
+
+	t.Run("старый бэкап без заголовка", func(t *testing.T) {
+		dir := t.TempDir()
+		file, err := os.Create(filepath.Join(dir, "backup"))
+		require.NoError(t, err)
+		require.NoError(t, gob.NewEncoder(file).Encode(&Data{
+			ItemsGauge:   map[string]float64{"g": 2.71},
+			ItemsCounter: map[string][]float64{"c": {42, 43}},
+		}))
+		require.NoError(t, file.Close())
 
-		err = fobj.readFromFileRetry(&data)
+		f, err := New(dir, "backup")
+		require.NoError(t, err)
+		data, err := f.ReadData()
 		require.NoError(t, err)
 		assert.Equal(t, 2.71, data.ItemsGauge["g"])
 		assert.Equal(t, []float64{42, 43}, data.ItemsCounter["c"])
-	})
 
-	t.Run("Чтение из пустого файла возвращает без ошибки", func(t *testing.T) {
-		tmpDir := t.TempDir()
-		filePath := filepath.Join(tmpDir, "empty_file")
-		_, err := os.Create(filePath)
+		// следующая запись уже в новом формате, старый бэкап остаётся предыдущим снимком
+		write(t, f, 3)
+		snap, err := readSnapshot(filepath.Join(dir, "backup"), &Data{})
 		require.NoError(t, err)
-
-		fobj, err := New(tmpDir, "empty_file")
+		assert.Equal(t, uint16(FORMATVERSION), snap.Version)
+		snap, err = readSnapshot(filepath.Join(dir, "backup.1"), &Data{})
 		require.NoError(t, err)
-		defer fobj.Close()
-
-		var data Data
-		data.ItemsGauge = make(map[string]float64)
-		data.ItemsCounter = make(map[string][]float64)
+		assert.Equal(t, uint16(0), snap.Version)
+	})
 
-		err = fobj.readFromFileRetry(&data)
+	t.Run("временные файлы не остаются", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := New(dir, "backup")
 		require.NoError(t, err)
-		assert.Empty(t, data.ItemsGauge)
-		assert.Empty(t, data.ItemsCounter)
+		write(t, f, 1)
+		matches, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
+		require.NoError(t, err)
+		assert.Empty(t, matches)
 	})
 
-	t.Run("Чтение из повреждённого файла (файл удаляется)", func(t *testing.T) {
-		tmpDir := t.TempDir()
-		filePath := filepath.Join(tmpDir, "corrupted_file")
-
-		// Запишем мусор
-		require.NoError(t, os.WriteFile(filePath, []byte("bad data"), 0644))
-
-		fobj, err := New(tmpDir, "corrupted_file")
+	t.Run("временные файлы прерванной записи удаляются при чтении", func(t *testing.T) {
+		dir := t.TempDir()
+		f, err := New(dir, "backup")
 		require.NoError(t, err)
-		defer fobj.Close()
+		write(t, f, 1)
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "backup.tmp-123"), []byte("partial"), 0644))
 
-		var data Data
-		err = fobj.readFromFileRetry(&data)
-		// Код удаляет файл и возвращает nil для data.Items...
-		// При этом сам метод возвращает nil (не ошибку), если успешно удалил.
+		assert.Equal(t, 1.0, gauge(t, f))
+		matches, err := filepath.Glob(filepath.Join(dir, "*.tmp-*"))
 		require.NoError(t, err)
-		assert.Nil(t, data.ItemsGauge)
-		assert.Nil(t, data.ItemsCounter)
-
-		// Проверяем, что файл удалён
-		_, statErr := os.Stat(filePath)
-		assert.True(t, os.IsNotExist(statErr))
+		assert.Empty(t, matches)
 	})
+}
 
-	t.Run("Ошибка Stat после всех попыток (например, некорректный диск)", func(t *testing.T) {
-		// Можно создать структуру File с file == nil и вызвать readFromFileRetry напрямую:
-		fobj := &File{
-			file: nil,
-			mu:   &sync.Mutex{},
-		}
-		var data Data
-		err := fobj.readFromFileRetry(&data)
-		assert.Error(t, err)
-	})
+func TestIsTransient(t *testing.T) {
+	assert.True(t, isTransient(fmt.Errorf("write: %w", syscall.EIO)), "ошибка ввода-вывода повторяется")
+	assert.False(t, isTransient(fmt.Errorf("open: %w", os.ErrNotExist)), "отсутствие файла не повторяется")
+	assert.False(t, isTransient(fmt.Errorf("open: %w", os.ErrPermission)), "запрет доступа не повторяется")
+	assert.False(t, isTransient(fmt.Errorf("read: %w", ErrSnapshotChecksum)), "повреждённый снимок не повторяется")
+	assert.False(t, isTransient(io.EOF), "пустой снимок не повторяется")
 }
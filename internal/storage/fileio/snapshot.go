@@ -0,0 +1,232 @@
+package fileio
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/gob"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+)
+
+// Формат снимка
+const (
+	FORMATVERSION = 1        // текущая версия формата снимка
+	TMPSUFFIX     = ".tmp-*" // шаблон временного файла для записи снимка
+)
+
+// snapshotMagic признак снимка с заголовком, файлы без него читаются как старый бэкап в чистом gob
+var snapshotMagic = [4]byte{'P', 'M', 'S', 'N'}
+
+// header заголовок снимка, пишется перед данными в big endian
+type header struct {
+	Magic    [4]byte
+	Version  uint16
+	Created  int64  // время создания, наносекунды unix
+	Size     uint64 // длина данных
+	Checksum uint32 // crc32 данных
+}
+
+// Snapshot сведения о снимке из заголовка
+// для старых бэкапов без заголовка Version равен 0, Created - время изменения файла
+type Snapshot struct {
+	Path    string
+	Version uint16
+	Created time.Time
+}
+
+// writeSnapshot запись снимка во временный файл с последующим переименованием
+// перед переименованием текущий снимок сдвигается в историю
+func (f *File) writeSnapshot(data *Data) error {
+	var payload bytes.Buffer
+	err := gob.NewEncoder(&payload).Encode(data)
+	if err != nil {
+		return fmt.Errorf("failed to encode data: %w", err)
+	}
+
+	tmp, err := os.CreateTemp(f.dir, f.filename+TMPSUFFIX)
+	if err != nil {
+		return fmt.Errorf("failed to create temp file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	h := header{
+		Magic:    snapshotMagic,
+		Version:  FORMATVERSION,
+		Created:  time.Now().UnixNano(),
+		Size:     uint64(payload.Len()),
+		Checksum: crc32.ChecksumIEEE(payload.Bytes()),
+	}
+	err = binary.Write(tmp, binary.BigEndian, h)
+	if err == nil {
+		_, err = tmp.Write(payload.Bytes())
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	closeErr := tmp.Close()
+	if err != nil {
+		return fmt.Errorf("failed to write data to temp file: %w", err)
+	}
+	if closeErr != nil {
+		return fmt.Errorf("failed to close temp file: %w", closeErr)
+	}
+
+	err = f.rotate()
+	if err != nil {
+		return fmt.Errorf("failed to rotate snapshots: %w", err)
+	}
+	err = os.Rename(tmp.Name(), f.fullpath)
+	if err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	return syncDir(f.dir)
+}
+
+// rotate сдвигает снимки: name.1 -> name.2 и т.д., лишние удаляются,
+// на текущий снимок заводится жёсткая ссылка name.1, так что текущий снимок на месте до переименования
+func (f *File) rotate() error {
+	for _, path := range f.older() {
+		if n := snapshotIndex(f.fullpath, path); n >= f.keep-1 {
+			if err := os.Remove(path); err != nil {
+				return err
+			}
+		}
+	}
+	if f.keep < 2 {
+		return nil
+	}
+	for i := f.keep - 2; i >= 1; i-- {
+		err := os.Rename(olderPath(f.fullpath, i), olderPath(f.fullpath, i+1))
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	info, err := os.Stat(f.fullpath)
+	if os.IsNotExist(err) || (err == nil && info.Size() == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return os.Link(f.fullpath, olderPath(f.fullpath, 1))
+}
+
+// candidates файлы снимков от нового к старому
+func (f *File) candidates() []string {
+	return append([]string{f.fullpath}, f.older()...)
+}
+
+// older существующие предыдущие снимки name.1, name.2, ... по возрастанию номера
+func (f *File) older() []string {
+	matches, _ := filepath.Glob(f.fullpath + ".*")
+	var paths []string
+	for _, path := range matches {
+		if snapshotIndex(f.fullpath, path) > 0 {
+			paths = append(paths, path)
+		}
+	}
+	sort.Slice(paths, func(i, j int) bool {
+		return snapshotIndex(f.fullpath, paths[i]) < snapshotIndex(f.fullpath, paths[j])
+	})
+	return paths
+}
+
+// removeTemp удаление временных файлов, оставшихся от прерванной записи снимка
+// ошибки удаления только логируются, чтению снимков они не мешают
+func (f *File) removeTemp() {
+	matches, _ := filepath.Glob(f.fullpath + TMPSUFFIX)
+	for _, path := range matches {
+		if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+			logger.Error(fmt.Sprintf("fail remove temp snapshot %s: %v", path, err))
+		}
+	}
+}
+
+// readSnapshot чтение и проверка одного снимка
+// io.EOF - файла нет или он пуст
+func readSnapshot(path string, data *Data) (*Snapshot, error) {
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return nil, io.EOF
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if info.Size() == 0 {
+		return nil, io.EOF
+	}
+
+	var h header
+	err = binary.Read(file, binary.BigEndian, &h)
+	if err != nil || h.Magic != snapshotMagic {
+		// старый бэкап без заголовка
+		if _, err = file.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		if err = gob.NewDecoder(file).Decode(data); err != nil {
+			return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupted, err)
+		}
+		return &Snapshot{Path: path, Created: info.ModTime()}, nil
+	}
+
+	if h.Version > FORMATVERSION {
+		return nil, fmt.Errorf("%w: %d", ErrSnapshotVersion, h.Version)
+	}
+	if h.Size > uint64(info.Size()) {
+		return nil, fmt.Errorf("%w: size %d", ErrSnapshotCorrupted, h.Size)
+	}
+	payload := make([]byte, h.Size)
+	if _, err = io.ReadFull(file, payload); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupted, err)
+	}
+	if crc32.ChecksumIEEE(payload) != h.Checksum {
+		return nil, ErrSnapshotChecksum
+	}
+	if err = gob.NewDecoder(bytes.NewReader(payload)).Decode(data); err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrSnapshotCorrupted, err)
+	}
+	return &Snapshot{Path: path, Version: h.Version, Created: time.Unix(0, h.Created)}, nil
+}
+
+// olderPath путь к предыдущему снимку с номером n
+func olderPath(fullpath string, n int) string {
+	return fullpath + "." + strconv.Itoa(n)
+}
+
+// snapshotIndex номер предыдущего снимка по пути, 0 - не снимок
+func snapshotIndex(fullpath, path string) int {
+	suffix, ok := strings.CutPrefix(path, fullpath+".")
+	if !ok {
+		return 0
+	}
+	n, err := strconv.Atoi(suffix)
+	if err != nil || n < 1 {
+		return 0
+	}
+	return n
+}
+
+// syncDir сброс на диск директории, чтобы переименование пережило сбой
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
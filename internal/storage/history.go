@@ -0,0 +1,161 @@
+package storage
+
+import (
+	"context"
+	"sort"
+	"time"
+)
+
+// Настройки хранения истории значений метрик
+const (
+	HISTORYRETENTION    = 24 * time.Hour // сколько по умолчанию хранится история
+	HISTORYTRIMINTERVAL = time.Minute    // как часто чистится история в базе данных
+)
+
+// Sample значение метрики с отметкой времени сервера
+// для counter в истории хранятся приращения, в ответах - накопленная сумма
+type Sample struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+// SetHistoryRetention задаёт время хранения истории значений метрик
+func (ms *MemStorage) SetHistoryRetention(retention time.Duration) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	ms.historyRetention = retention
+}
+
+// History получение истории значений метрики за период [from, to]
+// если step больше нуля, значения группируются по интервалам step,
+// от каждого интервала берётся последнее значение с меткой времени начала интервала
+// метки метрики работают как фильтр так же, как в Get
+func (ms *MemStorage) History(ctx context.Context, metric *Metric, from, to time.Time, step time.Duration) ([]Sample, error) {
+	ms.mu.Lock()
+	now := ms.now()
+	retention := ms.historyRetention
+	ms.mu.Unlock()
+	return history(ctx, metric, from, to, step, now, retention, ms.historyMemory)
+}
+
+// history общая часть получения истории: проверка и уточнение периода,
+// загрузка текущего значения и значений после from через load, построение ответа
+func history(ctx context.Context, metric *Metric, from, to time.Time, step time.Duration, now time.Time, retention time.Duration,
+	load func(ctx context.Context, metric *Metric, from time.Time) (float64, []Sample, error)) ([]Sample, error) {
+	if err := validateGet(metric); err != nil {
+		return nil, err
+	}
+	if step < 0 {
+		return nil, ErrHistoryRange
+	}
+	if to.IsZero() {
+		to = now
+	}
+	if from.IsZero() {
+		from = now.Add(-retention)
+	}
+	if from.After(to) {
+		return nil, ErrHistoryRange
+	}
+
+	current, samples, err := load(ctx, metric, from)
+	if err != nil {
+		return nil, err
+	}
+
+	return buildHistory(metric.Type, current, samples, from, to, step), nil
+}
+
+// historyMemory текущее значение метрики и её история из памяти начиная с from
+func (ms *MemStorage) historyMemory(_ context.Context, metric *Metric, from time.Time) (float64, []Sample, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+
+	series := narrow(metric, ms.selectSeries(metric))
+	current, err := resolve(metric, series)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	history := ms.historyGauge
+	if metric.Type == TYPECOUNTER {
+		history = ms.historyCounter
+	}
+	var samples []Sample
+	for key := range series {
+		for _, s := range history[key] {
+			if !s.Time.Before(from) {
+				samples = append(samples, s)
+			}
+		}
+	}
+	return current, samples, nil
+}
+
+// pushHistory сохранение значения метрики в историю
+// вызывается под блокировкой, устаревшие значения серии отбрасываются сразу
+func (ms *MemStorage) pushHistory(metric *Metric, now time.Time) {
+	history := ms.historyGauge
+	if metric.Type == TYPECOUNTER {
+		history = ms.historyCounter
+	}
+	key := metric.Key()
+	samples := append(history[key], Sample{Time: now, Value: metric.Value})
+	history[key] = trimSamples(samples, now.Add(-ms.historyRetention))
+}
+
+// now текущее время сервера
+func (ms *MemStorage) now() time.Time {
+	if ms.clock != nil {
+		return ms.clock()
+	}
+	return time.Now()
+}
+
+// trimSamples отбрасывает значения старше before
+// значения упорядочены по времени
+func trimSamples(samples []Sample, before time.Time) []Sample {
+	idx := sort.Search(len(samples), func(i int) bool {
+		return !samples[i].Time.Before(before)
+	})
+	if idx == 0 {
+		return samples
+	}
+	return append(samples[:0], samples[idx:]...)
+}
+
+// buildHistory построение ответа по истории значений
+// для counter значения переводятся в накопленную сумму:
+// сумма на момент from вычисляется как текущее значение за вычетом приращений после from
+func buildHistory(mType string, current float64, samples []Sample, from, to time.Time, step time.Duration) []Sample {
+	sort.SliceStable(samples, func(i, j int) bool { return samples[i].Time.Before(samples[j].Time) })
+
+	if mType == TYPECOUNTER {
+		total := current
+		for _, s := range samples {
+			total -= s.Value
+		}
+		for i := range samples {
+			total += samples[i].Value
+			samples[i].Value = total
+		}
+	}
+
+	points := make([]Sample, 0, len(samples))
+	for _, s := range samples {
+		if s.Time.After(to) {
+			break
+		}
+		if step == 0 {
+			points = append(points, s)
+			continue
+		}
+		bucket := from.Add(s.Time.Sub(from) / step * step)
+		if len(points) > 0 && points[len(points)-1].Time.Equal(bucket) {
+			points[len(points)-1].Value = s.Value
+			continue
+		}
+		points = append(points, Sample{Time: bucket, Value: s.Value})
+	}
+	return points
+}
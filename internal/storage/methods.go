@@ -1,27 +1,87 @@
 package storage
 
 import (
+	"context"
 	"fmt"
 	"net/http"
+	"path/filepath"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
 
-	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage/fileio"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage/wal"
 )
 
-// New создаёт экземпляр хранилища с/без бэкапирования в файл и с хранением в оперативной памяти или в базе данных postgres
-func New(intervalBackup int, filepathBackup string, restoreFromBackup bool, db psql.StorDB) (*MemStorage, error) {
+func init() {
+	Register(BACKENDMEMORY, openMemory)
+	Register(BACKENDFILE, openFile)
+}
+
+// openMemory создание хранилища только в оперативной памяти
+func openMemory(opts Options) (Backend, error) {
+	storage, err := New(0, "", false)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HistoryRetention > 0 {
+		storage.SetHistoryRetention(opts.HistoryRetention)
+	}
+	return storage, nil
+}
+
+// openFile создание хранилища в оперативной памяти с бэкапом в файл
+// цикл бэкапа запускается сразу, останавливается в Close
+func openFile(opts Options) (Backend, error) {
+	if opts.FilePath == "" {
+		return nil, fmt.Errorf("%w: empty file storage path", ErrBackendOptions)
+	}
+	storage, err := New(opts.StoreInterval, opts.FilePath, opts.Restore)
+	if err != nil {
+		return nil, err
+	}
+	if opts.HistoryRetention > 0 {
+		storage.SetHistoryRetention(opts.HistoryRetention)
+	}
+	if opts.BackupKeep > 0 {
+		storage.backupFile.SetKeep(opts.BackupKeep)
+	}
+	err = storage.openAgents(filepath.Join(opts.FilePath, AGENTSFILENAME))
+	if err != nil {
+		storage.backupFile.Close()
+		return nil, err
+	}
+	if opts.WAL {
+		err = storage.openWAL(opts.FilePath, opts.WALSync, opts.WALSyncInterval, opts.Restore)
+		if err != nil {
+			storage.backupFile.Close()
+			return nil, err
+		}
+	}
+	go storage.BackupLoop()
+	return storage, nil
+}
+
+// New создаёт экземпляр хранилища в оперативной памяти с/без бэкапирования в файл
+// без пути к файлу бэкап не ведётся
+func New(intervalBackup int, filepathBackup string, restoreFromBackup bool) (*MemStorage, error) {
 	var storage MemStorage
 
-	if intervalBackup != 0 {
-		storage.backupTicker = time.NewTicker(time.Duration(intervalBackup) * time.Second)
-		storage.backupTickerChan = storage.backupTicker.C
-	} else {
-		storage.backupChan = make(chan struct{})
+	storage.historyGauge = make(map[string][]Sample)
+	storage.historyCounter = make(map[string][]Sample)
+	storage.historyRetention = HISTORYRETENTION
+	storage.done = make(chan struct{})
+
+	if filepathBackup != "" {
+		if intervalBackup != 0 {
+			storage.backupTicker = time.NewTicker(time.Duration(intervalBackup) * time.Second)
+			storage.backupTickerChan = storage.backupTicker.C
+		} else {
+			storage.backupChan = make(chan struct{})
+		}
 	}
 
 	var err error
@@ -31,138 +91,302 @@ func New(intervalBackup int, filepathBackup string, restoreFromBackup bool, db p
 		return nil, fmt.Errorf("fail while create/open file: %w", err)
 	}
 
-    
-	if db != nil {
-		storage.DB = db
-
-		err = db.CreateMetricsTable()
-		if err != nil {
-			return nil, fmt.Errorf("fail while create metrics table: %w", err)
-		}
-	} else if restoreFromBackup {
-		storage.ItemsGauge, storage.ItemsCounter, err = storage.backupFile.Read()
+	if restoreFromBackup {
+		data, err := storage.backupFile.ReadData()
 		if err != nil {
 			return nil, fmt.Errorf("fail while read from backup file: %w", err)
 		}
+		storage.ItemsGauge, storage.ItemsCounter, storage.CounterBase = data.ItemsGauge, data.ItemsCounter, data.CounterBase
+		storage.walSeq = data.WALSeq
 	} else {
 		storage.ItemsGauge = make(map[string]float64)
 		storage.ItemsCounter = make(map[string][]float64)
+		storage.CounterBase = make(map[string]float64)
 	}
 
 	return &storage, nil
 }
 
 // Push отправляет метрики на хранение
-func (ms *MemStorage) Push(metric *Metric) error {
-	switch ms.DB {
-	case nil:
-		ms.mu.Lock()
-		if metric == nil {
-			return ErrMetricEmpty
+// метрики с разными метками хранятся как отдельные серии
+// каждое значение также сохраняется в историю с отметкой времени сервера
+func (ms *MemStorage) Push(_ context.Context, metric *Metric) error {
+	if err := validatePush(metric); err != nil {
+		return err
+	}
+	ms.mu.Lock()
+	now := ms.now()
+	if ms.wal != nil {
+		seq, err := ms.wal.Append(wal.Record{Type: metric.Type, Name: metric.Name, Labels: metric.Labels, Value: metric.Value, Time: now})
+		if err != nil {
+			ms.mu.Unlock()
+			return fmt.Errorf("fail while append to wal: %w", err)
 		}
-		switch metric.Type {
-		case TYPEGAUGE:
-			ms.ItemsGauge[metric.Name] = metric.Value
-		case TYPECOUNTER:
-			ms.ItemsCounter[metric.Name] = append(ms.ItemsCounter[metric.Name], metric.Value)
-		default:
-			return ErrMetricTypeUnknown
+		ms.walSeq = seq
+	}
+	ms.apply(metric, now)
+	ms.mu.Unlock()
+	if ms.backupChan != nil {
+		select {
+		case ms.backupChan <- struct{}{}:
+		case <-ms.done:
 		}
-		ms.mu.Unlock()
-	default:
-		if metric == nil {
-			return ErrMetricEmpty
+	}
+	return nil
+}
+
+// apply применение значения метрики к картам и истории
+// вызывается под блокировкой
+func (ms *MemStorage) apply(metric *Metric, now time.Time) {
+	switch metric.Type {
+	case TYPEGAUGE:
+		ms.ItemsGauge[metric.Key()] = metric.Value
+	case TYPECOUNTER:
+		ms.ItemsCounter[metric.Key()] = append(ms.ItemsCounter[metric.Key()], metric.Value)
+	}
+	ms.pushHistory(metric, now)
+}
+
+// PushBatch сохраняет пачку метрик и возвращает их обновлённые значения
+// пачка проверяется целиком до записи и применяется под одной блокировкой,
+// так что конкурентные запросы не видят её частично
+func (ms *MemStorage) PushBatch(_ context.Context, items []Metric) ([]Metric, error) {
+	for i := range items {
+		if err := validatePush(&items[i]); err != nil {
+			return nil, err
 		}
-		switch metric.Type {
-		case TYPEGAUGE:
-			err := ms.DB.PushReplace(metric.Type, metric.Name, metric.Value)
-			if err != nil {
-				return fmt.Errorf("fail while push gauge to db: %w", err)
-			}
-		case TYPECOUNTER:
-			err := ms.DB.PushAdd(metric.Type, metric.Name, metric.Value)
+	}
+	ms.mu.Lock()
+	now := ms.now()
+	for i := range items {
+		if ms.wal != nil {
+			seq, err := ms.wal.Append(wal.Record{Type: items[i].Type, Name: items[i].Name, Labels: items[i].Labels, Value: items[i].Value, Time: now})
 			if err != nil {
-				return fmt.Errorf("fail while push counter to db: %w", err)
+				ms.mu.Unlock()
+				return nil, fmt.Errorf("fail while append to wal: %w", err)
 			}
-		default:
-			return ErrMetricTypeUnknown
+			ms.walSeq = seq
+		}
+		ms.apply(&items[i], now)
+		renewValue, err := resolve(&items[i], ms.selectSeries(&items[i]))
+		if err != nil {
+			ms.mu.Unlock()
+			return nil, fmt.Errorf("fail while control renew data: %w", err)
 		}
+		items[i].Value = renewValue
 	}
-	if ms.backupChan != nil {
-		ms.backupChan <- struct{}{}
+	ms.mu.Unlock()
+	if ms.backupChan != nil && len(items) > 0 {
+		select {
+		case ms.backupChan <- struct{}{}:
+		case <-ms.done:
+		}
 	}
-	return nil
+	return items, nil
 }
 
 // Get получение значения конкретной метрики
-func (ms *MemStorage) Get(metric *Metric) (float64, error) {
-	switch ms.DB {
-	case nil:
-		ms.mu.Lock()
-		defer ms.mu.Unlock()
-		if metric == nil {
-			return 0, ErrMetricEmpty
+// метки метрики работают как фильтр: если серии с точно такими метками нет,
+// значения counter по всем подходящим сериям суммируются,
+// а для gauge подходящая серия должна быть единственной
+func (ms *MemStorage) Get(_ context.Context, metric *Metric) (float64, error) {
+	if err := validateGet(metric); err != nil {
+		return 0, err
+	}
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return resolve(metric, ms.selectSeries(metric))
+}
+
+// selectSeries отбор серий метрики из памяти, подходящих под метки
+// вызывается под блокировкой
+func (ms *MemStorage) selectSeries(metric *Metric) map[string][]float64 {
+	series := make(map[string][]float64)
+	key := metric.Key()
+	switch metric.Type {
+	case TYPEGAUGE:
+		if v, ok := ms.ItemsGauge[key]; ok {
+			series[key] = []float64{v}
+			return series
 		}
-		switch metric.Type {
-		case TYPEGAUGE:
-			result, ok := ms.ItemsGauge[metric.Name]
-			if !ok {
-				return 0, ErrMetricNoData
-			}
-			return result, nil
-		case TYPECOUNTER:
-			values, ok := ms.ItemsCounter[metric.Name]
-			if !ok {
-				return 0, ErrMetricNoData
+		for k, v := range ms.ItemsGauge {
+			if name, l := labels.ParseKey(k); name == metric.Name && l.Match(metric.Labels) {
+				series[k] = []float64{v}
 			}
-			var result float64
-			for _, v := range values {
-				result += v
-			}
-			return result, nil
-		default:
-			return 0, ErrMetricTypeUnknown
 		}
-	default:
-		if metric == nil {
-			return 0, ErrMetricEmpty
+	case TYPECOUNTER:
+		if _, ok := ms.ItemsCounter[key]; ok {
+			series[key] = ms.counterValues(key)
+			return series
 		}
-		switch metric.Type {
-		case TYPEGAUGE:
-			return ms.DB.GetOneValue(metric.Type, metric.Name)
-		case TYPECOUNTER:
-			values, err := ms.DB.GetArrayValues(metric.Type, metric.Name)
-			if err != nil {
-				return 0, fmt.Errorf("error while get value from postgres: %v", err)
+		for k := range ms.ItemsCounter {
+			if name, l := labels.ParseKey(k); name == metric.Name && l.Match(metric.Labels) {
+				series[k] = ms.counterValues(k)
 			}
-			var result float64
-			for _, v := range values {
-				result += v
+		}
+	}
+	return series
+}
+
+// counterValues значения серии counter вместе с накопленной суммой свёрнутых приращений
+// вызывается под блокировкой
+func (ms *MemStorage) counterValues(key string) []float64 {
+	values := ms.ItemsCounter[key]
+	base, ok := ms.CounterBase[key]
+	if !ok {
+		return values
+	}
+	return append([]float64{base}, values...)
+}
+
+// counterSeries все серии counter вместе с накопленными суммами
+// вызывается под блокировкой
+func (ms *MemStorage) counterSeries() map[string][]float64 {
+	if len(ms.CounterBase) == 0 {
+		return ms.ItemsCounter
+	}
+	series := make(map[string][]float64, len(ms.ItemsCounter))
+	for k := range ms.ItemsCounter {
+		series[k] = ms.counterValues(k)
+	}
+	return series
+}
+
+// narrow оставляет из отобранных серий только серию с точно совпадающими метками, если она есть
+func narrow(metric *Metric, series map[string][]float64) map[string][]float64 {
+	if values, ok := series[metric.Key()]; ok && len(series) > 1 {
+		return map[string][]float64{metric.Key(): values}
+	}
+	return series
+}
+
+// resolve вычисление значения метрики по отобранным сериям
+func resolve(metric *Metric, series map[string][]float64) (float64, error) {
+	if len(series) == 0 {
+		return 0, ErrMetricNoData
+	}
+	series = narrow(metric, series)
+	switch metric.Type {
+	case TYPEGAUGE:
+		if len(series) > 1 {
+			return 0, ErrMetricAmbiguous
+		}
+		for _, values := range series {
+			if len(values) == 0 {
+				return 0, ErrMetricNoData
 			}
-			return result, nil
-		default:
-			return 0, ErrMetricTypeUnknown
+			return values[len(values)-1], nil
+		}
+	case TYPECOUNTER:
+		var result float64
+		for _, values := range series {
+			result += sum(values)
 		}
+		return result, nil
 	}
+	return 0, ErrMetricTypeUnknown
 }
 
 // List предоставляет весь список хранимых метрик в формате ряда отформатированных записей
-func (ms *MemStorage) List() ([]string, error) {
-	var mapGauge map[string]float64
-	var mapCounter map[string][]float64
-	var err error
-	switch ms.DB {
-	case nil:
-		mapGauge = ms.ItemsGauge
-		mapCounter = ms.ItemsCounter
-	default:
-		mapGauge, mapCounter, err = ms.DB.List(TYPEGAUGE, TYPECOUNTER)
+func (ms *MemStorage) List(_ context.Context) ([]string, error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return formatList(ms.ItemsGauge, ms.counterSeries()), nil
+}
+
+// Snapshot предоставляет текущие значения всех хранимых метрик
+// ключами служат ключи серий labels.Key
+// для counter возвращается накопленная сумма
+func (ms *MemStorage) Snapshot(_ context.Context) (gauges map[string]float64, counters map[string]float64, err error) {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	return snapshot(ms.ItemsGauge, ms.counterSeries())
+}
+
+// Ping хранилище в памяти доступно всегда
+func (ms *MemStorage) Ping(_ context.Context) error {
+	return nil
+}
+
+// Close останавливает бэкап, сохраняет последние данные и закрывает файл бэкапа
+// повторный вызов ничего не делает
+func (ms *MemStorage) Close() error {
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if ms.closed {
+		return nil
+	}
+	ms.closed = true
+	close(ms.done)
+	if ms.backupTicker != nil {
+		ms.backupTicker.Stop()
+	}
+	err := ms.backupFile.Write(ms.backupData())
+	if err != nil {
+		return fmt.Errorf("fail while write backup: %w", err)
+	}
+	if ms.wal != nil {
+		err = ms.truncateWAL()
 		if err != nil {
-			return nil, fmt.Errorf("fail while get list of metrics from db: %w", err)
+			return err
+		}
+		err = ms.wal.Close()
+		if err != nil {
+			return fmt.Errorf("fail while close wal: %w", err)
+		}
+	}
+	return ms.backupFile.Close()
+}
+
+// BackupLoop сохраняет периодически метрики в бэкап
+// завершается после Close
+func (ms *MemStorage) BackupLoop() {
+	for {
+		select {
+		case <-ms.done:
+			return
+		case <-ms.backupChan:
+			ms.backup()
+		case <-ms.backupTickerChan:
+			ms.backup()
 		}
 	}
+}
+
+// backup запись текущих данных в файл бэкапа
+// после успешной записи журнал wal больше не нужен и очищается
+func (ms *MemStorage) backup() {
 	ms.mu.Lock()
 	defer ms.mu.Unlock()
+	if ms.closed {
+		return
+	}
+	err := ms.backupFile.Write(ms.backupData())
+	if err != nil {
+		logger.Error(err)
+		return
+	}
+	if ms.wal != nil {
+		err = ms.truncateWAL()
+		if err != nil {
+			logger.Error(err)
+		}
+	}
+}
+
+// backupData данные для записи в бэкап
+// вызывается под блокировкой
+func (ms *MemStorage) backupData() *fileio.Data {
+	return &fileio.Data{
+		ItemsGauge:   ms.ItemsGauge,
+		ItemsCounter: ms.ItemsCounter,
+		CounterBase:  ms.CounterBase,
+		WALSeq:       ms.walSeq,
+	}
+}
+
+// formatList форматирование перечня метрик
+func formatList(mapGauge map[string]float64, mapCounter map[string][]float64) []string {
 	list := make([]string, len(mapGauge)+len(mapCounter))
 	var listMu sync.Mutex
 	var wg sync.WaitGroup
@@ -172,56 +396,20 @@ func (ms *MemStorage) List() ([]string, error) {
 
 	wg.Wait()
 
-	return list, nil
+	return list
 }
 
-// BackupLoop сохраняет периодически метрики в бэкап
-func (ms *MemStorage) BackupLoop() {
-	defer func() {
-		ms.mu.Lock()
-		err := ms.backupFile.Write(&fileio.Data{
-			ItemsGauge:   ms.ItemsGauge,
-			ItemsCounter: ms.ItemsCounter,
-		})
-		ms.mu.Unlock()
-		if err != nil {
-			logger.Error(err)
-		}
-		if ms.backupTicker != nil {
-			ms.backupTicker.Stop()
-		}
-		if ms.backupChan != nil {
-			close(ms.backupChan)
-		}
-		err = ms.backupFile.Close()
-		if err != nil {
-			logger.Error(fmt.Sprintf("fail whil close file: %v", err))
-		}
-	}()
-	for {
-		select {
-		case <-ms.backupChan:
-			ms.mu.Lock()
-			err := ms.backupFile.Write(&fileio.Data{
-				ItemsGauge:   ms.ItemsGauge,
-				ItemsCounter: ms.ItemsCounter,
-			})
-			ms.mu.Unlock()
-			if err != nil {
-				logger.Error(err)
-			}
-		case <-ms.backupTickerChan:
-			ms.mu.Lock()
-			err := ms.backupFile.Write(&fileio.Data{
-				ItemsGauge:   ms.ItemsGauge,
-				ItemsCounter: ms.ItemsCounter,
-			})
-			ms.mu.Unlock()
-			if err != nil {
-				logger.Error(err)
-			}
-		}
+// snapshot копия значений серий, для counter - сумма приращений
+func snapshot(mapGauge map[string]float64, mapCounter map[string][]float64) (map[string]float64, map[string]float64, error) {
+	gauges := make(map[string]float64, len(mapGauge))
+	counters := make(map[string]float64, len(mapCounter))
+	for n, v := range mapGauge {
+		gauges[n] = v
 	}
+	for n, values := range mapCounter {
+		counters[n] = sum(values)
+	}
+	return gauges, counters, nil
 }
 
 // listGauge получение отформатированного перечня метрик gauge
@@ -255,6 +443,15 @@ func listCounter(lenGauge int, counter map[string][]float64, list *[]string, wg
 	}
 }
 
+// sum сумма значений counter
+func sum(values []float64) float64 {
+	var result float64
+	for _, v := range values {
+		result += v
+	}
+	return result
+}
+
 // ValidateAndConvert используется для валидации метрик поступающих в хранилище
 func ValidateAndConvert(method, mType, mName, mValue string) (*Metric, error) {
 	var result Metric
@@ -6,8 +6,9 @@ import (
 	"sync"
 	"time"
 
-	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage/fileio"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage/wal"
 )
 
 // Типы метрик
@@ -19,29 +20,44 @@ const (
 // Название файла с бэкапом
 const BACKUPFILENAME = "backup"
 
-// Stor внешний интерфейс для хранилища метрик
-type Stor interface {
-	Push(name, value, typeMetric string) error
-	Pop(name string) ([]string, error)
-}
-
-// MemStorage структура, которая используется для хранения метрик в оперативной памяти и реализует интерфейс Stor 
+// MemStorage хранилище метрик в оперативной памяти с необязательным бэкапом в файл,
+// реализует Backend под именами memory и file
+// при включённом журнале wal каждая запись сначала дописывается в него, walSeq - номер последней записи
+// ключами ItemsGauge и ItemsCounter служат ключи серий labels.Key: имя метрики и её метки
+// CounterBase хранит накопленные суммы приращений counter, свёрнутых при компактизации
+// agentKeys - ключи агентов, при бэкапе в файл они сохраняются в agentsPath, см. KeyStore
 type MemStorage struct {
-	DB               psql.StorDB
 	ItemsGauge       map[string]float64
 	ItemsCounter     map[string][]float64
+	CounterBase      map[string]float64
 	backupChan       chan struct{}
 	backupTickerChan <-chan time.Time
 	backupTicker     *time.Ticker
 	backupFile       *fileio.File
+	wal              *wal.WAL
+	walSeq           uint64
+	historyGauge     map[string][]Sample
+	historyCounter   map[string][]Sample
+	historyRetention time.Duration
+	clock            func() time.Time
+	agentKeys        []AgentKey
+	agentsPath       string
+	done             chan struct{}
+	closed           bool
 	mu               sync.Mutex
 }
 
 // Metric единичная метрика
 type Metric struct {
-	Type  string  `json:"type"`
-	Name  string  `json:"id"`
-	Value float64 `json:"-"`
+	Type   string        `json:"type"`
+	Name   string        `json:"id"`
+	Labels labels.Labels `json:"labels,omitempty"`
+	Value  float64       `json:"-"`
+}
+
+// Key ключ серии метрики с учётом меток
+func (m *Metric) Key() string {
+	return labels.Key(m.Name, m.Labels)
 }
 
 // MarshalJSON кастомная сериализация для Metric 
@@ -0,0 +1,314 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+)
+
+func init() {
+	Register(BACKENDPOSTGRES, openPostgres)
+}
+
+// DBStorage хранилище метрик в базе данных postgres, реализует Backend под именем postgres
+type DBStorage struct {
+	DB               psql.StorDB
+	Replica          psql.StorDB // реплика для чтения значений, nil - всё читается из DB
+	replica          replicaState
+	historyRetention time.Duration
+	lastTrim         time.Time
+	clock            func() time.Time
+	mu               sync.Mutex
+}
+
+// openPostgres подключение к базе данных и создание хранилища поверх неё
+func openPostgres(opts Options) (Backend, error) {
+	if opts.DSN == "" {
+		return nil, fmt.Errorf("%w: empty database dsn", ErrBackendOptions)
+	}
+	ctx := context.Background()
+	pool := psql.PoolConfig{
+		MaxOpenConns:     opts.MaxOpenConns,
+		MaxIdleConns:     opts.MaxIdleConns,
+		ConnMaxLifetime:  opts.ConnMaxLifetime,
+		StatementTimeout: opts.StatementTimeout,
+	}
+	db, err := psql.ConnectDB(ctx, opts.DSN, pool)
+	if err != nil {
+		return nil, fmt.Errorf("fail while connect to db: %w", err)
+	}
+	if opts.QueryTimeout > 0 {
+		db.SetQueryTimeout(opts.QueryTimeout)
+	}
+	storage, err := NewDB(ctx, db)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+	if opts.HistoryRetention > 0 {
+		storage.SetHistoryRetention(opts.HistoryRetention)
+	}
+	if opts.ReplicaDSN != "" {
+		// недоступная при старте реплика не мешает работе, чтение идёт с основной базы
+		replica, err := psql.OpenDB(opts.ReplicaDSN, pool)
+		if err != nil {
+			db.Close()
+			return nil, fmt.Errorf("fail while open replica: %w", err)
+		}
+		if opts.QueryTimeout > 0 {
+			replica.SetQueryTimeout(opts.QueryTimeout)
+		}
+		storage.SetReplica(replica, opts.ReplicaMaxLag)
+	}
+	return storage, nil
+}
+
+// NewDB создаёт хранилище поверх подключения к базе данных, схема приводится к последней версии
+func NewDB(ctx context.Context, db psql.StorDB) (*DBStorage, error) {
+	err := db.Migrate(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("fail while migrate db: %w", err)
+	}
+	return &DBStorage{
+		DB:               db,
+		historyRetention: HISTORYRETENTION,
+	}, nil
+}
+
+// Push отправляет метрики на хранение
+// каждое значение также сохраняется в историю с отметкой времени сервера
+// значение и история пишутся в одной транзакции, как пачка из одной метрики:
+// при ошибке не остаётся ни того, ни другого, и повтор запроса агентом не учтёт counter дважды
+func (ds *DBStorage) Push(ctx context.Context, metric *Metric) error {
+	if err := validatePush(metric); err != nil {
+		return err
+	}
+	now := ds.now()
+	_, err := ds.DB.PushBatch(ctx, TYPEGAUGE, []psql.BatchItem{{
+		MetricType: metric.Type,
+		MetricName: metric.Name,
+		Labels:     metric.Labels,
+		Value:      metric.Value,
+	}}, now)
+	if err != nil {
+		return fmt.Errorf("fail while push %s to db: %w", metric.Type, err)
+	}
+	return ds.trimHistory(ctx, now)
+}
+
+// PushBatch сохраняет пачку метрик в одной транзакции и возвращает их обновлённые значения
+// при ошибке в базе не остаётся ни одного значения из пачки
+func (ds *DBStorage) PushBatch(ctx context.Context, items []Metric) ([]Metric, error) {
+	batch := make([]psql.BatchItem, len(items))
+	for i := range items {
+		if err := validatePush(&items[i]); err != nil {
+			return nil, err
+		}
+		batch[i] = psql.BatchItem{
+			MetricType: items[i].Type,
+			MetricName: items[i].Name,
+			Labels:     items[i].Labels,
+			Value:      items[i].Value,
+		}
+	}
+	now := ds.now()
+	values, err := ds.DB.PushBatch(ctx, TYPEGAUGE, batch, now)
+	if err != nil {
+		return nil, fmt.Errorf("fail while push batch to db: %w", err)
+	}
+	for i := range items {
+		items[i].Value = values[i]
+	}
+	return items, ds.trimHistory(ctx, now)
+}
+
+// Get получение значения конкретной метрики
+// метки работают как фильтр так же, как в MemStorage.Get
+func (ds *DBStorage) Get(ctx context.Context, metric *Metric) (float64, error) {
+	if err := validateGet(metric); err != nil {
+		return 0, err
+	}
+	var series map[string][]float64
+	err := ds.read(ctx, func(db psql.StorDB) (err error) {
+		series, err = db.Select(ctx, metric.Type, metric.Name, metric.Labels)
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error while get value from postgres: %w", err)
+	}
+	return resolve(metric, series)
+}
+
+// List предоставляет весь список хранимых метрик в формате ряда отформатированных записей
+func (ds *DBStorage) List(ctx context.Context) ([]string, error) {
+	var mapGauge map[string]float64
+	var mapCounter map[string][]float64
+	err := ds.read(ctx, func(db psql.StorDB) (err error) {
+		mapGauge, mapCounter, err = db.List(ctx, TYPEGAUGE, TYPECOUNTER)
+		return err
+	})
+	if err != nil {
+		return nil, fmt.Errorf("fail while get list of metrics from db: %w", err)
+	}
+	return formatList(mapGauge, mapCounter), nil
+}
+
+// Snapshot предоставляет текущие значения всех хранимых метрик
+// для counter возвращается накопленная сумма
+func (ds *DBStorage) Snapshot(ctx context.Context) (gauges map[string]float64, counters map[string]float64, err error) {
+	mapGauge, mapCounter, err := ds.DB.List(ctx, TYPEGAUGE, TYPECOUNTER)
+	if err != nil {
+		return nil, nil, fmt.Errorf("fail while get list of metrics from db: %w", err)
+	}
+	return snapshot(mapGauge, mapCounter)
+}
+
+// History получение истории значений метрики за период [from, to]
+// параметры те же, что у MemStorage.History
+func (ds *DBStorage) History(ctx context.Context, metric *Metric, from, to time.Time, step time.Duration) ([]Sample, error) {
+	ds.mu.Lock()
+	now := ds.now()
+	retention := ds.historyRetention
+	ds.mu.Unlock()
+	return history(ctx, metric, from, to, step, now, retention, ds.historyDB)
+}
+
+// Aggregate вычисление агрегата по истории значений на стороне базы, см. Query
+// серии отбираются так же, как в Get: если есть серия с точно совпадающими метками, агрегируется только она
+func (ds *DBStorage) Aggregate(ctx context.Context, q *Query) (float64, error) {
+	if err := validateQuery(q); err != nil {
+		return 0, err
+	}
+	ds.mu.Lock()
+	now := ds.now()
+	ds.mu.Unlock()
+
+	var value float64
+	var count int64
+	err := ds.read(ctx, func(db psql.StorDB) error {
+		series, err := db.Select(ctx, q.Metric.Type, q.Metric.Name, q.Metric.Labels)
+		if err != nil {
+			return err
+		}
+		_, exact := series[q.Metric.Key()]
+		value, count, err = db.Aggregate(ctx, psql.AggregateQuery{
+			MetricType: q.Metric.Type,
+			MetricName: q.Metric.Name,
+			Labels:     q.Metric.Labels,
+			Exact:      exact,
+			Func:       aggregateFunc(q.Func),
+			Quantile:   q.Quantile,
+			From:       now.Add(-q.Range),
+			To:         now,
+		})
+		return err
+	})
+	if err != nil {
+		return 0, fmt.Errorf("error while aggregate history in postgres: %w", err)
+	}
+	if count == 0 {
+		return 0, ErrMetricNoData
+	}
+	if q.Func == QUERYRATE {
+		value /= q.Range.Seconds()
+	}
+	return value, nil
+}
+
+// aggregateFunc агрегатная функция базы для функции запроса, rate считается от суммы
+func aggregateFunc(fn string) string {
+	if fn == QUERYRATE {
+		return psql.AGGSUM
+	}
+	return fn
+}
+
+// SetHistoryRetention задаёт время хранения истории значений метрик
+func (ds *DBStorage) SetHistoryRetention(retention time.Duration) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.historyRetention = retention
+}
+
+// Compact сворачивает старые приращения counter в накопленную сумму
+func (ds *DBStorage) Compact(ctx context.Context, keep int) error {
+	if keep < 0 {
+		keep = 0
+	}
+	err := ds.DB.CompactCounters(ctx, TYPECOUNTER, keep)
+	if err != nil {
+		return fmt.Errorf("fail while compact counters in db: %w", err)
+	}
+	return nil
+}
+
+// Ping проверка подключения к базе данных
+func (ds *DBStorage) Ping(ctx context.Context) error {
+	return ds.DB.PingDB(ctx)
+}
+
+// DBStats статистика пула подключений к базе данных
+func (ds *DBStorage) DBStats() sql.DBStats {
+	return ds.DB.Stats()
+}
+
+// Close закрытие подключений к базе данных и реплике
+func (ds *DBStorage) Close() error {
+	return errors.Join(ds.DB.Close(), ds.closeReplica())
+}
+
+// historyDB текущее значение метрики и её история из базы данных начиная с from
+func (ds *DBStorage) historyDB(ctx context.Context, metric *Metric, from time.Time) (float64, []Sample, error) {
+	series, err := ds.DB.Select(ctx, metric.Type, metric.Name, metric.Labels)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while get value from postgres: %w", err)
+	}
+	series = narrow(metric, series)
+	current, err := resolve(metric, series)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	history, err := ds.DB.History(ctx, metric.Type, metric.Name, metric.Labels, from)
+	if err != nil {
+		return 0, nil, fmt.Errorf("error while get history from postgres: %w", err)
+	}
+	var samples []Sample
+	for key := range series {
+		for _, s := range history[key] {
+			samples = append(samples, Sample{Time: s.Time, Value: s.Value})
+		}
+	}
+	return current, samples, nil
+}
+
+// trimHistory удаление устаревших значений истории не чаще HISTORYTRIMINTERVAL
+func (ds *DBStorage) trimHistory(ctx context.Context, now time.Time) error {
+	ds.mu.Lock()
+	trim := now.Sub(ds.lastTrim) >= HISTORYTRIMINTERVAL
+	if trim {
+		ds.lastTrim = now
+	}
+	retention := ds.historyRetention
+	ds.mu.Unlock()
+	if trim {
+		err := ds.DB.TrimHistory(ctx, now.Add(-retention))
+		if err != nil {
+			return fmt.Errorf("fail while trim history in db: %w", err)
+		}
+	}
+	return nil
+}
+
+// now текущее время сервера
+func (ds *DBStorage) now() time.Time {
+	if ds.clock != nil {
+		return ds.clock()
+	}
+	return time.Now()
+}
@@ -0,0 +1,202 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+)
+
+// Функции агрегирования выражения запроса
+const (
+	QUERYSUM      = "sum"      // сумма значений
+	QUERYAVG      = "avg"      // среднее значение
+	QUERYMIN      = "min"      // минимальное значение
+	QUERYMAX      = "max"      // максимальное значение
+	QUERYCOUNT    = "count"    // количество значений
+	QUERYRATE     = "rate"     // прирост counter в секунду
+	QUERYQUANTILE = "quantile" // квантиль значений, доля задаётся первым аргументом
+)
+
+// Query разобранное выражение агрегирования, например rate(counter:PollCount[5m])
+// агрегат вычисляется по значениям истории за последние Range всех серий, отобранных метками Metric,
+// метки работают как фильтр так же, как в Get
+// для counter агрегируются приращения: sum - прирост за период, rate - прирост в секунду
+type Query struct {
+	Func     string
+	Quantile float64 // доля от 0 до 1 для quantile
+	Metric   Metric  // тип, имя и метки, значение не используется
+	Range    time.Duration
+}
+
+// Aggregator хранилище, вычисляющее агрегаты по истории значений
+// реализуется хранилищами с историей, см. Query
+type Aggregator interface {
+	Aggregate(ctx context.Context, q *Query) (float64, error)
+}
+
+// ParseQuery разбор выражения вида func(type:name{k="v"}[range]) или quantile(0.95, type:name[range])
+// range - длительность (30s, 5m), значения старше времени хранения истории в агрегат не попадут
+func ParseQuery(expr string) (*Query, error) {
+	expr = strings.TrimSpace(expr)
+	open := strings.IndexByte(expr, '(')
+	if open <= 0 || !strings.HasSuffix(expr, ")") {
+		return nil, fmt.Errorf("%w: expected func(selector)", ErrQuery)
+	}
+	q := &Query{Func: strings.TrimSpace(expr[:open])}
+	args := expr[open+1 : len(expr)-1]
+
+	switch q.Func {
+	case QUERYSUM, QUERYAVG, QUERYMIN, QUERYMAX, QUERYCOUNT, QUERYRATE:
+	case QUERYQUANTILE:
+		param, rest, ok := strings.Cut(args, ",")
+		if !ok {
+			return nil, fmt.Errorf("%w: quantile expects quantile(phi, selector)", ErrQuery)
+		}
+		phi, err := strconv.ParseFloat(strings.TrimSpace(param), 64)
+		if err != nil || phi < 0 || phi > 1 {
+			return nil, fmt.Errorf("%w: quantile must be between 0 and 1", ErrQuery)
+		}
+		q.Quantile = phi
+		args = rest
+	default:
+		return nil, fmt.Errorf("%w: unknown function %q", ErrQuery, q.Func)
+	}
+
+	err := parseSelector(strings.TrimSpace(args), q)
+	if err != nil {
+		return nil, err
+	}
+	if q.Func == QUERYRATE && q.Metric.Type != TYPECOUNTER {
+		return nil, fmt.Errorf("%w: rate applies only to counter", ErrQuery)
+	}
+	return q, nil
+}
+
+// parseSelector разбор селектора type:name{k="v"}[range] в q
+func parseSelector(source string, q *Query) error {
+	open := strings.LastIndexByte(source, '[')
+	if open < 0 || !strings.HasSuffix(source, "]") {
+		return fmt.Errorf("%w: selector needs range, e.g. [5m]", ErrQuery)
+	}
+	rng, err := time.ParseDuration(source[open+1 : len(source)-1])
+	if err != nil || rng <= 0 {
+		return fmt.Errorf("%w: wrong range %q", ErrQuery, source[open+1:len(source)-1])
+	}
+	q.Range = rng
+
+	mType, key, ok := strings.Cut(source[:open], ":")
+	if !ok {
+		return fmt.Errorf("%w: selector needs type:name", ErrQuery)
+	}
+	if mType != TYPEGAUGE && mType != TYPECOUNTER {
+		return fmt.Errorf("%w: %w", ErrQuery, ErrMetricTypeUnknown)
+	}
+	name, l := labels.ParseKey(key)
+	if name == "" || strings.ContainsAny(name, "{}") {
+		return fmt.Errorf("%w: wrong metric name or labels %q", ErrQuery, key)
+	}
+	q.Metric = Metric{Type: mType, Name: name, Labels: l}
+	return nil
+}
+
+// String выражение запроса в каноническом виде
+func (q *Query) String() string {
+	selector := q.Metric.Type + ":" + q.Metric.Key() + "[" + formatRange(q.Range) + "]"
+	if q.Func == QUERYQUANTILE {
+		return q.Func + "(" + strconv.FormatFloat(q.Quantile, 'g', -1, 64) + ", " + selector + ")"
+	}
+	return q.Func + "(" + selector + ")"
+}
+
+// formatRange длительность без нулевых младших единиц: 5m вместо 5m0s
+func formatRange(d time.Duration) string {
+	s := d.String()
+	if strings.HasSuffix(s, "m0s") {
+		s = strings.TrimSuffix(s, "0s")
+	}
+	if strings.HasSuffix(s, "h0m") {
+		s = strings.TrimSuffix(s, "0m")
+	}
+	return s
+}
+
+// evaluate вычисление агрегата по значениям в памяти
+// квантиль интерполируется линейно, как percentile_cont в postgres
+func evaluate(q *Query, values []float64) (float64, error) {
+	if len(values) == 0 {
+		return 0, ErrMetricNoData
+	}
+	switch q.Func {
+	case QUERYSUM:
+		return sum(values), nil
+	case QUERYRATE:
+		return sum(values) / q.Range.Seconds(), nil
+	case QUERYAVG:
+		return sum(values) / float64(len(values)), nil
+	case QUERYMIN:
+		result := math.Inf(1)
+		for _, v := range values {
+			result = math.Min(result, v)
+		}
+		return result, nil
+	case QUERYMAX:
+		result := math.Inf(-1)
+		for _, v := range values {
+			result = math.Max(result, v)
+		}
+		return result, nil
+	case QUERYCOUNT:
+		return float64(len(values)), nil
+	case QUERYQUANTILE:
+		sorted := append([]float64(nil), values...)
+		sort.Float64s(sorted)
+		pos := q.Quantile * float64(len(sorted)-1)
+		lower := int(math.Floor(pos))
+		if lower >= len(sorted)-1 {
+			return sorted[len(sorted)-1], nil
+		}
+		return sorted[lower] + (sorted[lower+1]-sorted[lower])*(pos-float64(lower)), nil
+	}
+	return 0, fmt.Errorf("%w: unknown function %q", ErrQuery, q.Func)
+}
+
+// validateQuery общая проверка запроса перед вычислением
+func validateQuery(q *Query) error {
+	if q == nil {
+		return ErrQuery
+	}
+	if q.Range <= 0 {
+		return fmt.Errorf("%w: wrong range", ErrQuery)
+	}
+	return validateGet(&q.Metric)
+}
+
+// Aggregate вычисление агрегата по истории значений в памяти
+func (ms *MemStorage) Aggregate(_ context.Context, q *Query) (float64, error) {
+	if err := validateQuery(q); err != nil {
+		return 0, err
+	}
+	ms.mu.Lock()
+	now := ms.now()
+	from := now.Add(-q.Range)
+	history := ms.historyGauge
+	if q.Metric.Type == TYPECOUNTER {
+		history = ms.historyCounter
+	}
+	var values []float64
+	for key := range ms.selectSeries(&q.Metric) {
+		for _, s := range history[key] {
+			if !s.Time.Before(from) && !s.Time.After(now) {
+				values = append(values, s.Value)
+			}
+		}
+	}
+	ms.mu.Unlock()
+	return evaluate(q, values)
+}
@@ -0,0 +1,123 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+)
+
+// Настройки чтения с реплики
+const (
+	REPLICAMAXLAG        = 10 * time.Second // допустимое отставание реплики по умолчанию
+	REPLICACHECKINTERVAL = 5 * time.Second  // как часто проверяется отставание реплики
+)
+
+// replicaState состояние реплики по последней проверке
+type replicaState struct {
+	maxLag    time.Duration
+	healthy   bool
+	checkedAt time.Time
+}
+
+// primaryKey ключ контекста, требующего чтения с основной базы
+type primaryKey struct{}
+
+// WithPrimary контекст, чтения в котором идут в основную базу,
+// нужен, чтобы прочитать только что записанное: реплика может его ещё не получить
+func WithPrimary(ctx context.Context) context.Context {
+	return context.WithValue(ctx, primaryKey{}, true)
+}
+
+// SetReplica задаёт реплику, с которой читаются значения метрик в Get и List
+// maxLag допустимое отставание реплики, 0 - по умолчанию
+// запись и остальные чтения всегда идут в основную базу
+func (ds *DBStorage) SetReplica(replica psql.StorDB, maxLag time.Duration) {
+	if maxLag <= 0 {
+		maxLag = REPLICAMAXLAG
+	}
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.Replica = replica
+	ds.replica = replicaState{maxLag: maxLag}
+}
+
+// read выполнение чтения на реплике, если она пригодна, иначе на основной базе
+// при ошибке на реплике чтение повторяется на основной базе,
+// а реплика не используется до следующей проверки
+func (ds *DBStorage) read(ctx context.Context, read func(db psql.StorDB) error) error {
+	db := ds.reader(ctx)
+	if db == ds.DB {
+		return read(ds.DB)
+	}
+	err := read(db)
+	if err == nil || ctx.Err() != nil {
+		return err
+	}
+	logger.Error(fmt.Sprintf("fail while read from replica, fallback to primary: %v", err))
+	ds.setReplicaHealth(false, ds.now())
+	return read(ds.DB)
+}
+
+// reader база для чтения: реплика, если она задана, доступна и отстаёт не больше допустимого,
+// иначе основная база; отставание проверяется не чаще REPLICACHECKINTERVAL
+func (ds *DBStorage) reader(ctx context.Context) psql.StorDB {
+	ds.mu.Lock()
+	replica := ds.Replica
+	state := ds.replica
+	now := ds.now()
+	ds.mu.Unlock()
+	if replica == nil || ctx.Value(primaryKey{}) != nil {
+		return ds.DB
+	}
+	if !state.checkedAt.IsZero() && now.Sub(state.checkedAt) < REPLICACHECKINTERVAL {
+		if state.healthy {
+			return replica
+		}
+		return ds.DB
+	}
+
+	lag, err := replica.ReplicationLag(ctx)
+	if err != nil && ctx.Err() != nil {
+		// отменён запрос, а не реплика недоступна
+		return ds.DB
+	}
+	healthy := err == nil && lag <= state.maxLag
+	if healthy != state.healthy || state.checkedAt.IsZero() {
+		switch {
+		case err != nil:
+			logger.Error(fmt.Sprintf("replica is unavailable, reads go to primary: %v", err))
+		case !healthy:
+			logger.Error(fmt.Sprintf("replica lag %s exceeds %s, reads go to primary", lag, state.maxLag))
+		default:
+			logger.Info("replica is available, reads go to replica")
+		}
+	}
+	ds.setReplicaHealth(healthy, now)
+	if healthy {
+		return replica
+	}
+	return ds.DB
+}
+
+// setReplicaHealth запоминает результат проверки реплики
+func (ds *DBStorage) setReplicaHealth(healthy bool, now time.Time) {
+	ds.mu.Lock()
+	defer ds.mu.Unlock()
+	ds.replica.healthy = healthy
+	ds.replica.checkedAt = now
+}
+
+// closeReplica закрытие подключения к реплике
+func (ds *DBStorage) closeReplica() error {
+	if ds.Replica == nil {
+		return nil
+	}
+	err := ds.Replica.Close()
+	if err != nil {
+		return fmt.Errorf("fail while close replica: %w", err)
+	}
+	return nil
+}
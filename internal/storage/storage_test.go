@@ -5,16 +5,21 @@ import (
 	"database/sql"
 	"database/sql/driver"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"net/http"
 	"os"
 	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
 	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage/fileio"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage/wal"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 )
@@ -29,12 +34,19 @@ type MockDB struct {
 	mu             sync.Mutex
 	metricsGauge   map[string]float64
 	metricsCounter map[string][]float64
+	history        map[string][]psql.Sample
+	agentKeys      []psql.AgentKey
+	lag            time.Duration
+	lagErr         error
+	readErr        error
+	writeErr       error
 }
 
 func NewMockDB() *MockDB {
 	return &MockDB{
 		metricsGauge:   make(map[string]float64),
 		metricsCounter: make(map[string][]float64),
+		history:        make(map[string][]psql.Sample),
 	}
 }
 
@@ -65,7 +77,7 @@ func (m *MockDB) Ping() error {
 func (m *MockDB) PingContext(ctx context.Context) error {
 	return nil
 }
-func (m *MockDB) PingDB() error {
+func (m *MockDB) PingDB(ctx context.Context) error {
 	return nil
 }
 func (m *MockDB) Prepare(query string) (*sql.Stmt, error) {
@@ -86,67 +98,158 @@ func (m *MockDB) QueryRow(query string, args ...any) *sql.Row {
 func (m *MockDB) QueryRowContext(ctx context.Context, query string, args ...any) *sql.Row {
 	return nil
 }
-func (m *MockDB) SetConnMaxIdleTime(d time.Duration) {}
-func (m *MockDB) SetConnMaxLifetime(d time.Duration) {}
-func (m *MockDB) SetMaxIdleConns(n int)              {}
-func (m *MockDB) SetMaxOpenConns(n int)              {}
+func (m *MockDB) ReplicationLag(ctx context.Context) (time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return m.lag, m.lagErr
+}
+func (m *MockDB) AgentKeys(ctx context.Context) ([]psql.AgentKey, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	return append([]psql.AgentKey(nil), m.agentKeys...), m.readErr
+}
+func (m *MockDB) SaveAgentKey(ctx context.Context, key psql.AgentKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	m.agentKeys = append(m.agentKeys, key)
+	return nil
+}
+func (m *MockDB) DeleteAgentKeys(ctx context.Context, agentID string, version int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	keys := m.agentKeys[:0]
+	for _, k := range m.agentKeys {
+		if k.AgentID != agentID || (version != 0 && k.Version != version) {
+			keys = append(keys, k)
+		}
+	}
+	m.agentKeys = keys
+	return m.writeErr
+}
+func (m *MockDB) ReplaceAgentKeys(ctx context.Context, agentID string, replace []psql.AgentKey) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writeErr != nil {
+		return m.writeErr
+	}
+	keys := make([]psql.AgentKey, 0, len(m.agentKeys)+len(replace))
+	for _, k := range m.agentKeys {
+		if k.AgentID != agentID {
+			keys = append(keys, k)
+		}
+	}
+	m.agentKeys = append(keys, replace...)
+	return nil
+}
+func (m *MockDB) SetConnMaxIdleTime(d time.Duration)    {}
+func (m *MockDB) SetConnMaxLifetime(d time.Duration)    {}
+func (m *MockDB) SetMaxIdleConns(n int)                 {}
+func (m *MockDB) SetMaxOpenConns(n int)                 {}
+func (m *MockDB) SetQueryTimeout(timeout time.Duration) {}
 func (m *MockDB) Stats() sql.DBStats {
 	return sql.DBStats{}
 }
 
-func (m *MockDB) CreateMetricsTable() error {
+func (m *MockDB) Migrate(ctx context.Context) error {
 	return nil
 }
 
-func (m *MockDB) PushReplace(metricType, name string, value float64) error {
+func (m *MockDB) PushReplace(ctx context.Context, metricType, name string, l labels.Labels, value float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.writeErr != nil {
+		return m.writeErr
+	}
 	if metricType != TYPEGAUGE {
 		return fmt.Errorf("PushReplace: unsupported metric type %s", metricType)
 	}
-	m.metricsGauge[name] = value
+	m.metricsGauge[labels.Key(name, l)] = value
 	return nil
 }
 
-func (m *MockDB) PushAdd(metricType, name string, value float64) error {
+func (m *MockDB) PushAdd(ctx context.Context, metricType, name string, l labels.Labels, value float64) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.writeErr != nil {
+		return m.writeErr
+	}
 	if metricType != TYPECOUNTER {
 		return fmt.Errorf("PushAdd: unsupported metric type %s", metricType)
 	}
-	m.metricsCounter[name] = append(m.metricsCounter[name], value)
+	key := labels.Key(name, l)
+	m.metricsCounter[key] = append(m.metricsCounter[key], value)
 	return nil
 }
 
-func (m *MockDB) GetOneValue(metricType, name string) (float64, error) {
+func (m *MockDB) PushBatch(ctx context.Context, metricOneValue string, items []psql.BatchItem, ts time.Time) ([]float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.writeErr != nil {
+		return nil, m.writeErr
+	}
+	values := make([]float64, len(items))
+	for i, item := range items {
+		key := labels.Key(item.MetricName, item.Labels)
+		switch item.MetricType {
+		case metricOneValue:
+			m.metricsGauge[key] = item.Value
+			values[i] = item.Value
+		case TYPECOUNTER:
+			m.metricsCounter[key] = append(m.metricsCounter[key], item.Value)
+			values[i] = sum(m.metricsCounter[key])
+		default:
+			return nil, fmt.Errorf("PushBatch: unsupported metric type %s", item.MetricType)
+		}
+		hkey := item.MetricType + psql.METRICSEPARATOR + key
+		m.history[hkey] = append(m.history[hkey], psql.Sample{Time: ts, Value: item.Value})
+	}
+	return values, nil
+}
+
+func (m *MockDB) GetOneValue(ctx context.Context, metricType, name string, l labels.Labels) (float64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if metricType != TYPEGAUGE {
 		return 0, fmt.Errorf("GetOneValue: unsupported metric type %s", metricType)
 	}
-	value, exists := m.metricsGauge[name]
+	value, exists := m.metricsGauge[labels.Key(name, l)]
 	if !exists {
 		return 0, ErrMetricNoData
 	}
 	return value, nil
 }
 
-func (m *MockDB) GetArrayValues(metricType, name string) ([]float64, error) {
+func (m *MockDB) GetArrayValues(ctx context.Context, metricType, name string, l labels.Labels) ([]float64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
 	if metricType != TYPECOUNTER {
 		return nil, fmt.Errorf("GetArrayValues: unsupported metric type %s", metricType)
 	}
-	values, exists := m.metricsCounter[name]
+	values, exists := m.metricsCounter[labels.Key(name, l)]
 	if !exists {
 		return nil, ErrMetricNoData
 	}
 	return values, nil
 }
 
-func (m *MockDB) List(metricOneValue string, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
+func (m *MockDB) List(ctx context.Context, metricOneValue string, metricArrayValues string) (map[string]float64, map[string][]float64, error) {
 	m.mu.Lock()
 	defer m.mu.Unlock()
+	if m.readErr != nil {
+		return nil, nil, m.readErr
+	}
 	resultGauge := make(map[string]float64)
 	resultCounter := make(map[string][]float64)
 
@@ -170,6 +273,133 @@ func (m *MockDB) List(metricOneValue string, metricArrayValues string) (map[stri
 	return resultGauge, resultCounter, nil
 }
 
+func (m *MockDB) Select(ctx context.Context, metricType, name string, filter labels.Labels) (map[string][]float64, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readErr != nil {
+		return nil, m.readErr
+	}
+	series := make(map[string][]float64)
+	switch metricType {
+	case TYPEGAUGE:
+		for k, v := range m.metricsGauge {
+			if n, l := labels.ParseKey(k); n == name && l.Match(filter) {
+				series[k] = []float64{v}
+			}
+		}
+	case TYPECOUNTER:
+		for k, v := range m.metricsCounter {
+			if n, l := labels.ParseKey(k); n == name && l.Match(filter) {
+				series[k] = v
+			}
+		}
+	default:
+		return nil, fmt.Errorf("Select: unsupported metric type %s", metricType)
+	}
+	return series, nil
+}
+
+func (m *MockDB) CompactCounters(ctx context.Context, metricType string, keep int) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if metricType != TYPECOUNTER {
+		return fmt.Errorf("CompactCounters: unsupported metric type %s", metricType)
+	}
+	for k, values := range m.metricsCounter {
+		if len(values) <= keep+1 {
+			continue
+		}
+		fold := len(values) - keep
+		var total float64
+		for _, v := range values[:fold] {
+			total += v
+		}
+		m.metricsCounter[k] = append([]float64{total}, values[fold:]...)
+	}
+	return nil
+}
+
+func (m *MockDB) PushHistory(ctx context.Context, metricType, name string, l labels.Labels, value float64, ts time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	key := metricType + psql.METRICSEPARATOR + labels.Key(name, l)
+	m.history[key] = append(m.history[key], psql.Sample{Time: ts, Value: value})
+	return nil
+}
+
+func (m *MockDB) History(ctx context.Context, metricType, name string, filter labels.Labels, from time.Time) (map[string][]psql.Sample, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	history := make(map[string][]psql.Sample)
+	for k, samples := range m.history {
+		mType, seriesKey, _ := strings.Cut(k, psql.METRICSEPARATOR)
+		if n, l := labels.ParseKey(seriesKey); mType != metricType || n != name || !l.Match(filter) {
+			continue
+		}
+		for _, s := range samples {
+			if !s.Time.Before(from) {
+				history[seriesKey] = append(history[seriesKey], s)
+			}
+		}
+	}
+	return history, nil
+}
+
+// Aggregate вычисляет агрегат в памяти так же, как его посчитал бы postgres
+func (m *MockDB) Aggregate(ctx context.Context, q psql.AggregateQuery) (float64, int64, error) {
+	if err := ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.readErr != nil {
+		return 0, 0, m.readErr
+	}
+	var values []float64
+	for k, samples := range m.history {
+		mType, seriesKey, _ := strings.Cut(k, psql.METRICSEPARATOR)
+		n, l := labels.ParseKey(seriesKey)
+		if mType != q.MetricType || n != q.MetricName || !l.Match(q.Labels) {
+			continue
+		}
+		if q.Exact && seriesKey != labels.Key(q.MetricName, q.Labels) {
+			continue
+		}
+		for _, s := range samples {
+			if !s.Time.Before(q.From) && !s.Time.After(q.To) {
+				values = append(values, s.Value)
+			}
+		}
+	}
+	if len(values) == 0 {
+		return 0, 0, nil
+	}
+	value, err := evaluate(&Query{Func: q.Func, Quantile: q.Quantile}, values)
+	return value, int64(len(values)), err
+}
+
+func (m *MockDB) TrimHistory(ctx context.Context, before time.Time) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, samples := range m.history {
+		m.history[k] = trimSamplesDB(samples, before)
+	}
+	return nil
+}
+
+func trimSamplesDB(samples []psql.Sample, before time.Time) []psql.Sample {
+	var result []psql.Sample
+	for _, s := range samples {
+		if !s.Time.Before(before) {
+			result = append(result, s)
+		}
+	}
+	return result
+}
+
 func TestNew(t *testing.T) {
 	// Инициализируем моковый логгер.
 	assert.NoError(t, logger.Init(&MockLogger{}, 5))
@@ -177,15 +407,15 @@ func TestNew(t *testing.T) {
 	t.Run("Создание файла в существующей директории без восстановления из бэкапа и без DB", func(t *testing.T) {
 		tmpDir := t.TempDir()
 
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		assert.NotNil(t, storage)
 		defer storage.backupFile.Close()
 
-		// Проверяем, что файл бэкапа создан.
+		// Файл бэкапа появляется при первой записи.
 		backupPath := filepath.Join(tmpDir, BACKUPFILENAME)
 		_, statErr := os.Stat(backupPath)
-		assert.NoError(t, statErr)
+		assert.True(t, os.IsNotExist(statErr))
 
 		// Проверяем, что ItemsGauge и ItemsCounter инициализированы пустыми.
 		assert.NotNil(t, storage.ItemsGauge)
@@ -210,7 +440,7 @@ func TestNew(t *testing.T) {
 		backupFile.Close()
 
 		// Теперь создаём MemStorage с восстановлением из бэкапа.
-		storage, err := New(0, nestedDir, true, nil)
+		storage, err := New(0, nestedDir, true)
 		require.NoError(t, err)
 		assert.NotNil(t, storage)
 		defer storage.backupFile.Close()
@@ -221,18 +451,11 @@ func TestNew(t *testing.T) {
 	})
 
 	t.Run("Создание с использованием DB", func(t *testing.T) {
-		tmpDir := t.TempDir()
-
 		mockDB := NewMockDB()
 
-		storage, err := New(0, tmpDir, false, mockDB)
+		storage, err := NewDB(context.Background(), mockDB)
 		require.NoError(t, err)
 		assert.NotNil(t, storage)
-		defer storage.backupFile.Close()
-
-		// Проверяем, что ItemsGauge и ItemsCounter не инициализированы.
-		assert.Nil(t, storage.ItemsGauge)
-		assert.Nil(t, storage.ItemsCounter)
 
 		// Проверяем, что DB инициализирована.
 		assert.Equal(t, mockDB, storage.DB)
@@ -248,7 +471,7 @@ func TestNew(t *testing.T) {
 			invalidPath = "C:\\invalid_path_!@#$%^&*()"
 		}
 
-		storage, err := New(0, invalidPath, false, nil)
+		storage, err := New(0, invalidPath, false)
 		assert.Error(t, err)
 		assert.Nil(t, storage)
 	})
@@ -259,7 +482,7 @@ func TestGet(t *testing.T) {
 
 	t.Run("Получение метрики из памяти", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
@@ -271,81 +494,79 @@ func TestGet(t *testing.T) {
 
 		// Получаем gauge.
 		metric := &Metric{Type: TYPEGAUGE, Name: "gauge1"}
-		value, err := storage.Get(metric)
+		value, err := storage.Get(context.Background(), metric)
 		require.NoError(t, err)
 		assert.Equal(t, 3.14, value)
 
 		// Получаем counter.
 		metricCounter := &Metric{Type: TYPECOUNTER, Name: "counter1"}
-		counterValue, err := storage.Get(metricCounter)
+		counterValue, err := storage.Get(context.Background(), metricCounter)
 		require.NoError(t, err)
 		assert.Equal(t, 6.0, counterValue)
 	})
 
 	t.Run("Получение метрики из базы данных", func(t *testing.T) {
-		tmpDir := t.TempDir()
 		mockDB := NewMockDB()
 
 		// Инициализируем DB с некоторыми данными.
 		mockDB.metricsGauge["gauge_db"] = 2.71
 		mockDB.metricsCounter["counter_db"] = []float64{5, 15}
 
-		storage, err := New(0, tmpDir, false, mockDB)
+		storage, err := NewDB(context.Background(), mockDB)
 		require.NoError(t, err)
-		defer storage.backupFile.Close()
 
 		// Получаем gauge из DB.
 		metric := &Metric{Type: TYPEGAUGE, Name: "gauge_db"}
-		value, err := storage.Get(metric)
+		value, err := storage.Get(context.Background(), metric)
 		require.NoError(t, err)
 		assert.Equal(t, 2.71, value)
 
 		// Получаем counter из DB.
 		metricCounter := &Metric{Type: TYPECOUNTER, Name: "counter_db"}
-		counterValue, err := storage.Get(metricCounter)
+		counterValue, err := storage.Get(context.Background(), metricCounter)
 		require.NoError(t, err)
 		assert.Equal(t, 20.0, counterValue)
 	})
 
 	t.Run("Получение несуществующей метрики", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
 		// Попытка получить несуществующую метрику.
 		metric := &Metric{Type: TYPEGAUGE, Name: "nonexistent"}
-		value, err := storage.Get(metric)
+		value, err := storage.Get(context.Background(), metric)
 		assert.Error(t, err)
 		assert.Equal(t, 0.0, value)
 
 		// Аналогично для counter.
 		metricCounter := &Metric{Type: TYPECOUNTER, Name: "nonexistent_counter"}
-		counterValue, err := storage.Get(metricCounter)
+		counterValue, err := storage.Get(context.Background(), metricCounter)
 		assert.Error(t, err)
 		assert.Equal(t, 0.0, counterValue)
 	})
 
 	t.Run("Ошибка при некорректном типе метрики", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
 		// Некорректный тип метрики.
 		metric := &Metric{Type: "invalid_type", Name: "metric1"}
-		value, err := storage.Get(metric)
+		value, err := storage.Get(context.Background(), metric)
 		assert.Error(t, err)
 		assert.Equal(t, 0.0, value)
 	})
 
 	t.Run("Ошибка при nil метрике", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
-		value, err := storage.Get(nil)
+		value, err := storage.Get(context.Background(), nil)
 		assert.Error(t, err)
 		assert.Equal(t, 0.0, value)
 	})
@@ -356,7 +577,7 @@ func TestList(t *testing.T) {
 
 	t.Run("Список метрик из памяти", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
@@ -368,7 +589,7 @@ func TestList(t *testing.T) {
 		storage.ItemsCounter["counter2"] = []float64{30, 40}
 		storage.mu.Unlock()
 
-		list, err := storage.List()
+		list, err := storage.List(context.Background())
 		require.NoError(t, err)
 
 		expected := []string{
@@ -383,7 +604,6 @@ func TestList(t *testing.T) {
 	})
 
 	t.Run("Список метрик из базы данных", func(t *testing.T) {
-		tmpDir := t.TempDir()
 		mockDB := NewMockDB()
 
 		// Инициализируем DB с некоторыми данными.
@@ -392,11 +612,10 @@ func TestList(t *testing.T) {
 		mockDB.metricsCounter["counter_db1"] = []float64{50, 60}
 		mockDB.metricsCounter["counter_db2"] = []float64{70, 80}
 
-		storage, err := New(0, tmpDir, false, mockDB)
+		storage, err := NewDB(context.Background(), mockDB)
 		require.NoError(t, err)
-		defer storage.backupFile.Close()
 
-		list, err := storage.List()
+		list, err := storage.List(context.Background())
 		require.NoError(t, err)
 
 		expected := []string{
@@ -411,18 +630,18 @@ func TestList(t *testing.T) {
 
 	t.Run("Список метрик при отсутствии метрик", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
-		list, err := storage.List()
+		list, err := storage.List(context.Background())
 		require.NoError(t, err)
 		assert.Empty(t, list)
 	})
 
 	t.Run("Список метрик с некорректным типом метрики", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
@@ -434,7 +653,7 @@ func TestList(t *testing.T) {
 		// Поэтому этот тест может быть пропущен или модифицирован.
 		storage.mu.Unlock()
 
-		list, err := storage.List()
+		list, err := storage.List(context.Background())
 		require.NoError(t, err)
 
 		expected := []string{
@@ -445,12 +664,46 @@ func TestList(t *testing.T) {
 	})
 }
 
+func TestSnapshot(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	t.Run("Снимок метрик из памяти", func(t *testing.T) {
+		storage, err := New(0, t.TempDir(), false)
+		require.NoError(t, err)
+		defer storage.backupFile.Close()
+
+		storage.mu.Lock()
+		storage.ItemsGauge["gauge1"] = 1.11
+		storage.ItemsCounter["counter1"] = []float64{10, 20}
+		storage.mu.Unlock()
+
+		gauges, counters, err := storage.Snapshot(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, map[string]float64{"gauge1": 1.11}, gauges)
+		assert.Equal(t, map[string]float64{"counter1": 30}, counters)
+	})
+
+	t.Run("Снимок метрик из базы данных", func(t *testing.T) {
+		mockDB := NewMockDB()
+		mockDB.metricsGauge["gauge_db"] = 3.33
+		mockDB.metricsCounter["counter_db"] = []float64{50, 60}
+
+		storage, err := NewDB(context.Background(), mockDB)
+		require.NoError(t, err)
+
+		gauges, counters, err := storage.Snapshot(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, map[string]float64{"gauge_db": 3.33}, gauges)
+		assert.Equal(t, map[string]float64{"counter_db": 110}, counters)
+	})
+}
+
 func TestBackupLoop(t *testing.T) {
 	assert.NoError(t, logger.Init(&MockLogger{}, 5))
 
 	t.Run("Бэкап при получении сигнала из backupChan", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
@@ -475,16 +728,15 @@ func TestBackupLoop(t *testing.T) {
 		assert.Equal(t, storage.ItemsGauge, gauges)
 		assert.Equal(t, storage.ItemsCounter, counters)
 
-		// Останавливаем BackupLoop через закрытие канала.
-		storage.backupChan <- struct{}{}
-		storage.backupFile.Close()
+		// Останавливаем BackupLoop.
+		require.NoError(t, storage.Close())
 	})
 
 	t.Run("Бэкап по тикеру", func(t *testing.T) {
 		// Устанавливаем короткий интервал для теста.
 		intervalBackup := 1 // секунда
 		tmpDir := t.TempDir()
-		storage, err := New(intervalBackup, tmpDir, false, nil)
+		storage, err := New(intervalBackup, tmpDir, false)
 		require.NoError(t, err)
 		defer storage.backupFile.Close()
 
@@ -506,18 +758,18 @@ func TestBackupLoop(t *testing.T) {
 		assert.Equal(t, storage.ItemsGauge, gauges)
 		assert.Equal(t, storage.ItemsCounter, counters)
 
-		// Останавливаем BackupLoop через закрытие канала.
-		storage.backupTicker.Stop()
-		storage.backupFile.Close()
+		// Останавливаем BackupLoop.
+		require.NoError(t, storage.Close())
 	})
 
 	t.Run("Ошибка при записи бэкапа", func(t *testing.T) {
 		tmpDir := t.TempDir()
-		storage, err := New(0, tmpDir, false, nil)
+		storage, err := New(0, tmpDir, false)
 		require.NoError(t, err)
 
-		// Закрываем файл, чтобы запись завершилась с ошибкой.
-		storage.backupFile.Close()
+		// Подменяем директорию бэкапа файлом, чтобы запись завершилась с ошибкой.
+		require.NoError(t, os.RemoveAll(tmpDir))
+		require.NoError(t, os.WriteFile(tmpDir, nil, 0644))
 
 		// Запускаем BackupLoop в отдельной горутине.
 		go storage.BackupLoop()
@@ -628,7 +880,7 @@ func TestValidateAndConvert(t *testing.T) {
 }
 
 func TestPush(t *testing.T) {
-	stor, err := New(0, "", false, nil)
+	stor, err := New(0, "", false)
 	assert.NoError(t, err)
 
 	metrics := []Metric{
@@ -659,21 +911,114 @@ func TestPush(t *testing.T) {
 		}
 	}()
 
-	err = stor.Push(&metrics[0])
+	err = stor.Push(context.Background(), &metrics[0])
 	assert.NoError(t, err)
 	assert.Equal(t, stor.ItemsGauge[metrics[0].Name], metrics[0].Value)
-	err = stor.Push(&metrics[1])
+	err = stor.Push(context.Background(), &metrics[1])
 	assert.Equal(t, stor.ItemsGauge[metrics[0].Name], metrics[1].Value)
 	assert.NoError(t, err)
 
-	err = stor.Push(&metrics[2])
+	err = stor.Push(context.Background(), &metrics[2])
 	assert.NoError(t, err)
-	err = stor.Push(&metrics[3])
+	err = stor.Push(context.Background(), &metrics[3])
 	assert.NoError(t, err)
 
 	assert.Equal(t, stor.ItemsCounter[metrics[3].Name], []float64{metrics[2].Value, metrics[3].Value})
 }
 
+func TestLabels(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	h1 := labels.Labels{"host": "h1", "env": "prod"}
+	h2 := labels.Labels{"host": "h2", "env": "prod"}
+
+	check := func(t *testing.T, stor Backend) {
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1, Value: 1}))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h2, Value: 2}))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: h1, Value: 3}))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: h2, Value: 4}))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: h2, Value: 5}))
+
+		t.Run("точное совпадение меток", func(t *testing.T) {
+			value, err := stor.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h2})
+			require.NoError(t, err)
+			assert.Equal(t, 2.0, value)
+
+			value, err = stor.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: h2})
+			require.NoError(t, err)
+			assert.Equal(t, 9.0, value)
+		})
+
+		t.Run("фильтр по части меток", func(t *testing.T) {
+			value, err := stor.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "h1"}})
+			require.NoError(t, err)
+			assert.Equal(t, 1.0, value)
+
+			value, err = stor.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: labels.Labels{"env": "prod"}})
+			require.NoError(t, err)
+			assert.Equal(t, 12.0, value, "counter суммируется по всем подходящим сериям")
+		})
+
+		t.Run("неоднозначный gauge", func(t *testing.T) {
+			_, err := stor.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+			assert.ErrorIs(t, err, ErrMetricAmbiguous)
+		})
+
+		t.Run("нет подходящих серий", func(t *testing.T) {
+			_, err := stor.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "h3"}})
+			assert.ErrorIs(t, err, ErrMetricNoData)
+		})
+
+		t.Run("снимок содержит серии с метками", func(t *testing.T) {
+			gauges, counters, err := stor.Snapshot(context.Background())
+			require.NoError(t, err)
+			assert.Equal(t, 2.0, gauges[labels.Key("Alloc", h2)])
+			assert.Equal(t, 3.0, counters[labels.Key("PollCount", h1)])
+		})
+
+		t.Run("некорректное имя метки", func(t *testing.T) {
+			err := stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"1host": "h1"}, Value: 1})
+			assert.ErrorIs(t, err, labels.ErrLabelName)
+		})
+	}
+
+	t.Run("в памяти", func(t *testing.T) {
+		stor, err := New(1, t.TempDir(), false)
+		require.NoError(t, err)
+		defer stor.backupFile.Close()
+		check(t, stor)
+	})
+
+	t.Run("в базе данных", func(t *testing.T) {
+		stor, err := NewDB(context.Background(), NewMockDB())
+		require.NoError(t, err)
+		check(t, stor)
+	})
+
+	t.Run("в bolt", func(t *testing.T) {
+		stor, err := NewBolt(t.TempDir())
+		require.NoError(t, err)
+		defer stor.Close()
+		check(t, stor)
+	})
+
+	t.Run("восстановление из бэкапа", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := New(1, dir, false)
+		require.NoError(t, err)
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1, Value: 7}))
+		require.NoError(t, stor.backupFile.Write(&fileio.Data{ItemsGauge: stor.ItemsGauge, ItemsCounter: stor.ItemsCounter}))
+		require.NoError(t, stor.backupFile.Close())
+
+		restored, err := New(1, dir, true)
+		require.NoError(t, err)
+		defer restored.backupFile.Close()
+		value, err := restored.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1})
+		require.NoError(t, err)
+		assert.Equal(t, 7.0, value)
+	})
+}
+
 func TestMarshal(t *testing.T) {
 	var item Metric
 	item.Name = "test"
@@ -693,12 +1038,24 @@ func TestUnmarshal(t *testing.T) {
 	assert.Equal(t, `counter PollCount 3`, fmt.Sprintf("%s %s %0.f", item.Type, item.Name, item.Value))
 }
 
+func TestMarshalLabels(t *testing.T) {
+	item := Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: labels.Labels{"host": "h1"}, Value: 2}
+
+	jn, err := json.Marshal(&item)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"type":"counter","id":"PollCount","labels":{"host":"h1"},"delta":2}`, string(jn))
+
+	var decoded Metric
+	assert.NoError(t, json.Unmarshal(jn, &decoded))
+	assert.Equal(t, item, decoded)
+}
+
 func BenchmarkGetMemoryGauge(b *testing.B) {
 	// Инициализируем моковый логгер.
 	assert.NoError(b, logger.Init(&MockLogger{}, 5))
 
 	tmpDir := b.TempDir()
-	storage, err := New(0, tmpDir, false, nil)
+	storage, err := New(0, tmpDir, false)
 	require.NoError(b, err)
 	defer storage.backupFile.Close()
 
@@ -714,7 +1071,7 @@ func BenchmarkGetMemoryGauge(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		value, err := storage.Get(metric)
+		value, err := storage.Get(context.Background(), metric)
 		require.NoError(b, err)
 		assert.Equal(b, 1.23, value)
 	}
@@ -724,12 +1081,10 @@ func BenchmarkGetDatabaseGauge(b *testing.B) {
 	// Инициализируем моковый логгер.
 	assert.NoError(b, logger.Init(&MockLogger{}, 5))
 
-	tmpDir := b.TempDir()
 	mockDB := NewMockDB()
 	mockDB.metricsGauge["benchmark_db_gauge"] = 1.23
-	storage, err := New(0, tmpDir, false, mockDB)
+	storage, err := NewDB(context.Background(), mockDB)
 	require.NoError(b, err)
-	defer storage.backupFile.Close()
 
 	metric := &Metric{
 		Type: TYPEGAUGE,
@@ -738,7 +1093,7 @@ func BenchmarkGetDatabaseGauge(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		value, err := storage.Get(metric)
+		value, err := storage.Get(context.Background(), metric)
 		require.NoError(b, err)
 		assert.Equal(b, 1.23, value)
 	}
@@ -749,7 +1104,7 @@ func BenchmarkListMemory(b *testing.B) {
 	assert.NoError(b, logger.Init(&MockLogger{}, 5))
 
 	tmpDir := b.TempDir()
-	storage, err := New(0, tmpDir, false, nil)
+	storage, err := New(0, tmpDir, false)
 	require.NoError(b, err)
 	defer storage.backupFile.Close()
 
@@ -763,7 +1118,7 @@ func BenchmarkListMemory(b *testing.B) {
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		list, err := storage.List()
+		list, err := storage.List(context.Background())
 		require.NoError(b, err)
 		assert.Len(b, list, 2000)
 	}
@@ -773,7 +1128,6 @@ func BenchmarkListDatabase(b *testing.B) {
 	// Инициализируем моковый логгер.
 	assert.NoError(b, logger.Init(&MockLogger{}, 5))
 
-	tmpDir := b.TempDir()
 	mockDB := NewMockDB()
 
 	// Добавляем множество метрик в моковую DB.
@@ -782,13 +1136,12 @@ func BenchmarkListDatabase(b *testing.B) {
 		mockDB.metricsCounter[fmt.Sprintf("counter_db_%d", i)] = []float64{float64(i), float64(i * 2)}
 	}
 
-	storage, err := New(0, tmpDir, false, mockDB)
+	storage, err := NewDB(context.Background(), mockDB)
 	require.NoError(b, err)
-	defer storage.backupFile.Close()
 
 	b.ResetTimer()
 	for i := 0; i < b.N; i++ {
-		list, err := storage.List()
+		list, err := storage.List(context.Background())
 		require.NoError(b, err)
 		assert.Len(b, list, 2000)
 	}
@@ -799,7 +1152,7 @@ func BenchmarkBackupLoopMemory(b *testing.B) {
 	assert.NoError(b, logger.Init(&MockLogger{}, 5))
 
 	tmpDir := b.TempDir()
-	storage, err := New(0, tmpDir, false, nil)
+	storage, err := New(0, tmpDir, false)
 	require.NoError(b, err)
 	defer storage.backupFile.Close()
 
@@ -829,37 +1182,921 @@ func BenchmarkBackupLoopMemory(b *testing.B) {
 	storage.backupFile.Close()
 }
 
-func BenchmarkBackupLoopDatabase(b *testing.B) {
-	// Инициализируем моковый логгер.
-	assert.NoError(b, logger.Init(&MockLogger{}, 5))
+func TestHistory(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
 
-	tmpDir := b.TempDir()
-	mockDB := NewMockDB()
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
 
-	// Добавляем метрики в моковую DB.
-	for i := 0; i < 1000; i++ {
-		mockDB.metricsGauge[fmt.Sprintf("gauge_db_%d", i)] = float64(i)
-		mockDB.metricsCounter[fmt.Sprintf("counter_db_%d", i)] = []float64{float64(i), float64(i * 2)}
+	type historyBackend interface {
+		Backend
+		SetHistoryRetention(retention time.Duration)
 	}
 
-	storage, err := New(0, tmpDir, false, mockDB)
-	require.NoError(b, err)
-	defer storage.backupFile.Close()
+	check := func(t *testing.T, stor historyBackend, clock *func() time.Time) {
+		pushAt := func(offset time.Duration, metric Metric) {
+			*clock = func() time.Time { return base.Add(offset) }
+			require.NoError(t, stor.Push(context.Background(), &metric))
+		}
+		pushAt(0, Metric{Type: TYPEGAUGE, Name: "CpuUtilization", Value: 10})
+		pushAt(0, Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 1})
+		pushAt(10*time.Second, Metric{Type: TYPEGAUGE, Name: "CpuUtilization", Value: 20})
+		pushAt(10*time.Second, Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2})
+		pushAt(70*time.Second, Metric{Type: TYPEGAUGE, Name: "CpuUtilization", Value: 30})
+		pushAt(70*time.Second, Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 3})
+
+		gauge := &Metric{Type: TYPEGAUGE, Name: "CpuUtilization"}
+		counter := &Metric{Type: TYPECOUNTER, Name: "PollCount"}
+		to := base.Add(2 * time.Minute)
+
+		t.Run("все значения gauge", func(t *testing.T) {
+			points, err := stor.History(context.Background(), gauge, base, to, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []Sample{
+				{Time: base, Value: 10},
+				{Time: base.Add(10 * time.Second), Value: 20},
+				{Time: base.Add(70 * time.Second), Value: 30},
+			}, points)
+		})
+
+		t.Run("gauge с шагом", func(t *testing.T) {
+			points, err := stor.History(context.Background(), gauge, base, to, time.Minute)
+			require.NoError(t, err)
+			assert.Equal(t, []Sample{
+				{Time: base, Value: 20},
+				{Time: base.Add(time.Minute), Value: 30},
+			}, points)
+		})
+
+		t.Run("counter накопленной суммой", func(t *testing.T) {
+			points, err := stor.History(context.Background(), counter, base.Add(5*time.Second), to, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []Sample{
+				{Time: base.Add(10 * time.Second), Value: 3},
+				{Time: base.Add(70 * time.Second), Value: 6},
+			}, points)
+
+			points, err = stor.History(context.Background(), counter, base, to, time.Minute)
+			require.NoError(t, err)
+			assert.Equal(t, []Sample{
+				{Time: base, Value: 3},
+				{Time: base.Add(time.Minute), Value: 6},
+			}, points)
+		})
+
+		t.Run("ограничение to", func(t *testing.T) {
+			points, err := stor.History(context.Background(), gauge, base, base.Add(30*time.Second), 0)
+			require.NoError(t, err)
+			assert.Len(t, points, 2)
+		})
+
+		t.Run("ошибки", func(t *testing.T) {
+			_, err := stor.History(context.Background(), gauge, to, base, 0)
+			assert.ErrorIs(t, err, ErrHistoryRange)
+
+			_, err = stor.History(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Unknown"}, base, to, 0)
+			assert.ErrorIs(t, err, ErrMetricNoData)
+		})
+
+		t.Run("устаревшие значения отбрасываются", func(t *testing.T) {
+			stor.SetHistoryRetention(time.Minute)
+			pushAt(5*time.Minute, Metric{Type: TYPEGAUGE, Name: "CpuUtilization", Value: 40})
+
+			points, err := stor.History(context.Background(), gauge, time.Time{}, time.Time{}, 0)
+			require.NoError(t, err)
+			assert.Equal(t, []Sample{{Time: base.Add(5 * time.Minute), Value: 40}}, points)
+		})
+	}
 
-	// Запускаем BackupLoop в отдельной горутине.
-	go storage.BackupLoop()
+	t.Run("в памяти", func(t *testing.T) {
+		stor, err := New(1, t.TempDir(), false)
+		require.NoError(t, err)
+		defer stor.backupFile.Close()
+		check(t, stor, &stor.clock)
+	})
 
-	b.ResetTimer()
-	for i := 0; i < b.N; i++ {
-		// Отправляем сигнал для бэкапа.
+	t.Run("в базе данных", func(t *testing.T) {
+		stor, err := NewDB(context.Background(), NewMockDB())
+		require.NoError(t, err)
+		check(t, stor, &stor.clock)
+	})
+
+	t.Run("в bolt", func(t *testing.T) {
+		stor, err := NewBolt(t.TempDir())
+		require.NoError(t, err)
+		defer stor.Close()
+		check(t, stor, &stor.clock)
+	})
+}
+
+func TestParseQuery(t *testing.T) {
+	tests := []struct {
+		expr    string
+		want    *Query
+		wantErr bool
+	}{
+		{"rate(counter:PollCount[5m])", &Query{Func: QUERYRATE, Metric: Metric{Type: TYPECOUNTER, Name: "PollCount"}, Range: 5 * time.Minute}, false},
+		{`avg(gauge:Alloc{host="a"}[30s])`, &Query{Func: QUERYAVG, Metric: Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "a"}}, Range: 30 * time.Second}, false},
+		{"quantile(0.95, gauge:Alloc[1h])", &Query{Func: QUERYQUANTILE, Quantile: 0.95, Metric: Metric{Type: TYPEGAUGE, Name: "Alloc"}, Range: time.Hour}, false},
+		{"median(gauge:Alloc[1h])", nil, true},
+		{"rate(gauge:Alloc[5m])", nil, true},
+		{"sum(gauge:Alloc)", nil, true},
+		{"sum(gauge:Alloc[0s])", nil, true},
+		{"sum(Alloc[5m])", nil, true},
+		{"sum(histogram:Alloc[5m])", nil, true},
+		{"sum(gauge:Alloc{host}[5m])", nil, true},
+		{"quantile(1.5, gauge:Alloc[5m])", nil, true},
+		{"gauge:Alloc[5m]", nil, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.expr, func(t *testing.T) {
+			q, err := ParseQuery(tt.expr)
+			if tt.wantErr {
+				assert.ErrorIs(t, err, ErrQuery)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.want, q)
+			again, err := ParseQuery(q.String())
+			require.NoError(t, err)
+			assert.Equal(t, q, again, "каноническое представление разбирается обратно")
+		})
+	}
+}
+
+func TestAggregate(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	base := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	check := func(t *testing.T, stor Backend, clock *func() time.Time) {
+		pushAt := func(offset time.Duration, metric Metric) {
+			*clock = func() time.Time { return base.Add(offset) }
+			require.NoError(t, stor.Push(context.Background(), &metric))
+		}
+		pushAt(0, Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 100})
+		pushAt(0, Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 50})
+		pushAt(4*time.Minute, Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "a"}, Value: 10})
+		pushAt(4*time.Minute, Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 10})
+		pushAt(5*time.Minute, Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "b"}, Value: 20})
+		pushAt(5*time.Minute, Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "a"}, Value: 30})
+		pushAt(6*time.Minute, Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 20})
+		pushAt(6*time.Minute, Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "b"}, Value: 40})
+		*clock = func() time.Time { return base.Add(7 * time.Minute) }
+
+		tests := []struct {
+			expr string
+			want float64
+		}{
+			{"sum(counter:PollCount[5m])", 30},
+			{"rate(counter:PollCount[5m])", 0.1},
+			{"count(counter:PollCount[10m])", 3},
+			{`avg(gauge:Alloc{host="a"}[5m])`, 20},
+			{`max(gauge:Alloc{host="b"}[5m])`, 40},
+			{`min(gauge:Alloc{host="a"}[5m])`, 10},
+			{"quantile(0.5, gauge:Alloc{host=\"b\"}[5m])", 30},
+		}
+		for _, tt := range tests {
+			t.Run(tt.expr, func(t *testing.T) {
+				q, err := ParseQuery(tt.expr)
+				require.NoError(t, err)
+				value, err := stor.(Aggregator).Aggregate(context.Background(), q)
+				require.NoError(t, err)
+				assert.InDelta(t, tt.want, value, 1e-9)
+			})
+		}
+
+		t.Run("серия с точными метками", func(t *testing.T) {
+			q, err := ParseQuery("count(gauge:Alloc[10m])")
+			require.NoError(t, err)
+			value, err := stor.(Aggregator).Aggregate(context.Background(), q)
+			require.NoError(t, err)
+			assert.Equal(t, 1.0, value, "есть серия без меток, агрегируется только она")
+		})
+
+		t.Run("нет значений за период", func(t *testing.T) {
+			q, err := ParseQuery("sum(counter:PollCount[30s])")
+			require.NoError(t, err)
+			_, err = stor.(Aggregator).Aggregate(context.Background(), q)
+			assert.ErrorIs(t, err, ErrMetricNoData)
+
+			q, err = ParseQuery("sum(counter:Unknown[1h])")
+			require.NoError(t, err)
+			_, err = stor.(Aggregator).Aggregate(context.Background(), q)
+			assert.ErrorIs(t, err, ErrMetricNoData)
+		})
+	}
+
+	t.Run("в памяти", func(t *testing.T) {
+		stor, err := New(1, t.TempDir(), false)
+		require.NoError(t, err)
+		defer stor.backupFile.Close()
+		check(t, stor, &stor.clock)
+	})
+
+	t.Run("в базе данных", func(t *testing.T) {
+		stor, err := NewDB(context.Background(), NewMockDB())
+		require.NoError(t, err)
+		check(t, stor, &stor.clock)
+	})
+
+	t.Run("в bolt", func(t *testing.T) {
+		stor, err := NewBolt(t.TempDir())
+		require.NoError(t, err)
+		defer stor.Close()
+		check(t, stor, &stor.clock)
+	})
+}
+
+func TestCompact(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	h1 := labels.Labels{"host": "h1"}
+
+	check := func(t *testing.T, stor Backend) {
+		for i := 1; i <= 10; i++ {
+			require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: float64(i)}))
+			require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: h1, Value: 1}))
+		}
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "Short", Value: 7}))
+
+		require.NoError(t, stor.Compact(context.Background(), 3))
+
+		value, err := stor.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount"})
+		require.NoError(t, err)
+		assert.Equal(t, 55.0, value, "сумма не меняется после компактизации")
+
+		value, err = stor.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Labels: h1})
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, value)
+
+		value, err = stor.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "Short"})
+		require.NoError(t, err)
+		assert.Equal(t, 7.0, value)
+
+		// повторная компактизация и новые приращения
+		require.NoError(t, stor.Compact(context.Background(), 0))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 5}))
+		value, err = stor.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount"})
+		require.NoError(t, err)
+		assert.Equal(t, 60.0, value)
+
+		_, counters, err := stor.Snapshot(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, 60.0, counters["PollCount"])
+	}
+
+	t.Run("в памяти", func(t *testing.T) {
+		stor, err := New(1, t.TempDir(), false)
+		require.NoError(t, err)
+		defer stor.backupFile.Close()
+		check(t, stor)
+
+		assert.Equal(t, []float64{5}, stor.ItemsCounter["PollCount"])
+		assert.Equal(t, 55.0, stor.CounterBase["PollCount"])
+	})
+
+	t.Run("в базе данных", func(t *testing.T) {
+		mockDB := NewMockDB()
+		stor, err := NewDB(context.Background(), mockDB)
+		require.NoError(t, err)
+		check(t, stor)
+
+		assert.Len(t, mockDB.metricsCounter["PollCount"], 2, "свёрнутая сумма и новое приращение")
+	})
+
+	t.Run("в bolt", func(t *testing.T) {
+		stor, err := NewBolt(t.TempDir())
+		require.NoError(t, err)
+		defer stor.Close()
+		check(t, stor)
+
+		list, err := stor.List(context.Background())
+		require.NoError(t, err)
+		assert.Contains(t, list, "PollCount: 55.000000, 5.000000", "свёрнутая сумма и новое приращение")
+	})
+
+	t.Run("накопленные суммы в бэкапе", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := New(1, dir, false)
+		require.NoError(t, err)
+		for i := 0; i < 5; i++ {
+			require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2}))
+		}
+		require.NoError(t, stor.Compact(context.Background(), 1))
+		require.NoError(t, stor.backupFile.Write(stor.backupData()))
+		require.NoError(t, stor.backupFile.Close())
+
+		restored, err := New(1, dir, true)
+		require.NoError(t, err)
+		defer restored.backupFile.Close()
+		value, err := restored.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount"})
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, value)
+		assert.Equal(t, []float64{2}, restored.ItemsCounter["PollCount"])
+	})
+}
+
+// historyDownDB база, в которой не удаётся отдельная запись в историю
+type historyDownDB struct {
+	*MockDB
+}
+
+func (h historyDownDB) PushHistory(context.Context, string, string, labels.Labels, float64, time.Time) error {
+	return errors.New("history is down")
+}
+
+func TestDBStoragePush(t *testing.T) {
+	t.Run("значение и история пишутся одной транзакцией", func(t *testing.T) {
+		mock := NewMockDB()
+		stor, err := NewDB(context.Background(), historyDownDB{mock})
+		require.NoError(t, err)
+
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2}))
+		assert.Equal(t, []float64{2}, mock.metricsCounter["PollCount"])
+		assert.Len(t, mock.history[TYPECOUNTER+psql.METRICSEPARATOR+"PollCount"], 1)
+	})
+
+	t.Run("при ошибке counter не меняется", func(t *testing.T) {
+		mock := NewMockDB()
+		stor, err := NewDB(context.Background(), mock)
+		require.NoError(t, err)
+		mock.writeErr = errors.New("db is down")
+
+		assert.Error(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2}))
+		assert.Empty(t, mock.metricsCounter["PollCount"])
+		assert.Empty(t, mock.history)
+	})
+}
+
+func TestContext(t *testing.T) {
+	t.Run("отменённый контекст доходит до базы данных", func(t *testing.T) {
+		stor, err := NewDB(context.Background(), NewMockDB())
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+
+		err = stor.Push(ctx, &Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 1})
+		assert.ErrorIs(t, err, context.Canceled)
+		_, err = stor.Get(ctx, &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		assert.ErrorIs(t, err, context.Canceled)
+	})
+
+	t.Run("CompactLoop завершается с отменой контекста", func(t *testing.T) {
+		stor, err := New(0, "", false)
+		require.NoError(t, err)
+		ctx, cancel := context.WithCancel(context.Background())
+		done := make(chan struct{})
+		go func() {
+			CompactLoop(ctx, stor, time.Millisecond, 1)
+			close(done)
+		}()
+		cancel()
 		select {
-		case storage.backupChan <- struct{}{}:
-		default:
-			// Если канал забит, пропускаем отправку.
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatal("CompactLoop не завершился после отмены контекста")
 		}
+	})
+}
+
+func TestReplica(t *testing.T) {
+	err := logger.Init(&MockLogger{}, 4)
+	require.NoError(t, err)
+
+	// newReplicated основная база и реплика, на реплике значение Alloc отстаёт
+	newReplicated := func(t *testing.T) (*DBStorage, *MockDB, *MockDB, *time.Time) {
+		primary, replica := NewMockDB(), NewMockDB()
+		stor, err := NewDB(context.Background(), primary)
+		require.NoError(t, err)
+		now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+		stor.clock = func() time.Time { return now }
+		stor.SetReplica(replica, time.Second)
+
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 2}))
+		replica.metricsGauge["Alloc"] = 1
+		return stor, primary, replica, &now
+	}
+	get := func(t *testing.T, ctx context.Context, stor *DBStorage) float64 {
+		value, err := stor.Get(ctx, &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		require.NoError(t, err)
+		return value
 	}
 
-	// Останавливаем BackupLoop через закрытие канала.
-	storage.backupChan <- struct{}{}
-	storage.backupFile.Close()
+	t.Run("чтение идёт с реплики, запись - в основную базу", func(t *testing.T) {
+		stor, primary, replica, _ := newReplicated(t)
+		assert.Equal(t, 1.0, get(t, context.Background(), stor))
+		list, err := stor.List(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Alloc: 1.000000"}, list)
+		assert.Equal(t, 2.0, primary.metricsGauge["Alloc"])
+		assert.Len(t, replica.history, 0)
+	})
+
+	t.Run("WithPrimary читает с основной базы", func(t *testing.T) {
+		stor, _, _, _ := newReplicated(t)
+		assert.Equal(t, 2.0, get(t, WithPrimary(context.Background()), stor))
+	})
+
+	t.Run("отставание реплики больше допустимого", func(t *testing.T) {
+		stor, _, replica, now := newReplicated(t)
+		replica.lag = 5 * time.Second
+		assert.Equal(t, 2.0, get(t, context.Background(), stor))
+
+		// до следующей проверки реплика не используется, даже если догнала
+		replica.lag = 0
+		assert.Equal(t, 2.0, get(t, context.Background(), stor))
+		*now = now.Add(REPLICACHECKINTERVAL)
+		assert.Equal(t, 1.0, get(t, context.Background(), stor))
+	})
+
+	t.Run("реплика недоступна", func(t *testing.T) {
+		stor, _, replica, _ := newReplicated(t)
+		replica.lagErr = fmt.Errorf("connection refused")
+		assert.Equal(t, 2.0, get(t, context.Background(), stor))
+	})
+
+	t.Run("ошибка чтения с реплики", func(t *testing.T) {
+		stor, _, replica, _ := newReplicated(t)
+		replica.readErr = fmt.Errorf("connection reset")
+		assert.Equal(t, 2.0, get(t, context.Background(), stor))
+		list, err := stor.List(context.Background())
+		require.NoError(t, err)
+		assert.Equal(t, []string{"Alloc: 2.000000"}, list)
+	})
+}
+
+func TestTransfer(t *testing.T) {
+	require.NoError(t, logger.Init(&MockLogger{}, 4))
+	h1 := labels.Labels{"host": "h1"}
+
+	// fileStorage хранилище с бэкапом в dir и несколькими сериями, часть counter свёрнута
+	fileStorage := func(t *testing.T, dir string) *MemStorage {
+		stor, err := New(300, dir, false)
+		require.NoError(t, err)
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1, Value: 1.5}))
+		for i := 1; i <= 4; i++ {
+			require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: float64(i)}))
+		}
+		require.NoError(t, stor.Compact(context.Background(), 2))
+		return stor
+	}
+
+	t.Run("импорт бэкапа в базу данных", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, fileStorage(t, dir).Close())
+
+		mockDB := NewMockDB()
+		db, err := NewDB(context.Background(), mockDB)
+		require.NoError(t, err)
+		n, err := ImportBackup(context.Background(), dir, db, false)
+		require.NoError(t, err)
+		assert.Equal(t, 4, n, "gauge, свёрнутая сумма и два приращения")
+
+		value, err := db.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1})
+		require.NoError(t, err)
+		assert.Equal(t, 1.5, value)
+		value, err = db.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount"})
+		require.NoError(t, err)
+		assert.Equal(t, 10.0, value)
+		assert.Equal(t, []float64{3, 3, 4}, mockDB.metricsCounter["PollCount"])
+
+		_, err = ImportBackup(context.Background(), dir, db, false)
+		assert.ErrorIs(t, err, ErrTransferNotEmpty, "повторный импорт удвоил бы counter")
+		_, err = ImportBackup(context.Background(), dir, db, true)
+		assert.NoError(t, err)
+	})
+
+	t.Run("выгрузка базы данных в бэкап", func(t *testing.T) {
+		db, err := NewDB(context.Background(), NewMockDB())
+		require.NoError(t, err)
+		require.NoError(t, db.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1, Value: 2}))
+		require.NoError(t, db.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 5}))
+		require.NoError(t, db.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 7}))
+
+		dir := t.TempDir()
+		n, err := ExportBackup(context.Background(), db, dir, 0)
+		require.NoError(t, err)
+		assert.Equal(t, 2, n)
+
+		restored, err := New(0, dir, true)
+		require.NoError(t, err)
+		value, err := restored.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: h1})
+		require.NoError(t, err)
+		assert.Equal(t, 2.0, value)
+		value, err = restored.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount"})
+		require.NoError(t, err)
+		assert.Equal(t, 12.0, value)
+	})
+
+	t.Run("выгрузка без директории", func(t *testing.T) {
+		_, err := ExportBackup(context.Background(), fileStorage(t, ""), "", 0)
+		assert.ErrorIs(t, err, ErrBackendOptions)
+	})
+}
+
+func TestDual(t *testing.T) {
+	require.NoError(t, logger.Init(&MockLogger{}, 4))
+
+	newDual := func(t *testing.T) (*DualStorage, *MemStorage, *MockDB) {
+		mem, err := New(0, "", false)
+		require.NoError(t, err)
+		mockDB := NewMockDB()
+		db, err := NewDB(context.Background(), mockDB)
+		require.NoError(t, err)
+		return NewDual(mem, db), mem, mockDB
+	}
+
+	t.Run("запись в оба хранилища", func(t *testing.T) {
+		dual, mem, mockDB := newDual(t)
+		require.NoError(t, dual.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 1}))
+		items, err := dual.PushBatch(context.Background(), []Metric{
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 2},
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 3},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, items[1].Value)
+
+		assert.Equal(t, 1.0, mem.ItemsGauge["Alloc"])
+		assert.Equal(t, []float64{2, 3}, mem.ItemsCounter["PollCount"])
+		assert.Equal(t, 1.0, mockDB.metricsGauge["Alloc"])
+		assert.Equal(t, []float64{2, 3}, mockDB.metricsCounter["PollCount"], "во второе хранилище пишутся исходные значения")
+	})
+
+	t.Run("ошибка второго хранилища не мешает записи", func(t *testing.T) {
+		dual, mem, mockDB := newDual(t)
+		ctx := context.Background()
+		mockDB.writeErr = fmt.Errorf("connection refused")
+		require.NoError(t, dual.Push(ctx, &Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 1}))
+		value, err := dual.Get(ctx, &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		require.NoError(t, err)
+		assert.Equal(t, 1.0, value)
+		assert.Equal(t, 1.0, mem.ItemsGauge["Alloc"])
+	})
+
+	t.Run("неизвестное основное хранилище", func(t *testing.T) {
+		_, err := Open(BACKENDDUAL, Options{DualPrimary: "bolt"})
+		assert.ErrorIs(t, err, ErrBackendOptions)
+	})
+}
+
+func TestPushBatch(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	check := func(t *testing.T, stor Backend) {
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 10}))
+
+		items, err := stor.PushBatch(context.Background(), []Metric{
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 1},
+			{Type: TYPEGAUGE, Name: "Alloc", Value: 5},
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 2},
+			{Type: TYPECOUNTER, Name: "PollCount", Labels: labels.Labels{"host": "h1"}, Value: 3},
+			{Type: TYPEGAUGE, Name: "Alloc", Value: 6},
+		})
+		require.NoError(t, err)
+		var values []float64
+		for _, item := range items {
+			values = append(values, item.Value)
+		}
+		assert.Equal(t, []float64{11, 5, 13, 3, 6}, values)
+
+		value, err := stor.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		require.NoError(t, err)
+		assert.Equal(t, 6.0, value)
+
+		// пачка с ошибкой не применяется целиком
+		_, err = stor.PushBatch(context.Background(), []Metric{
+			{Type: TYPEGAUGE, Name: "Alloc", Value: 100},
+			{Type: "unknown", Name: "Alloc", Value: 1},
+		})
+		assert.ErrorIs(t, err, ErrMetricTypeUnknown)
+		value, err = stor.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		require.NoError(t, err)
+		assert.Equal(t, 6.0, value)
+	}
+
+	t.Run("в памяти", func(t *testing.T) {
+		stor, err := New(0, "", false)
+		require.NoError(t, err)
+		check(t, stor)
+	})
+
+	t.Run("в бд", func(t *testing.T) {
+		mockDB := NewMockDB()
+		stor, err := NewDB(context.Background(), mockDB)
+		require.NoError(t, err)
+		check(t, stor)
+
+		// каждое значение пачки попадает в историю
+		history, err := mockDB.History(context.Background(), TYPECOUNTER, "PollCount", nil, time.Time{})
+		require.NoError(t, err)
+		assert.Len(t, history["PollCount"], 3)
+	})
+
+	t.Run("в bolt", func(t *testing.T) {
+		stor, err := NewBolt(t.TempDir())
+		require.NoError(t, err)
+		defer stor.Close()
+		check(t, stor)
+	})
+}
+
+func TestBackends(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	t.Run("встроенные хранилища зарегистрированы", func(t *testing.T) {
+		assert.Equal(t, []string{BACKENDBOLT, BACKENDDUAL, BACKENDFILE, BACKENDMEMORY, BACKENDPOSTGRES}, Backends())
+	})
+
+	t.Run("неизвестное хранилище", func(t *testing.T) {
+		_, err := Open("unknown", Options{})
+		assert.ErrorIs(t, err, ErrBackendUnknown)
+	})
+
+	t.Run("повторная регистрация", func(t *testing.T) {
+		assert.Panics(t, func() { Register(BACKENDMEMORY, openMemory) })
+	})
+
+	t.Run("память", func(t *testing.T) {
+		stor, err := Open(BACKENDMEMORY, Options{})
+		require.NoError(t, err)
+		require.NoError(t, stor.Ping(context.Background()))
+
+		items, err := stor.PushBatch(context.Background(), []Metric{
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 2},
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 3},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, items[1].Value)
+		require.NoError(t, stor.Close())
+		require.NoError(t, stor.Close())
+	})
+
+	t.Run("файл без пути", func(t *testing.T) {
+		_, err := Open(BACKENDFILE, Options{})
+		assert.ErrorIs(t, err, ErrBackendOptions)
+	})
+
+	t.Run("файл сохраняет данные при закрытии", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := Open(BACKENDFILE, Options{StoreInterval: 300, FilePath: dir})
+		require.NoError(t, err)
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 1.5}))
+		require.NoError(t, stor.Close())
+
+		restored, err := Open(BACKENDFILE, Options{StoreInterval: 300, FilePath: dir, Restore: true})
+		require.NoError(t, err)
+		defer restored.Close()
+		value, err := restored.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		require.NoError(t, err)
+		assert.Equal(t, 1.5, value)
+	})
+
+	t.Run("bolt сохраняет данные между запусками", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := Open(BACKENDBOLT, Options{BoltPath: dir})
+		require.NoError(t, err)
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "h1"}, Value: 1.5}))
+		_, err = stor.PushBatch(context.Background(), []Metric{
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 2},
+			{Type: TYPECOUNTER, Name: "PollCount", Value: 3},
+		})
+		require.NoError(t, err)
+		require.NoError(t, stor.Close())
+		assert.Error(t, stor.Ping(context.Background()), "закрытая база недоступна")
+
+		reopened, err := Open(BACKENDBOLT, Options{BoltPath: dir})
+		require.NoError(t, err)
+		defer reopened.Close()
+		value, err := reopened.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Labels: labels.Labels{"host": "h1"}})
+		require.NoError(t, err)
+		assert.Equal(t, 1.5, value)
+		value, err = reopened.Get(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount"})
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, value)
+	})
+
+	t.Run("bolt без пути", func(t *testing.T) {
+		_, err := Open(BACKENDBOLT, Options{})
+		assert.ErrorIs(t, err, ErrBackendOptions)
+	})
+
+	t.Run("postgres без dsn", func(t *testing.T) {
+		_, err := Open(BACKENDPOSTGRES, Options{})
+		assert.ErrorIs(t, err, ErrBackendOptions)
+	})
+}
+
+func TestWAL(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+
+	opts := func(dir string) Options {
+		return Options{StoreInterval: 300, FilePath: dir, Restore: true, WAL: true, WALSync: wal.SYNCALWAYS}
+	}
+	counter := &Metric{Type: TYPECOUNTER, Name: "PollCount"}
+
+	t.Run("записи без бэкапа восстанавливаются из журнала", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := Open(BACKENDFILE, opts(dir))
+		require.NoError(t, err)
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc", Value: 1.5}))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2}))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 3}))
+		// сбой: хранилище не закрыто, бэкап не записан
+
+		restored, err := Open(BACKENDFILE, opts(dir))
+		require.NoError(t, err)
+		defer restored.Close()
+		value, err := restored.Get(context.Background(), &Metric{Type: TYPEGAUGE, Name: "Alloc"})
+		require.NoError(t, err)
+		assert.Equal(t, 1.5, value)
+		value, err = restored.Get(context.Background(), counter)
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, value)
+	})
+
+	t.Run("записи из бэкапа не применяются повторно", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := New(300, dir, true)
+		require.NoError(t, err)
+		require.NoError(t, stor.openWAL(dir, wal.SYNCALWAYS, 0, true))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2}))
+		// сбой между записью бэкапа и очисткой журнала
+		require.NoError(t, stor.backupFile.Write(stor.backupData()))
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 3}))
+
+		restored, err := Open(BACKENDFILE, opts(dir))
+		require.NoError(t, err)
+		value, err := restored.Get(context.Background(), counter)
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, value)
+		require.NoError(t, restored.Close())
+
+		// после Close данные в бэкапе, журнал пуст
+		info, err := os.Stat(filepath.Join(dir, wal.FILENAME))
+		require.NoError(t, err)
+		assert.Zero(t, info.Size())
+
+		reopened, err := Open(BACKENDFILE, opts(dir))
+		require.NoError(t, err)
+		defer reopened.Close()
+		value, err = reopened.Get(context.Background(), counter)
+		require.NoError(t, err)
+		assert.Equal(t, 5.0, value)
+	})
+
+	t.Run("без восстановления журнал очищается", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := Open(BACKENDFILE, opts(dir))
+		require.NoError(t, err)
+		require.NoError(t, stor.Push(context.Background(), &Metric{Type: TYPECOUNTER, Name: "PollCount", Value: 2}))
+
+		o := opts(dir)
+		o.Restore = false
+		fresh, err := Open(BACKENDFILE, o)
+		require.NoError(t, err)
+		defer fresh.Close()
+		_, err = fresh.Get(context.Background(), counter)
+		assert.ErrorIs(t, err, ErrMetricNoData)
+	})
+
+	t.Run("неизвестная политика", func(t *testing.T) {
+		o := opts(t.TempDir())
+		o.WALSync = "sometimes"
+		_, err := Open(BACKENDFILE, o)
+		assert.ErrorIs(t, err, wal.ErrSyncPolicy)
+	})
+}
+
+func TestAgentKeys(t *testing.T) {
+	assert.NoError(t, logger.Init(&MockLogger{}, 5))
+	ctx := context.Background()
+	expires := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	created := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	// checkKeyStore общий сценарий: две версии одного агента, отзыв версии и всего агента
+	checkKeyStore := func(t *testing.T, keys KeyStore) {
+		require.NoError(t, keys.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 1, Key: "k1", CreatedAt: created}))
+		require.NoError(t, keys.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 2, Key: "k2", CreatedAt: created}))
+		require.NoError(t, keys.SaveAgentKey(ctx, AgentKey{AgentID: "a10", Version: 1, Key: "k3", CreatedAt: created}))
+		require.NoError(t, keys.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 1, Key: "k1", CreatedAt: created, ExpiresAt: &expires}))
+
+		list, err := keys.AgentKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, list, 3)
+		assert.Equal(t, "a1", list[0].AgentID)
+		assert.Equal(t, 1, list[0].Version)
+		require.NotNil(t, list[0].ExpiresAt, "повторное сохранение версии заменяет её")
+		assert.True(t, expires.Equal(*list[0].ExpiresAt))
+		assert.Equal(t, "k2", list[1].Key)
+
+		require.NoError(t, keys.DeleteAgentKeys(ctx, "a1", 1))
+		list, err = keys.AgentKeys(ctx)
+		require.NoError(t, err)
+		assert.Len(t, list, 2)
+
+		require.NoError(t, keys.DeleteAgentKeys(ctx, "a1", 0))
+		list, err = keys.AgentKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, list, 1, "ключи агента с похожим id не удаляются")
+		assert.Equal(t, "a10", list[0].AgentID)
+
+		require.NoError(t, keys.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 1, Key: "k1", CreatedAt: created}))
+		require.NoError(t, keys.ReplaceAgentKeys(ctx, "a1", []AgentKey{
+			{AgentID: "a1", Version: 2, Key: "k2", CreatedAt: created, ExpiresAt: &expires},
+			{AgentID: "a1", Version: 3, Key: "k4", CreatedAt: created},
+		}))
+		list, err = keys.AgentKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, list, 3, "версии агента заменены целиком")
+		assert.Equal(t, 2, list[0].Version)
+		assert.Equal(t, 3, list[1].Version)
+		assert.Equal(t, "a10", list[2].AgentID)
+		require.NoError(t, keys.ReplaceAgentKeys(ctx, "a1", nil))
+		list, err = keys.AgentKeys(ctx)
+		require.NoError(t, err)
+		assert.Len(t, list, 1)
+	}
+
+	t.Run("память", func(t *testing.T) {
+		stor, err := Open(BACKENDMEMORY, Options{})
+		require.NoError(t, err)
+		defer stor.Close()
+		checkKeyStore(t, stor.(KeyStore))
+	})
+
+	t.Run("файл", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := Open(BACKENDFILE, Options{StoreInterval: 300, FilePath: dir})
+		require.NoError(t, err)
+		checkKeyStore(t, stor.(KeyStore))
+		require.NoError(t, stor.Close())
+
+		reopened, err := Open(BACKENDFILE, Options{StoreInterval: 300, FilePath: dir})
+		require.NoError(t, err)
+		defer reopened.Close()
+		list, err := reopened.(KeyStore).AgentKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, list, 1, "ключи читаются из файла и без восстановления метрик")
+		assert.Equal(t, "k3", list[0].Key)
+	})
+
+	t.Run("повреждённый файл ключей", func(t *testing.T) {
+		dir := t.TempDir()
+		require.NoError(t, os.WriteFile(filepath.Join(dir, AGENTSFILENAME), []byte("{"), 0o600))
+		_, err := Open(BACKENDFILE, Options{StoreInterval: 300, FilePath: dir})
+		assert.Error(t, err)
+	})
+
+	t.Run("bolt", func(t *testing.T) {
+		dir := t.TempDir()
+		stor, err := Open(BACKENDBOLT, Options{BoltPath: dir})
+		require.NoError(t, err)
+		checkKeyStore(t, stor.(KeyStore))
+		require.NoError(t, stor.Close())
+
+		reopened, err := Open(BACKENDBOLT, Options{BoltPath: dir})
+		require.NoError(t, err)
+		defer reopened.Close()
+		list, err := reopened.(KeyStore).AgentKeys(ctx)
+		require.NoError(t, err)
+		assert.Len(t, list, 1)
+	})
+
+	t.Run("база данных", func(t *testing.T) {
+		mockDB := NewMockDB()
+		db, err := NewDB(ctx, mockDB)
+		require.NoError(t, err)
+		require.NoError(t, db.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 1, Key: "k1"}))
+		list, err := db.AgentKeys(ctx)
+		require.NoError(t, err)
+		assert.Equal(t, []AgentKey{{AgentID: "a1", Version: 1, Key: "k1"}}, list)
+
+		mockDB.writeErr = fmt.Errorf("connection refused")
+		assert.Error(t, db.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 2, Key: "k2"}))
+	})
+
+	t.Run("переходное хранилище пишет ключи в оба", func(t *testing.T) {
+		mem, err := New(0, "", false)
+		require.NoError(t, err)
+		mockDB := NewMockDB()
+		db, err := NewDB(ctx, mockDB)
+		require.NoError(t, err)
+		require.NoError(t, mem.SaveAgentKey(ctx, AgentKey{AgentID: "a0", Version: 1, Key: "k0"}))
+		n, err := CopyAgentKeys(ctx, mem, db)
+		require.NoError(t, err)
+		assert.Equal(t, 1, n)
+
+		dual := NewDual(mem, db)
+		require.NoError(t, dual.SaveAgentKey(ctx, AgentKey{AgentID: "a1", Version: 1, Key: "k1"}))
+		assert.Len(t, mockDB.agentKeys, 2)
+		require.NoError(t, dual.DeleteAgentKeys(ctx, "a0", 0))
+		assert.Len(t, mockDB.agentKeys, 1)
+		list, err := dual.AgentKeys(ctx)
+		require.NoError(t, err)
+		require.Len(t, list, 1)
+		assert.Equal(t, "a1", list[0].AgentID)
+
+		mockDB.writeErr = fmt.Errorf("connection refused")
+		assert.NoError(t, dual.SaveAgentKey(ctx, AgentKey{AgentID: "a2", Version: 1, Key: "k2"}), "ошибка второго хранилища только журналируется")
+	})
 }
@@ -0,0 +1,179 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage/fileio"
+)
+
+// TRANSFERBATCHSIZE сколько значений переносится одной пачкой
+const TRANSFERBATCHSIZE = 500
+
+// ImportBackup загрузка бэкапа из директории dir в хранилище dst
+// приращения counter переносятся как есть, свёрнутая сумма - одним приращением,
+// поэтому повторный импорт удвоил бы counter: непустое хранилище без force не принимается
+// история значений в бэкапе не хранится и не переносится
+// возвращает количество перенесённых значений
+func ImportBackup(ctx context.Context, dir string, dst Backend, force bool) (int, error) {
+	file, err := fileio.New(dir, BACKUPFILENAME)
+	if err != nil {
+		return 0, fmt.Errorf("fail while open backup: %w", err)
+	}
+	data, err := file.ReadData()
+	if err != nil {
+		return 0, fmt.Errorf("fail while read backup: %w", err)
+	}
+	if !force {
+		if err = ensureEmpty(ctx, dst); err != nil {
+			return 0, err
+		}
+	}
+	return pushItems(ctx, dst, backupItems(data))
+}
+
+// ExportBackup выгрузка текущих значений хранилища src в бэкап в директории dir
+// counter выгружается накопленной суммой, прежний бэкап сдвигается в историю снимков
+// возвращает количество выгруженных серий
+func ExportBackup(ctx context.Context, src Backend, dir string, keep int) (int, error) {
+	if dir == "" {
+		return 0, fmt.Errorf("%w: empty file storage path", ErrBackendOptions)
+	}
+	gauges, counters, err := src.Snapshot(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("fail while snapshot storage: %w", err)
+	}
+	data := &fileio.Data{
+		ItemsGauge:   gauges,
+		ItemsCounter: make(map[string][]float64, len(counters)),
+		CounterBase:  make(map[string]float64),
+	}
+	for key, value := range counters {
+		data.ItemsCounter[key] = []float64{value}
+	}
+
+	file, err := fileio.New(dir, BACKUPFILENAME)
+	if err != nil {
+		return 0, fmt.Errorf("fail while open backup: %w", err)
+	}
+	if keep > 0 {
+		file.SetKeep(keep)
+	}
+	err = file.Write(data)
+	if err != nil {
+		return 0, fmt.Errorf("fail while write backup: %w", err)
+	}
+	return len(gauges) + len(counters), nil
+}
+
+// Copy перенос текущих значений всех серий из src в dst, counter переносится накопленной суммой
+// непустое хранилище dst без force не принимается
+// возвращает количество перенесённых серий
+func Copy(ctx context.Context, src, dst Backend, force bool) (int, error) {
+	gauges, counters, err := src.Snapshot(ctx)
+	if err != nil {
+		return 0, fmt.Errorf("fail while snapshot source storage: %w", err)
+	}
+	if !force {
+		if err = ensureEmpty(ctx, dst); err != nil {
+			return 0, err
+		}
+	}
+	items := make([]Metric, 0, len(gauges)+len(counters))
+	items = appendSeries(items, TYPEGAUGE, gauges)
+	items = appendSeries(items, TYPECOUNTER, counters)
+	return pushItems(ctx, dst, items)
+}
+
+// CopyAgentKeys перенос ключей агентов из src в dst, версии с теми же номерами перезаписываются
+// хранилища без ключей агентов пропускаются
+// возвращает количество перенесённых версий ключей
+func CopyAgentKeys(ctx context.Context, src, dst Backend) (int, error) {
+	from, ok := src.(KeyStore)
+	if !ok {
+		return 0, nil
+	}
+	to, ok := dst.(KeyStore)
+	if !ok {
+		return 0, nil
+	}
+	keys, err := from.AgentKeys(ctx)
+	if err != nil {
+		return 0, err
+	}
+	for i, key := range keys {
+		if err = to.SaveAgentKey(ctx, key); err != nil {
+			return i, err
+		}
+	}
+	return len(keys), nil
+}
+
+// ensureEmpty проверка, что в хранилище нет ни одной серии
+func ensureEmpty(ctx context.Context, stor Backend) error {
+	gauges, counters, err := stor.Snapshot(ctx)
+	if err != nil {
+		return fmt.Errorf("fail while snapshot destination storage: %w", err)
+	}
+	if n := len(gauges) + len(counters); n > 0 {
+		return fmt.Errorf("%w: %d series", ErrTransferNotEmpty, n)
+	}
+	return nil
+}
+
+// backupItems значения из бэкапа в порядке записи
+// серии упорядочены по ключу, чтобы перенос был воспроизводимым
+func backupItems(data *fileio.Data) []Metric {
+	var items []Metric
+	items = appendSeries(items, TYPEGAUGE, data.ItemsGauge)
+	for _, key := range seriesKeys(data.CounterBase, data.ItemsCounter) {
+		name, l := labels.ParseKey(key)
+		if base := data.CounterBase[key]; base != 0 {
+			items = append(items, Metric{Type: TYPECOUNTER, Name: name, Labels: l, Value: base})
+		}
+		for _, value := range data.ItemsCounter[key] {
+			items = append(items, Metric{Type: TYPECOUNTER, Name: name, Labels: l, Value: value})
+		}
+	}
+	return items
+}
+
+// appendSeries добавление значений серий одного типа в порядке ключей
+func appendSeries(items []Metric, mType string, series map[string]float64) []Metric {
+	for _, key := range seriesKeys(series, nil) {
+		name, l := labels.ParseKey(key)
+		items = append(items, Metric{Type: mType, Name: name, Labels: l, Value: series[key]})
+	}
+	return items
+}
+
+// seriesKeys отсортированные ключи серий обеих карт без повторов
+func seriesKeys(single map[string]float64, multi map[string][]float64) []string {
+	seen := make(map[string]bool, len(single)+len(multi))
+	keys := make([]string, 0, len(single)+len(multi))
+	for key := range single {
+		seen[key] = true
+		keys = append(keys, key)
+	}
+	for key := range multi {
+		if !seen[key] {
+			keys = append(keys, key)
+		}
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// pushItems запись значений пачками по TRANSFERBATCHSIZE
+func pushItems(ctx context.Context, dst Backend, items []Metric) (int, error) {
+	for start := 0; start < len(items); start += TRANSFERBATCHSIZE {
+		end := min(start+TRANSFERBATCHSIZE, len(items))
+		_, err := dst.PushBatch(ctx, items[start:end])
+		if err != nil {
+			return start, fmt.Errorf("fail while push values: %w", err)
+		}
+	}
+	return len(items), nil
+}
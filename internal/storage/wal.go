@@ -0,0 +1,62 @@
+package storage
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage/wal"
+)
+
+// openWAL подключение журнала упреждающей записи в директории path
+// при replay записи журнала, не попавшие в бэкап, применяются поверх восстановленных данных,
+// иначе журнал очищается вместе с прежними данными
+func (ms *MemStorage) openWAL(path, policy string, interval time.Duration, replay bool) error {
+	journal, err := wal.Open(path, policy, interval)
+	if err != nil {
+		return fmt.Errorf("fail while open wal: %w", err)
+	}
+
+	ms.mu.Lock()
+	defer ms.mu.Unlock()
+	if replay {
+		var replayed int
+		err = journal.Replay(func(rec wal.Record) error {
+			if rec.Seq <= ms.walSeq {
+				return nil
+			}
+			metric := &Metric{Type: rec.Type, Name: rec.Name, Labels: rec.Labels, Value: rec.Value}
+			if err := validatePush(metric); err != nil {
+				return fmt.Errorf("wrong wal record %d: %w", rec.Seq, err)
+			}
+			ms.apply(metric, rec.Time)
+			ms.walSeq = rec.Seq
+			replayed++
+			return nil
+		})
+		if err != nil {
+			journal.Close()
+			return fmt.Errorf("fail while replay wal: %w", err)
+		}
+		logger.Info(fmt.Sprintf("wal replayed: %d records", replayed))
+	} else {
+		err = journal.Truncate()
+		if err != nil {
+			journal.Close()
+			return fmt.Errorf("fail while truncate wal: %w", err)
+		}
+	}
+	journal.Advance(ms.walSeq)
+	ms.wal = journal
+	return nil
+}
+
+// truncateWAL очистка журнала после успешного бэкапа
+// вызывается под блокировкой
+func (ms *MemStorage) truncateWAL() error {
+	err := ms.wal.Truncate()
+	if err != nil {
+		return fmt.Errorf("fail while truncate wal: %w", err)
+	}
+	return nil
+}
@@ -0,0 +1,10 @@
+package wal
+
+import "errors"
+
+var (
+	ErrSyncPolicy   = errors.New("unknown wal sync policy")
+	ErrSyncInterval = errors.New("wal sync interval must be positive")
+	ErrChecksum     = errors.New("wal record checksum mismatch")
+	ErrRecordSize   = errors.New("wal record too large")
+)
@@ -0,0 +1,264 @@
+// Модуль отвечает за журнал упреждающей записи (WAL) хранилища в памяти:
+// каждая запись метрики дописывается в журнал до применения,
+// после успешного бэкапа журнал очищается
+package wal
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+)
+
+// Политики сброса журнала на диск (fsync)
+const (
+	SYNCALWAYS   = "always"   // после каждой записи
+	SYNCBATCH    = "batch"    // после каждых BATCHSIZE записей
+	SYNCINTERVAL = "interval" // периодически в фоне
+)
+
+// Настройки журнала
+const (
+	FILENAME   = "wal"   // название файла журнала в директории бэкапа
+	BATCHSIZE  = 64      // количество записей между fsync для политики batch
+	HEADERSIZE = 8       // длина и контрольная сумма записи, по 4 байта
+	MAXRECORD  = 1 << 20 // записи длиннее считаются повреждёнными
+)
+
+// Record запись журнала об одном значении метрики
+// Seq сквозной номер записи, по нему при восстановлении пропускаются записи, уже попавшие в бэкап
+type Record struct {
+	Seq    uint64        `json:"seq"`
+	Type   string        `json:"type"`
+	Name   string        `json:"name"`
+	Labels labels.Labels `json:"labels,omitempty"`
+	Value  float64       `json:"value"`
+	Time   time.Time     `json:"time"`
+}
+
+// WAL журнал упреждающей записи
+// формат записи: длина (4 байта), crc32 (4 байта), JSON записи
+type WAL struct {
+	file    *os.File
+	policy  string
+	seq     uint64
+	pending int
+	done    chan struct{}
+	mu      sync.Mutex
+}
+
+// Open открывает или создаёт журнал в директории path
+// оборванная при сбое последняя запись отбрасывается
+// для политики interval запускается фоновый сброс на диск с периодом interval
+func Open(path, policy string, interval time.Duration) (*WAL, error) {
+	switch policy {
+	case SYNCALWAYS, SYNCBATCH:
+	case SYNCINTERVAL:
+		if interval <= 0 {
+			return nil, ErrSyncInterval
+		}
+	default:
+		return nil, fmt.Errorf("%w: %s", ErrSyncPolicy, policy)
+	}
+
+	err := os.MkdirAll(path, 0755)
+	if err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(filepath.Join(path, FILENAME), os.O_RDWR|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	w := &WAL{
+		file:   file,
+		policy: policy,
+		done:   make(chan struct{}),
+	}
+	// проход по журналу восстанавливает номер последней записи и отрезает оборванный хвост
+	err = w.Replay(func(Record) error { return nil })
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	if policy == SYNCINTERVAL {
+		go w.syncLoop(interval)
+	}
+	return w, nil
+}
+
+// Append дописывает запись в журнал и возвращает присвоенный ей номер
+// на диск запись сбрасывается согласно политике
+func (w *WAL) Append(rec Record) (uint64, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	rec.Seq = w.seq + 1
+	payload, err := json.Marshal(rec)
+	if err != nil {
+		return 0, err
+	}
+	frame := make([]byte, HEADERSIZE+len(payload))
+	binary.BigEndian.PutUint32(frame, uint32(len(payload)))
+	binary.BigEndian.PutUint32(frame[4:], crc32.ChecksumIEEE(payload))
+	copy(frame[HEADERSIZE:], payload)
+
+	_, err = w.file.Write(frame)
+	if err != nil {
+		return 0, err
+	}
+	w.seq = rec.Seq
+	w.pending++
+
+	switch w.policy {
+	case SYNCALWAYS:
+		err = w.sync()
+	case SYNCBATCH:
+		if w.pending >= BATCHSIZE {
+			err = w.sync()
+		}
+	}
+	if err != nil {
+		return 0, err
+	}
+	return rec.Seq, nil
+}
+
+// Replay передаёт в fn все записи журнала по порядку
+// чтение останавливается на первой повреждённой записи, журнал обрезается до неё
+func (w *WAL) Replay(fn func(Record) error) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	_, err := w.file.Seek(0, io.SeekStart)
+	if err != nil {
+		return err
+	}
+	reader := bufio.NewReader(w.file)
+	var offset int64
+	header := make([]byte, HEADERSIZE)
+	for {
+		_, err = io.ReadFull(reader, header)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil {
+			return w.cut(offset, err)
+		}
+		size := binary.BigEndian.Uint32(header)
+		if size > MAXRECORD {
+			return w.cut(offset, ErrRecordSize)
+		}
+		payload := make([]byte, size)
+		_, err = io.ReadFull(reader, payload)
+		if err != nil {
+			return w.cut(offset, err)
+		}
+		if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:]) {
+			return w.cut(offset, ErrChecksum)
+		}
+		var rec Record
+		err = json.Unmarshal(payload, &rec)
+		if err != nil {
+			return w.cut(offset, err)
+		}
+		err = fn(rec)
+		if err != nil {
+			return err
+		}
+		if rec.Seq > w.seq {
+			w.seq = rec.Seq
+		}
+		offset += int64(HEADERSIZE + len(payload))
+	}
+}
+
+// Advance гарантирует, что следующие записи получат номера больше seq
+// используется после восстановления из бэкапа, когда журнал уже очищен
+func (w *WAL) Advance(seq uint64) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if seq > w.seq {
+		w.seq = seq
+	}
+}
+
+// Truncate очищает журнал, вызывается после успешного бэкапа
+// нумерация записей продолжается
+func (w *WAL) Truncate() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	err := w.file.Truncate(0)
+	if err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// Sync сбрасывает на диск записи, ещё не сброшенные по политике
+func (w *WAL) Sync() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if w.pending == 0 {
+		return nil
+	}
+	return w.sync()
+}
+
+// Close сбрасывает журнал на диск и закрывает файл
+func (w *WAL) Close() error {
+	close(w.done)
+	err := w.Sync()
+	if err != nil {
+		return err
+	}
+	return w.file.Close()
+}
+
+// sync сброс на диск, вызывается под блокировкой
+func (w *WAL) sync() error {
+	err := w.file.Sync()
+	if err != nil {
+		return err
+	}
+	w.pending = 0
+	return nil
+}
+
+// cut обрезает журнал после последней целой записи
+func (w *WAL) cut(offset int64, reason error) error {
+	logger.Error(fmt.Sprintf("wal is damaged at offset %d, tail dropped: %v", offset, reason))
+	err := w.file.Truncate(offset)
+	if err != nil {
+		return err
+	}
+	return w.sync()
+}
+
+// syncLoop периодический сброс журнала на диск для политики interval
+func (w *WAL) syncLoop(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-w.done:
+			return
+		case <-ticker.C:
+			err := w.Sync()
+			if err != nil {
+				logger.Error(fmt.Sprintf("fail while sync wal: %v", err))
+			}
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package wal
+
+import (
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// readAll все записи журнала
+func readAll(t *testing.T, w *WAL) []Record {
+	t.Helper()
+	var records []Record
+	require.NoError(t, w.Replay(func(rec Record) error {
+		records = append(records, rec)
+		return nil
+	}))
+	return records
+}
+
+func TestOpen(t *testing.T) {
+	require.NoError(t, logger.Init(io.Discard, 0))
+
+	t.Run("неизвестная политика", func(t *testing.T) {
+		_, err := Open(t.TempDir(), "sometimes", 0)
+		assert.ErrorIs(t, err, ErrSyncPolicy)
+	})
+
+	t.Run("interval без периода", func(t *testing.T) {
+		_, err := Open(t.TempDir(), SYNCINTERVAL, 0)
+		assert.ErrorIs(t, err, ErrSyncInterval)
+	})
+
+	for _, policy := range []string{SYNCALWAYS, SYNCBATCH, SYNCINTERVAL} {
+		t.Run("политика "+policy, func(t *testing.T) {
+			w, err := Open(t.TempDir(), policy, 10*time.Millisecond)
+			require.NoError(t, err)
+			_, err = w.Append(Record{Type: "gauge", Name: "Alloc", Value: 1})
+			require.NoError(t, err)
+			assert.Len(t, readAll(t, w), 1)
+			require.NoError(t, w.Close())
+		})
+	}
+}
+
+func TestAppendReplay(t *testing.T) {
+	require.NoError(t, logger.Init(io.Discard, 0))
+	dir := t.TempDir()
+	ts := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	w, err := Open(dir, SYNCALWAYS, 0)
+	require.NoError(t, err)
+	seq, err := w.Append(Record{Type: "gauge", Name: "Alloc", Labels: labels.Labels{"host": "h1"}, Value: 1.5, Time: ts})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(1), seq)
+	seq, err = w.Append(Record{Type: "counter", Name: "PollCount", Value: 2, Time: ts})
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), seq)
+	require.NoError(t, w.Close())
+
+	w, err = Open(dir, SYNCALWAYS, 0)
+	require.NoError(t, err)
+	defer w.Close()
+	assert.Equal(t, []Record{
+		{Seq: 1, Type: "gauge", Name: "Alloc", Labels: labels.Labels{"host": "h1"}, Value: 1.5, Time: ts},
+		{Seq: 2, Type: "counter", Name: "PollCount", Value: 2, Time: ts},
+	}, readAll(t, w))
+
+	t.Run("нумерация продолжается после открытия и очистки", func(t *testing.T) {
+		require.NoError(t, w.Truncate())
+		assert.Empty(t, readAll(t, w))
+		seq, err := w.Append(Record{Type: "gauge", Name: "Alloc", Value: 2})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), seq)
+
+		w.Advance(10)
+		seq, err = w.Append(Record{Type: "gauge", Name: "Alloc", Value: 3})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(11), seq)
+		assert.Len(t, readAll(t, w), 2)
+	})
+}
+
+func TestReplayDamaged(t *testing.T) {
+	require.NoError(t, logger.Init(io.Discard, 0))
+
+	prepare := func(t *testing.T) (string, int64) {
+		dir := t.TempDir()
+		w, err := Open(dir, SYNCBATCH, 0)
+		require.NoError(t, err)
+		for i := 0; i < 3; i++ {
+			_, err = w.Append(Record{Type: "counter", Name: "PollCount", Value: 1})
+			require.NoError(t, err)
+		}
+		require.NoError(t, w.Close())
+		info, err := os.Stat(filepath.Join(dir, FILENAME))
+		require.NoError(t, err)
+		return dir, info.Size()
+	}
+
+	t.Run("оборванная последняя запись", func(t *testing.T) {
+		dir, size := prepare(t)
+		require.NoError(t, os.Truncate(filepath.Join(dir, FILENAME), size-3))
+
+		w, err := Open(dir, SYNCALWAYS, 0)
+		require.NoError(t, err)
+		defer w.Close()
+		assert.Len(t, readAll(t, w), 2)
+
+		// после обрезки хвоста новые записи читаются
+		seq, err := w.Append(Record{Type: "counter", Name: "PollCount", Value: 1})
+		require.NoError(t, err)
+		assert.Equal(t, uint64(3), seq)
+		assert.Len(t, readAll(t, w), 3)
+	})
+
+	t.Run("испорченная контрольная сумма", func(t *testing.T) {
+		dir, size := prepare(t)
+		file, err := os.OpenFile(filepath.Join(dir, FILENAME), os.O_RDWR, 0644)
+		require.NoError(t, err)
+		_, err = file.WriteAt([]byte{'X'}, size-2)
+		require.NoError(t, err)
+		require.NoError(t, file.Close())
+
+		w, err := Open(dir, SYNCALWAYS, 0)
+		require.NoError(t, err)
+		defer w.Close()
+		assert.Len(t, readAll(t, w), 2)
+	})
+}
@@ -0,0 +1,10 @@
+package webclient
+
+import "errors"
+
+var (
+	ErrRetryableStatus = errors.New("server temporarily unavailable")
+	ErrServerStatus    = errors.New("server failed to save metrics")
+	ErrBatchRejected   = errors.New("server rejected metrics")
+	ErrSpoolSize       = errors.New("spool size limit must be positive")
+)
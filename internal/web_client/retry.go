@@ -0,0 +1,72 @@
+package webclient
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
+)
+
+// retryPolicy политика повторов отправки, переменная для подмены задержек в тестах
+var retryPolicy = retry.New("webclient", isTransient)
+
+// isTransient временный сбой отправки: сетевая ошибка или ответ сервера о временной недоступности
+func isTransient(err error) bool {
+	return errors.Is(err, ErrRetryableStatus) || retry.Transient(err)
+}
+
+// retryableStatus ответы сервера, после которых отправку имеет смысл повторить
+func retryableStatus(code int) bool {
+	switch code {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// doRetry отправка req с повторами по политике retryPolicy
+// тело запроса для каждой попытки получается заново через GetBody, иначе повтор ушёл бы с пустым телом
+// sign, если задан, подписывает каждую попытку заново, см. requestSigner
+func doRetry(ctx context.Context, cl *http.Client, req *http.Request, sign func(req *http.Request) error) (*http.Response, error) {
+	var resp *http.Response
+	var errCollect []error
+	err := retryPolicy.Do(ctx, func(ctx context.Context) error {
+		try := req.WithContext(ctx)
+		if req.GetBody != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return err
+			}
+			try.Body = body
+		}
+		if sign != nil {
+			try.Header = req.Header.Clone()
+			if err := sign(try); err != nil {
+				return err
+			}
+		}
+		r, err := cl.Do(try)
+		if err != nil {
+			errCollect = append(errCollect, err)
+			return err
+		}
+		if retryableStatus(r.StatusCode) {
+			r.Body.Close()
+			err = fmt.Errorf("%w: %s", ErrRetryableStatus, r.Status)
+			errCollect = append(errCollect, err)
+			return err
+		}
+		resp = r
+		return nil
+	})
+	if errCollect != nil {
+		logger.Error(fmt.Sprintf("problem with sending metrics: %s\n", errors.Join(errCollect...).Error()))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return resp, nil
+}
@@ -7,15 +7,19 @@ import (
 	"context"
 	"crypto/hmac"
 	"crypto/sha256"
+	"crypto/tls"
 	"encoding/hex"
 	"encoding/json"
-	"errors"
 	"fmt"
+	"net"
 	"net/http"
+	"strconv"
 	"sync"
 	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
 	cryptoutils "github.com/Grifonhard/Practicum-metrics/internal/crypto_utils"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	metgen "github.com/Grifonhard/Practicum-metrics/internal/met_gen"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage"
@@ -23,10 +27,11 @@ import (
 
 // Metrics для сериализации данных из генератора метрик
 type Metrics struct {
-	ID    string   `json:"id"`              // имя метрики
-	MType string   `json:"type"`            // параметр, принимающий значение gauge или counter
-	Delta *int64   `json:"delta,omitempty"` // значение метрики в случае передачи counter
-	Value *float64 `json:"value,omitempty"` // значение метрики в случае передачи gauge
+	ID     string        `json:"id"`               // имя метрики
+	MType  string        `json:"type"`             // параметр, принимающий значение gauge или counter
+	Delta  *int64        `json:"delta,omitempty"`  // значение метрики в случае передачи counter
+	Value  *float64      `json:"value,omitempty"`  // значение метрики в случае передачи gauge
+	Labels labels.Labels `json:"labels,omitempty"` // метки серии
 }
 
 // Настройки режима отправки данных
@@ -35,118 +40,110 @@ const (
 	SENDARRAY       = "array mode"       // для /updates
 )
 
-// Настройки повторных попыток отправить данные, если происходят сбои
-const (
-	MAXRETRIES            = 3               // Максимальное количество попыток
-	RETRYINTERVALINCREASE = 2 * time.Second // на столько растёт интервал между попытками, начиная с 1 секунды
-)
-
 // SendMetric агрегирует и отправляет данные на сервер
-func SendMetric(wg *sync.WaitGroup, url string, gen *metgen.MetGen, keyHash, sendMethod string) {
+// метки l добавляются к каждой метрике
+// если задан AgentSpool, неотправленный пакет сохраняется в нём и отправляется позже
+func SendMetric(wg *sync.WaitGroup, url string, gen *metgen.MetGen, keyHash, sendMethod string, l labels.Labels) {
 	wg.Add(1)
 	defer wg.Done()
 	ctx, cancel := context.WithCancel(context.Background())
 	ch := make(chan *Metrics)
 
 	// подготовка данных
-	var buf bytes.Buffer
 	gauge, counter, err := gen.Collect()
 	if err != nil {
 		logger.Error(fmt.Sprintf("fail collect metrics: %s", err.Error()))
 	}
-	enc := json.NewEncoder(&buf)
-	// используется только для массива итемов /updates
-	var items []*Metrics
+	var batch []Metrics
 
-	go prepareDataToSend(gauge, counter, ch, cancel)
+	go prepareDataToSend(gauge, counter, l, ch, cancel)
 	for {
 		select {
 		case item := <-ch:
-			switch sendMethod {
-			case SENDSUBSEQUENCE:
-				err = enc.Encode(item)
-				if err != nil {
-					logger.Error(fmt.Sprintf("fail encode metrics: %s", err.Error()))
-				}
-			case SENDARRAY:
-				items = append(items, item)
-			}
+			batch = append(batch, *item)
 		case <-ctx.Done():
 			close(ch)
-			if sendMethod == SENDARRAY {
-				err = enc.Encode(items)
-				if err != nil {
-					logger.Error(fmt.Sprintf("fail encode metrics: %s", err.Error()))
-				}
-			}
-			//сжимаем данные
-			compressed, err := compressBeforeSend(buf.Bytes())
-			if err != nil {
-				logger.Error(fmt.Sprintf("fail while compress: %s", err.Error()))
-				cancel()
-				return
+			send := func(batch []Metrics) error {
+				return sendBatch(url, batch, keyHash, sendMethod)
 			}
-			// шифрование, если есть ключ
-			var finalBody *bytes.Buffer
-			if cryptoutils.PublicKey != nil {
-				encrypted, err := cryptoutils.EncryptRSA(compressed.Bytes(), cryptoutils.PublicKey)
-				if err != nil {
-					logger.Error("error encrypting data: ", err)
-					return
-				}
-				requestBody := []byte(fmt.Sprintf(`{"data":"%s"}`, encrypted))
-				finalBody = bytes.NewBuffer(requestBody)
+			if AgentSpool != nil {
+				err = AgentSpool.Send(batch, send)
 			} else {
-				finalBody = compressed
+				err = send(batch)
 			}
-			//подготовка реквеста и клиента
-			req, err := http.NewRequest(http.MethodPost, url, finalBody)
 			if err != nil {
-				logger.Error(fmt.Sprintf("fail while create request: %s", err.Error()))
-				cancel()
-				return
-			}
-			if keyHash != "" {
-				hmacHash := computeHMAC(compressed.String(), keyHash)
-				req.Header.Set("HashSHA256", hmacHash)
-			}
-			req.Header.Set("Content-Type", "application/json")
-			req.Header.Set("Content-Encoding", "gzip")
-			//какого-то хрена заголовок Accept-Encoding gzip устанавливается автоматически в клиенте по умолчанию
-			cl := &http.Client{
-				Timeout: time.Minute,
+				logger.Error(fmt.Sprintf("fail while sending metrics: %s\n", err.Error()))
 			}
+			return
+		}
+	}
+}
 
-			var resp *http.Response
-			var errCollect []error
-			for i := 0; i < MAXRETRIES; i++ {
-				resp, err = cl.Do(req)
-				if err != nil {
-					time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
-					errCollect = append(errCollect, err)
-					continue
-				} else {
-					defer resp.Body.Close()
-					break
-				}
-			}
-			if errCollect != nil {
-				logger.Error(fmt.Sprintf("problem with sending metrics: %s\n", errors.Join(errCollect...).Error()))
-			}
+// sendBatch отправка пакета метрик одним запросом
+// ответ 5xx возвращается как ErrServerStatus, 4xx - как ErrBatchRejected: повтор такого пакета бесполезен
+func sendBatch(url string, batch []Metrics, keyHash, sendMethod string) error {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	switch sendMethod {
+	case SENDSUBSEQUENCE:
+		for _, item := range batch {
+			err := enc.Encode(item)
 			if err != nil {
-				logger.Error(fmt.Sprintf("fail while sending metrics: %s\n", err.Error()))
-				return
+				return fmt.Errorf("fail encode metrics: %w", err)
 			}
-
-			logger.Info(fmt.Sprintf("success send, status: %s\n", resp.Status))
-			return
 		}
+	case SENDARRAY:
+		err := enc.Encode(batch)
+		if err != nil {
+			return fmt.Errorf("fail encode metrics: %w", err)
+		}
+	}
+	//сжимаем данные
+	compressed, err := compressBeforeSend(buf.Bytes())
+	if err != nil {
+		return fmt.Errorf("fail while compress: %w", err)
+	}
+	// шифрование, если есть ключ
+	var finalBody *bytes.Buffer
+	if cryptoutils.PublicKey != nil {
+		requestBody, err := encryptBody(compressed.Bytes())
+		if err != nil {
+			return fmt.Errorf("error encrypting data: %w", err)
+		}
+		finalBody = bytes.NewBuffer(requestBody)
+	} else {
+		finalBody = compressed
+	}
+	//подготовка реквеста и клиента
+	req, err := http.NewRequest(http.MethodPost, url, finalBody)
+	if err != nil {
+		return fmt.Errorf("fail while create request: %w", err)
 	}
+	setRealIP(req)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Content-Encoding", "gzip")
+	//какого-то хрена заголовок Accept-Encoding gzip устанавливается автоматически в клиенте по умолчанию
+	cl := newClient()
+
+	resp, err := doRetry(context.Background(), cl, req, requestSigner(compressed.Bytes(), keyHash))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= http.StatusInternalServerError {
+		return fmt.Errorf("%w: %s", ErrServerStatus, resp.Status)
+	}
+	if resp.StatusCode >= http.StatusBadRequest {
+		return fmt.Errorf("%w: %s", ErrBatchRejected, resp.Status)
+	}
+
+	logger.Info(fmt.Sprintf("success send, status: %s\n", resp.Status))
+	return nil
 }
 
 // prepareDataToSend подготовка и отправка данных
 // приспособлена для асинхронной работы с функциями отправляющими данные
-func prepareDataToSend(g map[string]float64, c map[string]int64, ch chan *Metrics, cancel context.CancelFunc) {
+func prepareDataToSend(g map[string]float64, c map[string]int64, l labels.Labels, ch chan *Metrics, cancel context.CancelFunc) {
 	wg := &sync.WaitGroup{}
 	wg.Add(2)
 	go func() {
@@ -155,6 +152,7 @@ func prepareDataToSend(g map[string]float64, c map[string]int64, ch chan *Metric
 			var metric Metrics
 			metric.ID = k
 			metric.MType = storage.TYPEGAUGE
+			metric.Labels = l
 			val := v
 			metric.Value = &val
 			ch <- &metric
@@ -167,6 +165,7 @@ func prepareDataToSend(g map[string]float64, c map[string]int64, ch chan *Metric
 			var metric Metrics
 			metric.ID = k
 			metric.MType = storage.TYPECOUNTER
+			metric.Labels = l
 			dlt := v
 			metric.Delta = &dlt
 			ch <- &metric
@@ -194,6 +193,105 @@ func compressBeforeSend(b []byte) (compressed *bytes.Buffer, err error) {
 	return compressed, nil
 }
 
+// transport транспорт с настройками TLS агента, nil - транспорт по умолчанию
+var transport *http.Transport
+
+// SetTLS настройки TLS для отправки метрик по https, см. cryptoutils.ClientTLSConfig
+func SetTLS(config *tls.Config) {
+	t := http.DefaultTransport.(*http.Transport).Clone()
+	t.TLSClientConfig = config
+	transport = t
+}
+
+// newClient http клиент для отправки метрик
+func newClient() *http.Client {
+	cl := &http.Client{
+		Timeout: time.Minute,
+	}
+	if transport != nil {
+		cl.Transport = transport
+	}
+	return cl
+}
+
+// encryptBody тело запроса, зашифрованное открытым ключом сервера, см. cryptoutils.Envelope
+func encryptBody(data []byte) ([]byte, error) {
+	envelope, err := cryptoutils.EncryptEnvelope(data, cryptoutils.PublicKey)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(envelope)
+}
+
+// id агента и версия его ключа, пустой id - запросы подписываются общим ключом сервера
+var (
+	agentID    string
+	keyVersion int
+)
+
+// SetAgent отправка метрик от имени агента id, ключ подписи - ключ этого агента версии version
+// version 0 - сервер проверяет подпись всеми действующими версиями ключа
+func SetAgent(id string, version int) {
+	agentID = id
+	keyVersion = version
+}
+
+// requestSigner подпись запроса ключом key, вызывается doRetry перед каждой попыткой отправки
+// подписываются время отправки, новый nonce и тело body, так что перехваченный запрос нельзя повторить,
+// а повтор после сбоя не отклоняется сервером как уже виденный, см. agents.ReplayGuard
+// без ключа запрос не подписывается
+func requestSigner(body []byte, key string) func(req *http.Request) error {
+	if key == "" {
+		return nil
+	}
+	return func(req *http.Request) error {
+		nonce, err := agents.NewNonce()
+		if err != nil {
+			return err
+		}
+		timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+		req.Header.Set(agents.HEADERTIMESTAMP, timestamp)
+		req.Header.Set(agents.HEADERNONCE, nonce)
+		req.Header.Set("HashSHA256", computeHMAC(string(agents.Signed(body, timestamp, nonce)), key))
+		if agentID != "" {
+			req.Header.Set(agents.HEADERAGENTID, agentID)
+			if keyVersion != 0 {
+				req.Header.Set(agents.HEADERKEYVERSION, strconv.Itoa(keyVersion))
+			}
+		}
+		return nil
+	}
+}
+
+// REALIPHEADER заголовок с адресом агента, сервер сверяет его с доверенной подсетью
+const REALIPHEADER = "X-Real-IP"
+
+// realIP адрес агента для заголовка X-Real-IP, nil - заголовок не отправляется
+var realIP net.IP
+
+// SetRealIP адрес агента, отправляемый в заголовке X-Real-IP, см. OutboundIP
+func SetRealIP(ip net.IP) {
+	realIP = ip
+}
+
+// OutboundIP адрес сетевого интерфейса, через который агент выходит на сервер addr (host:port)
+// UDP соединение только выбирает маршрут, пакеты не отправляются
+func OutboundIP(addr string) (net.IP, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP, nil
+}
+
+// setRealIP заголовок X-Real-IP, если адрес агента задан
+func setRealIP(req *http.Request) {
+	if realIP != nil {
+		req.Header.Set(REALIPHEADER, realIP.String())
+	}
+}
+
 // computeHMAC подготовка hmac для отправляемых данных
 func computeHMAC(value, key string) string {
 	h := hmac.New(sha256.New, []byte(key))
@@ -202,7 +300,8 @@ func computeHMAC(value, key string) string {
 }
 
 // SendMetricWithWorkerPool асинхронная подготовка и отправка метрик
-func SendMetricWithWorkerPool(wgSig *sync.WaitGroup, url string, gen *metgen.MetGen, keyHash string, rateLimit int) {
+// метки l добавляются к каждой метрике
+func SendMetricWithWorkerPool(wgSig *sync.WaitGroup, url string, gen *metgen.MetGen, keyHash string, rateLimit int, l labels.Labels) {
 	wgSig.Add(1)
 	defer wgSig.Done()
 	collectG := make(chan metgen.OneMetric)
@@ -223,7 +322,7 @@ func SendMetricWithWorkerPool(wgSig *sync.WaitGroup, url string, gen *metgen.Met
 	go gen.CollectCounterToChan(ctx, collectC, errChan)
 
 	// собираем данные в канал для воркеров
-	go fanIn(ctx, collectG, collectC, workerChan)
+	go fanIn(ctx, collectG, collectC, l, workerChan)
 
 	// обработка ошибок
 	go func() {
@@ -260,9 +359,7 @@ func SendMetricWithWorkerPool(wgSig *sync.WaitGroup, url string, gen *metgen.Met
 func sendWorker(ctx context.Context, wg *sync.WaitGroup, url, keyHash string, input chan Metrics, errChan chan error) {
 	defer wg.Done()
 	//какого-то хрена заголовок Accept-Encoding gzip устанавливается автоматически в клиенте по умолчанию
-	cl := &http.Client{
-		Timeout: time.Minute,
-	}
+	cl := newClient()
 	for {
 		select {
 		case <-ctx.Done():
@@ -284,12 +381,11 @@ func sendWorker(ctx context.Context, wg *sync.WaitGroup, url, keyHash string, in
 			// шифрование, если есть ключ
 			var finalBody *bytes.Buffer
 			if cryptoutils.PublicKey != nil {
-				encrypted, err := cryptoutils.EncryptRSA(compressed.Bytes(), cryptoutils.PublicKey)
+				requestBody, err := encryptBody(compressed.Bytes())
 				if err != nil {
 					logger.Error("error encrypting data: ", err)
 					return
 				}
-				requestBody := []byte(fmt.Sprintf(`{"data":"%s"}`, encrypted))
 				finalBody = bytes.NewBuffer(requestBody)
 			} else {
 				finalBody = compressed
@@ -300,28 +396,13 @@ func sendWorker(ctx context.Context, wg *sync.WaitGroup, url, keyHash string, in
 				errChan <- err
 				return
 			}
-			if keyHash != "" {
-				hmacHash := computeHMAC(compressed.String(), keyHash)
-				req.Header.Set("HashSHA256", hmacHash)
-			}
+			setRealIP(req)
 			req.Header.Set("Content-Type", "application/json")
 			req.Header.Set("Content-Encoding", "gzip")
 
-			var resp *http.Response
-			var errCollect []error
-			for i := 0; i < MAXRETRIES; i++ {
-				resp, err = cl.Do(req)
-				if err != nil {
-					time.Sleep(time.Second + RETRYINTERVALINCREASE*time.Duration(i))
-					errCollect = append(errCollect, err)
-					continue
-				} else {
-					defer resp.Body.Close()
-					break
-				}
-			}
-			if errCollect != nil {
-				logger.Error(fmt.Sprintf("problem with sending metrics: %s\n", errors.Join(errCollect...).Error()))
+			resp, err := doRetry(ctx, cl, req, requestSigner(compressed.Bytes(), keyHash))
+			if err == nil {
+				defer resp.Body.Close()
 			}
 			if err != nil {
 				errChan <- err
@@ -333,7 +414,7 @@ func sendWorker(ctx context.Context, wg *sync.WaitGroup, url, keyHash string, in
 }
 
 // fanIn посредник между продюсерами метрик и воркерами для отправки метрик
-func fanIn(ctx context.Context, inputG, inputC chan metgen.OneMetric, output chan Metrics) {
+func fanIn(ctx context.Context, inputG, inputC chan metgen.OneMetric, l labels.Labels, output chan Metrics) {
 	defer close(output)
 	var closed [2]int
 	for {
@@ -350,6 +431,7 @@ func fanIn(ctx context.Context, inputG, inputC chan metgen.OneMetric, output cha
 			var metric Metrics
 			metric.ID = one.Name
 			metric.MType = storage.TYPEGAUGE
+			metric.Labels = l
 			val := one.Metric
 			metric.Value = &val
 			output <- metric
@@ -363,6 +445,7 @@ func fanIn(ctx context.Context, inputG, inputC chan metgen.OneMetric, output cha
 			var metric Metrics
 			metric.ID = one.Name
 			metric.MType = storage.TYPECOUNTER
+			metric.Labels = l
 			dlt := int64(one.Metric)
 			metric.Delta = &dlt
 			output <- metric
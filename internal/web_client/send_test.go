@@ -4,17 +4,27 @@ import (
 	"bytes"
 	"compress/gzip"
 	"context"
+	"crypto/rand"
+	"crypto/rsa"
 	"encoding/json"
+	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"net/http/httptest"
 	"os"
+	"path/filepath"
+	"strings"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	cryptoutils "github.com/Grifonhard/Practicum-metrics/internal/crypto_utils"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	metgen "github.com/Grifonhard/Practicum-metrics/internal/met_gen"
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -58,7 +68,7 @@ func TestPrepareDataToSend(t *testing.T) {
 	defer cancel()
 
 	// Вызов функции
-	prepareDataToSend(gaugeData, counterData, ch, cancel)
+	prepareDataToSend(gaugeData, counterData, nil, ch, cancel)
 
 	// Ожидаем завершения отправки метрик
 	<-ctx.Done()
@@ -111,6 +121,21 @@ func TestPrepareDataToSend(t *testing.T) {
 	}
 }
 
+func TestPrepareDataToSend_Labels(t *testing.T) {
+	ch := make(chan *Metrics, 2)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	l := labels.Labels{"host": "h1"}
+	prepareDataToSend(map[string]float64{"Alloc": 1}, map[string]int64{"PollCount": 1}, l, ch, cancel)
+	<-ctx.Done()
+	close(ch)
+
+	for metric := range ch {
+		assert.Equal(t, l, metric.Labels, "метки добавляются к каждой метрике")
+	}
+}
+
 func TestSendMetric(t *testing.T) {
 	// Создаем временный HTTP-сервер
 	var receivedRequest *http.Request
@@ -153,7 +178,7 @@ func TestSendMetric(t *testing.T) {
 	var wg sync.WaitGroup
 
 	// Вызов функции SendMetric с тестовым сервером и реальными метриками
-	SendMetric(&wg, ts.URL, realMetGen, "", SENDSUBSEQUENCE)
+	SendMetric(&wg, ts.URL, realMetGen, "", SENDSUBSEQUENCE, nil)
 
 	// Проверяем, что запрос был получен
 	require.NotNil(t, receivedRequest, "Сервер не получил запрос")
@@ -196,3 +221,349 @@ func TestSendMetric(t *testing.T) {
 		assert.Equal(t, expectedMetric, metric, "Метрика %s не соответствует ожидаемой", metric.ID)
 	}
 }
+
+func TestDoRetry(t *testing.T) {
+	old := retryPolicy
+	retryPolicy = &retry.Policy{Name: "webclient-test", MaxAttempts: 3, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Retryable: isTransient}
+	defer func() { retryPolicy = old }()
+
+	t.Run("503 повторяется с тем же телом", func(t *testing.T) {
+		var bodies []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			if len(bodies) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewBufferString("payload"))
+		require.NoError(t, err)
+		resp, err := doRetry(context.Background(), ts.Client(), req, nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusOK, resp.StatusCode)
+		assert.Equal(t, []string{"payload", "payload"}, bodies)
+	})
+
+	t.Run("каждая попытка подписывается заново", func(t *testing.T) {
+		var nonces []string
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			signed := agents.Signed(body, r.Header.Get(agents.HEADERTIMESTAMP), r.Header.Get(agents.HEADERNONCE))
+			assert.Equal(t, agents.Sign(signed, "key"), r.Header.Get("HashSHA256"))
+			nonces = append(nonces, r.Header.Get(agents.HEADERNONCE))
+			if len(nonces) == 1 {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewBufferString("payload"))
+		require.NoError(t, err)
+		resp, err := doRetry(context.Background(), ts.Client(), req, requestSigner([]byte("payload"), "key"))
+		require.NoError(t, err)
+		resp.Body.Close()
+		require.Len(t, nonces, 2)
+		assert.NotEqual(t, nonces[0], nonces[1], "повтор после сбоя не выглядит для сервера повтором запроса")
+		assert.Empty(t, req.Header.Get(agents.HEADERNONCE), "исходный запрос не меняется")
+	})
+
+	t.Run("400 не повторяется", func(t *testing.T) {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(http.StatusBadRequest)
+		}))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, bytes.NewBufferString("payload"))
+		require.NoError(t, err)
+		resp, err := doRetry(context.Background(), ts.Client(), req, nil)
+		require.NoError(t, err)
+		resp.Body.Close()
+		assert.Equal(t, http.StatusBadRequest, resp.StatusCode)
+		assert.Equal(t, 1, attempts)
+	})
+
+	t.Run("исчерпание попыток", func(t *testing.T) {
+		attempts := 0
+		ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			attempts++
+			w.WriteHeader(http.StatusBadGateway)
+		}))
+		defer ts.Close()
+
+		req, err := http.NewRequest(http.MethodPost, ts.URL, nil)
+		require.NoError(t, err)
+		resp, err := doRetry(context.Background(), ts.Client(), req, nil)
+		assert.ErrorIs(t, err, ErrRetryableStatus)
+		assert.Nil(t, resp)
+		assert.Equal(t, 3, attempts)
+	})
+}
+
+func TestSpool(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 4))
+
+	gauge := func(name string, v float64) Metrics {
+		return Metrics{ID: name, MType: storage.TYPEGAUGE, Value: &v}
+	}
+	counter := func(name string, d int64) Metrics {
+		return Metrics{ID: name, MType: storage.TYPECOUNTER, Delta: &d}
+	}
+	errDown := fmt.Errorf("%w: 503", ErrRetryableStatus)
+
+	t.Run("Пакет при доступном сервере не попадает на диск", func(t *testing.T) {
+		s, err := OpenSpool(t.TempDir(), 1<<20)
+		require.NoError(t, err)
+		var sent [][]Metrics
+		require.NoError(t, s.Send([]Metrics{gauge("Alloc", 1)}, func(b []Metrics) error {
+			sent = append(sent, b)
+			return nil
+		}))
+		assert.Len(t, sent, 1)
+		assert.Equal(t, 0, s.Len())
+	})
+
+	t.Run("Очередь отправляется по порядку после восстановления и перезапуска", func(t *testing.T) {
+		dir := t.TempDir()
+		s, err := OpenSpool(dir, 1<<20)
+		require.NoError(t, err)
+		down := func([]Metrics) error { return errDown }
+		assert.ErrorIs(t, s.Send([]Metrics{counter("PollCount", 1)}, down), ErrRetryableStatus)
+		assert.ErrorIs(t, s.Send([]Metrics{counter("PollCount", 2)}, down), ErrRetryableStatus)
+		assert.Equal(t, 2, s.Len())
+
+		// недописанный пакет прошлого запуска отбрасывается
+		require.NoError(t, os.WriteFile(filepath.Join(dir, "00000000000000000009"+SPOOLEXT+SPOOLTMPEXT), []byte("[{"), 0o644))
+		s, err = OpenSpool(dir, 1<<20)
+		require.NoError(t, err)
+		require.Equal(t, 2, s.Len(), "пакеты переживают перезапуск агента")
+
+		var deltas []int64
+		require.NoError(t, s.Send([]Metrics{counter("PollCount", 3)}, func(b []Metrics) error {
+			deltas = append(deltas, *b[0].Delta)
+			return nil
+		}))
+		assert.Equal(t, []int64{1, 2, 3}, deltas)
+		assert.Equal(t, 0, s.Len())
+		assert.Equal(t, int64(0), s.Size())
+		entries, err := os.ReadDir(dir)
+		require.NoError(t, err)
+		assert.Empty(t, entries)
+	})
+
+	t.Run("Отправка останавливается на первой ошибке", func(t *testing.T) {
+		s, err := OpenSpool(t.TempDir(), 1<<20)
+		require.NoError(t, err)
+		down := func([]Metrics) error { return errDown }
+		assert.Error(t, s.Send([]Metrics{counter("PollCount", 1)}, down))
+
+		calls := 0
+		assert.Error(t, s.Send([]Metrics{counter("PollCount", 2)}, func([]Metrics) error {
+			calls++
+			return errDown
+		}))
+		assert.Equal(t, 1, calls)
+		assert.Equal(t, 2, s.Len())
+	})
+
+	t.Run("Отвергнутый сервером пакет удаляется", func(t *testing.T) {
+		s, err := OpenSpool(t.TempDir(), 1<<20)
+		require.NoError(t, err)
+		assert.Error(t, s.Send([]Metrics{gauge("Bad", 1)}, func([]Metrics) error { return errDown }))
+
+		var sent []string
+		require.NoError(t, s.Send([]Metrics{gauge("Alloc", 2)}, func(b []Metrics) error {
+			sent = append(sent, b[0].ID)
+			if b[0].ID == "Bad" {
+				return fmt.Errorf("%w: 400", ErrBatchRejected)
+			}
+			return nil
+		}))
+		assert.Equal(t, []string{"Bad", "Alloc"}, sent)
+		assert.Equal(t, 0, s.Len())
+	})
+
+	t.Run("При нехватке места старые пакеты сливаются без потери counter", func(t *testing.T) {
+		l := labels.Labels{"host": "h1"}
+		first := []Metrics{gauge("Alloc", 1), counter("PollCount", 5), gauge("Old", 7)}
+		first[1].Labels = l
+		second := []Metrics{gauge("Alloc", 2), counter("PollCount", 10), counter("Other", 1)}
+		second[1].Labels = l
+		second[2].Labels = l
+		data, err := json.Marshal(first)
+		require.NoError(t, err)
+
+		s, err := OpenSpool(t.TempDir(), int64(len(data))+10)
+		require.NoError(t, err)
+		down := func([]Metrics) error { return errDown }
+		assert.Error(t, s.Send(first, down))
+		assert.Error(t, s.Send(second, down))
+		require.Equal(t, 1, s.Len(), "два пакета не помещаются и сливаются")
+
+		var sent [][]Metrics
+		require.NoError(t, s.Send([]Metrics{counter("PollCount", 1)}, func(b []Metrics) error {
+			sent = append(sent, b)
+			return nil
+		}))
+		require.Len(t, sent, 1, "новый пакет тоже не поместился и слился с очередью")
+		merged := make(map[string]Metrics)
+		for _, m := range sent[0] {
+			merged[m.MType+":"+labels.Key(m.ID, m.Labels)] = m
+		}
+		assert.Len(t, merged, 5)
+		assert.Equal(t, int64(1), *merged["counter:PollCount"].Delta)
+		assert.Equal(t, 2.0, *merged["gauge:Alloc"].Value, "остаётся новое значение gauge")
+		assert.Equal(t, 7.0, *merged["gauge:Old"].Value)
+		assert.Equal(t, int64(15), *merged["counter:"+labels.Key("PollCount", l)].Delta, "дельты counter суммируются")
+		assert.Equal(t, int64(1), *merged["counter:"+labels.Key("Other", l)].Delta)
+	})
+
+	t.Run("Некорректный размер", func(t *testing.T) {
+		_, err := OpenSpool(t.TempDir(), 0)
+		assert.ErrorIs(t, err, ErrSpoolSize)
+	})
+}
+
+func TestSendMetricSpool(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 4))
+	old := retryPolicy
+	retryPolicy = &retry.Policy{Name: "webclient-test", MaxAttempts: 1, BaseDelay: time.Millisecond, MaxDelay: time.Millisecond, Retryable: isTransient}
+	spool, err := OpenSpool(t.TempDir(), 1<<20)
+	require.NoError(t, err)
+	AgentSpool = spool
+	defer func() {
+		retryPolicy = old
+		AgentSpool = nil
+	}()
+
+	var mu sync.Mutex
+	status := http.StatusInternalServerError
+	var deltas []int64
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if status != http.StatusOK {
+			w.WriteHeader(status)
+			return
+		}
+		gr, err := gzip.NewReader(r.Body)
+		require.NoError(t, err)
+		var metrics []Metrics
+		require.NoError(t, json.NewDecoder(gr).Decode(&metrics))
+		for _, m := range metrics {
+			if m.MType == storage.TYPECOUNTER {
+				deltas = append(deltas, *m.Delta)
+			}
+		}
+	}))
+	defer ts.Close()
+
+	gen := &metgen.MetGen{MetricsGauge: map[string]float64{}, MetricsCounter: map[string]int64{"PollCount": 1}}
+	var wg sync.WaitGroup
+	SendMetric(&wg, ts.URL, gen, "", SENDARRAY, nil)
+	gen.MetricsCounter["PollCount"] = 2
+	SendMetric(&wg, ts.URL, gen, "", SENDARRAY, nil)
+	assert.Equal(t, 2, spool.Len(), "при ошибке сервера пакеты остаются в буфере")
+
+	mu.Lock()
+	status = http.StatusOK
+	mu.Unlock()
+	gen.MetricsCounter["PollCount"] = 3
+	SendMetric(&wg, ts.URL, gen, "", SENDARRAY, nil)
+	assert.Equal(t, []int64{1, 2, 3}, deltas)
+	assert.Equal(t, 0, spool.Len())
+}
+
+func TestSendMetricEncrypted(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 4))
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	require.NoError(t, err)
+	cryptoutils.PublicKey = &priv.PublicKey
+	defer func() { cryptoutils.PublicKey = nil }()
+
+	var received []Metrics
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var env cryptoutils.Envelope
+		require.NoError(t, json.NewDecoder(r.Body).Decode(&env))
+		compressed, err := cryptoutils.DecryptEnvelope(&env, priv)
+		require.NoError(t, err)
+		gr, err := gzip.NewReader(bytes.NewReader(compressed))
+		require.NoError(t, err)
+		require.NoError(t, json.NewDecoder(gr).Decode(&received))
+	}))
+	defer ts.Close()
+
+	// полный набор runtime метрик не помещается в один блок RSA
+	gen := &metgen.MetGen{MetricsGauge: map[string]float64{}, MetricsCounter: map[string]int64{"PollCount": 1}}
+	for i := 0; i < 30; i++ {
+		gen.MetricsGauge[fmt.Sprintf("RuntimeGauge%d", i)] = float64(i) + 0.5
+	}
+	var wg sync.WaitGroup
+	SendMetric(&wg, ts.URL, gen, "", SENDARRAY, nil)
+	assert.Len(t, received, 31)
+}
+
+func TestSendMetricAgent(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 4))
+	SetAgent("agent-1", 2)
+	defer SetAgent("", 0)
+
+	var header http.Header
+	var body []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		header = r.Header.Clone()
+		var err error
+		body, err = io.ReadAll(r.Body)
+		require.NoError(t, err)
+	}))
+	defer ts.Close()
+
+	gen := &metgen.MetGen{MetricsGauge: map[string]float64{}, MetricsCounter: map[string]int64{"PollCount": 1}}
+	var wg sync.WaitGroup
+	SendMetric(&wg, ts.URL, gen, "agent-key", SENDARRAY, nil)
+	assert.Equal(t, "agent-1", header.Get(agents.HEADERAGENTID))
+	assert.Equal(t, "2", header.Get(agents.HEADERKEYVERSION))
+	signed := agents.Signed(body, header.Get(agents.HEADERTIMESTAMP), header.Get(agents.HEADERNONCE))
+	assert.Equal(t, agents.Sign(signed, "agent-key"), header.Get("HashSHA256"), "подпись ключом агента проверяется сервером")
+	assert.Len(t, header.Get(agents.HEADERNONCE), 2*agents.NONCESIZE)
+
+	SendMetric(&wg, ts.URL, gen, "", SENDARRAY, nil)
+	assert.Empty(t, header.Get(agents.HEADERAGENTID), "без ключа запрос не подписывается")
+}
+
+func TestSendMetricRealIP(t *testing.T) {
+	require.NoError(t, logger.Init(os.Stdout, 4))
+
+	var realIPs []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		realIPs = append(realIPs, r.Header.Get(REALIPHEADER))
+	}))
+	defer ts.Close()
+
+	ip, err := OutboundIP(strings.TrimPrefix(ts.URL, "http://"))
+	require.NoError(t, err)
+	assert.True(t, ip.IsLoopback(), "до локального сервера агент выходит через loopback")
+	SetRealIP(ip)
+	defer SetRealIP(nil)
+
+	gen := &metgen.MetGen{MetricsGauge: map[string]float64{}, MetricsCounter: map[string]int64{"PollCount": 1}}
+	var wg sync.WaitGroup
+	SendMetric(&wg, ts.URL, gen, "", SENDARRAY, nil)
+	SendMetricWithWorkerPool(&wg, ts.URL, gen, "", 1, nil)
+	wg.Wait()
+	require.NotEmpty(t, realIPs)
+	for _, got := range realIPs {
+		assert.Equal(t, ip.String(), got, "заголовок есть и в пакетной отправке, и у воркеров")
+	}
+
+	_, err = OutboundIP("localhost")
+	assert.Error(t, err, "адрес без порта")
+}
@@ -0,0 +1,286 @@
+package webclient
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+)
+
+// Файлы локального буфера неотправленных пакетов
+const (
+	SPOOLEXT    = ".batch" // пакет, ожидающий отправки
+	SPOOLTMPEXT = ".tmp"   // недописанный пакет, удаляется при открытии буфера
+)
+
+// AgentSpool буфер неотправленных пакетов агента
+// nil - пакет, который не удалось отправить, теряется
+// используется только в SendMetric с SENDARRAY, сочетание с gRPC и RATE_LIMIT отклоняется конфигурацией
+var AgentSpool *Spool
+
+// Spool ограниченная по размеру очередь неотправленных пакетов метрик на диске
+// каждый пакет - отдельный файл с порядковым номером в имени, поэтому порядок отправки
+// сохраняется и между перезапусками агента
+// при превышении MaxBytes два самых старых пакета сливаются в один, см. mergeBatches:
+// дельты counter суммируются, для gauge остаётся более новое значение,
+// так что при нехватке места теряется история gauge, но не прирост counter
+// единственный пакет не сливается и не удаляется, даже если он больше MaxBytes
+type Spool struct {
+	Dir      string
+	MaxBytes int64
+
+	mu    sync.Mutex
+	seqs  []uint64 // номера пакетов на диске по возрастанию
+	sizes map[uint64]int64
+	size  int64
+}
+
+// OpenSpool открытие буфера в директории dir с ограничением maxBytes
+// пакеты, оставшиеся от прошлого запуска, будут отправлены первыми
+func OpenSpool(dir string, maxBytes int64) (*Spool, error) {
+	if maxBytes <= 0 {
+		return nil, fmt.Errorf("%w: %d", ErrSpoolSize, maxBytes)
+	}
+	err := os.MkdirAll(dir, 0o755)
+	if err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &Spool{
+		Dir:      dir,
+		MaxBytes: maxBytes,
+		sizes:    make(map[uint64]int64),
+	}
+	for _, entry := range entries {
+		name := entry.Name()
+		if strings.HasSuffix(name, SPOOLTMPEXT) {
+			os.Remove(filepath.Join(dir, name))
+			continue
+		}
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, SPOOLEXT), 10, 64)
+		if err != nil || !strings.HasSuffix(name, SPOOLEXT) {
+			continue
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return nil, err
+		}
+		s.seqs = append(s.seqs, seq)
+		s.sizes[seq] = info.Size()
+		s.size += info.Size()
+	}
+	sort.Slice(s.seqs, func(i, j int) bool { return s.seqs[i] < s.seqs[j] })
+	return s, nil
+}
+
+// Len количество пакетов в буфере
+func (s *Spool) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.seqs)
+}
+
+// Size суммарный размер пакетов в буфере в байтах
+func (s *Spool) Size() int64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.size
+}
+
+// Send отправка пакета через буфер
+// при пустом буфере пакет отправляется сразу и попадает на диск только при ошибке,
+// иначе встаёт в конец очереди, и очередь отправляется по порядку до первой ошибки
+// пакет, отвергнутый сервером (ErrBatchRejected), удаляется, чтобы не блокировать очередь
+// отправки через один буфер выполняются строго по одной
+func (s *Spool) Send(batch []Metrics, send func([]Metrics) error) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(s.seqs) == 0 {
+		err := send(batch)
+		if err == nil || errors.Is(err, ErrBatchRejected) {
+			return err
+		}
+		if pushErr := s.push(batch); pushErr != nil {
+			return errors.Join(err, pushErr)
+		}
+		return err
+	}
+
+	err := s.push(batch)
+	if err != nil {
+		return err
+	}
+	return s.replay(send)
+}
+
+// replay отправка пакетов очереди от старых к новым до первой ошибки
+func (s *Spool) replay(send func([]Metrics) error) error {
+	for len(s.seqs) > 0 {
+		seq := s.seqs[0]
+		batch, err := s.read(seq)
+		if err != nil {
+			// повреждённый пакет повторно не прочитать, он только остановил бы очередь
+			logger.Error(fmt.Sprintf("spool: drop unreadable batch %d: %s", seq, err.Error()))
+			s.remove(seq)
+			continue
+		}
+		err = send(batch)
+		if errors.Is(err, ErrBatchRejected) {
+			logger.Error(fmt.Sprintf("spool: drop rejected batch %d: %s", seq, err.Error()))
+		} else if err != nil {
+			return err
+		}
+		s.remove(seq)
+	}
+	return nil
+}
+
+// push запись пакета в конец очереди и слияние старых пакетов при превышении размера
+// пакет пишется во временный файл и переименовывается, так что на диске не бывает недописанных пакетов
+func (s *Spool) push(batch []Metrics) error {
+	var seq uint64 = 1
+	if len(s.seqs) > 0 {
+		seq = s.seqs[len(s.seqs)-1] + 1
+	}
+	size, err := s.write(seq, batch)
+	if err != nil {
+		return err
+	}
+	s.seqs = append(s.seqs, seq)
+	s.sizes[seq] = size
+	s.size += size
+
+	for s.size > s.MaxBytes && len(s.seqs) > 1 {
+		err = s.mergeOldest()
+		if err != nil {
+			return err
+		}
+	}
+	if s.size > s.MaxBytes {
+		logger.Error(fmt.Sprintf("spool: batch of %d bytes exceeds limit %d, kept to save counters", s.size, s.MaxBytes))
+	}
+	return nil
+}
+
+// mergeOldest слияние самого старого пакета со следующим за ним
+func (s *Spool) mergeOldest() error {
+	oldest, next := s.seqs[0], s.seqs[1]
+	older, err := s.read(oldest)
+	if err != nil {
+		logger.Error(fmt.Sprintf("spool: drop unreadable batch %d: %s", oldest, err.Error()))
+		s.remove(oldest)
+		return nil
+	}
+	newer, err := s.read(next)
+	if err != nil {
+		logger.Error(fmt.Sprintf("spool: drop unreadable batch %d: %s", next, err.Error()))
+		s.remove(next)
+		return nil
+	}
+	size, err := s.write(next, mergeBatches(older, newer))
+	if err != nil {
+		return err
+	}
+	s.size += size - s.sizes[next]
+	s.sizes[next] = size
+	s.remove(oldest)
+	logger.Info(fmt.Sprintf("spool: batch %d merged into %d, spool size %d", oldest, next, s.size))
+	return nil
+}
+
+// mergeBatches объединение двух последовательных пакетов в один
+// дельты одной серии counter складываются, для серии gauge берётся значение из newer,
+// серии, которых нет в newer, переносятся из older
+func mergeBatches(older, newer []Metrics) []Metrics {
+	index := make(map[string]int, len(older)+len(newer))
+	merged := make([]Metrics, 0, len(older)+len(newer))
+	add := func(m Metrics) {
+		key := m.MType + ":" + labels.Key(m.ID, m.Labels)
+		i, ok := index[key]
+		if !ok {
+			index[key] = len(merged)
+			merged = append(merged, m)
+			return
+		}
+		if m.MType == storage.TYPECOUNTER && merged[i].Delta != nil && m.Delta != nil {
+			delta := *merged[i].Delta + *m.Delta
+			m.Delta = &delta
+		}
+		merged[i] = m
+	}
+	for _, m := range older {
+		add(m)
+	}
+	for _, m := range newer {
+		add(m)
+	}
+	return merged
+}
+
+// path путь к файлу пакета seq
+func (s *Spool) path(seq uint64) string {
+	return filepath.Join(s.Dir, fmt.Sprintf("%020d%s", seq, SPOOLEXT))
+}
+
+// write запись пакета seq, возвращает размер файла
+func (s *Spool) write(seq uint64, batch []Metrics) (int64, error) {
+	data, err := json.Marshal(batch)
+	if err != nil {
+		return 0, err
+	}
+	tmp := s.path(seq) + SPOOLTMPEXT
+	err = os.WriteFile(tmp, data, 0o644)
+	if err != nil {
+		return 0, err
+	}
+	err = os.Rename(tmp, s.path(seq))
+	if err != nil {
+		os.Remove(tmp)
+		return 0, err
+	}
+	return int64(len(data)), nil
+}
+
+// read чтение пакета seq
+func (s *Spool) read(seq uint64) ([]Metrics, error) {
+	data, err := os.ReadFile(s.path(seq))
+	if err != nil {
+		return nil, err
+	}
+	var batch []Metrics
+	err = json.Unmarshal(data, &batch)
+	if err != nil {
+		return nil, err
+	}
+	return batch, nil
+}
+
+// remove удаление пакета seq из очереди и с диска
+func (s *Spool) remove(seq uint64) {
+	err := os.Remove(s.path(seq))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		logger.Error(fmt.Sprintf("spool: fail remove batch %d: %s", seq, err.Error()))
+	}
+	for i, v := range s.seqs {
+		if v == seq {
+			s.seqs = append(s.seqs[:i], s.seqs[i+1:]...)
+			break
+		}
+	}
+	s.size -= s.sizes[seq]
+	delete(s.sizes, seq)
+}
@@ -0,0 +1,125 @@
+package webserver
+
+import (
+	"crypto/subtle"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	"github.com/gin-gonic/gin"
+)
+
+// Параметры запросов управления агентами
+const (
+	AGENTID      = "id"      // id агента в пути
+	AGENTVERSION = "version" // версия ключа в пути
+	AGENTGRACE   = "grace"   // сколько действует прежний ключ после смены: длительность (1h) или секунды
+)
+
+// AdminAuth доступ к управлению агентами по токену из заголовка Authorization: Bearer <token>
+// при пустом token управление выключено
+func AdminAuth(token string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if token == "" {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "admin api is disabled"})
+			return
+		}
+		received, ok := strings.CutPrefix(c.GetHeader("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(received), []byte(token)) != 1 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "invalid admin token"})
+			return
+		}
+		c.Next()
+	}
+}
+
+// ListAgents перечень агентов и версий их ключей, сами ключи не выдаются
+// GET /admin/agents
+func ListAgents(reg *agents.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, reg.List())
+	}
+}
+
+// AddAgent регистрация агента, в ответе первая версия ключа
+// ключ выдаётся только здесь и при смене, сервер его больше не показывает
+// POST /admin/agents/:id
+func AddAgent(reg *agents.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		key, err := reg.Add(c.Request.Context(), c.Param(AGENTID))
+		if err != nil {
+			respondWithError(c, agentErrorStatus(err), "fail while add agent", err.Error(), err)
+			return
+		}
+		c.JSON(http.StatusCreated, key)
+	}
+}
+
+// RotateAgentKey выпуск новой версии ключа агента
+// прежние версии действуют ещё grace, по умолчанию agents.ROTATIONGRACE, grace=0 - отзываются сразу
+// POST /admin/agents/:id/keys?grace=
+func RotateAgentKey(reg *agents.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		grace := agents.ROTATIONGRACE
+		if source := c.Query(AGENTGRACE); source != "" {
+			var err error
+			grace, err = parseHistoryStep(source)
+			if err != nil || grace < 0 {
+				respondWithError(c, http.StatusBadRequest, "validate error", "wrong grace", errors.New("wrong grace "+source))
+				return
+			}
+		}
+		key, err := reg.Rotate(c.Request.Context(), c.Param(AGENTID), grace)
+		if err != nil {
+			respondWithError(c, agentErrorStatus(err), "fail while rotate agent key", err.Error(), err)
+			return
+		}
+		c.JSON(http.StatusCreated, key)
+	}
+}
+
+// RevokeAgent отзыв всех ключей агента
+// DELETE /admin/agents/:id
+func RevokeAgent(reg *agents.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		err := reg.Revoke(c.Request.Context(), c.Param(AGENTID), 0)
+		if err != nil {
+			respondWithError(c, agentErrorStatus(err), "fail while revoke agent", err.Error(), err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// RevokeAgentKey отзыв одной версии ключа агента
+// DELETE /admin/agents/:id/keys/:version
+func RevokeAgentKey(reg *agents.Registry) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		version, err := strconv.Atoi(c.Param(AGENTVERSION))
+		if err != nil || version <= 0 {
+			respondWithError(c, http.StatusBadRequest, "validate error", "wrong key version", errors.New("wrong key version "+c.Param(AGENTVERSION)))
+			return
+		}
+		err = reg.Revoke(c.Request.Context(), c.Param(AGENTID), version)
+		if err != nil {
+			respondWithError(c, agentErrorStatus(err), "fail while revoke agent key", err.Error(), err)
+			return
+		}
+		c.Status(http.StatusNoContent)
+	}
+}
+
+// agentErrorStatus код ответа при ошибке управления агентами
+func agentErrorStatus(err error) int {
+	switch {
+	case errors.Is(err, agents.ErrAgentID):
+		return http.StatusBadRequest
+	case errors.Is(err, agents.ErrAgentExists):
+		return http.StatusConflict
+	case errors.Is(err, agents.ErrAgentUnknown), errors.Is(err, agents.ErrKeyVersion):
+		return http.StatusNotFound
+	}
+	return http.StatusInternalServerError
+}
@@ -0,0 +1,15 @@
+package webserver
+
+import (
+	"net/http"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/alert"
+	"github.com/gin-gonic/gin"
+)
+
+// Alerts предоставляет состояния правил алертинга после последней проверки
+func Alerts(m *alert.Manager) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, m.States())
+	}
+}
@@ -12,6 +12,7 @@ import (
 	"sync"
 
 	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage"
 	"github.com/gin-gonic/gin"
@@ -23,11 +24,12 @@ const (
 	METRICTYPE        = "metric_type"
 	METRICTYPEJSON    = "json"
 	METRICTYPEDEFAULT = "default"
+	SIGNEDREQUEST     = "signed_request" // подпись запроса проверена, см. ReplayProtect
 )
 
 // Update обновление данных о хранимых метриках
 // приспособлено для принятия одиночных метрик
-func Update(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
+func Update(wg *sync.WaitGroup, stor storage.Backend) gin.HandlerFunc {
 	defer wg.Done()
 	return func(c *gin.Context) {
 		mType, ok := c.Get(METRICTYPE)
@@ -44,11 +46,16 @@ func Update(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
 				respondWithError(c, http.StatusBadRequest, "validate error", err.Error(), err)
 				return
 			}
+			item.Labels, err = queryLabels(c)
+			if err != nil {
+				respondWithError(c, http.StatusBadRequest, "validate error", err.Error(), err)
+				return
+			}
 
 			//сохраняем данные
-			err = stor.Push(item)
+			err = stor.Push(c.Request.Context(), item)
 			if err != nil {
-				respondWithError(c, http.StatusInternalServerError, "fail while push error", "fail while push data in db", err)
+				respondWithError(c, pushErrorStatus(err), "fail while push error", "fail while push data in db", err)
 				return
 			}
 			c.Header("Content-Length", fmt.Sprint(len("success")))
@@ -73,13 +80,14 @@ func Update(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
 					return
 				}
 
-				err = stor.Push(&item)
+				err = stor.Push(c.Request.Context(), &item)
 				if err != nil {
-					respondWithError(c, http.StatusInternalServerError, "fail while push error", "fail push data to db", err)
+					respondWithError(c, pushErrorStatus(err), "fail while push error", "fail push data to db", err)
 					return
 				}
 
-				renewValue, err := stor.Get(&item)
+				// значение только что записано, читать его нужно с основной базы, а не с реплики
+				renewValue, err := stor.Get(storage.WithPrimary(c.Request.Context()), &item)
 				if err != nil {
 					respondWithError(c, http.StatusInternalServerError, "fail while get error", "fail while control renew data", err)
 					return
@@ -104,7 +112,7 @@ func Update(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
 
 // Updates  обновление данных о хранимых метриках
 // приспособлено для принятия агрегированных данных о метриках
-func Updates(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
+func Updates(wg *sync.WaitGroup, stor storage.Backend) gin.HandlerFunc {
 	defer wg.Done()
 	return func(c *gin.Context) {
 		var buf bytes.Buffer
@@ -121,20 +129,10 @@ func Updates(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
 			return
 		}
 
-		for i, item := range items {
-			err = stor.Push(&item)
-			if err != nil {
-				respondWithError(c, http.StatusInternalServerError, "fail while push error", "fail push data to db", err)
-				return
-			}
-
-			renewValue, err := stor.Get(&item)
-			if err != nil {
-				respondWithError(c, http.StatusInternalServerError, "fail while get error", "fail while control renew data", err)
-				return
-			}
-
-			items[i].Value = renewValue
+		items, err = stor.PushBatch(c.Request.Context(), items)
+		if err != nil {
+			respondWithError(c, pushErrorStatus(err), "fail while push error", "fail push data to db", err)
+			return
 		}
 		c.JSON(http.StatusOK, items)
 	}
@@ -142,7 +140,8 @@ func Updates(wg *sync.WaitGroup, stor *storage.MemStorage) gin.HandlerFunc {
 
 // GetJSON предоставление информации о метрике
 // отправляет в формате JSON
-func GetJSON(stor *storage.MemStorage) gin.HandlerFunc {
+// метки из поля labels используются как фильтр серий
+func GetJSON(stor storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		c.Header("Content-Type", "application/json; charset=utf-8")
 		if !strings.Contains(c.Request.Header.Get("Content-Type"), "application/json") {
@@ -159,10 +158,13 @@ func GetJSON(stor *storage.MemStorage) gin.HandlerFunc {
 			return
 		}
 
-		value, err := stor.Get(&item)
+		value, err := stor.Get(c.Request.Context(), &item)
 		if err != nil && (errors.Is(err, storage.ErrMetricNoData) || errors.Is(err, psql.ErrNoData)) {
 			respondWithError(c, http.StatusNotFound, "fail while get error", "fail get data from db: no data", err)
 			return
+		} else if errors.Is(err, storage.ErrMetricAmbiguous) {
+			respondWithError(c, http.StatusBadRequest, "fail while get error", err.Error(), err)
+			return
 		} else if err != nil {
 			respondWithError(c, http.StatusInternalServerError, "fail while get error", "fail while get data from db", err)
 			return
@@ -177,7 +179,8 @@ func GetJSON(stor *storage.MemStorage) gin.HandlerFunc {
 
 // Get предоставление информации о метрике
 // отправляет значение
-func Get(stor *storage.MemStorage) gin.HandlerFunc {
+// параметры запроса используются как фильтр по меткам: /value/gauge/Alloc?host=h1
+func Get(stor storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		mType, ok := c.Get(METRICTYPE)
 		if !ok {
@@ -194,13 +197,23 @@ func Get(stor *storage.MemStorage) gin.HandlerFunc {
 				c.Abort()
 				return
 			}
+			item.Labels, err = queryLabels(c)
+			if err != nil {
+				c.String(http.StatusBadRequest, err.Error())
+				c.Abort()
+				return
+			}
 
 			//получаем данные
-			value, err := stor.Get(item)
+			value, err := stor.Get(c.Request.Context(), item)
 			if err != nil && (errors.Is(err, storage.ErrMetricNoData) || errors.Is(err, psql.ErrNoData)) {
 				c.String(http.StatusNotFound, err.Error())
 				c.Abort()
 				return
+			} else if errors.Is(err, storage.ErrMetricAmbiguous) {
+				c.String(http.StatusBadRequest, err.Error())
+				c.Abort()
+				return
 			} else if err != nil {
 				respondWithError(c, http.StatusInternalServerError, "fail while get error", "data not found", err)
 				return
@@ -220,9 +233,9 @@ func Get(stor *storage.MemStorage) gin.HandlerFunc {
 }
 
 // List предоставляет перечень всех хранимых метрик
-func List(stor *storage.MemStorage) gin.HandlerFunc {
+func List(stor storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		list, err := stor.List()
+		list, err := stor.List(c.Request.Context())
 		if err != nil {
 			respondWithError(c, http.StatusInternalServerError, "fail while list error", "can't get list of metrics", err)
 			return
@@ -235,10 +248,10 @@ func List(stor *storage.MemStorage) gin.HandlerFunc {
 	}
 }
 
-// PingDB позволяет проверить подключение к базе данных
-func PingDB(db *psql.DB) gin.HandlerFunc {
+// PingDB позволяет проверить доступность хранилища, для postgres - подключение к базе данных
+func PingDB(stor storage.Backend) gin.HandlerFunc {
 	return func(c *gin.Context) {
-		err := db.Ping()
+		err := stor.Ping(c.Request.Context())
 		if err != nil {
 			respondWithError(c, http.StatusInternalServerError, "fail ping db error", "not pong", err)
 			return
@@ -247,6 +260,35 @@ func PingDB(db *psql.DB) gin.HandlerFunc {
 	}
 }
 
+// queryLabels получение меток из параметров запроса
+// каждый параметр, кроме перечисленных в reserved, считается меткой, берётся первое значение
+func queryLabels(c *gin.Context, reserved ...string) (labels.Labels, error) {
+	query := c.Request.URL.Query()
+	for _, r := range reserved {
+		query.Del(r)
+	}
+	if len(query) == 0 {
+		return nil, nil
+	}
+	l := make(labels.Labels, len(query))
+	for k := range query {
+		l[k] = query.Get(k)
+	}
+	if err := l.Validate(); err != nil {
+		return nil, err
+	}
+	return l, nil
+}
+
+// pushErrorStatus код ответа при ошибке сохранения метрики
+// некорректные метки - ошибка клиента, остальное - ошибка сервера
+func pushErrorStatus(err error) int {
+	if errors.Is(err, labels.ErrLabelName) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
 // respondWithError записывает в логгер информацию о произведённой ошибке и отправляет ошибку клиенту
 func respondWithError(c *gin.Context, status int, logMessage string, userMessage string, err error) {
 	logger.Error(fmt.Sprintf("%s: %s", logMessage, err.Error()))
@@ -2,15 +2,31 @@ package webserver
 
 import (
 	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"database/sql"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 	"log"
+	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
 	"os"
+	"strconv"
 	"sync"
 	"testing"
+	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	"github.com/Grifonhard/Practicum-metrics/internal/alert"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
 	"github.com/Grifonhard/Practicum-metrics/internal/storage"
 	"github.com/gin-gonic/gin"
 	"github.com/stretchr/testify/assert"
@@ -18,7 +34,7 @@ import (
 
 func TestPost(t *testing.T) {
 	//подготовка
-	stor, err := storage.New(0, "", false, nil)
+	stor, err := storage.New(0, "", false)
 	assert.NoError(t, err)
 
 	go stor.BackupLoop()
@@ -89,7 +105,7 @@ func TestPost(t *testing.T) {
 
 func TestGetJSON(t *testing.T) {
 	//подготовка
-	stor, err := storage.New(0, "", false, nil)
+	stor, err := storage.New(0, "", false)
 	assert.NoError(t, err)
 
 	go stor.BackupLoop()
@@ -123,3 +139,590 @@ func TestGetJSON(t *testing.T) {
 
 	fmt.Println(w.Body.String())
 }
+
+func TestMetrics(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+
+	stor.ItemsCounter = map[string][]float64{
+		"PollCount": {1, 2},
+	}
+	stor.ItemsGauge = map[string]float64{
+		"Alloc":      3.5,
+		"bad-name.1": 1,
+	}
+
+	router := gin.Default()
+	router.GET("/metrics", Metrics(stor))
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	assert.Equal(t, PROMETHEUSCONTENTTYPE, w.Header().Get("Content-Type"))
+	expected := "# TYPE Alloc gauge\n" +
+		"Alloc 3.5\n" +
+		"# TYPE bad_name_1 gauge\n" +
+		"bad_name_1 1\n" +
+		"# TYPE PollCount counter\n" +
+		"PollCount 3\n"
+	assert.Equal(t, expected, w.Body.String())
+}
+
+func TestMetricsCollisions(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+
+	stor.ItemsCounter = map[string][]float64{
+		"Requests":        {1, 2},
+		`Requests{a="1"}`: {4},
+	}
+	stor.ItemsGauge = map[string]float64{
+		"Requests":        5,
+		"cpu.load":        1,
+		"cpu-load":        2,
+		`cpu-load{a="1"}`: 3,
+	}
+
+	router := gin.Default()
+	router.GET("/metrics", Metrics(stor))
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	expected := "# TYPE Requests_gauge gauge\n" +
+		"Requests_gauge 5\n" +
+		"# TYPE cpu_load gauge\n" +
+		`cpu_load{a="1",metric_name="cpu-load"} 3` + "\n" +
+		`cpu_load{metric_name="cpu-load"} 2` + "\n" +
+		`cpu_load{metric_name="cpu.load"} 1` + "\n" +
+		"# TYPE Requests_counter counter\n" +
+		"Requests_counter 3\n" +
+		`Requests_counter{a="1"} 4` + "\n"
+	assert.Equal(t, expected, w.Body.String())
+}
+
+func TestGetLabels(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+
+	stor.ItemsGauge = map[string]float64{
+		`Alloc{host="h1"}`: 1,
+		`Alloc{host="h2"}`: 2,
+	}
+	stor.ItemsCounter = map[string][]float64{
+		`PollCount{host="h1"}`: {1, 2},
+		`PollCount{host="h2"}`: {3},
+	}
+
+	router := gin.Default()
+	router.GET("/value/:type/:name", DataExtraction(), Get(stor))
+	router.POST("/value/", GetJSON(stor))
+
+	tests := []struct {
+		url      string
+		wantCode int
+		wantBody string
+		message  string
+	}{
+		{"/value/gauge/Alloc?host=h2", http.StatusOK, "2", "фильтр по метке"},
+		{"/value/counter/PollCount", http.StatusOK, "6", "сумма counter по всем сериям"},
+		{"/value/counter/PollCount?host=h1", http.StatusOK, "3", "counter одной серии"},
+		{"/value/gauge/Alloc", http.StatusBadRequest, "", "несколько серий gauge"},
+		{"/value/gauge/Alloc?host=h3", http.StatusNotFound, "", "нет серии"},
+		{"/value/gauge/Alloc?1host=h1", http.StatusBadRequest, "", "некорректное имя метки"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantBody != "" {
+				assert.Equal(t, tt.wantBody, w.Body.String())
+			}
+		})
+	}
+
+	t.Run("фильтр по меткам в JSON", func(t *testing.T) {
+		r := httptest.NewRequest(http.MethodPost, "/value/", bytes.NewBufferString(`{"id":"Alloc","type":"gauge","labels":{"host":"h1"}}`))
+		r.Header.Set("Content-Type", "application/json")
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.JSONEq(t, `{"id":"Alloc","type":"gauge","labels":{"host":"h1"},"value":1}`, w.Body.String())
+	})
+}
+
+func TestMetricsLabels(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+
+	stor.ItemsCounter = map[string][]float64{}
+	stor.ItemsGauge = map[string]float64{
+		`Alloc{host="h2"}`:            2,
+		`Alloc{env="a\"b",host="h1"}`: 1,
+	}
+
+	router := gin.Default()
+	router.GET("/metrics", Metrics(stor))
+
+	r := httptest.NewRequest(http.MethodGet, "/metrics", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	expected := "# TYPE Alloc gauge\n" +
+		`Alloc{env="a\"b",host="h1"} 1` + "\n" +
+		`Alloc{host="h2"} 2` + "\n"
+	assert.Equal(t, expected, w.Body.String())
+}
+
+func TestHistory(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+	go stor.BackupLoop()
+
+	assert.NoError(t, stor.Push(context.Background(), &storage.Metric{Type: storage.TYPEGAUGE, Name: "HeapAlloc", Labels: labels.Labels{"host": "h1"}, Value: 1}))
+	assert.NoError(t, stor.Push(context.Background(), &storage.Metric{Type: storage.TYPEGAUGE, Name: "HeapAlloc", Labels: labels.Labels{"host": "h1"}, Value: 2}))
+
+	router := gin.Default()
+	router.GET("/history/:type/:name", History(stor))
+
+	tests := []struct {
+		url        string
+		wantCode   int
+		wantPoints int
+		message    string
+	}{
+		{"/history/gauge/HeapAlloc", http.StatusOK, 2, "вся история"},
+		{"/history/gauge/HeapAlloc?host=h1&step=1h", http.StatusOK, 1, "с шагом и фильтром"},
+		{fmt.Sprintf("/history/gauge/HeapAlloc?from=%d", time.Now().Add(time.Hour).Unix()), http.StatusBadRequest, 0, "from позже to"},
+		{"/history/gauge/HeapAlloc?step=wrong", http.StatusBadRequest, 0, "неверный шаг"},
+		{"/history/gauge/HeapAlloc?from=yesterday", http.StatusBadRequest, 0, "неверное время"},
+		{"/history/gauge/Unknown", http.StatusNotFound, 0, "нет метрики"},
+		{"/history/wrong/HeapAlloc", http.StatusBadRequest, 0, "неверный тип"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, tt.url, nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var resp HistoryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, "HeapAlloc", resp.Name)
+			assert.Len(t, resp.Points, tt.wantPoints)
+			assert.Equal(t, 2.0, resp.Points[len(resp.Points)-1].Value)
+		})
+	}
+}
+
+func TestQuery(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+	go stor.BackupLoop()
+
+	assert.NoError(t, stor.Push(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "PollCount", Value: 30}))
+	assert.NoError(t, stor.Push(context.Background(), &storage.Metric{Type: storage.TYPECOUNTER, Name: "PollCount", Value: 30}))
+
+	router := gin.Default()
+	router.GET("/query", Query(stor))
+
+	tests := []struct {
+		expr      string
+		wantCode  int
+		wantValue float64
+		message   string
+	}{
+		{"rate(counter:PollCount[1m])", http.StatusOK, 1, "прирост в секунду"},
+		{"sum(counter:PollCount[5m])", http.StatusOK, 60, "прирост за период"},
+		{"sum(counter:Unknown[5m])", http.StatusNotFound, 0, "нет метрики"},
+		{"rate(gauge:Alloc[5m])", http.StatusBadRequest, 0, "rate для gauge"},
+		{"", http.StatusBadRequest, 0, "нет выражения"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/query?"+url.Values{QUERYEXPR: {tt.expr}}.Encode(), nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode != http.StatusOK {
+				return
+			}
+			var resp QueryResponse
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.expr, resp.Expr)
+			assert.InDelta(t, tt.wantValue, resp.Value, 1e-9)
+		})
+	}
+
+	t.Run("хранилище без агрегатов", func(t *testing.T) {
+		router := gin.Default()
+		router.GET("/query", Query(noQueryStub{stor}))
+		r := httptest.NewRequest(http.MethodGet, "/query?expr=sum(counter:PollCount[5m])", nil)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, r)
+		assert.Equal(t, http.StatusNotImplemented, w.Code)
+	})
+}
+
+// noQueryStub хранилище, не вычисляющее агрегаты
+type noQueryStub struct {
+	storage.Backend
+}
+
+// dbStorStub хранилище в памяти, притворяющееся базой данных с заданной статистикой пула
+type dbStorStub struct {
+	*storage.MemStorage
+	stats   sql.DBStats
+	pingErr error
+}
+
+func (s *dbStorStub) DBStats() sql.DBStats {
+	return s.stats
+}
+
+func (s *dbStorStub) Ping(ctx context.Context) error {
+	return s.pingErr
+}
+
+func TestHealthDB(t *testing.T) {
+	mem, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+	stats := sql.DBStats{MaxOpenConnections: 10, OpenConnections: 4, InUse: 3, Idle: 1, WaitCount: 7, WaitDuration: 1500 * time.Millisecond}
+
+	tests := []struct {
+		stor     storage.Backend
+		wantCode int
+		want     DBHealth
+		message  string
+	}{
+		{&dbStorStub{MemStorage: mem, stats: stats}, http.StatusOK, DBHealth{Status: DBSTATUSOK, MaxOpenConnections: 10, OpenConnections: 4, InUse: 3, Idle: 1, WaitCount: 7, WaitDurationMs: 1500}, "база доступна"},
+		{&dbStorStub{MemStorage: mem, stats: stats, pingErr: errors.New("connection refused")}, http.StatusServiceUnavailable, DBHealth{Status: DBSTATUSUNAVAILABLE, MaxOpenConnections: 10, OpenConnections: 4, InUse: 3, Idle: 1, WaitCount: 7, WaitDurationMs: 1500}, "база недоступна"},
+		{mem, http.StatusNotFound, DBHealth{}, "хранилище не база данных"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.message, func(t *testing.T) {
+			router := gin.Default()
+			router.GET("/health/db", HealthDB(tt.stor))
+
+			r := httptest.NewRequest(http.MethodGet, "/health/db", nil)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			assert.Equal(t, tt.wantCode, w.Code)
+			if tt.wantCode == http.StatusNotFound {
+				return
+			}
+			var resp DBHealth
+			assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+			assert.Equal(t, tt.want, resp)
+		})
+	}
+}
+
+func TestHealthRetry(t *testing.T) {
+	p := &retry.Policy{Name: "health-test", MaxAttempts: 1}
+	_ = p.Do(context.Background(), func(ctx context.Context) error { return nil })
+
+	router := gin.Default()
+	router.GET("/health/retry", HealthRetry())
+
+	r := httptest.NewRequest(http.MethodGet, "/health/retry", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp map[string]retry.Stats
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	assert.Equal(t, retry.Stats{Calls: 1}, resp["health-test"])
+}
+
+func TestAlerts(t *testing.T) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+	go stor.BackupLoop()
+	assert.NoError(t, stor.Push(context.Background(), &storage.Metric{Type: storage.TYPEGAUGE, Name: "CpuUtilization", Value: 95}))
+
+	rule, err := alert.ParseRule("gauge CpuUtilization > 90")
+	assert.NoError(t, err)
+	m := alert.NewManager([]alert.Rule{rule}, stor, nil)
+	m.Evaluate(context.Background())
+
+	router := gin.Default()
+	router.GET("/alerts", Alerts(m))
+
+	r := httptest.NewRequest(http.MethodGet, "/alerts", nil)
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+
+	assert.Equal(t, http.StatusOK, w.Code)
+	var resp []alert.RuleState
+	assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &resp))
+	if assert.Len(t, resp, 1) {
+		assert.Equal(t, alert.STATEFIRING, resp[0].State)
+		assert.Equal(t, 95.0, resp[0].Value)
+	}
+}
+
+func TestCertAuth(t *testing.T) {
+	router := gin.New()
+	router.POST("/update/", CertAuth([]string{"agent-1", "CN=agent-2,O=Metrics"}), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.POST("/open/", CertAuth(nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	do := func(path string, subject *pkix.Name) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if subject != nil {
+			req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{{Subject: *subject}}}}
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do("/update/", &pkix.Name{CommonName: "agent-1"}), "разрешённый CN")
+	assert.Equal(t, http.StatusOK, do("/update/", &pkix.Name{CommonName: "agent-2", Organization: []string{"Metrics"}}), "разрешённый DN")
+	assert.Equal(t, http.StatusForbidden, do("/update/", &pkix.Name{CommonName: "agent-2"}), "CN без организации не совпадает с DN")
+	assert.Equal(t, http.StatusUnauthorized, do("/update/", nil), "без сертификата")
+	assert.Equal(t, http.StatusOK, do("/open/", nil), "проверка выключена")
+}
+
+func newAgentsRouter(t *testing.T, key, token string, sharedFallback bool) (*gin.Engine, *agents.Registry) {
+	stor, err := storage.New(0, "", false)
+	assert.NoError(t, err)
+	reg, err := agents.NewRegistry(context.Background(), stor)
+	assert.NoError(t, err)
+
+	router := gin.New()
+	router.POST("/updates/", AgentAuth(reg, key, sharedFallback), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	admin := router.Group("/admin", AdminAuth(token))
+	admin.GET("/agents", ListAgents(reg))
+	admin.POST("/agents/:id", AddAgent(reg))
+	admin.POST("/agents/:id/keys", RotateAgentKey(reg))
+	admin.DELETE("/agents/:id", RevokeAgent(reg))
+	admin.DELETE("/agents/:id/keys/:version", RevokeAgentKey(reg))
+	return router, reg
+}
+
+func TestAgentAuth(t *testing.T) {
+	assert.NoError(t, logger.Init(io.Discard, 4))
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	do := func(router *gin.Engine, agentID, version, hash string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		if agentID != "" {
+			req.Header.Set(agents.HEADERAGENTID, agentID)
+		}
+		if version != "" {
+			req.Header.Set(agents.HEADERKEYVERSION, version)
+		}
+		if hash != "" {
+			req.Header.Set("HashSHA256", hash)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	t.Run("без агентов работает общий ключ", func(t *testing.T) {
+		router, _ := newAgentsRouter(t, "shared", "", false)
+		assert.Equal(t, http.StatusOK, do(router, "", "", computeHMAC(body, "shared")))
+		assert.Equal(t, http.StatusOK, do(router, "agent-1", "", computeHMAC(body, "shared")), "реестр пуст, id не проверяется")
+		assert.Equal(t, http.StatusBadRequest, do(router, "", "", computeHMAC(body, "other")))
+	})
+
+	t.Run("ключ агента", func(t *testing.T) {
+		router, reg := newAgentsRouter(t, "", "", false)
+		key, err := reg.Add(context.Background(), "agent-1")
+		assert.NoError(t, err)
+
+		assert.Equal(t, http.StatusOK, do(router, "agent-1", "", agents.Sign(body, key.Key)))
+		assert.Equal(t, http.StatusOK, do(router, "agent-1", "1", agents.Sign(body, key.Key)))
+		assert.Equal(t, http.StatusUnauthorized, do(router, "agent-1", "2", agents.Sign(body, key.Key)), "неизвестная версия")
+		assert.Equal(t, http.StatusBadRequest, do(router, "agent-1", "x", agents.Sign(body, key.Key)))
+		assert.Equal(t, http.StatusUnauthorized, do(router, "agent-2", "", agents.Sign(body, key.Key)), "неизвестный агент")
+		assert.Equal(t, http.StatusUnauthorized, do(router, "agent-1", "", agents.Sign(body, "other")), "чужой ключ")
+		assert.Equal(t, http.StatusUnauthorized, do(router, "agent-1", "", ""), "без подписи")
+		assert.Equal(t, http.StatusUnauthorized, do(router, "", "", agents.Sign(body, key.Key)), "без id при выключенном общем ключе")
+	})
+
+	t.Run("общий ключ рядом с ключами агентов", func(t *testing.T) {
+		router, reg := newAgentsRouter(t, "shared", "", false)
+		_, err := reg.Add(context.Background(), "agent-1")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusUnauthorized, do(router, "", "", computeHMAC(body, "shared")), "без разрешения общий ключ не принимается")
+
+		router, reg = newAgentsRouter(t, "shared", "", true)
+		_, err = reg.Add(context.Background(), "agent-1")
+		assert.NoError(t, err)
+		assert.Equal(t, http.StatusOK, do(router, "", "", computeHMAC(body, "shared")), "агенты без id переходят постепенно")
+		assert.Equal(t, http.StatusUnauthorized, do(router, "agent-1", "", computeHMAC(body, "shared")), "агент с id подписывает своим ключом")
+	})
+
+	t.Run("после отзыва всех агентов проверка не выключается", func(t *testing.T) {
+		router, reg := newAgentsRouter(t, "", "", false)
+		key, err := reg.Add(context.Background(), "agent-1")
+		assert.NoError(t, err)
+		assert.NoError(t, reg.Revoke(context.Background(), "agent-1", 0))
+		assert.Equal(t, http.StatusUnauthorized, do(router, "", "", ""), "без подписи")
+		assert.Equal(t, http.StatusUnauthorized, do(router, "agent-1", "", agents.Sign(body, key.Key)), "отозванный ключ")
+	})
+}
+
+func TestAdminAgents(t *testing.T) {
+	assert.NoError(t, logger.Init(io.Discard, 4))
+	do := func(router *gin.Engine, method, path, token string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, path, nil)
+		if token != "" {
+			req.Header.Set("Authorization", "Bearer "+token)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w
+	}
+
+	t.Run("доступ по токену", func(t *testing.T) {
+		router, _ := newAgentsRouter(t, "", "secret", false)
+		assert.Equal(t, http.StatusUnauthorized, do(router, http.MethodGet, "/admin/agents", "").Code)
+		assert.Equal(t, http.StatusUnauthorized, do(router, http.MethodGet, "/admin/agents", "wrong").Code)
+		assert.Equal(t, http.StatusOK, do(router, http.MethodGet, "/admin/agents", "secret").Code)
+
+		router, _ = newAgentsRouter(t, "", "", false)
+		assert.Equal(t, http.StatusForbidden, do(router, http.MethodGet, "/admin/agents", "").Code, "без токена управление выключено")
+	})
+
+	t.Run("регистрация, смена и отзыв ключей", func(t *testing.T) {
+		router, reg := newAgentsRouter(t, "", "secret", false)
+		body := []byte("data")
+
+		w := do(router, http.MethodPost, "/admin/agents/agent-1", "secret")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var first storage.AgentKey
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &first))
+		assert.Equal(t, "agent-1", first.AgentID)
+		assert.NoError(t, reg.Verify("agent-1", 1, body, agents.Sign(body, first.Key)))
+
+		assert.Equal(t, http.StatusConflict, do(router, http.MethodPost, "/admin/agents/agent-1", "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, do(router, http.MethodPost, "/admin/agents/agent%201", "secret").Code)
+
+		w = do(router, http.MethodPost, "/admin/agents/agent-1/keys?grace=1h", "secret")
+		assert.Equal(t, http.StatusCreated, w.Code)
+		var second storage.AgentKey
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &second))
+		assert.Equal(t, 2, second.Version)
+		assert.NoError(t, reg.Verify("agent-1", 0, body, agents.Sign(body, first.Key)), "старый ключ действует в период смены")
+		assert.Equal(t, http.StatusBadRequest, do(router, http.MethodPost, "/admin/agents/agent-1/keys?grace=x", "secret").Code)
+		assert.Equal(t, http.StatusNotFound, do(router, http.MethodPost, "/admin/agents/agent-2/keys", "secret").Code)
+
+		w = do(router, http.MethodGet, "/admin/agents", "secret")
+		assert.Equal(t, http.StatusOK, w.Code)
+		assert.NotContains(t, w.Body.String(), first.Key, "ключи не выдаются в списке")
+		var list []agents.AgentInfo
+		assert.NoError(t, json.Unmarshal(w.Body.Bytes(), &list))
+		if assert.Len(t, list, 1) {
+			assert.Len(t, list[0].Keys, 2)
+		}
+
+		assert.Equal(t, http.StatusNoContent, do(router, http.MethodDelete, "/admin/agents/agent-1/keys/"+strconv.Itoa(first.Version), "secret").Code)
+		assert.Error(t, reg.Verify("agent-1", 0, body, agents.Sign(body, first.Key)))
+		assert.Equal(t, http.StatusNotFound, do(router, http.MethodDelete, "/admin/agents/agent-1/keys/1", "secret").Code)
+		assert.Equal(t, http.StatusBadRequest, do(router, http.MethodDelete, "/admin/agents/agent-1/keys/0", "secret").Code)
+
+		assert.Equal(t, http.StatusNoContent, do(router, http.MethodDelete, "/admin/agents/agent-1", "secret").Code)
+		assert.Equal(t, http.StatusNotFound, do(router, http.MethodDelete, "/admin/agents/agent-1", "secret").Code)
+		assert.Empty(t, reg.List())
+	})
+}
+
+func TestTrustedSubnet(t *testing.T) {
+	_, subnet, err := net.ParseCIDR("192.168.1.0/24")
+	assert.NoError(t, err)
+	router := gin.New()
+	router.POST("/updates/", TrustedSubnet(subnet), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	router.POST("/open/", TrustedSubnet(nil), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	do := func(path, realIP string) int {
+		req := httptest.NewRequest(http.MethodPost, path, nil)
+		if realIP != "" {
+			req.Header.Set(REALIPHEADER, realIP)
+		}
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	assert.Equal(t, http.StatusOK, do("/updates/", "192.168.1.15"))
+	assert.Equal(t, http.StatusForbidden, do("/updates/", "192.168.2.15"), "адрес вне подсети")
+	assert.Equal(t, http.StatusForbidden, do("/updates/", ""), "без заголовка")
+	assert.Equal(t, http.StatusForbidden, do("/updates/", "localhost"), "не адрес")
+	assert.Equal(t, http.StatusOK, do("/open/", ""), "проверка выключена")
+}
+
+func TestReplayProtect(t *testing.T) {
+	assert.NoError(t, logger.Init(io.Discard, 4))
+	body := []byte(`[{"id":"Alloc","type":"gauge","value":1}]`)
+	router := gin.New()
+	router.POST("/updates/", PseudoAuth("shared"), ReplayProtect(agents.NewReplayGuard(time.Minute, 100)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+
+	do := func(timestamp, nonce, hash string) int {
+		req := httptest.NewRequest(http.MethodPost, "/updates/", bytes.NewReader(body))
+		req.Header.Set(agents.HEADERTIMESTAMP, timestamp)
+		req.Header.Set(agents.HEADERNONCE, nonce)
+		req.Header.Set("HashSHA256", hash)
+		w := httptest.NewRecorder()
+		router.ServeHTTP(w, req)
+		return w.Code
+	}
+	sign := func(timestamp, nonce string) string {
+		return computeHMAC(agents.Signed(body, timestamp, nonce), "shared")
+	}
+
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	nonce, err := agents.NewNonce()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusOK, do(now, nonce, sign(now, nonce)))
+	assert.Equal(t, http.StatusUnauthorized, do(now, nonce, sign(now, nonce)), "повтор перехваченного запроса")
+
+	other, err := agents.NewNonce()
+	assert.NoError(t, err)
+	assert.Equal(t, http.StatusBadRequest, do(now, other, sign(now, nonce)), "nonce покрыт подписью")
+	assert.Equal(t, http.StatusBadRequest, do(now, other, computeHMAC(body, "shared")), "подпись только тела не подходит")
+
+	stale := strconv.FormatInt(time.Now().Add(-time.Hour).Unix(), 10)
+	assert.Equal(t, http.StatusUnauthorized, do(stale, other, sign(stale, other)), "время вне окна")
+	assert.Equal(t, http.StatusUnauthorized, do("", "", computeHMAC(body, "shared")), "подписанный запрос без времени и nonce")
+	assert.Equal(t, http.StatusOK, do(now, other, sign(now, other)))
+
+	router = gin.New()
+	router.POST("/updates/", PseudoAuth("shared"), ReplayProtect(agents.NewReplayGuard(time.Minute, 1)), func(c *gin.Context) {
+		c.Status(http.StatusOK)
+	})
+	assert.Equal(t, http.StatusOK, do(now, nonce, sign(now, nonce)))
+	assert.Equal(t, http.StatusServiceUnavailable, do(now, other, sign(now, other)), "кэш nonce заполнен, агент повторит позже")
+}
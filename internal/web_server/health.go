@@ -0,0 +1,80 @@
+package webserver
+
+import (
+	"database/sql"
+	"net/http"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/logger"
+	"github.com/Grifonhard/Practicum-metrics/internal/retry"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Состояния базы данных в ответе /health/db
+const (
+	DBSTATUSOK          = "ok"
+	DBSTATUSUNAVAILABLE = "unavailable"
+)
+
+// DBHealth состояние базы данных и пула подключений к ней
+// длительности в миллисекундах
+type DBHealth struct {
+	Status             string `json:"status"`
+	MaxOpenConnections int    `json:"max_open_connections"`
+	OpenConnections    int    `json:"open_connections"`
+	InUse              int    `json:"in_use"`
+	Idle               int    `json:"idle"`
+	WaitCount          int64  `json:"wait_count"`
+	WaitDurationMs     int64  `json:"wait_duration_ms"`
+	MaxIdleClosed      int64  `json:"max_idle_closed"`
+	MaxIdleTimeClosed  int64  `json:"max_idle_time_closed"`
+	MaxLifetimeClosed  int64  `json:"max_lifetime_closed"`
+}
+
+// HealthDB предоставляет статистику пула подключений к базе данных
+// по ней видно, упирается ли сервер в пул или в саму базу:
+// рост wait_count и wait_duration_ms при in_use равном max_open_connections - нехватка подключений в пуле
+// если база не отвечает, статистика отдаётся со статусом 503
+func HealthDB(stor storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		statser, ok := stor.(storage.DBStatser)
+		if !ok {
+			c.JSON(http.StatusNotFound, gin.H{"error": "storage is not a database"})
+			return
+		}
+
+		health := newDBHealth(statser.DBStats())
+		status := http.StatusOK
+		err := stor.Ping(c.Request.Context())
+		if err != nil {
+			logger.Error("fail ping db error: " + err.Error())
+			health.Status = DBSTATUSUNAVAILABLE
+			status = http.StatusServiceUnavailable
+		}
+		c.JSON(status, health)
+	}
+}
+
+// newDBHealth перевод статистики пула в формат ответа
+func newDBHealth(stats sql.DBStats) DBHealth {
+	return DBHealth{
+		Status:             DBSTATUSOK,
+		MaxOpenConnections: stats.MaxOpenConnections,
+		OpenConnections:    stats.OpenConnections,
+		InUse:              stats.InUse,
+		Idle:               stats.Idle,
+		WaitCount:          stats.WaitCount,
+		WaitDurationMs:     stats.WaitDuration.Milliseconds(),
+		MaxIdleClosed:      stats.MaxIdleClosed,
+		MaxIdleTimeClosed:  stats.MaxIdleTimeClosed,
+		MaxLifetimeClosed:  stats.MaxLifetimeClosed,
+	}
+}
+
+// HealthRetry предоставляет счётчики повторных попыток по политикам процесса (psql, fileio)
+// рост exhausted - сбои, которые повторы уже не спасают, рост recovered - сбои, скрытые повторами
+func HealthRetry() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.JSON(http.StatusOK, retry.Snapshot())
+	}
+}
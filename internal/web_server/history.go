@@ -0,0 +1,105 @@
+package webserver
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// Параметры запроса истории значений метрики
+const (
+	HISTORYFROM = "from"
+	HISTORYTO   = "to"
+	HISTORYSTEP = "step"
+)
+
+// HistoryResponse ответ на запрос истории значений метрики
+type HistoryResponse struct {
+	Type   string           `json:"type"`
+	Name   string           `json:"id"`
+	Labels labels.Labels    `json:"labels,omitempty"`
+	Points []storage.Sample `json:"points"`
+}
+
+// History предоставление истории значений метрики
+// GET /history/:type/:name?from=&to=&step=
+// from и to - unix время в секундах или RFC3339, step - длительность (30s, 1m) или секунды
+// остальные параметры запроса используются как фильтр по меткам
+func History(stor storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		item, err := storage.ValidateAndConvert(http.MethodGet, c.Param("type"), c.Param("name"), "")
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "validate error", err.Error(), err)
+			return
+		}
+		item.Labels, err = queryLabels(c, HISTORYFROM, HISTORYTO, HISTORYSTEP)
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "validate error", err.Error(), err)
+			return
+		}
+		from, err := parseHistoryTime(c.Query(HISTORYFROM))
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "validate error", "wrong from", err)
+			return
+		}
+		to, err := parseHistoryTime(c.Query(HISTORYTO))
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "validate error", "wrong to", err)
+			return
+		}
+		step, err := parseHistoryStep(c.Query(HISTORYSTEP))
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "validate error", "wrong step", err)
+			return
+		}
+
+		points, err := stor.History(c.Request.Context(), item, from, to, step)
+		if err != nil && (errors.Is(err, storage.ErrMetricNoData) || errors.Is(err, psql.ErrNoData)) {
+			respondWithError(c, http.StatusNotFound, "fail while history error", "no data", err)
+			return
+		} else if errors.Is(err, storage.ErrMetricAmbiguous) || errors.Is(err, storage.ErrHistoryRange) {
+			respondWithError(c, http.StatusBadRequest, "fail while history error", err.Error(), err)
+			return
+		} else if err != nil {
+			respondWithError(c, http.StatusInternalServerError, "fail while history error", "fail while get history", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, HistoryResponse{
+			Type:   item.Type,
+			Name:   item.Name,
+			Labels: item.Labels,
+			Points: points,
+		})
+	}
+}
+
+// parseHistoryTime разбор границы периода: unix время в секундах или RFC3339
+// пустая строка - граница не задана
+func parseHistoryTime(source string) (time.Time, error) {
+	if source == "" {
+		return time.Time{}, nil
+	}
+	if sec, err := strconv.ParseInt(source, 10, 64); err == nil {
+		return time.Unix(sec, 0), nil
+	}
+	return time.Parse(time.RFC3339, source)
+}
+
+// parseHistoryStep разбор шага группировки: длительность или секунды
+// пустая строка - без группировки
+func parseHistoryStep(source string) (time.Duration, error) {
+	if source == "" {
+		return 0, nil
+	}
+	if sec, err := strconv.Atoi(source); err == nil {
+		return time.Duration(sec) * time.Second, nil
+	}
+	return time.ParseDuration(source)
+}
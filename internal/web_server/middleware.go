@@ -6,13 +6,18 @@ import (
 	"crypto/hmac"
 	"crypto/sha256"
 	"encoding/hex"
+	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/Grifonhard/Practicum-metrics/internal/agents"
+	cryptoutils "github.com/Grifonhard/Practicum-metrics/internal/crypto_utils"
 	"github.com/Grifonhard/Practicum-metrics/internal/logger"
 	"github.com/gin-gonic/gin"
 	"github.com/sirupsen/logrus"
@@ -207,7 +212,55 @@ func RespEncode() gin.HandlerFunc {
 	}
 }
 
+// CertAuth авторизация агента по subject клиентского сертификата
+// subject сверяется и с CommonName, и с полным DN вида CN=agent,O=org
+// пустой subjects - проверка отключена; без проверенного сертификата запрос отклоняется с 401
+func CertAuth(subjects []string) gin.HandlerFunc {
+	allowed := make(map[string]struct{}, len(subjects))
+	for _, s := range subjects {
+		allowed[s] = struct{}{}
+	}
+	return func(c *gin.Context) {
+		if len(allowed) == 0 {
+			c.Next()
+			return
+		}
+		if c.Request.TLS == nil || len(c.Request.TLS.VerifiedChains) == 0 {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "client certificate required"})
+			return
+		}
+		subject := c.Request.TLS.VerifiedChains[0][0].Subject
+		if !cryptoutils.SubjectAllowed(allowed, subject) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": fmt.Sprintf("subject %s is not allowed", subject.String())})
+			return
+		}
+		c.Next()
+	}
+}
+
+// REALIPHEADER заголовок с адресом агента, см. TrustedSubnet
+const REALIPHEADER = "X-Real-IP"
+
+// TrustedSubnet приём запросов только от агентов из подсети subnet
+// адрес агента берётся из заголовка X-Real-IP, запрос без него или с чужим адресом отклоняется
+// nil subnet - проверка выключена
+func TrustedSubnet(subnet *net.IPNet) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if subnet == nil {
+			c.Next()
+			return
+		}
+		ip := net.ParseIP(strings.TrimSpace(c.GetHeader(REALIPHEADER)))
+		if ip == nil || !subnet.Contains(ip) {
+			c.AbortWithStatusJSON(http.StatusForbidden, gin.H{"error": "address is not in trusted subnet"})
+			return
+		}
+		c.Next()
+	}
+}
+
 // PseudoAuth аутентификация
+// подпись HashSHA256 покрывает тело запроса, а если заданы X-Timestamp и X-Nonce - и их, см. ReplayProtect
 func PseudoAuth(key string) gin.HandlerFunc {
 	return func(c *gin.Context) {
 		if key != "" {
@@ -227,14 +280,90 @@ func PseudoAuth(key string) gin.HandlerFunc {
 				return
 			}
 
-			expectedHash := computeHMAC(body, key)
+			expectedHash := computeHMAC(signedBody(c, body), key)
 			if receivedHash != expectedHash {
 				c.JSON(http.StatusBadRequest, gin.H{"error": "Invalid HMAC"})
 				c.Abort()
 				return
 			}
+			c.Set(SIGNEDREQUEST, true)
+		}
+
+		c.Next()
+	}
+}
+
+// AgentAuth аутентификация агента по его собственному ключу из реестра reg
+// пока в реестре не было ни одного агента, работает общий ключ key, как в PseudoAuth,
+// после этого запрос проверяется ключом агента из X-Agent-ID, версия берётся из X-Key-Version,
+// а без X-Agent-ID отклоняется, общий ключ принимается только при sharedFallback
+func AgentAuth(reg *agents.Registry, key string, sharedFallback bool) gin.HandlerFunc {
+	pseudoAuth := PseudoAuth(key)
+	return func(c *gin.Context) {
+		agentID := c.GetHeader(agents.HEADERAGENTID)
+		if !reg.Enabled() || (agentID == "" && sharedFallback && key != "") {
+			pseudoAuth(c)
+			return
+		}
+		if agentID == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing " + agents.HEADERAGENTID + " header"})
+			return
+		}
+		var version int
+		if v := c.GetHeader(agents.HEADERKEYVERSION); v != "" {
+			var err error
+			version, err = strconv.Atoi(v)
+			if err != nil || version <= 0 {
+				c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Invalid " + agents.HEADERKEYVERSION + " header"})
+				return
+			}
+		}
+		receivedHash := c.GetHeader("HashSHA256")
+		if receivedHash == "" {
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Missing HashSHA256 header"})
+			return
+		}
+		body, err := io.ReadAll(c.Request.Body)
+		if err != nil {
+			c.AbortWithStatusJSON(http.StatusBadRequest, gin.H{"error": "Failed to read request body"})
+			return
+		}
+		c.Request.Body = io.NopCloser(bytes.NewBuffer(body))
+
+		err = reg.Verify(agentID, version, signedBody(c, body), receivedHash)
+		if err != nil {
+			logger.Error(fmt.Sprintf("agent auth: %s", err.Error()))
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": "Invalid agent credentials"})
+			return
 		}
+		c.Set(SIGNEDREQUEST, true)
+		c.Next()
+	}
+}
 
+// ReplayProtect защита подписанных запросов от повтора, ставится после проверки подписи
+// время X-Timestamp должно быть в окне guard, а X-Nonce - новым, иначе 401,
+// при заполненном кэше nonce 503, агент повторит запрос позже
+// проверяются все запросы, подпись которых проверила PseudoAuth или AgentAuth,
+// то есть при заданном ключе время и nonce обязательны, а наличие заголовка HashSHA256 не важно
+// nil guard - защита выключена
+func ReplayProtect(guard *agents.ReplayGuard) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if guard == nil || !c.GetBool(SIGNEDREQUEST) {
+			c.Next()
+			return
+		}
+		err := guard.Check(c.GetHeader(agents.HEADERTIMESTAMP), c.GetHeader(agents.HEADERNONCE))
+		if errors.Is(err, agents.ErrNonceCache) {
+			logger.Error(fmt.Sprintf("replay protection: %s", err.Error()))
+			c.AbortWithStatusJSON(http.StatusServiceUnavailable, gin.H{"error": err.Error()})
+			return
+		}
+		if err != nil {
+			logger.Error(fmt.Sprintf("replay protection: %s", err.Error()))
+			c.AbortWithStatusJSON(http.StatusUnauthorized, gin.H{"error": err.Error()})
+			return
+		}
 		c.Next()
 	}
 }
@@ -247,6 +376,11 @@ func WGadd(wg *sync.WaitGroup) gin.HandlerFunc {
 	}
 }
 
+// signedBody подписываемые данные запроса: тело вместе с X-Timestamp и X-Nonce, см. agents.Signed
+func signedBody(c *gin.Context, body []byte) []byte {
+	return agents.Signed(body, c.GetHeader(agents.HEADERTIMESTAMP), c.GetHeader(agents.HEADERNONCE))
+}
+
 // computeHMAC высчитывает хэш данных
 func computeHMAC(value []byte, key string) string {
 	h := hmac.New(sha256.New, []byte(key))
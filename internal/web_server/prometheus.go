@@ -0,0 +1,179 @@
+package webserver
+
+import (
+	"bytes"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/labels"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// PROMETHEUSCONTENTTYPE тип содержимого текстового формата экспозиции prometheus
+const PROMETHEUSCONTENTTYPE = "text/plain; version=0.0.4; charset=utf-8"
+
+// Metrics предоставляет все хранимые метрики в текстовом формате prometheus
+func Metrics(stor storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		gauges, counters, err := stor.Snapshot(c.Request.Context())
+		if err != nil {
+			respondWithError(c, http.StatusInternalServerError, "fail while snapshot error", "can't get list of metrics", err)
+			return
+		}
+
+		var buf bytes.Buffer
+		writePrometheus(&buf, gauges, counters)
+
+		c.Data(http.StatusOK, PROMETHEUSCONTENTTYPE, buf.Bytes())
+	}
+}
+
+// ORIGINALNAMELABEL метка с исходным именем метрики
+// добавляется сериям семейства, в которое после приведения имён попало несколько разных метрик
+const ORIGINALNAMELABEL = "metric_name"
+
+// familyKey семейство метрик prometheus определяется именем и типом
+type familyKey struct {
+	name  string
+	mType string
+}
+
+// series одна серия семейства
+// raw исходное имя метрики до приведения к формату prometheus
+type series struct {
+	raw    string
+	labels labels.Labels
+	value  float64
+}
+
+// writePrometheus записывает метрики в формате prometheus, сначала gauge, затем counter
+// серии группируются в семейства по приведённому имени метрики, вывод сортируется, чтобы быть стабильным
+// у каждого имени ровно одна строка # TYPE:
+// если имя занято метриками обоих типов, к нему добавляется суффикс типа (_gauge, _counter),
+// если в одно имя попало несколько метрик одного типа, семейства объединяются,
+// а исходное имя сохраняется в метке ORIGINALNAMELABEL
+func writePrometheus(buf *bytes.Buffer, gauges, counters map[string]float64) {
+	families := make(map[familyKey][]series)
+	for key, v := range gauges {
+		addSeries(families, storage.TYPEGAUGE, key, v)
+	}
+	for key, v := range counters {
+		addSeries(families, storage.TYPECOUNTER, key, v)
+	}
+	separateTypes(families)
+
+	keys := make([]familyKey, 0, len(families))
+	for k := range families {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if keys[i].mType != keys[j].mType {
+			return keys[i].mType == storage.TYPEGAUGE
+		}
+		return keys[i].name < keys[j].name
+	})
+
+	for _, k := range keys {
+		fmt.Fprintf(buf, "# TYPE %s %s\n", k.name, k.mType)
+		for _, line := range familyLines(k.name, families[k]) {
+			buf.WriteString(line)
+		}
+	}
+}
+
+// addSeries разбор ключа серии и добавление её в семейство по приведённому имени
+func addSeries(families map[familyKey][]series, mType, key string, v float64) {
+	n, l := labels.ParseKey(key)
+	k := familyKey{name: prometheusName(n), mType: mType}
+	families[k] = append(families[k], series{raw: n, labels: l, value: v})
+}
+
+// separateTypes разводит суффиксом типа имена, занятые семействами обоих типов
+// переименованное семейство может совпасть с уже существующим, поэтому повторяется до устойчивого состояния;
+// переименованные в одном проходе семейства разных типов различаются суффиксом, так что цикл конечен
+func separateTypes(families map[familyKey][]series) {
+	for {
+		var mixed []string
+		for k := range families {
+			if k.mType != storage.TYPEGAUGE {
+				continue
+			}
+			if _, ok := families[familyKey{name: k.name, mType: storage.TYPECOUNTER}]; ok {
+				mixed = append(mixed, k.name)
+			}
+		}
+		if len(mixed) == 0 {
+			return
+		}
+		for _, name := range mixed {
+			for _, mType := range []string{storage.TYPEGAUGE, storage.TYPECOUNTER} {
+				from := familyKey{name: name, mType: mType}
+				to := familyKey{name: name + "_" + mType, mType: mType}
+				families[to] = append(families[to], families[from]...)
+				delete(families, from)
+			}
+		}
+	}
+}
+
+// familyLines строки серий семейства в отсортированном виде
+// если в семействе несколько исходных метрик, каждая серия помечается исходным именем,
+// иначе серии разных метрик с одинаковыми метками совпали бы
+func familyLines(name string, list []series) []string {
+	raw := make(map[string]struct{})
+	for _, s := range list {
+		raw[s.raw] = struct{}{}
+	}
+
+	lines := make([]string, 0, len(list))
+	for _, s := range list {
+		l := s.labels
+		if len(raw) > 1 {
+			l = make(labels.Labels, len(s.labels)+1)
+			for k, v := range s.labels {
+				l[k] = v
+			}
+			l[ORIGINALNAMELABEL] = s.raw
+		}
+		lines = append(lines, fmt.Sprintf("%s%s %s\n", name, prometheusLabels(l), strconv.FormatFloat(s.value, 'g', -1, 64)))
+	}
+	sort.Strings(lines)
+	return lines
+}
+
+// prometheusLabels представление меток в формате prometheus {k="v",...}
+// в значениях экранируются обратный слэш, кавычки и перевод строки
+func prometheusLabels(l labels.Labels) string {
+	if len(l) == 0 {
+		return ""
+	}
+	escaper := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+	var sb strings.Builder
+	sb.WriteByte('{')
+	for i, k := range l.Names() {
+		if i > 0 {
+			sb.WriteByte(',')
+		}
+		fmt.Fprintf(&sb, `%s="%s"`, k, escaper.Replace(l[k]))
+	}
+	sb.WriteByte('}')
+	return sb.String()
+}
+
+// prometheusName приводит имя метрики к допустимому в prometheus виду [a-zA-Z_:][a-zA-Z0-9_:]*
+func prometheusName(name string) string {
+	result := []byte(name)
+	for i, ch := range result {
+		switch {
+		case ch >= 'a' && ch <= 'z', ch >= 'A' && ch <= 'Z', ch == '_', ch == ':':
+		case ch >= '0' && ch <= '9' && i > 0:
+		default:
+			result[i] = '_'
+		}
+	}
+	return string(result)
+}
@@ -0,0 +1,57 @@
+package webserver
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/Grifonhard/Practicum-metrics/internal/drivers/psql"
+	"github.com/Grifonhard/Practicum-metrics/internal/storage"
+	"github.com/gin-gonic/gin"
+)
+
+// QUERYEXPR параметр запроса с выражением агрегирования
+const QUERYEXPR = "expr"
+
+// QueryResponse ответ на запрос агрегата
+type QueryResponse struct {
+	Expr  string  `json:"expr"`
+	Value float64 `json:"value"`
+}
+
+// Query вычисление агрегата по истории значений метрики
+// GET /query?expr=rate(counter:PollCount[5m])
+// функции: sum, avg, min, max, count, rate (только counter), quantile(phi, ...), см. storage.ParseQuery
+func Query(stor storage.Backend) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		agg, ok := stor.(storage.Aggregator)
+		if !ok {
+			respondWithError(c, http.StatusNotImplemented, "query error", storage.ErrQueryUnsupported.Error(), storage.ErrQueryUnsupported)
+			return
+		}
+		q, err := storage.ParseQuery(c.Query(QUERYEXPR))
+		if err != nil {
+			respondWithError(c, http.StatusBadRequest, "validate error", err.Error(), err)
+			return
+		}
+
+		value, err := agg.Aggregate(c.Request.Context(), q)
+		if err != nil && (errors.Is(err, storage.ErrMetricNoData) || errors.Is(err, psql.ErrNoData)) {
+			respondWithError(c, http.StatusNotFound, "fail while query error", "no data", err)
+			return
+		} else if errors.Is(err, storage.ErrQueryUnsupported) {
+			respondWithError(c, http.StatusNotImplemented, "fail while query error", err.Error(), err)
+			return
+		} else if errors.Is(err, storage.ErrQuery) {
+			respondWithError(c, http.StatusBadRequest, "fail while query error", err.Error(), err)
+			return
+		} else if err != nil {
+			respondWithError(c, http.StatusInternalServerError, "fail while query error", "fail while aggregate", err)
+			return
+		}
+
+		c.JSON(http.StatusOK, QueryResponse{
+			Expr:  q.String(),
+			Value: value,
+		})
+	}
+}